@@ -3,15 +3,35 @@ package main
 import (
 	"flag"
 	"log"
+	"strings"
 
 	"github.com/Entidi89/ssh_proxy1/internal/agent"
 )
 
 func main() {
-	proxyWS := flag.String("proxy-ws", "ws://localhost:8080/ws?agent_id=127.0.0.1:2222", "proxy websocket URL with agent_id queryparam")
+	proxyAddr := flag.String("proxy", "localhost:8443", "host:port of the proxy agent listener")
+	stateDir := flag.String("state-dir", "agent_state", "directory for the agent key, certificate and proxy CA")
+	joinToken := flag.String("join-token", "", "one-time join token for the first enrollment (proxy agents token)")
+	caPin := flag.String("ca-pin", "", "sha256 pin of the proxy agent CA, printed with the join token")
+	allowPath := flag.String("allow", "agent_allow.json", "local allowlist of target CIDRs and ports the agent forwards to")
+	labels := flag.String("labels", "", "comma-separated key=value labels shown in the proxy agent list")
 	flag.Parse()
 
-	cfg := agent.AgentConfig{ProxyWS: *proxyWS}
+	allow, err := agent.LoadAllowlist(*allowPath)
+	if err != nil {
+		log.Fatalf("cannot load forward allowlist: %v", err)
+	}
+	cfg := agent.AgentConfig{ProxyAddr: *proxyAddr, StateDir: *stateDir, JoinToken: *joinToken, CAPin: *caPin, Allow: allow}
+	if *labels != "" {
+		cfg.Labels = map[string]string{}
+		for _, kv := range strings.Split(*labels, ",") {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok || strings.TrimSpace(k) == "" {
+				log.Fatalf("invalid label %q, want key=value", kv)
+			}
+			cfg.Labels[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
 	if err := agent.RunAgent(cfg); err != nil {
 		log.Fatalf("agent error: %v", err)
 	}
@@ -36,7 +36,7 @@ func main() {
 		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
 			continue
 		}
-		if e.Type != "stdout" && e.Type != "event" {
+		if e.Type != "stdout" && e.Type != "stderr" && e.Type != "event" {
 			continue
 		}
 		if start == -1 {
@@ -47,7 +47,7 @@ func main() {
 		if delta > 0 {
 			time.Sleep(delta)
 		}
-		if e.Type == "stdout" {
+		if e.Type == "stdout" || e.Type == "stderr" {
 			s, _ := e.V.(string)
 			b, _ := base64.StdEncoding.DecodeString(s)
 			os.Stdout.Write(b)
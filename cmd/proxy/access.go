@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/access"
+)
+
+// runAccess xử lý subcommand "proxy access ..." qua HTTP API quản trị của proxy đang chạy.
+// Token lấy từ -token hoặc biến môi trường PROXY_ADMIN_TOKEN; người duyệt là chủ token.
+//
+//	proxy access list [-status pending]
+//	proxy access approve -id req-... [-note "INC-123"]
+//	proxy access deny -id req-... [-note "không đủ lý do"]
+func runAccess(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: proxy access list|approve|deny ...")
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "list":
+		fs := flag.NewFlagSet("access list", flag.ExitOnError)
+		api := fs.String("api", "http://127.0.0.1:8080", "địa chỉ HTTP API quản trị của proxy")
+		status := fs.String("status", "pending", "lọc theo trạng thái (pending|approved|denied|expired, rỗng = tất cả)")
+		user := fs.String("user", "", "lọc theo user")
+		token := fs.String("token", os.Getenv("PROXY_ADMIN_TOKEN"), "bearer token của API quản trị")
+		fs.Parse(args[1:])
+
+		query := url.Values{"status": {*status}, "user": {*user}}
+		resp := adminRequest(http.MethodGet, *api+"/admin/access/requests?"+query.Encode(), *token, nil)
+		var list []access.Request
+		decodeResponse(resp, &list)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSER\tMÁY ĐÍCH\tROLE\tTHỜI HẠN\tTRẠNG THÁI\tLÝ DO")
+		for _, r := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.ID, r.User, r.Target, r.Role, r.Duration, r.Status, r.Reason)
+		}
+		w.Flush()
+	case "approve", "deny":
+		fs := flag.NewFlagSet("access "+args[0], flag.ExitOnError)
+		api := fs.String("api", "http://127.0.0.1:8080", "địa chỉ HTTP API quản trị của proxy")
+		id := fs.String("id", "", "ID yêu cầu")
+		note := fs.String("note", "", "ghi chú")
+		token := fs.String("token", os.Getenv("PROXY_ADMIN_TOKEN"), "bearer token của API quản trị")
+		fs.Parse(args[1:])
+		if *id == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+
+		body, _ := json.Marshal(map[string]string{"id": *id, "note": *note})
+		resp := adminRequest(http.MethodPost, *api+"/admin/access/"+args[0], *token, body)
+		var r access.Request
+		decodeResponse(resp, &r)
+		fmt.Printf("Yêu cầu %s của '%s': %s", r.ID, r.User, r.Status)
+		if r.Status == access.Approved {
+			fmt.Printf(" (%s trên %s tới %s)", r.Role, r.Target, r.ExpiresAt.Local().Format(time.DateTime))
+		}
+		fmt.Println()
+	default:
+		fmt.Fprintln(os.Stderr, "usage: proxy access list|approve|deny ...")
+		os.Exit(2)
+	}
+}
+
+// decodeResponse đọc JSON trả về từ API, thoát với thông báo lỗi nếu API báo lỗi
+func decodeResponse(resp *http.Response, v interface{}) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		log.Fatalf("API trả về lỗi %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		log.Fatalf("Phản hồi không hợp lệ: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Entidi89/ssh_proxy1/internal/proxy"
+)
+
+// runAdmin xử lý subcommand "proxy admin token -user <tên> -roles <role,...>":
+// sinh bearer token mới cho HTTP API quản trị và in dòng cần thêm vào admin_auth.json
+func runAdmin(args []string) {
+	if len(args) == 0 || args[0] != "token" {
+		fmt.Fprintln(os.Stderr, "usage: proxy admin token -user <user> -roles <role,...>")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("admin token", flag.ExitOnError)
+	user := fs.String("user", "", "người dùng API quản trị (ghi vào audit, là người duyệt yêu cầu cấp quyền)")
+	roleList := fs.String("roles", "", "role quản trị trong admin_auth.json (phân cách bằng dấu phẩy)")
+	fs.Parse(args[1:])
+	if *user == "" || *roleList == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Fatalf("Lỗi sinh token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	sum := sha256.Sum256([]byte(token))
+	entry, _ := json.Marshal(proxy.AdminToken{User: *user, SHA256: hex.EncodeToString(sum[:]), Roles: strings.Split(*roleList, ",")})
+
+	fmt.Printf("Token  : %s\n", token)
+	fmt.Printf("Entry  : %s\n", entry)
+	fmt.Println("Thêm entry vào mục \"tokens\" của admin_auth.json rồi khởi động lại proxy. Token chỉ hiển thị một lần.")
+}
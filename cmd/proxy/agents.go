@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/ws"
+)
+
+// runAgents xử lý subcommand "proxy agents ..." qua HTTP API quản trị của proxy đang chạy.
+// Token lấy từ -token hoặc biến môi trường PROXY_ADMIN_TOKEN.
+//
+//	proxy agents list
+//	proxy agents disconnect -id dc2
+//	proxy agents token -id dc2 [-ttl 1h] [-proxy proxy.example.com:8443]
+//	proxy agents rotate -id dc2
+//	proxy agents revoke -id dc2 [-reason "máy bị xâm nhập"]
+func runAgents(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: proxy agents list|disconnect|token|rotate|revoke ...")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("agents "+args[0], flag.ExitOnError)
+	api := fs.String("api", "http://127.0.0.1:8080", "địa chỉ HTTP API quản trị của proxy")
+	token := fs.String("token", os.Getenv("PROXY_ADMIN_TOKEN"), "bearer token của API quản trị")
+	id := fs.String("id", "", "ID agent (trùng với \"agent\" của máy đích trong inventory)")
+
+	switch args[0] {
+	case "list":
+		fs.Parse(args[1:])
+		var list []ws.AgentInfo
+		decodeResponse(adminRequest(http.MethodGet, *api+"/admin/agents", *token, nil), &list)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tHOSTNAME\tPHIÊN BẢN\tĐỊA CHỈ\tKẾT NỐI TỪ\tLẦN CUỐI\tRTT\tPHIÊN\tNHÃN")
+		for _, a := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%.1fms\t%d\t%s\n", a.ID, a.Hostname, a.Version, a.Remote,
+				a.ConnectedSince.Local().Format(time.DateTime), a.LastSeen.Local().Format(time.TimeOnly), a.RTTMillis, a.Sessions, formatLabels(a.Labels))
+		}
+		w.Flush()
+	case "disconnect":
+		fs.Parse(args[1:])
+		if *id == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+		body, _ := json.Marshal(map[string]string{"agent_id": *id})
+		var a ws.AgentInfo
+		decodeResponse(adminRequest(http.MethodPost, *api+"/admin/agents/disconnect", *token, body), &a)
+		fmt.Printf("Đã ngắt kết nối agent '%s' (%d phiên đang mở bị đóng)\n", a.ID, a.Sessions)
+	case "token":
+		ttl := fs.Duration("ttl", time.Hour, "thời hạn của join token")
+		proxyAddr := fs.String("proxy", "<proxy>:8443", "địa chỉ listener agent, dùng để in lệnh chạy agent")
+		fs.Parse(args[1:])
+		if *id == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+		body, _ := json.Marshal(map[string]string{"agent_id": *id, "ttl": ttl.String()})
+		var resp struct {
+			AgentID   string    `json:"agent_id"`
+			Token     string    `json:"token"`
+			ExpiresAt time.Time `json:"expires_at"`
+			CAPin     string    `json:"ca_pin"`
+		}
+		decodeResponse(adminRequest(http.MethodPost, *api+"/admin/agents/tokens", *token, body), &resp)
+		fmt.Printf("Join token cho agent '%s' (dùng một lần, hết hạn %s):\n", resp.AgentID, resp.ExpiresAt.Local().Format(time.DateTime))
+		fmt.Printf("  agent -proxy %s -join-token %s -ca-pin %s\n", *proxyAddr, resp.Token, resp.CAPin)
+	case "rotate":
+		fs.Parse(args[1:])
+		if *id == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+		body, _ := json.Marshal(map[string]string{"agent_id": *id})
+		var resp map[string]string
+		decodeResponse(adminRequest(http.MethodPost, *api+"/admin/agents/rotate", *token, body), &resp)
+		fmt.Printf("Đã yêu cầu agent '%s' đổi certificate\n", *id)
+	case "revoke":
+		reason := fs.String("reason", "", "lý do thu hồi (ghi vào audit)")
+		fs.Parse(args[1:])
+		if *id == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+		body, _ := json.Marshal(map[string]string{"agent_id": *id, "reason": *reason})
+		var resp struct {
+			Revoked      int  `json:"revoked"`
+			Disconnected bool `json:"disconnected"`
+		}
+		decodeResponse(adminRequest(http.MethodPost, *api+"/admin/agents/revoke", *token, body), &resp)
+		fmt.Printf("Đã thu hồi %d certificate/token của agent '%s'", resp.Revoked, *id)
+		if resp.Disconnected {
+			fmt.Print(", kết nối đang mở đã bị ngắt")
+		}
+		fmt.Println()
+	default:
+		fmt.Fprintln(os.Stderr, "usage: proxy agents list|disconnect|token|rotate|revoke ...")
+		os.Exit(2)
+	}
+}
+
+// formatLabels in nhãn agent theo thứ tự khóa: "dc=hn,env=prod"
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + labels[k]
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+	"golang.org/x/crypto/ssh"
+)
+
+// runHost xử lý subcommand "proxy host ...":
+//
+//	proxy host sign -key ssh_host_ed25519_key.pub -principals 10.0.0.5,web1 [-inventory inventory.json] [-ttl 720h] [-out file]
+//	proxy host ca
+func runHost(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: proxy host sign|ca ...")
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "sign":
+		runHostSign(args[1:])
+	case "ca":
+		vaultClient := mustVaultClient()
+		if err := vaultClient.EnableHostSigner(); err != nil {
+			log.Fatalf("%v", err)
+		}
+		ca, err := vaultClient.GetHostCAPublicKey()
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		// Dòng cho ~/.ssh/known_hosts của client và máy đích
+		fmt.Printf("@cert-authority * %s\n", strings.TrimSpace(ca))
+	default:
+		fmt.Fprintln(os.Stderr, "usage: proxy host sign|ca ...")
+		os.Exit(2)
+	}
+}
+
+func runHostSign(args []string) {
+	fs := flag.NewFlagSet("host sign", flag.ExitOnError)
+	keyPath := fs.String("key", "", "host public key của máy đích (vd /etc/ssh/ssh_host_ed25519_key.pub)")
+	principals := fs.String("principals", "", "hostname/IP của máy đích, phân cách bằng dấu phẩy")
+	ttl := fs.String("ttl", "", "thời hạn certificate (mặc định theo role của Vault)")
+	out := fs.String("out", "", "file lưu certificate (mặc định <key>-cert.pub)")
+	inventoryPath := fs.String("inventory", "inventory.json", "danh sách máy đích; principal phải là tên hoặc địa chỉ trong file này")
+	fs.Parse(args)
+	if *keyPath == "" || *principals == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	inv, err := inventory.Load(*inventoryPath)
+	if err != nil {
+		log.Fatalf("Không thể nạp %s: %v", *inventoryPath, err)
+	}
+	for _, p := range strings.Split(*principals, ",") {
+		if !inv.IsHostPrincipal(p) {
+			log.Fatalf("Principal '%s' không phải tên hoặc địa chỉ máy đích trong %s", p, *inventoryPath)
+		}
+	}
+
+	pub, err := os.ReadFile(*keyPath)
+	if err != nil {
+		log.Fatalf("Không đọc được host key: %v", err)
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey(pub); err != nil {
+		log.Fatalf("Host key không hợp lệ: %v", err)
+	}
+
+	vaultClient := mustVaultClient()
+	if err := vaultClient.EnableHostSigner(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	signed, err := vaultClient.SignHostKey(pub, strings.Split(*principals, ","), *ttl)
+	if err != nil {
+		log.Fatalf("Lỗi ký host key: %v", err)
+	}
+
+	if *out == "" {
+		*out = strings.TrimSuffix(*keyPath, ".pub") + "-cert.pub"
+	}
+	if err := os.WriteFile(*out, []byte(signed), 0644); err != nil {
+		log.Fatalf("Không ghi được certificate: %v", err)
+	}
+	fmt.Printf("Đã ký host certificate -> %s\n", *out)
+	fmt.Println("Trên máy đích, thêm vào sshd_config: HostCertificate " + *out)
+}
@@ -1,28 +1,34 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"log"
 	"net"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/Entidi89/ssh_proxy1/internal/access"
+	"github.com/Entidi89/ssh_proxy1/internal/audit"
+	"github.com/Entidi89/ssh_proxy1/internal/enroll"
+	"github.com/Entidi89/ssh_proxy1/internal/hostkeys"
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+	"github.com/Entidi89/ssh_proxy1/internal/mfa"
 	"github.com/Entidi89/ssh_proxy1/internal/proxy"
+	"github.com/Entidi89/ssh_proxy1/internal/rbac"
+	"github.com/Entidi89/ssh_proxy1/internal/roles"
 	"github.com/Entidi89/ssh_proxy1/internal/vault"
+	"github.com/Entidi89/ssh_proxy1/internal/ws"
+	"golang.org/x/crypto/ssh"
 )
 
-// Cấu trúc để hứng dữ liệu từ file JSON
-type PolicyConfig struct {
-	User    string   `json:"user"`
-	Role    string   `json:"role"`
-	Targets []string `json:"targets"`
-}
-
-func main() {
-	// 1. Khởi động Vault Client
-	log.Println("[INIT] Đang khởi động Core PAM Engine...")
+// mustVaultClient tạo Vault Client từ biến môi trường VAULT_ADDR / VAULT_TOKEN
+func mustVaultClient() *vault.VaultClient {
 	vaultAddr := os.Getenv("VAULT_ADDR")
 	vaultToken := os.Getenv("VAULT_TOKEN")
-	
+
 	if vaultAddr == "" || vaultToken == "" {
 		log.Fatal("Thiếu biến môi trường VAULT_ADDR hoặc VAULT_TOKEN")
 	}
@@ -31,35 +37,304 @@ func main() {
 	if err != nil {
 		log.Fatalf("Lỗi kết nối Vault: %v", err)
 	}
+	return vaultClient
+}
+
+// mustAdminTLS dựng cấu hình HTTPS cho API quản trị. Có -http-client-ca thì client
+// certificate được xác minh theo CA đó (không bắt buộc, người gọi vẫn có thể dùng token).
+func mustAdminTLS(certPath, keyPath, clientCAPath string) *tls.Config {
+	if certPath == "" && keyPath == "" {
+		if clientCAPath != "" {
+			log.Fatal("-http-client-ca cần -http-tls-cert và -http-tls-key")
+		}
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		log.Fatalf("Không nạp được certificate HTTPS: %v", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAPath != "" {
+		pem, err := os.ReadFile(clientCAPath)
+		if err != nil {
+			log.Fatalf("Không đọc được %s: %v", clientCAPath, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("%s không chứa certificate PEM hợp lệ", clientCAPath)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg
+}
+
+// mustAgentEnroll nạp CA của agent (tạo mới nếu chưa có) và file join token / certificate
+func mustAgentEnroll(pkiDir, storePath string, certTTL time.Duration, auditLog *audit.Logger) *enroll.Store {
+	ca, err := enroll.LoadOrCreateCA(pkiDir)
+	if err != nil {
+		log.Fatalf("Không nạp được CA của agent: %v", err)
+	}
+	store, err := enroll.Open(storePath, ca)
+	if err != nil {
+		log.Fatalf("Không thể nạp %s: %v", storePath, err)
+	}
+	store.CertTTL = certTTL
+	store.Audit = auditLog
+	return store
+}
+
+// isLoopback cho biết địa chỉ lắng nghe chỉ nhận kết nối nội bộ
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// mustHostKeyVerifier dựng bộ kiểm tra host key máy đích: known_hosts + TOFU/strict,
+// và nhận host certificate do SSH host CA trên Vault ký (nếu đã cấu hình)
+func mustHostKeyVerifier(v *vault.VaultClient, knownHostsPath string, mode hostkeys.Mode, auditLog *audit.Logger) *hostkeys.Verifier {
+	if mode != hostkeys.TOFU && mode != hostkeys.Strict {
+		log.Fatalf("host-key-mode không hợp lệ: %s (tofu|strict)", mode)
+	}
+	known, err := hostkeys.LoadKnownHosts(knownHostsPath)
+	if err != nil {
+		log.Fatalf("Không đọc được known_hosts: %v", err)
+	}
+	verifier := &hostkeys.Verifier{Mode: mode, Known: known, Audit: auditLog}
+
+	caLine, err := v.GetHostCAPublicKey()
+	if err != nil {
+		log.Printf("[WARN] Không lấy được SSH host CA từ Vault -> chỉ dùng known_hosts (%s): %v", mode, err)
+		return verifier
+	}
+	caKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(caLine))
+	if err != nil {
+		log.Fatalf("Public key của host CA không hợp lệ: %v", err)
+	}
+	verifier.CAKeys = append(verifier.CAKeys, caKey)
+	log.Printf("[INIT] Chấp nhận host certificate ký bởi host CA %s", ssh.FingerprintSHA256(caKey))
+	return verifier
+}
+
+func main() {
+	// Subcommand quản trị: proxy mfa ...
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "mfa":
+			runMFA(os.Args[2:])
+			return
+		case "host":
+			runHost(os.Args[2:])
+			return
+		case "access":
+			runAccess(os.Args[2:])
+			return
+		case "policy":
+			runPolicy(os.Args[2:])
+			return
+		case "sessions":
+			runSessions(os.Args[2:])
+			return
+		case "admin":
+			runAdmin(os.Args[2:])
+			return
+		case "agents":
+			runAgents(os.Args[2:])
+			return
+		}
+	}
+
+	policiesPath := flag.String("policies", "policies.json", "file phân quyền (RBAC) dùng chung cho SSH và HTTP API")
+	inventoryPath := flag.String("inventory", "inventory.json", "danh sách máy đích (tên, địa chỉ, nhãn) dùng trong policy")
+	groupsPath := flag.String("groups", "groups.json", "file thành viên nhóm (dùng khi không cấu hình LDAP)")
+	ldapConfigPath := flag.String("ldap-config", "", "file cấu hình LDAP/AD để tra cứu nhóm (rỗng = dùng -groups)")
+	accessPath := flag.String("access-requests", "access_requests.json", "file lưu yêu cầu cấp quyền tạm thời")
+	accessMax := flag.Duration("access-max-duration", 8*time.Hour, "thời hạn tối đa của một quyền tạm thời")
+	reloadInterval := flag.Duration("reload-interval", 5*time.Second, "chu kỳ kiểm tra thay đổi của policies/inventory/groups (0 = chỉ nạp lại khi nhận SIGHUP)")
+	rolesPath := flag.String("roles", "roles.json", "file định nghĩa role (Vault role, TTL, OS login...)")
+	pruneVaultRoles := flag.Bool("prune-vault-roles", false, "xóa role trên mount ssh-client-signer không có trong roles.json (chỉ bật khi mount chỉ do proxy quản lý)")
+	recordDir := flag.String("record-dir", "sessions", "thư mục lưu bản ghi phiên SSH")
+	recordFailClosed := flag.Bool("record-fail-closed", false, "từ chối phiên nếu không mở được bản ghi")
+	knownHostsPath := flag.String("known-hosts", "known_hosts", "file known_hosts của máy đích do proxy quản lý")
+	hostKeyMode := flag.String("host-key-mode", "tofu", "xử lý máy đích chưa biết: tofu (ghim lần đầu) hoặc strict")
+	auditPath := flag.String("audit-log", "audit.jsonl", "file ghi sự kiện audit")
+	hostKeyPath := flag.String("host-key", "", "private key SSH của proxy, quyền 0600 (rỗng = host key tạm trong bộ nhớ, đổi mỗi lần khởi động)")
+	hostCertPrincipals := flag.String("host-cert-principals", "", "hostname/IP của proxy để Vault cấp host certificate (phân cách bằng dấu phẩy)")
+	hostCertTTL := flag.String("host-cert-ttl", "720h", "thời hạn host certificate của proxy")
+	httpAddr := flag.String("http-addr", "127.0.0.1:8080", "địa chỉ HTTP API quản trị (rỗng = tắt)")
+	adminAuthPath := flag.String("admin-auth", "admin_auth.json", "người dùng và role của HTTP API quản trị (token SHA-256, client certificate)")
+	httpTLSCert := flag.String("http-tls-cert", "", "certificate HTTPS cho API quản trị (rỗng = HTTP thường)")
+	httpTLSKey := flag.String("http-tls-key", "", "private key HTTPS cho API quản trị")
+	httpClientCA := flag.String("http-client-ca", "", "CA dùng để xác minh client certificate (mTLS) của API quản trị")
+	adminOrigins := flag.String("admin-origins", "", "origin trình duyệt (vd https://ops.example.com) ngoài chính địa chỉ API được mở WebSocket quản trị (phân cách bằng dấu phẩy)")
+	agentAddr := flag.String("agent-addr", "", "địa chỉ listener HTTPS cho agent reverse tunnel (rỗng = tắt)")
+	agentHostnames := flag.String("agent-hostnames", "localhost,127.0.0.1", "hostname/IP agent dùng để gọi proxy, ghi vào certificate của listener agent (phân cách bằng dấu phẩy)")
+	agentPKIDir := flag.String("agent-pki-dir", "agent_pki", "thư mục CA ký client certificate cho agent")
+	agentStorePath := flag.String("agent-store", "agents.json", "file lưu join token và certificate đã cấp cho agent")
+	agentCertTTL := flag.Duration("agent-cert-ttl", 30*24*time.Hour, "thời hạn client certificate của agent (agent tự gia hạn khi còn 1/3)")
+	flag.Parse()
+
+	auditLog, err := audit.Open(*auditPath)
+	if err != nil {
+		log.Fatalf("Không mở được file audit: %v", err)
+	}
+	defer auditLog.Close()
+
+	// 1. Khởi động Vault Client
+	log.Println("[INIT] Đang khởi động Core PAM Engine...")
+	vaultClient := mustVaultClient()
 
-	// 2. Cấu hình hệ thống (Tạo Key, Role...)
-	if err := vaultClient.ConfigurePAMSystem(); err != nil {
+	// 2. Cấu hình hệ thống (Tạo Key, đồng bộ Role từ roles.json...)
+	roleSet, err := roles.Load(*rolesPath)
+	if err != nil {
+		log.Fatalf("Không thể nạp %s: %v", *rolesPath, err)
+	}
+	if err := vaultClient.ConfigurePAMSystem(roleSet, *pruneVaultRoles); err != nil {
 		log.Fatalf("Lỗi khởi tạo hệ thống PAM: %v", err)
 	}
 
 	// 3. Cấu hình RBAC TỪ FILE JSON (NÂNG CẤP)
-	rbacService := proxy.NewRBACService()
-	
-	// Đọc file policies.json
-	log.Println("[INIT] Đang đọc cấu hình từ policies.json...")
-	configFile, err := os.ReadFile("policies.json")
+	log.Printf("[INIT] Đang đọc cấu hình từ %s...", *policiesPath)
+	rbacService, err := rbac.Load(*policiesPath)
 	if err != nil {
-		log.Fatalf("Không thể đọc file policies.json: %v", err)
+		log.Fatalf("Không thể nạp %s: %v", *policiesPath, err)
 	}
-
-	var policies []PolicyConfig
-	if err := json.Unmarshal(configFile, &policies); err != nil {
-		log.Fatalf("Lỗi cú pháp trong file JSON: %v", err)
+	if b, err := os.ReadFile(*policiesPath); err == nil {
+		lintOpts := rbac.LintOptions{RoleExists: func(name string) bool { _, ok := roleSet.Get(name); return ok }}
+		for _, issue := range rbac.Lint(b, lintOpts) {
+			log.Printf("[WARN] %s (chạy 'proxy policy check' để xem chi tiết)", issue)
+		}
+	}
+	inv, err := inventory.Load(*inventoryPath)
+	if err != nil {
+		log.Fatalf("Không thể nạp %s: %v", *inventoryPath, err)
+	}
+	rbacService.SetInventory(inv)
+	resolver, err := loadGroupResolver(*groupsPath, *ldapConfigPath)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
+	rbacService.SetGroupResolver(resolver)
+	if *ldapConfigPath != "" {
+		log.Printf("[INIT] Thành viên nhóm được tra cứu từ LDAP (%s)", *ldapConfigPath)
+	}
+	log.Printf("[INIT] Đã nạp xong danh sách phân quyền (RBAC), inventory có %d máy đích.", len(inv.Hosts()))
 
-	// Nạp từng người vào hệ thống
-	for _, p := range policies {
-		//log.Printf(">>> Đã thêm quyền: User=%s | Role=%s | Targets=%v", p.User, p.Role, p.Targets)
-		rbacService.AddPolicy(p.User, p.Role, p.Targets)
+	// Yêu cầu cấp quyền tạm thời (just-in-time): quyền đã duyệt được CheckAccess xét tới
+	accessStore, err := access.Open(*accessPath)
+	if err != nil {
+		log.Fatalf("Không thể nạp %s: %v", *accessPath, err)
 	}
-        log.Println("[INIT] Đã nạp xong danh sách phân quyền (RBAC).")
+	accessStore.MaxDuration = *accessMax
+	accessStore.Audit = auditLog
+	rbacService.SetGrantProvider(accessStore)
+	go accessStore.ExpireLoop(time.Minute)
+
+	// Bộ kiểm tra mã TOTP dùng chung (chống dùng lại mã giữa các kết nối)
+	mfaVerifier := mfa.NewVerifier()
 
 	// 4. Khởi động Server Proxy
+	sshServer, err := proxy.NewSSHServer(vaultClient, rbacService, roleSet, mfaVerifier)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *hostKeyPath != "" {
+		if err := sshServer.LoadHostKey(*hostKeyPath); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	sshServer.RecordDir = *recordDir
+	sshServer.RecordFailClosed = *recordFailClosed
+	sshServer.Audit = auditLog
+	sshServer.Access = accessStore
+	sshServer.HostKeys = mustHostKeyVerifier(vaultClient, *knownHostsPath, hostkeys.Mode(*hostKeyMode), auditLog)
+
+	// Nạp lại policy khi nhận SIGHUP / file thay đổi, rồi ngắt các phiên đã mất quyền
+	watchedGroups := *groupsPath
+	if *ldapConfigPath != "" {
+		watchedGroups = ""
+	}
+	// Vault chỉ ký host certificate cho máy đích trong inventory và cho chính proxy
+	var proxyPrincipals []string
+	if *hostCertPrincipals != "" {
+		proxyPrincipals = strings.Split(*hostCertPrincipals, ",")
+	}
+	syncHostPrincipals := func() error {
+		principals := append(rbacService.Inventory().HostPrincipals(), proxyPrincipals...)
+		return vaultClient.SetHostPrincipals(principals)
+	}
+	if err := syncHostPrincipals(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	onReload := func() {
+		if err := syncHostPrincipals(); err != nil {
+			log.Printf("[ERROR] Không cập nhật được principal ký host certificate theo inventory mới: %v", err)
+		}
+		sshServer.ReevaluateSessions()
+	}
+	policyReloader := newReloader(rbacService, *policiesPath, *inventoryPath, watchedGroups, auditLog, onReload)
+	go policyReloader.run(*reloadInterval)
+
+	// Host certificate của proxy do Vault ký: client tin host CA thay vì TOFU
+	if len(proxyPrincipals) > 0 {
+		principals := proxyPrincipals
+		expires, err := sshServer.IssueHostCertificate(vaultClient, principals, *hostCertTTL)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		go sshServer.RenewHostCertificate(vaultClient, principals, *hostCertTTL, expires)
+	} else {
+		log.Println("[WARN] Chưa cấu hình -host-cert-principals -> client phải TOFU host key của proxy")
+		if *hostKeyPath == "" {
+			log.Println("[WARN] Chưa cấu hình -host-key -> host key của proxy đổi sau mỗi lần khởi động")
+		}
+	}
+
+	// 5. HTTP API quản trị và listener cho agent reverse tunnel
+	var agents *ws.Manager
+	if *agentAddr != "" {
+		agents = ws.NewManager()
+		sshServer.Agents = agents
+	} else {
+		for _, h := range inv.Hosts() {
+			if h.Agent != "" {
+				log.Printf("[WARN] Máy đích '%s' nằm sau agent '%s' nhưng -agent-addr rỗng -> agent không kết nối được", h.Name, h.Agent)
+			}
+		}
+	}
+	httpServer := proxy.NewProxyServer(agents, rbacService)
+	httpServer.Vault = vaultClient
+	httpServer.Access = accessStore
+	httpServer.ReloadPolicy = policyReloader.reloadNow
+	httpServer.Sessions = sshServer.Sessions
+	httpServer.Audit = auditLog
+	if *agentAddr != "" {
+		httpServer.Enroll = mustAgentEnroll(*agentPKIDir, *agentStorePath, *agentCertTTL, auditLog)
+		go httpServer.RunAgents(*agentAddr, strings.Split(*agentHostnames, ","))
+	}
+	if *httpAddr != "" {
+		auth, err := proxy.LoadAdminAuth(*adminAuthPath)
+		if err != nil {
+			log.Fatalf("Không thể nạp %s: %v", *adminAuthPath, err)
+		}
+		httpServer.Auth = auth
+		if *adminOrigins != "" {
+			httpServer.AllowedOrigins = strings.Split(*adminOrigins, ",")
+		}
+		httpServer.TLSConfig = mustAdminTLS(*httpTLSCert, *httpTLSKey, *httpClientCA)
+		if httpServer.TLSConfig == nil && !isLoopback(*httpAddr) {
+			log.Printf("[WARN] API quản trị nghe trên %s không có TLS -> token đi qua mạng ở dạng rõ", *httpAddr)
+		}
+		go httpServer.RunHTTP(*httpAddr)
+	}
+
 	listener, err := net.Listen("tcp", "0.0.0.0:3023")
 	if err != nil {
 		log.Fatalf("Không thể mở port 3023: %v", err)
@@ -74,6 +349,6 @@ func main() {
 			log.Printf("Lỗi chấp nhận kết nối: %v", err)
 			continue
 		}
-		go proxy.HandleConnection(conn, vaultClient, rbacService)
+		go sshServer.HandleConnection(conn)
 	}
 }
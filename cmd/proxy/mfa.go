@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/Entidi89/ssh_proxy1/internal/mfa"
+)
+
+// runMFA xử lý subcommand "proxy mfa enroll -user <tên>"
+func runMFA(args []string) {
+	if len(args) == 0 || args[0] != "enroll" {
+		fmt.Fprintln(os.Stderr, "usage: proxy mfa enroll -user <user> [-issuer SSH-Proxy]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("mfa enroll", flag.ExitOnError)
+	user := fs.String("user", "", "proxy user cần đăng ký TOTP")
+	issuer := fs.String("issuer", "SSH-Proxy", "tên hiển thị trong app Authenticator")
+	fs.Parse(args[1:])
+	if *user == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	vaultClient := mustVaultClient()
+	if err := vaultClient.EnableMFAStore(); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	secret, err := mfa.GenerateSecret()
+	if err != nil {
+		log.Fatalf("Lỗi sinh secret TOTP: %v", err)
+	}
+	if err := vaultClient.PutTOTPSecret(*user, secret); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	fmt.Printf("Đã đăng ký TOTP cho user '%s'.\n", *user)
+	fmt.Printf("Secret : %s\n", secret)
+	fmt.Printf("URI    : %s\n", mfa.ProvisioningURI(*issuer, *user, secret))
+	fmt.Println("Nhập secret hoặc URI trên vào app Authenticator (Google Authenticator, FreeOTP, ...).")
+}
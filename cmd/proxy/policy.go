@@ -0,0 +1,240 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/access"
+	"github.com/Entidi89/ssh_proxy1/internal/directory"
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+	"github.com/Entidi89/ssh_proxy1/internal/rbac"
+	"github.com/Entidi89/ssh_proxy1/internal/roles"
+)
+
+const policyUsage = "usage: proxy policy check|explain ..."
+
+// runPolicy xử lý subcommand "proxy policy ...":
+//
+//	proxy policy check [-policies policies.json] [-roles roles.json] [-inventory inventory.json] [-vault]
+//	proxy policy explain -user alice -target 10.0.0.50 [-login deploy] [-at 2026-01-02T23:00:00+07:00]
+func runPolicy(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, policyUsage)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "check":
+		runPolicyCheck(args[1:])
+	case "explain":
+		runPolicyExplain(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, policyUsage)
+		os.Exit(2)
+	}
+}
+
+// runPolicyCheck kiểm tra policies.json với roles.json (và Vault nếu -vault), in mọi vấn đề
+// tìm thấy. Thoát với mã 1 nếu có lỗi, để dùng được trong CI trước khi triển khai.
+func runPolicyCheck(args []string) {
+	fs := flag.NewFlagSet("policy check", flag.ExitOnError)
+	policiesPath := fs.String("policies", "policies.json", "file phân quyền cần kiểm tra")
+	rolesPath := fs.String("roles", "roles.json", "file định nghĩa role")
+	inventoryPath := fs.String("inventory", "inventory.json", "danh sách máy đích (dùng để kiểm tra mẫu nhãn)")
+	checkVault := fs.Bool("vault", false, "kiểm tra role đã tồn tại trên Vault (cần VAULT_ADDR / VAULT_TOKEN)")
+	fs.Parse(args)
+
+	b, err := os.ReadFile(*policiesPath)
+	if err != nil {
+		log.Fatalf("Không đọc được %s: %v", *policiesPath, err)
+	}
+	roleSet, err := roles.Load(*rolesPath)
+	if err != nil {
+		log.Fatalf("Không thể nạp %s: %v", *rolesPath, err)
+	}
+	inv, err := inventory.Load(*inventoryPath)
+	if err != nil {
+		log.Fatalf("Không thể nạp %s: %v", *inventoryPath, err)
+	}
+
+	issues := rbac.Lint(b, rbac.LintOptions{
+		RoleExists: func(name string) bool { _, ok := roleSet.Get(name); return ok },
+		Inventory:  inv,
+	})
+	if *checkVault {
+		issues = append(issues, vaultRoleIssues(roleSet)...)
+	}
+
+	for _, i := range issues {
+		fmt.Println(i)
+	}
+	if rbac.HasErrors(issues) {
+		fmt.Printf("%s: %d vấn đề, có lỗi -> policy sẽ không được nạp hoặc hoạt động sai\n", *policiesPath, len(issues))
+		os.Exit(1)
+	}
+	fmt.Printf("%s: hợp lệ (%d cảnh báo)\n", *policiesPath, len(issues))
+}
+
+// vaultRoleIssues báo các role trong roles.json chưa có trên Vault (proxy chưa khởi động
+// lại để đồng bộ) -> ký certificate cho role đó sẽ thất bại
+func vaultRoleIssues(roleSet *roles.Set) []rbac.Issue {
+	existing, err := mustVaultClient().ListSSHRoles()
+	if err != nil {
+		return []rbac.Issue{{Level: rbac.LevelError, Where: "vault", Message: err.Error()}}
+	}
+	onVault := map[string]bool{}
+	for _, name := range existing {
+		onVault[name] = true
+	}
+	var issues []rbac.Issue
+	for _, r := range roleSet.List() {
+		if !onVault[r.VaultRole] {
+			issues = append(issues, rbac.Issue{Level: rbac.LevelError, Where: "roles[" + r.Name + "]",
+				Message: fmt.Sprintf("Vault role '%s' chưa tồn tại trên ssh-client-signer", r.VaultRole)})
+		}
+	}
+	return issues
+}
+
+// runPolicyExplain in quyết định của policy cho một user và máy đích giống hệt lúc user kết nối:
+// rule khớp, role, Vault role, OS login và thời hạn certificate sẽ được cấp
+func runPolicyExplain(args []string) {
+	fs := flag.NewFlagSet("policy explain", flag.ExitOnError)
+	user := fs.String("user", "", "proxy user")
+	target := fs.String("target", "", "máy đích (IP, IP:port, hostname hoặc tên trong inventory)")
+	login := fs.String("login", "", "OS login user yêu cầu (rỗng = default_login của role)")
+	at := fs.String("at", "", "thời điểm đánh giá, RFC3339 (mặc định: bây giờ)")
+	policiesPath := fs.String("policies", "policies.json", "file phân quyền")
+	rolesPath := fs.String("roles", "roles.json", "file định nghĩa role")
+	inventoryPath := fs.String("inventory", "inventory.json", "danh sách máy đích")
+	groupsPath := fs.String("groups", "groups.json", "file thành viên nhóm (dùng khi không cấu hình LDAP)")
+	ldapConfigPath := fs.String("ldap-config", "", "file cấu hình LDAP/AD để tra cứu nhóm")
+	accessPath := fs.String("access-requests", "access_requests.json", "file yêu cầu cấp quyền tạm thời")
+	fs.Parse(args)
+	if *user == "" || *target == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	now := time.Now()
+	if *at != "" {
+		t, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			log.Fatalf("-at không hợp lệ: %v", err)
+		}
+		now = t
+	}
+
+	rbacService, err := rbac.Load(*policiesPath)
+	if err != nil {
+		log.Fatalf("Không thể nạp %s: %v", *policiesPath, err)
+	}
+	roleSet, err := roles.Load(*rolesPath)
+	if err != nil {
+		log.Fatalf("Không thể nạp %s: %v", *rolesPath, err)
+	}
+	inv, err := inventory.Load(*inventoryPath)
+	if err != nil {
+		log.Fatalf("Không thể nạp %s: %v", *inventoryPath, err)
+	}
+	rbacService.SetInventory(inv)
+	resolver, err := loadGroupResolver(*groupsPath, *ldapConfigPath)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	rbacService.SetGroupResolver(resolver)
+	accessStore, err := access.Open(*accessPath)
+	if err != nil {
+		log.Fatalf("Không thể nạp %s: %v", *accessPath, err)
+	}
+	rbacService.SetGrantProvider(accessStore)
+
+	dest, err := rbacService.Normalize(*target)
+	if err != nil {
+		log.Fatalf("Máy đích không hợp lệ: %v", err)
+	}
+	d := rbacService.CheckAccessAt(*user, dest, now)
+
+	fmt.Printf("User       : %s\n", *user)
+	fmt.Printf("Máy đích   : %s\n", dest)
+	fmt.Printf("Thời điểm  : %s\n", now.Format(time.RFC3339))
+	if len(d.Groups) > 0 {
+		fmt.Printf("Nhóm       : %s\n", strings.Join(d.Groups, ", "))
+	}
+	result := "DENY"
+	if d.Allowed {
+		result = "ALLOW"
+	}
+	fmt.Printf("Kết quả    : %s\n", result)
+	if d.Rule != "" {
+		fmt.Printf("Rule       : %s (%s)\n", d.Rule, d.Pattern)
+	}
+	fmt.Printf("Lý do      : %s\n", d.Reason)
+	for _, id := range d.DeniedAllows {
+		fmt.Printf("Bị deny chặn: %s\n", id)
+	}
+	for _, id := range d.Overridden {
+		fmt.Printf("Bị lấn át  : %s\n", id)
+	}
+	for _, why := range d.Inactive {
+		fmt.Printf("Chưa hiệu lực: %s\n", why)
+	}
+	if !d.Allowed {
+		os.Exit(1)
+	}
+	if d.Deadline != nil {
+		fmt.Printf("Hạn phiên  : %s\n", d.Deadline.Format(time.RFC3339))
+	}
+
+	fmt.Printf("Role       : %s\n", d.Role)
+	role, ok := roleSet.Get(d.Role)
+	if !ok {
+		fmt.Printf("[ERROR] role '%s' chưa được khai báo trong %s -> kết nối sẽ bị từ chối\n", d.Role, *rolesPath)
+		os.Exit(1)
+	}
+	fmt.Printf("Vault role : %s\n", role.VaultRole)
+	osLogin, err := role.ResolveLogin(*login)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("OS login   : %s\n", osLogin)
+	ttl := role.TTL
+	if ttl == "" {
+		ttl = "mặc định của Vault"
+	}
+	fmt.Printf("Cert TTL   : %s\n", ttl)
+	settings := rbacService.Settings(d.Role)
+	fmt.Printf("MFA        : %s\n", onOff(settings.RequireMFA, "bắt buộc", "không"))
+	fmt.Printf("SFTP       : upload %s, download %s\n",
+		onOff(settings.SFTP.DenyUpload, "bị chặn", "cho phép"), onOff(settings.SFTP.DenyDownload, "bị chặn", "cho phép"))
+}
+
+func onOff(b bool, yes, no string) string {
+	if b {
+		return yes
+	}
+	return no
+}
+
+// loadGroupResolver dựng nguồn thành viên nhóm: LDAP nếu có cấu hình, ngược lại groups.json
+func loadGroupResolver(groupsPath, ldapConfigPath string) (rbac.GroupResolver, error) {
+	if ldapConfigPath != "" {
+		ldapConfig, err := directory.LoadLDAPConfig(ldapConfigPath)
+		if err != nil {
+			return nil, fmt.Errorf("không thể nạp %s: %v", ldapConfigPath, err)
+		}
+		resolver, err := directory.NewLDAPResolver(ldapConfig)
+		if err != nil {
+			return nil, fmt.Errorf("lỗi cấu hình LDAP: %v", err)
+		}
+		return resolver, nil
+	}
+	groups, err := directory.LoadGroupsFile(groupsPath)
+	if err != nil {
+		return nil, fmt.Errorf("không thể nạp %s: %v", groupsPath, err)
+	}
+	return groups, nil
+}
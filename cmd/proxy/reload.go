@@ -0,0 +1,136 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/audit"
+	"github.com/Entidi89/ssh_proxy1/internal/directory"
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+	"github.com/Entidi89/ssh_proxy1/internal/rbac"
+)
+
+// reloader nạp lại policies.json, inventory.json và groups.json khi nhận SIGHUP,
+// khi file thay đổi hoặc qua /admin/rbac/reload. File lỗi bị từ chối và cấu hình
+// đang chạy được giữ nguyên.
+type reloader struct {
+	rbac          *rbac.RBAC
+	policiesPath  string
+	inventoryPath string
+	groupsPath    string // rỗng khi thành viên nhóm lấy từ LDAP
+	audit         *audit.Logger
+	// Gọi sau mỗi lần nạp lại thành công (vd đánh giá lại các phiên đang mở)
+	onReload func()
+
+	mu    sync.Mutex
+	stamp map[string]fileStamp
+	// Chỉ một lần nạp lại chạy tại một thời điểm (watcher, SIGHUP, HTTP API)
+	reloadMu sync.Mutex
+}
+
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+func newReloader(r *rbac.RBAC, policiesPath, inventoryPath, groupsPath string, auditLog *audit.Logger, onReload func()) *reloader {
+	rl := &reloader{
+		rbac: r, policiesPath: policiesPath, inventoryPath: inventoryPath, groupsPath: groupsPath,
+		audit: auditLog, onReload: onReload, stamp: make(map[string]fileStamp),
+	}
+	rl.changed() // ghi nhận trạng thái hiện tại của các file
+	return rl
+}
+
+func (rl *reloader) files() []string {
+	files := []string{rl.policiesPath, rl.inventoryPath}
+	if rl.groupsPath != "" {
+		files = append(files, rl.groupsPath)
+	}
+	return files
+}
+
+// changed cho biết có file nào đổi thời gian sửa / kích thước kể từ lần kiểm tra trước
+func (rl *reloader) changed() bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	changed := false
+	for _, path := range rl.files() {
+		var st fileStamp
+		if fi, err := os.Stat(path); err == nil {
+			st = fileStamp{mod: fi.ModTime(), size: fi.Size()}
+		}
+		if st != rl.stamp[path] {
+			rl.stamp[path] = st
+			changed = true
+		}
+	}
+	return changed
+}
+
+// reloadNow nạp lại ngay theo yêu cầu (SIGHUP, /admin/rbac/reload)
+func (rl *reloader) reloadNow(reason string) error {
+	rl.changed()
+	return rl.reload(reason)
+}
+
+// reload đọc và kiểm tra mọi file trước, chỉ áp dụng (nguyên khối) khi tất cả hợp lệ
+func (rl *reloader) reload(reason string) error {
+	rl.reloadMu.Lock()
+	defer rl.reloadMu.Unlock()
+	inv, err := inventory.Load(rl.inventoryPath)
+	if err != nil {
+		return rl.fail(reason, rl.inventoryPath, err)
+	}
+	// nil = giữ nguồn nhóm hiện tại (LDAP)
+	var groups rbac.GroupResolver
+	if rl.groupsPath != "" {
+		file, err := directory.LoadGroupsFile(rl.groupsPath)
+		if err != nil {
+			return rl.fail(reason, rl.groupsPath, err)
+		}
+		groups = file
+	}
+	// Policy, inventory và nhóm được thay trong cùng một lần
+	if err := rl.rbac.ReloadWith(rl.policiesPath, inv, groups); err != nil {
+		return rl.fail(reason, rl.policiesPath, err)
+	}
+	log.Printf("[RBAC] Đã nạp lại policy (%s)", reason)
+	rl.audit.Log("policy.reloaded", map[string]interface{}{"reason": reason, "files": rl.files()})
+	if rl.onReload != nil {
+		rl.onReload()
+	}
+	return nil
+}
+
+func (rl *reloader) fail(reason, path string, err error) error {
+	log.Printf("[RBAC] Từ chối nạp lại %s (%s), giữ policy đang chạy: %v", path, reason, err)
+	rl.audit.Log("policy.reload-failed", map[string]interface{}{"reason": reason, "file": path, "error": err.Error()})
+	return err
+}
+
+// run nạp lại khi nhận SIGHUP hoặc khi file thay đổi (kiểm tra mỗi interval)
+func (rl *reloader) run(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-hup:
+			rl.reloadNow("SIGHUP")
+		case <-tick:
+			if rl.changed() {
+				rl.reload("file thay đổi")
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/proxy"
+)
+
+// runSessions xử lý subcommand "proxy sessions ..." qua HTTP API quản trị của proxy đang chạy.
+// Token lấy từ -token hoặc biến môi trường PROXY_ADMIN_TOKEN.
+//
+//	proxy sessions list
+//	proxy sessions terminate -id <session-id> [-message "bảo trì khẩn cấp"]
+func runSessions(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: proxy sessions list|terminate ...")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("sessions "+args[0], flag.ExitOnError)
+	api := fs.String("api", "http://127.0.0.1:8080", "địa chỉ HTTP API quản trị của proxy")
+	token := fs.String("token", os.Getenv("PROXY_ADMIN_TOKEN"), "bearer token của API quản trị")
+
+	switch args[0] {
+	case "list":
+		fs.Parse(args[1:])
+		var list []proxy.SessionInfo
+		decodeResponse(adminRequest(http.MethodGet, *api+"/admin/sessions", *token, nil), &list)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSER\tMÁY ĐÍCH\tROLE\tLOGIN\tCLIENT\tBẮT ĐẦU\tVÀO\tRA\tOBSERVER")
+		for _, s := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\n", s.ID, s.User, s.Target, s.Role, s.OSUser, s.Client,
+				s.Start.Local().Format(time.DateTime), s.BytesIn, s.BytesOut, len(s.Observers))
+		}
+		w.Flush()
+	case "terminate":
+		id := fs.String("id", "", "ID phiên cần ngắt")
+		message := fs.String("message", "", "thông báo hiển thị cho user")
+		fs.Parse(args[1:])
+		if *id == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+		body, _ := json.Marshal(map[string]string{"id": *id, "message": *message})
+		var s proxy.SessionInfo
+		decodeResponse(adminRequest(http.MethodPost, *api+"/admin/sessions/terminate", *token, body), &s)
+		fmt.Printf("Đã ngắt phiên %s của '%s' trên %s\n", s.ID, s.User, s.Target)
+	default:
+		fmt.Fprintln(os.Stderr, "usage: proxy sessions list|terminate ...")
+		os.Exit(2)
+	}
+}
+
+// adminRequest gọi API quản trị kèm bearer token
+func adminRequest(method, url, token string, body []byte) *http.Response {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("Không gọi được API: %v", err)
+	}
+	return resp
+}
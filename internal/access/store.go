@@ -0,0 +1,288 @@
+package access
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/audit"
+	"github.com/Entidi89/ssh_proxy1/internal/rbac"
+)
+
+// Status: trạng thái của một yêu cầu cấp quyền tạm thời
+type Status string
+
+const (
+	Pending  Status = "pending"
+	Approved Status = "approved"
+	Denied   Status = "denied"
+	Expired  Status = "expired"
+)
+
+// Sự kiện audit của quy trình cấp quyền
+const (
+	EventRequested = "access.requested"
+	EventApproved  = "access.approved"
+	EventDenied    = "access.denied-request"
+	EventExpired   = "access.expired"
+)
+
+var (
+	ErrNotFound     = errors.New("không tìm thấy yêu cầu")
+	ErrNotPending   = errors.New("yêu cầu không còn ở trạng thái chờ duyệt")
+	ErrSelfApproval = errors.New("không được tự duyệt yêu cầu của chính mình")
+)
+
+// Request: yêu cầu cấp quyền truy cập tạm thời (just-in-time)
+type Request struct {
+	ID   string `json:"id"`
+	User string `json:"user"`
+	// Máy đích đã chuẩn hóa (ip:port) và chuỗi user nhập
+	Target      string `json:"target"`
+	TargetInput string `json:"target_input,omitempty"`
+	Role        string `json:"role"`
+	Duration    string `json:"duration"`
+	Reason      string `json:"reason"`
+	Status      Status `json:"status"`
+
+	CreatedAt time.Time `json:"created_at"`
+	// Người duyệt / từ chối và ghi chú
+	DecidedBy string     `json:"decided_by,omitempty"`
+	DecidedAt *time.Time `json:"decided_at,omitempty"`
+	Note      string     `json:"note,omitempty"`
+	// Thời điểm quyền (đã duyệt) hoặc yêu cầu (đang chờ) hết hạn
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Store lưu các yêu cầu vào file JSON, ghi lại toàn bộ file sau mỗi thay đổi
+type Store struct {
+	// Thời hạn tối đa được xin cho một quyền
+	MaxDuration time.Duration
+	// Yêu cầu không được duyệt trong khoảng này sẽ hết hạn
+	PendingTTL time.Duration
+	Audit      *audit.Logger
+
+	mu       sync.Mutex
+	path     string
+	requests map[string]*Request
+}
+
+// Open đọc file lưu yêu cầu. File chưa tồn tại được coi là rỗng.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		MaxDuration: 8 * time.Hour,
+		PendingTTL:  24 * time.Hour,
+		path:        path,
+		requests:    make(map[string]*Request),
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	var list []*Request
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("lỗi cú pháp trong %s: %v", path, err)
+	}
+	for _, r := range list {
+		s.requests[r.ID] = r
+	}
+	return s, nil
+}
+
+// save ghi toàn bộ yêu cầu ra file (ghi file tạm rồi đổi tên để không hỏng file khi lỗi giữa chừng)
+func (s *Store) save() error {
+	list := s.sortedLocked()
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".access-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *Store) sortedLocked() []*Request {
+	list := make([]*Request, 0, len(s.requests))
+	for _, r := range s.requests {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+func (s *Store) log(event string, r *Request) {
+	s.Audit.Log(event, map[string]interface{}{
+		"request_id": r.ID, "user": r.User, "target": r.Target, "role": r.Role,
+		"duration": r.Duration, "reason": r.Reason, "decided_by": r.DecidedBy, "note": r.Note,
+	})
+}
+
+func newID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return "req-" + hex.EncodeToString(b)
+}
+
+// Create ghi nhận một yêu cầu mới ở trạng thái chờ duyệt
+func (s *Store) Create(user, target, targetInput, role string, duration time.Duration, reason string) (*Request, error) {
+	if duration <= 0 || duration > s.MaxDuration {
+		return nil, fmt.Errorf("thời hạn phải trong khoảng (0, %s]", s.MaxDuration)
+	}
+	if reason == "" {
+		return nil, fmt.Errorf("cần ghi rõ lý do")
+	}
+	now := time.Now()
+	r := &Request{
+		ID: newID(), User: user, Target: target, TargetInput: targetInput, Role: role,
+		Duration: duration.String(), Reason: reason, Status: Pending,
+		CreatedAt: now, ExpiresAt: now.Add(s.PendingTTL),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[r.ID] = r
+	if err := s.save(); err != nil {
+		delete(s.requests, r.ID)
+		return nil, err
+	}
+	s.log(EventRequested, r)
+	return r, nil
+}
+
+// Approve duyệt yêu cầu: quyền có hiệu lực từ lúc duyệt trong khoảng Duration
+func (s *Store) Approve(id, approver, note string) (*Request, error) {
+	return s.decide(id, approver, note, Approved)
+}
+
+// Deny từ chối yêu cầu
+func (s *Store) Deny(id, approver, note string) (*Request, error) {
+	return s.decide(id, approver, note, Denied)
+}
+
+func (s *Store) decide(id, approver, note string, status Status) (*Request, error) {
+	if approver == "" {
+		return nil, fmt.Errorf("thiếu người duyệt")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.expireLocked(now)
+	r, ok := s.requests[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if r.Status != Pending {
+		return nil, ErrNotPending
+	}
+	if r.User == approver {
+		return nil, ErrSelfApproval
+	}
+	prev := *r
+	r.Status, r.DecidedBy, r.DecidedAt, r.Note = status, approver, &now, note
+	if status == Approved {
+		d, _ := time.ParseDuration(r.Duration)
+		r.ExpiresAt = now.Add(d)
+	}
+	if err := s.save(); err != nil {
+		*r = prev
+		return nil, err
+	}
+	if status == Approved {
+		s.log(EventApproved, r)
+	} else {
+		s.log(EventDenied, r)
+	}
+	out := *r
+	return &out, nil
+}
+
+// expireLocked chuyển các yêu cầu đã quá hạn sang Expired
+func (s *Store) expireLocked(now time.Time) bool {
+	changed := false
+	for _, r := range s.requests {
+		if (r.Status == Pending || r.Status == Approved) && !now.Before(r.ExpiresAt) {
+			r.Status = Expired
+			changed = true
+			s.log(EventExpired, r)
+		}
+	}
+	return changed
+}
+
+// Expire cập nhật trạng thái hết hạn và lưu lại nếu có thay đổi
+func (s *Store) Expire(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.expireLocked(now) {
+		return s.save()
+	}
+	return nil
+}
+
+// ExpireLoop định kỳ đánh dấu hết hạn (chạy trong goroutine riêng)
+func (s *Store) ExpireLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.Expire(time.Now())
+	}
+}
+
+// List trả về các yêu cầu (lọc theo user / trạng thái nếu khác rỗng), cũ nhất trước
+func (s *Store) List(user string, status Status) []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.expireLocked(time.Now()) {
+		s.save()
+	}
+	var out []Request
+	for _, r := range s.sortedLocked() {
+		if (user == "" || r.User == user) && (status == "" || r.Status == status) {
+			out = append(out, *r)
+		}
+	}
+	return out
+}
+
+// Get trả về một yêu cầu theo ID
+func (s *Store) Get(id string) (Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.requests[id]
+	if !ok {
+		return Request{}, ErrNotFound
+	}
+	return *r, nil
+}
+
+// Grants trả về các quyền đã duyệt còn hiệu lực của user tại thời điểm now (dùng cho rbac.CheckAccess),
+// quyền còn lâu hết hạn nhất trước
+func (s *Store) Grants(user string, now time.Time) []rbac.Grant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []rbac.Grant
+	for _, r := range s.requests {
+		if r.User == user && r.Status == Approved && now.Before(r.ExpiresAt) {
+			out = append(out, rbac.Grant{ID: r.ID, Role: r.Role, Target: r.Target, Expires: r.ExpiresAt})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Expires.After(out[j].Expires) })
+	return out
+}
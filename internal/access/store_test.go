@@ -0,0 +1,220 @@
+package access
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/audit"
+)
+
+// testStore mở store trong thư mục tạm, kèm file audit để kiểm tra các sự kiện đã ghi
+func testStore(t *testing.T) (*Store, string) {
+	t.Helper()
+	dir := t.TempDir()
+	s, err := Open(filepath.Join(dir, "access.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditPath := filepath.Join(dir, "audit.jsonl")
+	if s.Audit, err = audit.Open(auditPath); err != nil {
+		t.Fatal(err)
+	}
+	return s, auditPath
+}
+
+// auditEvents trả về tên các sự kiện audit của yêu cầu id, theo thứ tự ghi
+func auditEvents(t *testing.T, path, id string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec audit.Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Fields["request_id"] == id {
+			events = append(events, rec.Event)
+		}
+	}
+	return events
+}
+
+func TestCreateValidation(t *testing.T) {
+	s, _ := testStore(t)
+	for _, d := range []time.Duration{0, -time.Hour, s.MaxDuration + time.Second} {
+		if _, err := s.Create("bob", "10.0.0.1:22", "db1", "ops", d, "incident"); err == nil {
+			t.Errorf("duration %v accepted", d)
+		}
+	}
+	if _, err := s.Create("bob", "10.0.0.1:22", "db1", "ops", time.Hour, ""); err == nil {
+		t.Error("empty reason accepted")
+	}
+	if list := s.List("", ""); len(list) != 0 {
+		t.Errorf("rejected requests stored: %v", list)
+	}
+}
+
+func TestApproveAndDeny(t *testing.T) {
+	s, auditPath := testStore(t)
+	r, err := s.Create("bob", "10.0.0.1:22", "db1", "ops", 2*time.Hour, "incident 42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != Pending || !r.ExpiresAt.Equal(r.CreatedAt.Add(s.PendingTTL)) {
+		t.Fatalf("new request %+v", r)
+	}
+
+	if _, err := s.Approve(r.ID, "", ""); err == nil {
+		t.Fatal("approved without an approver")
+	}
+	if _, err := s.Approve("req-missing", "alice", ""); err != ErrNotFound {
+		t.Fatalf("missing request: err = %v", err)
+	}
+	approved, err := s.Approve(r.ID, "alice", "ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Quyền tính từ lúc duyệt, không phải từ lúc xin
+	if approved.Status != Approved || approved.DecidedBy != "alice" || approved.DecidedAt == nil ||
+		!approved.ExpiresAt.Equal(approved.DecidedAt.Add(2*time.Hour)) {
+		t.Fatalf("approved request %+v", approved)
+	}
+	// Đã quyết định thì không đổi được nữa
+	if _, err := s.Approve(r.ID, "carol", ""); err != ErrNotPending {
+		t.Fatalf("second approval: err = %v", err)
+	}
+	if _, err := s.Deny(r.ID, "carol", ""); err != ErrNotPending {
+		t.Fatalf("deny after approval: err = %v", err)
+	}
+
+	r2, err := s.Create("bob", "10.0.0.2:22", "", "ops", time.Hour, "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	denied, err := s.Deny(r2.ID, "alice", "not today")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if denied.Status != Denied || denied.Note != "not today" {
+		t.Fatalf("denied request %+v", denied)
+	}
+	if _, err := s.Approve(r2.ID, "carol", ""); err != ErrNotPending {
+		t.Fatalf("approve after denial: err = %v", err)
+	}
+	grants := s.Grants("bob", time.Now())
+	if len(grants) != 1 || grants[0].ID != r.ID || grants[0].Target != "10.0.0.1:22" || grants[0].Role != "ops" {
+		t.Fatalf("grants %+v", grants)
+	}
+
+	// Trạng thái được lưu xuống file
+	reopened, err := Open(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := reopened.Get(r.ID); err != nil || got.Status != Approved || got.DecidedBy != "alice" {
+		t.Fatalf("reopened %+v, %v", got, err)
+	}
+	if got, err := reopened.Get(r2.ID); err != nil || got.Status != Denied {
+		t.Fatalf("reopened %+v, %v", got, err)
+	}
+
+	if got, want := auditEvents(t, auditPath, r.ID), []string{EventRequested, EventApproved}; !reflect.DeepEqual(got, want) {
+		t.Errorf("audit %v, want %v", got, want)
+	}
+	if got, want := auditEvents(t, auditPath, r2.ID), []string{EventRequested, EventDenied}; !reflect.DeepEqual(got, want) {
+		t.Errorf("audit %v, want %v", got, want)
+	}
+}
+
+func TestSelfApprovalBlocked(t *testing.T) {
+	s, auditPath := testStore(t)
+	r, err := s.Create("bob", "10.0.0.1:22", "", "ops", time.Hour, "incident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Approve(r.ID, "bob", ""); err != ErrSelfApproval {
+		t.Fatalf("self approval: err = %v", err)
+	}
+	if _, err := s.Deny(r.ID, "bob", ""); err != ErrSelfApproval {
+		t.Fatalf("self denial: err = %v", err)
+	}
+	if got, _ := s.Get(r.ID); got.Status != Pending || got.DecidedBy != "" {
+		t.Fatalf("request changed by its owner: %+v", got)
+	}
+	if grants := s.Grants("bob", time.Now()); len(grants) != 0 {
+		t.Fatalf("grants %+v", grants)
+	}
+	if got, want := auditEvents(t, auditPath, r.ID), []string{EventRequested}; !reflect.DeepEqual(got, want) {
+		t.Errorf("audit %v, want %v", got, want)
+	}
+}
+
+func TestPendingRequestExpires(t *testing.T) {
+	s, auditPath := testStore(t)
+	r, err := s.Create("bob", "10.0.0.1:22", "", "ops", time.Hour, "incident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Expire(r.ExpiresAt.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Get(r.ID); got.Status != Pending {
+		t.Fatalf("expired early: %+v", got)
+	}
+	if err := s.Expire(r.ExpiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Get(r.ID); got.Status != Expired {
+		t.Fatalf("status %s, want expired", got.Status)
+	}
+	if _, err := s.Approve(r.ID, "alice", ""); err != ErrNotPending {
+		t.Fatalf("approve expired request: err = %v", err)
+	}
+	if got, want := auditEvents(t, auditPath, r.ID), []string{EventRequested, EventExpired}; !reflect.DeepEqual(got, want) {
+		t.Errorf("audit %v, want %v", got, want)
+	}
+}
+
+func TestGrantExpiry(t *testing.T) {
+	s, auditPath := testStore(t)
+	r, err := s.Create("bob", "10.0.0.1:22", "", "ops", time.Hour, "incident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	approved, err := s.Approve(r.ID, "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := approved.ExpiresAt
+
+	if grants := s.Grants("bob", end.Add(-time.Second)); len(grants) != 1 || !grants[0].Expires.Equal(end) {
+		t.Fatalf("grants before expiry %+v", grants)
+	}
+	if grants := s.Grants("carol", end.Add(-time.Second)); len(grants) != 0 {
+		t.Fatalf("grant leaked to another user: %+v", grants)
+	}
+	// Hết hạn đúng tại ExpiresAt, kể cả trước khi ExpireLoop kịp đổi trạng thái
+	if grants := s.Grants("bob", end); len(grants) != 0 {
+		t.Fatalf("grants at expiry %+v", grants)
+	}
+
+	if err := s.Expire(end); err != nil {
+		t.Fatal(err)
+	}
+	if list := s.List("bob", Expired); len(list) != 1 || list[0].ID != r.ID {
+		t.Fatalf("expired list %+v", list)
+	}
+	if got, want := auditEvents(t, auditPath, r.ID), []string{EventRequested, EventApproved, EventExpired}; !reflect.DeepEqual(got, want) {
+		t.Errorf("audit %v, want %v", got, want)
+	}
+}
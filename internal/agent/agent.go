@@ -1,29 +1,93 @@
 package agent
 
 import (
+	"errors"
 	"log"
+	"os"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// Version is reported to the proxy; set at build time with
+// -ldflags "-X github.com/Entidi89/ssh_proxy1/internal/agent.Version=1.2.0"
+var Version = "dev"
+
 type AgentConfig struct {
-	ProxyWS string // e.g. ws://proxy-host:8080/ws?agent_id=ID
+	// host:port of the proxy agent listener (-agent-addr on the proxy)
+	ProxyAddr string
+	// where the agent keeps its key, certificate and the proxy CA
+	StateDir string
+	// one-time join token and CA pin, only needed for the first enrollment
+	JoinToken string
+	CAPin     string
+	// targets the agent may forward to (required)
+	Allow *Allowlist
+	// shown in the proxy's agent list ("dc": "hn", ...)
+	Labels map[string]string
 }
 
 func RunAgent(cfg AgentConfig) error {
-	u := cfg.ProxyWS
+	if cfg.Allow == nil {
+		return errors.New("no forward allowlist configured")
+	}
+	id, err := loadIdentity(cfg.StateDir)
+	if errors.Is(err, os.ErrNotExist) {
+		if id, err = enroll(cfg); err != nil {
+			return err
+		}
+		log.Printf("enrolled as agent %s (certificate valid until %s)", id.ID, id.Leaf.NotAfter.Format(time.RFC3339))
+	} else if err != nil {
+		return err
+	} else if cfg.JoinToken != "" {
+		log.Printf("already enrolled as agent %s, ignoring join token", id.ID)
+	}
+
+	u := "wss://" + cfg.ProxyAddr + "/ws"
 	for {
-		log.Printf("connecting to %s", u)
-		d := websocket.DefaultDialer
-		ws, _, err := d.Dial(u, nil)
+		if id.renewIn() <= 0 {
+			if next, err := renew(cfg, id); err != nil {
+				if time.Now().After(id.Leaf.NotAfter) {
+					return errors.New("certificate expired and could not be renewed; enroll again with a new join token")
+				}
+				log.Printf("certificate renewal failed: %v", err)
+			} else {
+				id = next
+				log.Printf("certificate renewed, valid until %s", id.Leaf.NotAfter.Format(time.RFC3339))
+			}
+		}
+
+		log.Printf("connecting to %s as %s", u, id.ID)
+		d := websocket.Dialer{TLSClientConfig: id.tlsConfig(), HandshakeTimeout: 10 * time.Second}
+		ws, resp, err := d.Dial(u, nil)
 		if err != nil {
-			log.Printf("ws dial err: %v; retry in 5s", err)
+			if resp != nil {
+				log.Printf("ws dial err: %v (%s); retry in 5s", err, resp.Status)
+			} else {
+				log.Printf("ws dial err: %v; retry in 5s", err)
+			}
 			time.Sleep(5 * time.Second)
 			continue
 		}
 		log.Printf("connected to proxy ws")
-		handleWSAgentConn(ws)
+		// reconnect when the certificate is due for renewal, or when the proxy asks
+		// for a rotation, so the next connection uses a fresh certificate
+		rotate := make(chan struct{}, 1)
+		timer := time.AfterFunc(max(id.renewIn(), time.Second), func() { ws.Close() })
+		handleWSAgentConn(ws, cfg, rotate)
+		timer.Stop()
+		select {
+		case <-rotate:
+			log.Printf("proxy requested certificate rotation")
+			if next, err := renew(cfg, id); err != nil {
+				log.Printf("certificate rotation failed: %v", err)
+			} else {
+				id = next
+				log.Printf("certificate rotated, valid until %s", id.Leaf.NotAfter.Format(time.RFC3339))
+			}
+			continue
+		default:
+		}
 		// on return, connection closed; reconnect
 		log.Printf("reconnect in 3s")
 		time.Sleep(3 * time.Second)
@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Allowlist restricts which targets the agent forwards to, whatever the proxy asks.
+// It is read from a local file so that a compromised proxy cannot widen it:
+//
+//	{"allow": [
+//	  {"cidr": "10.0.0.0/24", "ports": ["22"]},
+//	  {"cidr": "10.0.1.5/32", "ports": ["22", "2200-2299"]}
+//	]}
+//
+// Targets must be IP:port; host names are refused because resolving them on the
+// agent would let DNS decide what is reachable.
+type Allowlist struct {
+	rules []allowRule
+}
+
+type allowRule struct {
+	prefix netip.Prefix
+	ports  []portRange
+}
+
+type portRange struct{ lo, hi uint16 }
+
+type allowFile struct {
+	Allow []struct {
+		CIDR  string   `json:"cidr"`
+		Ports []string `json:"ports"`
+	} `json:"allow"`
+}
+
+// LoadAllowlist reads the allowlist file. Every rule needs a CIDR and at least one port.
+func LoadAllowlist(path string) (*Allowlist, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f allowFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	a := &Allowlist{}
+	for i, r := range f.Allow {
+		prefix, err := netip.ParsePrefix(r.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("%s: allow[%d]: %w", path, i, err)
+		}
+		if len(r.Ports) == 0 {
+			return nil, fmt.Errorf("%s: allow[%d]: no ports", path, i)
+		}
+		// Targets are unmapped before matching, so an IPv4-mapped rule must be too
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		rule := allowRule{prefix: prefix.Masked()}
+		for _, p := range r.Ports {
+			pr, err := parsePortRange(p)
+			if err != nil {
+				return nil, fmt.Errorf("%s: allow[%d]: %w", path, i, err)
+			}
+			rule.ports = append(rule.ports, pr)
+		}
+		a.rules = append(a.rules, rule)
+	}
+	return a, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hi = lo
+	}
+	l, err1 := strconv.ParseUint(lo, 10, 16)
+	h, err2 := strconv.ParseUint(hi, 10, 16)
+	if err1 != nil || err2 != nil || l == 0 || l > h {
+		return portRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	return portRange{uint16(l), uint16(h)}, nil
+}
+
+// Check returns which rule allows target ("allow[0]"), or why it is refused
+func (a *Allowlist) Check(target string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return "", errors.New("target is not an IP address")
+	}
+	ip = ip.Unmap()
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	for i, r := range a.rules {
+		if !r.prefix.Contains(ip) {
+			continue
+		}
+		for _, pr := range r.ports {
+			if uint16(p) >= pr.lo && uint16(p) <= pr.hi {
+				return fmt.Sprintf("allow[%d]", i), nil
+			}
+		}
+	}
+	return "", errors.New("not in the agent allowlist")
+}
@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeAllowlist(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "allowlist.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in     string
+		lo, hi uint16
+		ok     bool
+	}{
+		{"22", 22, 22, true},
+		{"1", 1, 1, true},
+		{"65535", 65535, 65535, true},
+		{"2200-2299", 2200, 2299, true},
+		{"22-22", 22, 22, true},
+		{"1-65535", 1, 65535, true},
+		{"0", 0, 0, false},
+		{"0-22", 0, 0, false},
+		{"65536", 0, 0, false},
+		{"22-65536", 0, 0, false},
+		{"2299-2200", 0, 0, false},
+		{"", 0, 0, false},
+		{"-", 0, 0, false},
+		{"22-", 0, 0, false},
+		{"-22", 0, 0, false},
+		{"22-23-24", 0, 0, false},
+		{" 22", 0, 0, false},
+		{"+22", 0, 0, false},
+		{"ssh", 0, 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parsePortRange(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("parsePortRange(%q): err = %v, want ok = %v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && (got.lo != tt.lo || got.hi != tt.hi) {
+			t.Errorf("parsePortRange(%q) = %d-%d, want %d-%d", tt.in, got.lo, got.hi, tt.lo, tt.hi)
+		}
+	}
+}
+
+func TestLoadAllowlistErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"syntax", `{"allow": [`},
+		{"missing cidr", `{"allow": [{"ports": ["22"]}]}`},
+		{"bare ip", `{"allow": [{"cidr": "10.0.0.5", "ports": ["22"]}]}`},
+		{"hostname", `{"allow": [{"cidr": "db.internal/32", "ports": ["22"]}]}`},
+		{"prefix too long", `{"allow": [{"cidr": "10.0.0.0/33", "ports": ["22"]}]}`},
+		{"no ports", `{"allow": [{"cidr": "10.0.0.0/24"}]}`},
+		{"empty ports", `{"allow": [{"cidr": "10.0.0.0/24", "ports": []}]}`},
+		{"bad port", `{"allow": [{"cidr": "10.0.0.0/24", "ports": ["22", "70000"]}]}`},
+		{"reversed range", `{"allow": [{"cidr": "10.0.0.0/24", "ports": ["30-20"]}]}`},
+	}
+	for _, tt := range tests {
+		if _, err := LoadAllowlist(writeAllowlist(t, tt.body)); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+	if _, err := LoadAllowlist(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing file: expected an error")
+	}
+}
+
+func TestAllowlistCheck(t *testing.T) {
+	a, err := LoadAllowlist(writeAllowlist(t, `{"allow": [
+		{"cidr": "10.0.0.0/24", "ports": ["22"]},
+		{"cidr": "10.0.1.5/32", "ports": ["22", "2200-2299"]},
+		{"cidr": "10.0.2.9/24", "ports": ["22"]},
+		{"cidr": "fd00:1::/64", "ports": ["22"]},
+		{"cidr": "::ffff:192.168.5.0/120", "ports": ["22"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target string
+		rule   string // "" = refused
+	}{
+		// CIDR edges
+		{"10.0.0.0:22", "allow[0]"},
+		{"10.0.0.255:22", "allow[0]"},
+		{"10.0.1.0:22", ""},
+		{"9.255.255.255:22", ""},
+		{"10.0.1.5:22", "allow[1]"},
+		{"10.0.1.4:22", ""},
+		{"10.0.1.6:22", ""},
+		// host bits in the rule are masked: 10.0.2.9/24 covers the whole /24
+		{"10.0.2.200:22", "allow[2]"},
+		// port ranges
+		{"10.0.1.5:2200", "allow[1]"},
+		{"10.0.1.5:2299", "allow[1]"},
+		{"10.0.1.5:2199", ""},
+		{"10.0.1.5:2300", ""},
+		{"10.0.0.7:2222", ""},
+		{"10.0.0.7:0", ""},
+		// IPv6
+		{"[fd00:1::5]:22", "allow[3]"},
+		{"[fd00:1::ffff:ffff:ffff:ffff]:22", "allow[3]"},
+		{"[fd00:2::5]:22", ""},
+		{"[fd00:1::5]:23", ""},
+		{"[fe80::1%eth0]:22", ""},
+		// IPv4-mapped targets are matched as IPv4, and mapped rules as IPv4 too
+		{"[::ffff:10.0.0.9]:22", "allow[0]"},
+		{"[::ffff:10.0.1.9]:22", ""},
+		{"192.168.5.10:22", "allow[4]"},
+		{"[::ffff:192.168.5.10]:22", "allow[4]"},
+		{"192.168.6.10:22", ""},
+		// host names are never resolved on the agent
+		{"localhost:22", ""},
+		{"db.internal:22", ""},
+		// malformed
+		{"10.0.0.7", ""},
+		{"10.0.0.7:", ""},
+		{"10.0.0.7:ssh", ""},
+		{"10.0.0.7:65536", ""},
+		{"fd00:1::5:22", ""},
+	}
+	for _, tt := range tests {
+		rule, err := a.Check(tt.target)
+		if tt.rule == "" {
+			if err == nil {
+				t.Errorf("Check(%q) allowed by %s, want refused", tt.target, rule)
+			}
+			continue
+		}
+		if err != nil || rule != tt.rule {
+			t.Errorf("Check(%q) = %q, %v; want %s", tt.target, rule, err, tt.rule)
+		}
+	}
+
+	empty, err := LoadAllowlist(writeAllowlist(t, `{"allow": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := empty.Check("10.0.0.1:22"); err == nil {
+		t.Error("empty allowlist allowed a target")
+	}
+}
@@ -0,0 +1,250 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// identity is the agent's client certificate, key and the proxy CA, kept in the state dir
+type identity struct {
+	ID   string
+	Cert tls.Certificate
+	Leaf *x509.Certificate
+	CA   *x509.CertPool
+}
+
+type enrollResponse struct {
+	AgentID     string `json:"agent_id"`
+	Certificate string `json:"certificate"`
+	CA          string `json:"ca"`
+}
+
+func statePaths(dir string) (key, cert, ca string) {
+	return filepath.Join(dir, "agent.key"), filepath.Join(dir, "agent.pem"), filepath.Join(dir, "ca.pem")
+}
+
+// loadIdentity reads the state dir; os.ErrNotExist means the agent never enrolled
+func loadIdentity(dir string) (*identity, error) {
+	keyPath, certPath, caPath := statePaths(dir)
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil && !os.IsNotExist(err) {
+		// saveIdentity was interrupted after moving the new certificate into place:
+		// its key is still staged, finish the swap
+		staged, serr := tls.LoadX509KeyPair(certPath, keyPath+".tmp")
+		if serr != nil {
+			return nil, err
+		}
+		if err := os.Rename(keyPath+".tmp", keyPath); err != nil {
+			return nil, err
+		}
+		pair = staged
+	} else if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("%s has no valid certificate", caPath)
+	}
+	return &identity{ID: leaf.Subject.CommonName, Cert: pair, Leaf: leaf, CA: pool}, nil
+}
+
+// renewIn returns how long until the certificate should be renewed (a third of
+// its lifetime before expiry); <= 0 means now
+func (id *identity) renewIn() time.Duration {
+	life := id.Leaf.NotAfter.Sub(id.Leaf.NotBefore)
+	return time.Until(id.Leaf.NotAfter.Add(-life / 3))
+}
+
+// newKeyAndCSR generates a fresh key for every enrollment and renewal
+func newKeyAndCSR() (keyPEM, csrPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the proxy sets the subject from the join token, this CN is informational
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}), nil
+}
+
+// pinnedTLS trusts the proxy only if its chain contains the CA matching pin
+// ("sha256:<hex>" of the CA public key). Used before the agent has the CA file.
+func pinnedTLS(host, pin string) *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true, // replaced by the pin check below
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			var certs []*x509.Certificate
+			for _, der := range raw {
+				c, err := x509.ParseCertificate(der)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, c)
+			}
+			for _, c := range certs {
+				if spkiPin(c) != pin {
+					continue
+				}
+				roots := x509.NewCertPool()
+				roots.AddCert(c)
+				_, err := certs[0].Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+				return err
+			}
+			return errors.New("proxy certificate does not match the CA pin")
+		},
+	}
+}
+
+func spkiPin(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// enroll exchanges a one-time join token for a client certificate and stores it
+func enroll(cfg AgentConfig) (*identity, error) {
+	if cfg.JoinToken == "" || cfg.CAPin == "" {
+		return nil, errors.New("agent is not enrolled: -join-token and -ca-pin are required (from 'proxy agents token')")
+	}
+	host, _, err := net.SplitHostPort(cfg.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, csrPEM, err := newKeyAndCSR()
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: pinnedTLS(host, cfg.CAPin)}}
+	var resp enrollResponse
+	if err := postJSON(client, "https://"+cfg.ProxyAddr+"/agent/enroll", map[string]string{"token": cfg.JoinToken, "csr": string(csrPEM)}, &resp); err != nil {
+		return nil, fmt.Errorf("enroll: %v", err)
+	}
+	// the CA handed back must be the one we pinned
+	block, _ := pem.Decode([]byte(resp.CA))
+	if block == nil {
+		return nil, errors.New("enroll: proxy returned no CA")
+	}
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || spkiPin(ca) != cfg.CAPin {
+		return nil, errors.New("enroll: CA returned by the proxy does not match the pin")
+	}
+	if err := saveIdentity(cfg.StateDir, keyPEM, []byte(resp.Certificate), []byte(resp.CA)); err != nil {
+		return nil, err
+	}
+	return loadIdentity(cfg.StateDir)
+}
+
+// renew gets a new certificate (with a new key) using the current one for mTLS.
+// The proxy revokes the previous certificate once the new one is issued.
+func renew(cfg AgentConfig, id *identity) (*identity, error) {
+	keyPEM, csrPEM, err := newKeyAndCSR()
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: id.tlsConfig()}}
+	var resp enrollResponse
+	if err := postJSON(client, "https://"+cfg.ProxyAddr+"/agent/renew", map[string]string{"csr": string(csrPEM)}, &resp); err != nil {
+		return nil, fmt.Errorf("renew: %v", err)
+	}
+	_, _, caPath := statePaths(cfg.StateDir)
+	caPEM, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveIdentity(cfg.StateDir, keyPEM, []byte(resp.Certificate), caPEM); err != nil {
+		return nil, err
+	}
+	return loadIdentity(cfg.StateDir)
+}
+
+func (id *identity) tlsConfig() *tls.Config {
+	return &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{id.Cert}, RootCAs: id.CA}
+}
+
+// saveIdentity stages every file under a temp name before renaming any of them, then
+// moves the certificate into place before its key. An interrupted save leaves either
+// the old pair or the new certificate with its key still staged, which loadIdentity
+// completes; never a new key next to an old certificate.
+func saveIdentity(dir string, keyPEM, certPEM, caPEM []byte) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	keyPath, certPath, caPath := statePaths(dir)
+	files := []struct {
+		path string
+		data []byte
+		mode os.FileMode
+	}{{caPath, caPEM, 0644}, {certPath, certPEM, 0644}, {keyPath, keyPEM, 0600}}
+	for _, f := range files {
+		if err := writeSynced(f.path+".tmp", f.data, f.mode); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		if err := os.Rename(f.path+".tmp", f.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSynced(path string, data []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func postJSON(client *http.Client, url string, body, out any) error {
+	b, _ := json.Marshal(body)
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
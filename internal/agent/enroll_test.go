@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+// testIdentity returns a fresh key and a self-signed certificate for it, both PEM
+func testIdentity(t *testing.T, cn string) (keyPEM, certPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestSaveIdentity(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := loadIdentity(dir); !os.IsNotExist(err) {
+		t.Fatalf("empty state dir: %v, want not exist", err)
+	}
+	keyPEM, certPEM := testIdentity(t, "edge-1")
+	if err := saveIdentity(dir, keyPEM, certPEM, certPEM); err != nil {
+		t.Fatal(err)
+	}
+	id, err := loadIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.ID != "edge-1" {
+		t.Fatalf("ID = %q", id.ID)
+	}
+	keyPath, _, _ := statePaths(dir)
+	if fi, err := os.Stat(keyPath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("key file mode %v, %v", fi.Mode().Perm(), err)
+	}
+
+	// renewal replaces both files
+	keyPEM, certPEM = testIdentity(t, "edge-1")
+	if err := saveIdentity(dir, keyPEM, certPEM, certPEM); err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := loadIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Leaf.SerialNumber.Cmp(id.Leaf.SerialNumber) == 0 {
+		t.Fatal("certificate was not replaced")
+	}
+}
+
+func TestLoadIdentityInterruptedSave(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, oldCert := testIdentity(t, "edge-1")
+	if err := saveIdentity(dir, oldKey, oldCert, oldCert); err != nil {
+		t.Fatal(err)
+	}
+	// crash between the two renames: the new certificate is in place, its key still staged
+	newKey, newCert := testIdentity(t, "edge-1")
+	keyPath, certPath, _ := statePaths(dir)
+	if err := os.WriteFile(keyPath+".tmp", newKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, newCert, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := loadIdentity(dir)
+	if err != nil {
+		t.Fatalf("interrupted save not recovered: %v", err)
+	}
+	if got := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: id.Leaf.Raw}); string(got) != string(newCert) {
+		t.Fatal("recovered identity does not use the new certificate")
+	}
+	if b, err := os.ReadFile(keyPath); err != nil || string(b) != string(newKey) {
+		t.Fatalf("staged key not moved into place: %v", err)
+	}
+	if _, err := os.Stat(keyPath + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("staged key left behind: %v", err)
+	}
+
+	// a mismatched pair without a staged key is still an error
+	otherKey, _ := testIdentity(t, "edge-1")
+	if err := os.WriteFile(keyPath, otherKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadIdentity(dir); err == nil {
+		t.Fatal("mismatched key and certificate loaded")
+	}
+}
@@ -1,86 +1,108 @@
 package agent
 
 import (
-	"bytes"
 	"encoding/json"
+	"io"
 	"log"
 	"net"
+	"os"
+	"time"
 
+	"github.com/Entidi89/ssh_proxy1/internal/tunnel"
 	"github.com/gorilla/websocket"
 )
 
-// incoming control format: {"type":"forward","id":"...","target":"127.0.0.1:22"}
+// How long the agent waits for a local target to accept a connection
+const dialTimeout = 5 * time.Second
 
-func handleWSAgentConn(ws *websocket.Conn) {
-	// central read loop
-	sessionMap := map[string]net.Conn{}
-	for {
-		mt, msg, err := ws.ReadMessage()
-		if err != nil {
-			log.Printf("ws read err: %v", err)
-			// cleanup
-			for _, c := range sessionMap {
-				c.Close()
-			}
+// Heartbeat: ping the proxy every pingInterval, reconnect when it is silent for pingTimeout
+const (
+	pingInterval = 15 * time.Second
+	pingTimeout  = 45 * time.Second
+)
+
+// hello tells the proxy who this agent is, for the admin API agent list
+type hello struct {
+	Type     string            `json:"type"`
+	Version  string            `json:"version"`
+	Hostname string            `json:"hostname"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// handleWSAgentConn serves one proxy connection until it drops. A "rotate" control
+// is signalled on rotate and ends the connection.
+func handleWSAgentConn(ws *websocket.Conn, cfg AgentConfig, rotate chan<- struct{}) {
+	mux := tunnel.NewMux(ws, "proxy", tunnel.Acceptor)
+	mux.Keepalive(pingInterval, pingTimeout)
+	mux.OnControl = func(payload []byte) {
+		var ctrl struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(payload, &ctrl); err != nil {
+			log.Printf("bad control message: %v", err)
 			return
 		}
-		if mt == websocket.TextMessage {
-			var ctrl map[string]string
-			if err := json.Unmarshal(msg, &ctrl); err != nil {
-				continue
-			}
-			typ := ctrl["type"]
-			id := ctrl["id"]
-			switch typ {
-			case "forward":
-				target := ctrl["target"]
-				// open local connection
-				local, err := net.Dial("tcp", target)
-				if err != nil {
-					// send ack fail
-					ack := map[string]string{"type": "forward-ack", "id": id, "status": "error", "error": err.Error()}
-					_ = ws.WriteJSON(ack)
-					continue
-				}
-				// store
-				sessionMap[id] = local
-				// send ack ok
-				ack := map[string]string{"type": "forward-ack", "id": id, "status": "ok"}
-				_ = ws.WriteJSON(ack)
-				// start local->ws forward
-				go func(id string, local net.Conn) {
-					buf := make([]byte, 32*1024)
-					for {
-						n, err := local.Read(buf)
-						if n > 0 {
-							frame := append([]byte(id+"|"), buf[:n]...)
-							_ = ws.WriteMessage(websocket.BinaryMessage, frame)
-						}
-						if err != nil {
-							local.Close()
-							// notify close
-							_ = ws.WriteJSON(map[string]string{"type": "forward-close", "id": id})
-							return
-						}
-					}
-				}(id, local)
-			case "close":
-				if c, ok := sessionMap[id]; ok {
-					c.Close()
-					delete(sessionMap, id)
-				}
-			}
-		} else if mt == websocket.BinaryMessage {
-			// binary frame: sid|payload
-			idx := bytes.IndexByte(msg, '|')
-			if idx <= 0 {
-				continue
+		switch ctrl.Type {
+		case "rotate":
+			select {
+			case rotate <- struct{}{}:
+			default:
 			}
-			sid := string(msg[:idx])
-			payload := msg[idx+1:]
-			if c, ok := sessionMap[sid]; ok {
-				_, _ = c.Write(payload)
+			mux.Close()
+		}
+	}
+	hostname, _ := os.Hostname()
+	if err := mux.SendControl(hello{Type: "hello", Version: Version, Hostname: hostname, Labels: cfg.Labels}); err != nil {
+		log.Printf("sending hello failed: %v", err)
+	}
+	go func() {
+		for {
+			s, err := mux.Accept()
+			if err != nil {
+				return
 			}
+			// dial in the background so a slow target does not stall other sessions
+			go forward(s, cfg.Allow)
 		}
+	}()
+	err := mux.Run()
+	log.Printf("ws read err: %v", err)
+}
+
+// forward connects a stream opened by the proxy to its target and copies data both
+// ways; each direction is half-closed on its own so the other can drain.
+// Targets outside the allowlist are refused before anything is dialed.
+func forward(s *tunnel.Stream, allow *Allowlist) {
+	rule, err := allow.Check(s.Target())
+	if err != nil {
+		log.Printf("forward %d to %s denied: %v", s.ID(), s.Target(), err)
+		s.Reject(tunnel.CodeDenied, err.Error())
+		return
+	}
+	log.Printf("forward %d to %s allowed by %s", s.ID(), s.Target(), rule)
+	local, err := net.DialTimeout("tcp", s.Target(), dialTimeout)
+	if err != nil {
+		log.Printf("forward %d to %s failed: %v", s.ID(), s.Target(), err)
+		s.Reject(tunnel.CodeRefused, err.Error())
+		return
 	}
+	if err := s.Confirm(); err != nil {
+		local.Close()
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		if _, err := io.Copy(local, s); err != nil {
+			// the proxy reset the stream: nobody reads what the target still sends
+			local.Close()
+		} else {
+			local.(*net.TCPConn).CloseWrite()
+		}
+		close(done)
+	}()
+	io.Copy(s, local)
+	s.CloseWrite()
+	<-done
+	local.Close()
+	s.Close()
 }
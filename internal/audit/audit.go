@@ -0,0 +1,57 @@
+package audit
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Record: một dòng trong file audit (JSON Lines)
+type Record struct {
+	Ts     int64                  `json:"ts"`
+	Event  string                 `json:"event"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Logger ghi các sự kiện bảo mật ra file audit. Logger nil chỉ ghi ra log chuẩn.
+type Logger struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func Open(path string) (*Logger, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{f: f}, nil
+}
+
+// Log ghi một sự kiện audit
+func (l *Logger) Log(event string, fields map[string]interface{}) {
+	log.Printf("[AUDIT] %s %v", event, fields)
+	if l == nil {
+		return
+	}
+	b, _ := json.Marshal(Record{Ts: time.Now().UnixMilli(), Event: event, Fields: fields})
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		log.Printf("[AUDIT] Lỗi ghi file audit: %v", err)
+	}
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
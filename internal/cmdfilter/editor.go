@@ -0,0 +1,215 @@
+package cmdfilter
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// LineEditor dựng lại dòng lệnh user đang gõ từ luồng stdin của terminal, mô phỏng
+// các phím sửa dòng phổ biến của readline: backspace, di chuyển con trỏ, Ctrl-U/K/W,
+// Home/End/Delete và văn bản dán (bracketed paste).
+//
+// Những thao tác mà proxy không thấy được kết quả (lịch sử lệnh, tab completion, yank,
+// escape sequence không nhận ra) đánh dấu dòng là không chắc chắn: dòng có thể khác
+// với lệnh shell thực sự chạy, nên role có rule chặn sẽ từ chối dòng đó.
+type LineEditor struct {
+	buf    []rune
+	cursor int
+	// Byte UTF-8 chưa đủ một ký tự
+	partial []byte
+	// Escape sequence đang đọc (bắt đầu bằng ESC)
+	esc   []byte
+	paste bool
+	// Dòng có thể khác với những gì shell nhận được
+	uncertain bool
+}
+
+// Line trả về dòng hiện tại và cho biết dòng có chắc chắn đầy đủ không
+func (e *LineEditor) Line() (line string, certain bool) {
+	return string(e.buf), !e.uncertain
+}
+
+// Reset bắt đầu một dòng mới
+func (e *LineEditor) Reset() {
+	e.buf = e.buf[:0]
+	e.cursor = 0
+	e.partial = e.partial[:0]
+	e.esc = e.esc[:0]
+	e.paste = false
+	e.uncertain = false
+}
+
+// Feed xử lý một byte stdin. Trả về true nếu byte này là phím Enter gửi dòng đi
+// (Enter bên trong văn bản dán không gửi dòng, giống readline khi bật bracketed paste).
+func (e *LineEditor) Feed(b byte) bool {
+	if len(e.esc) > 0 {
+		e.esc = append(e.esc, b)
+		e.escape()
+		return false
+	}
+	if len(e.partial) > 0 || b >= utf8.RuneSelf {
+		e.partial = append(e.partial, b)
+		if utf8.FullRune(e.partial) {
+			r, _ := utf8.DecodeRune(e.partial)
+			e.partial = e.partial[:0]
+			e.insert(r)
+		}
+		return false
+	}
+
+	switch b {
+	case '\r', '\n':
+		if e.paste {
+			e.insert('\n')
+			return false
+		}
+		return true
+	case 0x1b: // ESC
+		e.esc = append(e.esc, b)
+	case 0x7f, 0x08: // Backspace
+		if e.cursor > 0 {
+			e.delete(e.cursor-1, e.cursor)
+		}
+	case 0x04: // Ctrl-D: xóa ký tự dưới con trỏ
+		if e.cursor < len(e.buf) {
+			e.delete(e.cursor, e.cursor+1)
+		}
+	case 0x01: // Ctrl-A
+		e.cursor = 0
+	case 0x05: // Ctrl-E
+		e.cursor = len(e.buf)
+	case 0x02: // Ctrl-B
+		if e.cursor > 0 {
+			e.cursor--
+		}
+	case 0x06: // Ctrl-F
+		if e.cursor < len(e.buf) {
+			e.cursor++
+		}
+	case 0x0b: // Ctrl-K
+		e.delete(e.cursor, len(e.buf))
+	case 0x15: // Ctrl-U
+		e.delete(0, e.cursor)
+	case 0x17: // Ctrl-W
+		e.delete(e.wordStart(), e.cursor)
+	case 0x03: // Ctrl-C: shell bỏ dòng đang gõ
+		e.Reset()
+	case 0x09, 0x10, 0x0e, 0x12, 0x19: // Tab, Ctrl-P/N/R, Ctrl-Y
+		e.uncertain = true
+	default:
+		if b >= 0x20 {
+			e.insert(rune(b))
+		}
+	}
+	return false
+}
+
+// escape xử lý escape sequence khi đã đọc đủ
+func (e *LineEditor) escape() {
+	seq := e.esc
+	if len(seq) < 2 {
+		return
+	}
+	if seq[1] != '[' && seq[1] != 'O' {
+		// Alt + phím
+		switch seq[1] {
+		case 'b':
+			e.cursor = e.wordStart()
+		case 'f':
+			e.cursor = e.wordEnd()
+		case 'd':
+			e.delete(e.cursor, e.wordEnd())
+		case 0x7f:
+			e.delete(e.wordStart(), e.cursor)
+		default:
+			// Alt-. / Alt-y / Alt-u / Alt-t... đổi dòng theo cách proxy không thấy
+			e.uncertain = true
+		}
+		e.esc = e.esc[:0]
+		return
+	}
+	last := seq[len(seq)-1]
+	if len(seq) == 2 || (seq[1] == '[' && (last < 0x40 || last > 0x7e)) {
+		// Chưa hết sequence
+		if len(seq) > 16 {
+			e.esc = e.esc[:0]
+		}
+		return
+	}
+	switch string(seq[2:]) {
+	case "D":
+		if e.cursor > 0 {
+			e.cursor--
+		}
+	case "C":
+		if e.cursor < len(e.buf) {
+			e.cursor++
+		}
+	case "H", "1~", "7~":
+		e.cursor = 0
+	case "F", "4~", "8~":
+		e.cursor = len(e.buf)
+	case "3~":
+		if e.cursor < len(e.buf) {
+			e.delete(e.cursor, e.cursor+1)
+		}
+	case "1;5D", "1;3D":
+		e.cursor = e.wordStart()
+	case "1;5C", "1;3C":
+		e.cursor = e.wordEnd()
+	case "A", "B", "5~", "6~":
+		// Lịch sử lệnh: proxy không biết dòng được thay bằng gì
+		e.uncertain = true
+	case "200~":
+		e.paste = true
+	case "201~":
+		e.paste = false
+	default:
+		// Phím proxy không mô phỏng được (vd phím chức năng đã gán lệnh readline)
+		e.uncertain = true
+	}
+	e.esc = e.esc[:0]
+}
+
+func (e *LineEditor) insert(r rune) {
+	e.buf = append(e.buf, 0)
+	copy(e.buf[e.cursor+1:], e.buf[e.cursor:])
+	e.buf[e.cursor] = r
+	e.cursor++
+}
+
+func (e *LineEditor) delete(from, to int) {
+	if from >= to {
+		return
+	}
+	e.buf = append(e.buf[:from], e.buf[to:]...)
+	if e.cursor > to {
+		e.cursor -= to - from
+	} else if e.cursor > from {
+		e.cursor = from
+	}
+}
+
+// wordStart: vị trí đầu từ đứng trước con trỏ (như Ctrl-W / Alt-B)
+func (e *LineEditor) wordStart() int {
+	i := e.cursor
+	for i > 0 && unicode.IsSpace(e.buf[i-1]) {
+		i--
+	}
+	for i > 0 && !unicode.IsSpace(e.buf[i-1]) {
+		i--
+	}
+	return i
+}
+
+// wordEnd: vị trí cuối từ đứng sau con trỏ (như Alt-F)
+func (e *LineEditor) wordEnd() int {
+	i := e.cursor
+	for i < len(e.buf) && unicode.IsSpace(e.buf[i]) {
+		i++
+	}
+	for i < len(e.buf) && !unicode.IsSpace(e.buf[i]) {
+		i++
+	}
+	return i
+}
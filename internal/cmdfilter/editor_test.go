@@ -0,0 +1,79 @@
+package cmdfilter
+
+import "testing"
+
+func feed(input string) (string, bool) {
+	var e LineEditor
+	for i := 0; i < len(input); i++ {
+		if e.Feed(input[i]) {
+			break
+		}
+	}
+	return e.Line()
+}
+
+func TestLineEditor(t *testing.T) {
+	cases := []struct {
+		name    string
+		input   string
+		line    string
+		certain bool
+	}{
+		{"plain", "ls -la\r", "ls -la", true},
+		{"backspace", "lx\x7fs\r", "ls", true},
+		{"ctrl-u", "rm -rf /\x15ls\r", "ls", true},
+		{"cursor", "s\x1b[Dl\x1b[C -l\r", "ls -l", true},
+		{"ctrl-w", "echo foo\x17bar\r", "echo bar", true},
+		{"paste", "\x1b[200~echo a\necho b\x1b[201~\r", "echo a\necho b", true},
+		{"utf8", "echo chào\r", "echo chào", true},
+		{"tab", "shutdo\t\r", "shutdo", false},
+		{"history up", "\x1b[A\r", "", false},
+		{"history ss3", "\x1bOA\r", "", false},
+		{"reverse search", "\x12shut\r", "shut", false},
+		{"yank", "\x19\r", "", false},
+		{"alt-dot", "ls \x1b.\r", "ls ", false},
+		{"alt-upcase", "echo x\x1bu\r", "echo x", false},
+		{"unknown csi", "ls\x1b[15~\r", "ls", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			line, certain := feed(c.input)
+			if line != c.line || certain != c.certain {
+				t.Fatalf("Line() = %q, %v; muốn %q, %v", line, certain, c.line, c.certain)
+			}
+		})
+	}
+}
+
+func TestLineEditorReset(t *testing.T) {
+	var e LineEditor
+	for _, b := range []byte("abc\t") {
+		e.Feed(b)
+	}
+	e.Reset()
+	if line, certain := e.Line(); line != "" || !certain {
+		t.Fatalf("sau Reset: %q, %v", line, certain)
+	}
+}
+
+func TestFilterBlocks(t *testing.T) {
+	var nilFilter *Filter
+	if nilFilter.Blocks() {
+		t.Fatal("filter nil không được coi là có rule chặn")
+	}
+	warnOnly, err := New([]Rule{{Pattern: "systemctl", Action: Warn}, {Pattern: "^sudo", Action: Flag}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warnOnly.Blocks() {
+		t.Fatal("filter chỉ có warn/flag không được coi là có rule chặn")
+	}
+	// Action để trống mặc định là block
+	blocking, err := New([]Rule{{Pattern: "systemctl", Action: Warn}, {Pattern: `\bshutdown\b`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blocking.Blocks() {
+		t.Fatal("filter có rule block phải trả về Blocks() = true")
+	}
+}
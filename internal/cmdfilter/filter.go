@@ -0,0 +1,106 @@
+package cmdfilter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Hành động khi dòng lệnh khớp rule
+const (
+	Block = "block" // không cho lệnh chạy
+	Warn  = "warn"  // cho chạy nhưng cảnh báo user
+	Flag  = "flag"  // chỉ đánh dấu trong bản ghi phiên
+)
+
+var severity = map[string]int{Flag: 1, Warn: 2, Block: 3}
+
+// Rule: một mẫu lệnh (regex) và hành động tương ứng
+type Rule struct {
+	Pattern string `json:"pattern"`
+	// block | warn | flag (mặc định block)
+	Action string `json:"action,omitempty"`
+	// Thông báo hiển thị cho user / ghi vào bản ghi
+	Message string `json:"message,omitempty"`
+}
+
+// Filter: tập rule đã biên dịch của một role
+type Filter struct {
+	rules []Rule
+	res   []*regexp.Regexp
+}
+
+// Match: rule khớp với một dòng lệnh
+type Match struct {
+	Rule    Rule
+	Index   int
+	Command string
+}
+
+// Reason trả về thông báo cho user
+func (m *Match) Reason() string {
+	if m.Rule.Message != "" {
+		return m.Rule.Message
+	}
+	return "khớp mẫu " + m.Rule.Pattern
+}
+
+// New biên dịch danh sách rule. Danh sách rỗng -> nil (không lọc).
+func New(rules []Rule) (*Filter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	f := &Filter{}
+	for i, r := range rules {
+		if r.Action == "" {
+			r.Action = Block
+		}
+		if _, ok := severity[r.Action]; !ok {
+			return nil, fmt.Errorf("rule lệnh thứ %d: action '%s' không hợp lệ (block|warn|flag)", i+1, r.Action)
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule lệnh thứ %d: pattern không hợp lệ: %v", i+1, err)
+		}
+		f.rules = append(f.rules, r)
+		f.res = append(f.res, re)
+	}
+	return f, nil
+}
+
+// Blocks cho biết có rule nào chặn lệnh không
+func (f *Filter) Blocks() bool {
+	if f == nil {
+		return false
+	}
+	for _, r := range f.rules {
+		if r.Action == Block {
+			return true
+		}
+	}
+	return false
+}
+
+// Check đối chiếu dòng lệnh (có thể gồm nhiều dòng khi dán) với các rule.
+// Trả về rule có hành động nặng nhất, cùng mức thì rule khai báo trước thắng; nil nếu không khớp.
+func (f *Filter) Check(command string) *Match {
+	if f == nil {
+		return nil
+	}
+	var best *Match
+	for _, line := range strings.Split(command, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		for i, re := range f.res {
+			if !re.MatchString(line) {
+				continue
+			}
+			if best == nil || severity[f.rules[i].Action] > severity[best.Rule.Action] {
+				best = &Match{Rule: f.rules[i], Index: i, Command: line}
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,54 @@
+package directory
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// GroupsFile: cấu trúc file groups.json, vd {"groups": {"sre": ["bob", "alice"]}}
+type GroupsFile struct {
+	Groups map[string][]string `json:"groups"`
+}
+
+// FileResolver: thành viên nhóm lấy từ file groups.json cục bộ
+type FileResolver struct {
+	members map[string][]string // user -> danh sách nhóm
+}
+
+// LoadGroupsFile đọc groups.json. File chưa tồn tại được coi là không có nhóm nào.
+func LoadGroupsFile(path string) (*FileResolver, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NewFileResolver(nil), nil
+		}
+		return nil, err
+	}
+	var f GroupsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("lỗi cú pháp trong %s: %v", path, err)
+	}
+	return NewFileResolver(f.Groups), nil
+}
+
+// NewFileResolver dựng FileResolver từ map nhóm -> thành viên
+func NewFileResolver(groups map[string][]string) *FileResolver {
+	r := &FileResolver{members: make(map[string][]string)}
+	for g, users := range groups {
+		for _, u := range users {
+			r.members[u] = append(r.members[u], strings.ToLower(g))
+		}
+	}
+	for u := range r.members {
+		sort.Strings(r.members[u])
+	}
+	return r
+}
+
+// Groups trả về các nhóm của user
+func (r *FileResolver) Groups(user string) ([]string, error) {
+	return r.members[user], nil
+}
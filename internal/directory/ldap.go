@@ -0,0 +1,220 @@
+package directory
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConfig: cấu hình tra cứu nhóm từ LDAP / Active Directory (file ldap.json)
+type LDAPConfig struct {
+	// vd "ldaps://ad.corp.local:636" hoặc "ldap://127.0.0.1:389" cho thư mục thử nghiệm
+	URL string `json:"url"`
+	// Tài khoản dịch vụ dùng để tìm kiếm. Mật khẩu lấy từ biến môi trường BindPasswordEnv.
+	BindDN          string `json:"bind_dn"`
+	BindPasswordEnv string `json:"bind_password_env"`
+	StartTLS        bool   `json:"start_tls"`
+	// Chỉ dùng cho thư mục thử nghiệm
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+
+	// Tìm entry của user. {user} được thay bằng tên user (đã escape).
+	BaseDN     string `json:"base_dn"`
+	UserFilter string `json:"user_filter"`
+
+	// Tìm nhóm chứa user. {dn} được thay bằng DN của user (đã escape).
+	// Bỏ trống GroupFilter để dùng thuộc tính memberOf của user (Active Directory).
+	GroupBaseDN    string `json:"group_base_dn"`
+	GroupFilter    string `json:"group_filter"`
+	GroupAttribute string `json:"group_attribute"`
+
+	// Thời gian giữ kết quả tra cứu, vd "5m"
+	CacheTTL string `json:"cache_ttl"`
+}
+
+// Thời gian chờ tối đa cho một lần kết nối / truy vấn LDAP
+const ldapTimeout = 5 * time.Second
+
+// LoadLDAPConfig đọc ldap.json và điền giá trị mặc định
+func LoadLDAPConfig(path string) (*LDAPConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c LDAPConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("lỗi cú pháp trong %s: %v", path, err)
+	}
+	if c.URL == "" || c.BaseDN == "" {
+		return nil, fmt.Errorf("%s: thiếu url hoặc base_dn", path)
+	}
+	if c.UserFilter == "" {
+		c.UserFilter = "(uid={user})"
+	}
+	if c.GroupBaseDN == "" {
+		c.GroupBaseDN = c.BaseDN
+	}
+	if c.GroupAttribute == "" {
+		c.GroupAttribute = "cn"
+	}
+	if c.BindPasswordEnv == "" {
+		c.BindPasswordEnv = "LDAP_BIND_PASSWORD"
+	}
+	if c.CacheTTL == "" {
+		c.CacheTTL = "5m"
+	}
+	if _, err := time.ParseDuration(c.CacheTTL); err != nil {
+		return nil, fmt.Errorf("%s: cache_ttl không hợp lệ: %v", path, err)
+	}
+	return &c, nil
+}
+
+type cachedGroups struct {
+	groups  []string
+	expires time.Time
+}
+
+// LDAPResolver: thành viên nhóm truy vấn trực tiếp từ LDAP, có cache theo CacheTTL
+type LDAPResolver struct {
+	cfg      LDAPConfig
+	password string
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedGroups
+}
+
+func NewLDAPResolver(cfg *LDAPConfig) (*LDAPResolver, error) {
+	ttl, err := time.ParseDuration(cfg.CacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &LDAPResolver{
+		cfg:      *cfg,
+		password: os.Getenv(cfg.BindPasswordEnv),
+		ttl:      ttl,
+		cache:    make(map[string]cachedGroups),
+	}, nil
+}
+
+// Groups trả về các nhóm của user (tên nhóm viết thường)
+func (r *LDAPResolver) Groups(user string) ([]string, error) {
+	r.mu.Lock()
+	c, ok := r.cache[user]
+	r.mu.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.groups, nil
+	}
+
+	groups, err := r.lookup(user)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.cache[user] = cachedGroups{groups: groups, expires: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+	return groups, nil
+}
+
+func (r *LDAPResolver) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: r.cfg.InsecureSkipVerify}
+	conn, err := ldap.DialURL(r.cfg.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("không kết nối được LDAP %s: %v", r.cfg.URL, err)
+	}
+	conn.SetTimeout(ldapTimeout)
+	if r.cfg.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("lỗi StartTLS với LDAP: %v", err)
+		}
+	}
+	if r.cfg.BindDN != "" {
+		if err := conn.Bind(r.cfg.BindDN, r.password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("lỗi bind LDAP bằng '%s': %v", r.cfg.BindDN, err)
+		}
+	}
+	return conn, nil
+}
+
+func (r *LDAPResolver) lookup(user string) ([]string, error) {
+	conn, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// 1. Tìm entry của user
+	attrs := []string{"dn"}
+	if r.cfg.GroupFilter == "" {
+		attrs = append(attrs, "memberOf")
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		r.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout/time.Second), false,
+		strings.ReplaceAll(r.cfg.UserFilter, "{user}", ldap.EscapeFilter(user)),
+		attrs, nil))
+	if err != nil {
+		return nil, fmt.Errorf("lỗi tìm user '%s' trên LDAP: %v", user, err)
+	}
+	switch len(res.Entries) {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("user '%s' khớp nhiều entry trên LDAP", user)
+	}
+	entry := res.Entries[0]
+
+	// 2a. Active Directory: lấy tên nhóm từ memberOf
+	var groups []string
+	if r.cfg.GroupFilter == "" {
+		for _, dn := range entry.GetAttributeValues("memberOf") {
+			if name := groupNameFromDN(dn, r.cfg.GroupAttribute); name != "" {
+				groups = append(groups, name)
+			}
+		}
+		sort.Strings(groups)
+		return groups, nil
+	}
+
+	// 2b. Tìm các nhóm có user là thành viên (groupOfNames / posixGroup...)
+	filter := strings.ReplaceAll(r.cfg.GroupFilter, "{dn}", ldap.EscapeFilter(entry.DN))
+	filter = strings.ReplaceAll(filter, "{user}", ldap.EscapeFilter(user))
+	res, err = conn.Search(ldap.NewSearchRequest(
+		r.cfg.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(ldapTimeout/time.Second), false,
+		filter, []string{r.cfg.GroupAttribute}, nil))
+	if err != nil {
+		return nil, fmt.Errorf("lỗi tìm nhóm của '%s' trên LDAP: %v", user, err)
+	}
+	for _, g := range res.Entries {
+		for _, name := range g.GetAttributeValues(r.cfg.GroupAttribute) {
+			groups = append(groups, strings.ToLower(name))
+		}
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+// groupNameFromDN lấy giá trị thuộc tính attr ở RDN đầu tiên, vd "CN=SRE,OU=Groups,..." -> "sre"
+func groupNameFromDN(dn, attr string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return ""
+	}
+	for _, a := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(a.Type, attr) {
+			return strings.ToLower(a.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,290 @@
+package directory
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+type fakeEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+type fakeSearch struct {
+	base   string
+	filter string
+}
+
+// fakeLDAP: máy chủ LDAP tối giản chạy trong tiến trình test. Chỉ hiểu Bind, Search và
+// Unbind; kết quả tìm kiếm do hàm search quyết định theo base DN và filter nhận được.
+type fakeLDAP struct {
+	url    string
+	search func(base, filter string) []fakeEntry
+
+	mu       sync.Mutex
+	binds    []string
+	searches []fakeSearch
+}
+
+func newFakeLDAP(t *testing.T, search func(base, filter string) []fakeEntry) *fakeLDAP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &fakeLDAP{url: "ldap://" + ln.Addr().String(), search: search}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		req, err := ber.ReadPacket(conn)
+		if err != nil || len(req.Children) < 2 {
+			return
+		}
+		id := req.Children[0].Value.(int64)
+		op := req.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			s.mu.Lock()
+			s.binds = append(s.binds, op.Children[1].Data.String()+":"+op.Children[2].Data.String())
+			s.mu.Unlock()
+			conn.Write(response(id, ldap.ApplicationBindResponse).Bytes())
+		case ldap.ApplicationSearchRequest:
+			base := op.Children[0].Data.String()
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.searches = append(s.searches, fakeSearch{base, filter})
+			s.mu.Unlock()
+			for _, e := range s.search(base, filter) {
+				conn.Write(searchEntry(id, e).Bytes())
+			}
+			conn.Write(response(id, ldap.ApplicationSearchResultDone).Bytes())
+		default: // Unbind
+			return
+		}
+	}
+}
+
+func (s *fakeLDAP) bound() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.binds...)
+}
+
+func (s *fakeLDAP) recorded() []fakeSearch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeSearch(nil), s.searches...)
+}
+
+func message(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.NewSequence("LDAPMessage")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "messageID"))
+	p.AppendChild(op)
+	return p
+}
+
+func response(id int64, tag ber.Tag) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(ldap.LDAPResultSuccess), "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return message(id, op)
+}
+
+func searchEntry(id int64, e fakeEntry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "objectName"))
+	attrs := ber.NewSequence("attributes")
+	for name, values := range e.attrs {
+		attr := ber.NewSequence("attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	return message(id, op)
+}
+
+func testResolver(t *testing.T, cfg LDAPConfig) *LDAPResolver {
+	t.Helper()
+	if cfg.CacheTTL == "" {
+		cfg.CacheTTL = "5m"
+	}
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = "(uid={user})"
+	}
+	if cfg.GroupBaseDN == "" {
+		cfg.GroupBaseDN = cfg.BaseDN
+	}
+	if cfg.GroupAttribute == "" {
+		cfg.GroupAttribute = "cn"
+	}
+	r, err := NewLDAPResolver(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestLDAPMemberOf(t *testing.T) {
+	srv := newFakeLDAP(t, func(base, filter string) []fakeEntry {
+		if filter != "(uid=bob)" {
+			return nil
+		}
+		return []fakeEntry{{
+			dn: "CN=Bob,OU=People,DC=corp,DC=local",
+			attrs: map[string][]string{"memberOf": {
+				"CN=SRE,OU=Groups,DC=corp,DC=local",
+				"CN=DBA,OU=Groups,DC=corp,DC=local",
+				// RDN đầu không phải cn -> bỏ qua
+				"OU=Contractors,DC=corp,DC=local",
+			}},
+		}}
+	})
+	t.Setenv("TEST_LDAP_PASSWORD", "s3cret")
+	r := testResolver(t, LDAPConfig{
+		URL:             srv.url,
+		BindDN:          "cn=svc,dc=corp,dc=local",
+		BindPasswordEnv: "TEST_LDAP_PASSWORD",
+		BaseDN:          "DC=corp,DC=local",
+	})
+
+	groups, err := r.Groups("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dba", "sre"}; !reflect.DeepEqual(groups, want) {
+		t.Fatalf("Groups = %v; muốn %v", groups, want)
+	}
+	if want := []string{"cn=svc,dc=corp,dc=local:s3cret"}; !reflect.DeepEqual(srv.bound(), want) {
+		t.Fatalf("bind = %v; muốn %v", srv.bound(), want)
+	}
+	// memberOf không cần truy vấn nhóm thứ hai
+	if got := srv.recorded(); len(got) != 1 {
+		t.Fatalf("số lần search = %d; muốn 1: %v", len(got), got)
+	}
+
+	// Lần thứ hai lấy từ cache
+	if _, err := r.Groups("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.recorded(); len(got) != 1 {
+		t.Fatalf("kết quả không được cache: %v", got)
+	}
+}
+
+func TestLDAPGroupFilter(t *testing.T) {
+	srv := newFakeLDAP(t, func(base, filter string) []fakeEntry {
+		switch filter {
+		case "(uid=alice)":
+			return []fakeEntry{{dn: "uid=alice,ou=people,dc=example,dc=org"}}
+		case "(member=uid=alice,ou=people,dc=example,dc=org)":
+			if base != "ou=groups,dc=example,dc=org" {
+				return nil
+			}
+			return []fakeEntry{
+				{dn: "cn=ops,ou=groups,dc=example,dc=org", attrs: map[string][]string{"cn": {"Ops"}}},
+				{dn: "cn=dev,ou=groups,dc=example,dc=org", attrs: map[string][]string{"cn": {"Dev"}}},
+			}
+		}
+		return nil
+	})
+	r := testResolver(t, LDAPConfig{
+		URL:         srv.url,
+		BaseDN:      "dc=example,dc=org",
+		GroupBaseDN: "ou=groups,dc=example,dc=org",
+		GroupFilter: "(member={dn})",
+	})
+
+	groups, err := r.Groups("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dev", "ops"}; !reflect.DeepEqual(groups, want) {
+		t.Fatalf("Groups = %v; muốn %v", groups, want)
+	}
+	want := []fakeSearch{
+		{"dc=example,dc=org", "(uid=alice)"},
+		{"ou=groups,dc=example,dc=org", "(member=uid=alice,ou=people,dc=example,dc=org)"},
+	}
+	if got := srv.recorded(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("search = %v; muốn %v", got, want)
+	}
+}
+
+func TestLDAPFilterEscaping(t *testing.T) {
+	const user = `bob*)(uid=*`
+	const dn = `cn=bob (ops)*,ou=people,dc=example,dc=org`
+	srv := newFakeLDAP(t, func(base, filter string) []fakeEntry {
+		if strings.HasPrefix(filter, "(uid=") {
+			return []fakeEntry{{dn: dn}}
+		}
+		return nil
+	})
+	r := testResolver(t, LDAPConfig{
+		URL:         srv.url,
+		BaseDN:      "dc=example,dc=org",
+		GroupFilter: "(|(member={dn})(memberUid={user}))",
+	})
+
+	if _, err := r.Groups(user); err != nil {
+		t.Fatal(err)
+	}
+	// Ký tự đặc biệt trong {user} và {dn} phải được escape: filter vẫn chỉ là một
+	// phép so sánh bằng, không bị chèn thêm điều kiện
+	want := []fakeSearch{
+		{"dc=example,dc=org", `(uid=bob\2a\29\28uid=\2a)`},
+		{"dc=example,dc=org", `(|(member=cn=bob \28ops\29\2a,ou=people,dc=example,dc=org)(memberUid=bob\2a\29\28uid=\2a))`},
+	}
+	if got := srv.recorded(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("search = %v; muốn %v", got, want)
+	}
+}
+
+func TestLDAPUserLookup(t *testing.T) {
+	srv := newFakeLDAP(t, func(base, filter string) []fakeEntry {
+		if filter == "(uid=dup)" {
+			return []fakeEntry{
+				{dn: "uid=dup,ou=a,dc=example,dc=org"},
+				{dn: "uid=dup,ou=b,dc=example,dc=org"},
+			}
+		}
+		return nil
+	})
+	r := testResolver(t, LDAPConfig{URL: srv.url, BaseDN: "dc=example,dc=org"})
+
+	_, err := r.Groups("dup")
+	if err == nil || !strings.Contains(err.Error(), "khớp nhiều entry") {
+		t.Fatalf("user khớp nhiều entry phải lỗi, nhận: %v", err)
+	}
+	groups, err := r.Groups("nobody")
+	if err != nil || groups != nil {
+		t.Fatalf("user không có trên LDAP: %v, %v; muốn nil, nil", groups, err)
+	}
+}
@@ -0,0 +1,105 @@
+package enroll
+
+import (
+	"crypto/x509"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadOrCreateCA(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "pki")
+	ca, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.cert.IsCA {
+		t.Fatal("CA certificate is not a CA")
+	}
+	// Lần sau đọc lại đúng CA đã tạo
+	again, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Pin() != ca.Pin() || string(again.CertPEM()) != string(ca.CertPEM()) {
+		t.Fatal("CA changed after reload")
+	}
+	if ca.Pin() != SPKIPin(ca.cert) || len(ca.Pin()) != len("sha256:")+64 {
+		t.Fatalf("pin %q", ca.Pin())
+	}
+}
+
+func TestSignClient(t *testing.T) {
+	ca, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cert, certPEM, err := ca.signClient(testCSR(t, "admin"), "edge-1", time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed := parseCert(t, certPEM); !parsed.Equal(cert) {
+		t.Fatal("PEM does not match the returned certificate")
+	}
+	if cert.Subject.CommonName != "edge-1" {
+		t.Fatalf("CN = %q", cert.Subject.CommonName)
+	}
+	if !cert.NotAfter.Equal(now.Add(time.Hour).Truncate(time.Second)) {
+		t.Fatalf("NotAfter = %v", cert.NotAfter)
+	}
+	// Chỉ dùng làm client certificate
+	opts := x509.VerifyOptions{Roots: ca.Pool(), CurrentTime: now}
+	opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	if _, err := cert.Verify(opts); err != nil {
+		t.Fatalf("client auth: %v", err)
+	}
+	opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	if _, err := cert.Verify(opts); err == nil {
+		t.Fatal("client certificate usable for server auth")
+	}
+	// Serial ngẫu nhiên cho mỗi lần ký
+	next, _, err := ca.signClient(testCSR(t, ""), "edge-1", time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serialOf(next) == serialOf(cert) {
+		t.Fatal("serial reused")
+	}
+
+	for _, csr := range [][]byte{nil, []byte("garbage"), certPEM} {
+		if _, _, err := ca.signClient(csr, "edge-1", time.Hour, now); err == nil {
+			t.Errorf("csr %.30q accepted", csr)
+		}
+	}
+}
+
+func TestServerCertificate(t *testing.T) {
+	ca, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := ca.ServerCertificate([]string{"proxy.example.com", "10.0.0.1", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pair.Certificate) != 2 {
+		t.Fatalf("chain has %d certificates, want leaf + CA", len(pair.Certificate))
+	}
+	if len(leaf.DNSNames) != 1 || len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("SANs %v %v", leaf.DNSNames, leaf.IPAddresses)
+	}
+	for _, host := range []string{"proxy.example.com", "10.0.0.1"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: ca.Pool()}); err != nil {
+			t.Errorf("%s: %v", host, err)
+		}
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "evil.example.com", Roots: ca.Pool()}); err == nil {
+		t.Error("certificate valid for a host it was not issued to")
+	}
+}
@@ -0,0 +1,278 @@
+package enroll
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/audit"
+)
+
+// Sự kiện audit của vòng đời agent
+const (
+	EventTokenCreated = "agent.token-created"
+	EventEnrolled     = "agent.enrolled"
+	EventRenewed      = "agent.cert-renewed"
+	EventRevoked      = "agent.revoked"
+)
+
+var (
+	ErrInvalidToken = errors.New("join token không hợp lệ, đã dùng hoặc đã hết hạn")
+	ErrUnknownCert  = errors.New("certificate của agent không được proxy cấp hoặc đã bị thu hồi")
+	ErrNoAgent      = errors.New("agent chưa đăng ký")
+)
+
+// ID agent dùng trong inventory ("agent") và làm Common Name của certificate
+var validID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,62}$`)
+
+// Token: join token dùng một lần. File chỉ lưu SHA-256 của token.
+type Token struct {
+	SHA256    string     `json:"sha256"`
+	AgentID   string     `json:"agent_id"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+// Cert: client certificate đã cấp cho agent
+type Cert struct {
+	Serial    string     `json:"serial"`
+	AgentID   string     `json:"agent_id"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	NotAfter  time.Time  `json:"not_after"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// Lý do thu hồi: "rotated" (đã cấp certificate mới) hoặc do quản trị viên ghi
+	Reason string `json:"reason,omitempty"`
+}
+
+type state struct {
+	Tokens []*Token `json:"tokens"`
+	Certs  []*Cert  `json:"certs"`
+}
+
+// Store: join token và certificate đã cấp cho agent, lưu trong file JSON
+type Store struct {
+	// Thời hạn client certificate của agent (agent tự gia hạn trước khi hết hạn)
+	CertTTL time.Duration
+	Audit   *audit.Logger
+
+	ca   *CA
+	mu   sync.Mutex
+	path string
+	st   state
+}
+
+// Open đọc file trạng thái. File chưa tồn tại được coi là rỗng.
+func Open(path string, ca *CA) (*Store, error) {
+	s := &Store{CertTTL: 30 * 24 * time.Hour, ca: ca, path: path}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.st); err != nil {
+		return nil, fmt.Errorf("lỗi cú pháp trong %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// CA trả về CA dùng để ký certificate agent
+func (s *Store) CA() *CA { return s.ca }
+
+// save ghi file tạm rồi đổi tên để không hỏng file khi lỗi giữa chừng
+func (s *Store) save() error {
+	b, err := json.MarshalIndent(s.st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".agents-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func serialOf(cert *x509.Certificate) string {
+	return cert.SerialNumber.Text(16)
+}
+
+// CreateToken sinh join token dùng một lần cho agentID, hiệu lực trong ttl
+func (s *Store) CreateToken(agentID, by string, ttl time.Duration) (string, *Token, error) {
+	if !validID.MatchString(agentID) {
+		return "", nil, fmt.Errorf("agent id '%s' không hợp lệ (chữ, số, . _ : -)", agentID)
+	}
+	if ttl <= 0 || ttl > 7*24*time.Hour {
+		return "", nil, fmt.Errorf("thời hạn token phải trong khoảng (0, 168h]")
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	now := time.Now()
+	t := &Token{SHA256: hashToken(token), AgentID: agentID, CreatedBy: by, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.st.Tokens = append(s.st.Tokens, t)
+	if err := s.save(); err != nil {
+		s.st.Tokens = s.st.Tokens[:len(s.st.Tokens)-1]
+		return "", nil, err
+	}
+	s.Audit.Log(EventTokenCreated, map[string]interface{}{"agent": agentID, "by": by, "expires": t.ExpiresAt.Format(time.RFC3339)})
+	out := *t
+	return token, &out, nil
+}
+
+// Enroll đổi join token lấy client certificate. Token chỉ dùng được một lần.
+func (s *Store) Enroll(token string, csrPEM []byte, remote string) (agentID string, certPEM []byte, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var t *Token
+	h := hashToken(token)
+	for _, cand := range s.st.Tokens {
+		if cand.SHA256 == h {
+			t = cand
+			break
+		}
+	}
+	if t == nil || t.UsedAt != nil || !now.Before(t.ExpiresAt) {
+		return "", nil, ErrInvalidToken
+	}
+	cert, certPEM, err := s.ca.signClient(csrPEM, t.AgentID, s.CertTTL, now)
+	if err != nil {
+		return "", nil, err
+	}
+	t.UsedAt = &now
+	s.st.Certs = append(s.st.Certs, &Cert{Serial: serialOf(cert), AgentID: t.AgentID, IssuedAt: now, NotAfter: cert.NotAfter})
+	if err := s.save(); err != nil {
+		t.UsedAt = nil
+		s.st.Certs = s.st.Certs[:len(s.st.Certs)-1]
+		return "", nil, err
+	}
+	s.Audit.Log(EventEnrolled, map[string]interface{}{"agent": t.AgentID, "serial": serialOf(cert), "remote": remote,
+		"not_after": cert.NotAfter.Format(time.RFC3339)})
+	return t.AgentID, certPEM, nil
+}
+
+// Renew cấp certificate mới cho agent đang giữ certificate hợp lệ (peer) rồi thu hồi
+// các certificate cũ của agent đó: tại mỗi thời điểm agent chỉ có một certificate dùng được.
+func (s *Store) Renew(peer *x509.Certificate, csrPEM []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	agentID, err := s.verifyLocked(peer)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cert, certPEM, err := s.ca.signClient(csrPEM, agentID, s.CertTTL, now)
+	if err != nil {
+		return nil, err
+	}
+	prev := append([]*Cert(nil), s.st.Certs...)
+	var old []string
+	for i, c := range s.st.Certs {
+		if c.AgentID == agentID && c.RevokedAt == nil {
+			cp := *c
+			cp.RevokedAt, cp.Reason = &now, "rotated"
+			s.st.Certs[i] = &cp
+			old = append(old, c.Serial)
+		}
+	}
+	s.st.Certs = append(s.st.Certs, &Cert{Serial: serialOf(cert), AgentID: agentID, IssuedAt: now, NotAfter: cert.NotAfter})
+	if err := s.save(); err != nil {
+		s.st.Certs = prev
+		return nil, err
+	}
+	s.Audit.Log(EventRenewed, map[string]interface{}{"agent": agentID, "serial": serialOf(cert), "replaced": old,
+		"not_after": cert.NotAfter.Format(time.RFC3339)})
+	return certPEM, nil
+}
+
+// Verify kiểm tra client certificate (đã được TLS xác minh theo CA) vẫn còn hiệu lực
+// trong store và trả về ID agent
+func (s *Store) Verify(cert *x509.Certificate) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.verifyLocked(cert)
+}
+
+func (s *Store) verifyLocked(cert *x509.Certificate) (string, error) {
+	serial := serialOf(cert)
+	for _, c := range s.st.Certs {
+		if c.Serial == serial && c.AgentID == cert.Subject.CommonName {
+			if c.RevokedAt != nil || !time.Now().Before(c.NotAfter) {
+				break
+			}
+			return c.AgentID, nil
+		}
+	}
+	return "", ErrUnknownCert
+}
+
+// Revoke thu hồi mọi certificate và join token chưa dùng của agent, trả về số mục bị thu hồi.
+// Agent phải đăng ký lại bằng join token mới.
+func (s *Store) Revoke(agentID, by, reason string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if reason == "" {
+		reason = "revoked by " + by
+	}
+	prev := append([]*Cert(nil), s.st.Certs...)
+	n := 0
+	for i, c := range s.st.Certs {
+		if c.AgentID == agentID && c.RevokedAt == nil {
+			cp := *c
+			cp.RevokedAt, cp.Reason = &now, reason
+			s.st.Certs[i] = &cp
+			n++
+		}
+	}
+	// Token chưa dùng của agent cũng bị vô hiệu
+	prevTokens := append([]*Token(nil), s.st.Tokens...)
+	for i, t := range s.st.Tokens {
+		if t.AgentID == agentID && t.UsedAt == nil && now.Before(t.ExpiresAt) {
+			cp := *t
+			cp.ExpiresAt = now
+			s.st.Tokens[i] = &cp
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, ErrNoAgent
+	}
+	if err := s.save(); err != nil {
+		s.st.Certs, s.st.Tokens = prev, prevTokens
+		return 0, err
+	}
+	s.Audit.Log(EventRevoked, map[string]interface{}{"agent": agentID, "by": by, "reason": reason, "count": n})
+	return n, nil
+}
@@ -0,0 +1,252 @@
+package enroll
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "pki"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(filepath.Join(dir, "agents.json"), ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testCSR sinh CSR mới; CN trong CSR bị proxy bỏ qua
+func testCSR(t *testing.T, cn string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func parseCert(t *testing.T, certPEM []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("certificate is not PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// enrollAgent tạo join token cho id và đổi lấy certificate
+func enrollAgent(t *testing.T, s *Store, id string) *x509.Certificate {
+	t.Helper()
+	token, _, err := s.CreateToken(id, "admin", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, certPEM, err := s.Enroll(token, testCSR(t, "whatever"), "192.0.2.1:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != id {
+		t.Fatalf("Enroll trả về agent %q, muốn %q", got, id)
+	}
+	return parseCert(t, certPEM)
+}
+
+func TestCreateTokenValidation(t *testing.T) {
+	s := testStore(t)
+	for _, id := range []string{"", "-edge", "a b", "dc1/edge", string(make([]byte, 64))} {
+		if _, _, err := s.CreateToken(id, "admin", time.Hour); err == nil {
+			t.Errorf("agent id %q accepted", id)
+		}
+	}
+	for _, ttl := range []time.Duration{0, -time.Minute, 7*24*time.Hour + time.Second} {
+		if _, _, err := s.CreateToken("edge-1", "admin", ttl); err == nil {
+			t.Errorf("ttl %v accepted", ttl)
+		}
+	}
+	token, rec, err := s.CreateToken("dc1:edge-1", "admin", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// File chỉ lưu hash của token
+	if rec.SHA256 == token || rec.SHA256 != hashToken(token) {
+		t.Fatalf("token record %+v", rec)
+	}
+}
+
+func TestJoinTokenSingleUse(t *testing.T) {
+	s := testStore(t)
+	token, _, err := s.CreateToken("edge-1", "admin", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Enroll("not-a-token", testCSR(t, "edge-1"), ""); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("unknown token: %v", err)
+	}
+	// CSR hỏng không tiêu tốn token
+	if _, _, err := s.Enroll(token, []byte("garbage"), ""); err == nil || errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("bad csr: %v", err)
+	}
+	if _, _, err := s.Enroll(token, testCSR(t, "edge-1"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Enroll(token, testCSR(t, "edge-1"), ""); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("reused token: %v", err)
+	}
+
+	// Trạng thái được lưu: token đã dùng vẫn bị từ chối sau khi mở lại store
+	reopened, err := Open(s.path, s.CA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := reopened.Enroll(token, testCSR(t, "edge-1"), ""); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("reused token after reopen: %v", err)
+	}
+}
+
+func TestJoinTokenExpiry(t *testing.T) {
+	s := testStore(t)
+	token, _, err := s.CreateToken("edge-1", "admin", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.st.Tokens[0].ExpiresAt = time.Now().Add(-time.Second)
+	if _, _, err := s.Enroll(token, testCSR(t, "edge-1"), ""); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expired token: %v", err)
+	}
+}
+
+func TestEnrollSetsSubjectFromToken(t *testing.T) {
+	s := testStore(t)
+	s.CertTTL = 2 * time.Hour
+	cert := enrollAgent(t, s, "edge-1")
+	if cert.Subject.CommonName != "edge-1" {
+		t.Fatalf("CN = %q, muốn edge-1 (không lấy từ CSR)", cert.Subject.CommonName)
+	}
+	if d := time.Until(cert.NotAfter); d > 2*time.Hour || d < 2*time.Hour-time.Minute {
+		t.Fatalf("NotAfter sau %v, muốn CertTTL 2h", d)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: s.CA().Pool(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Fatalf("certificate không xác minh được theo CA: %v", err)
+	}
+}
+
+func TestRenewRevokesPrevious(t *testing.T) {
+	s := testStore(t)
+	first := enrollAgent(t, s, "edge-1")
+	if id, err := s.Verify(first); err != nil || id != "edge-1" {
+		t.Fatalf("Verify(first) = %q, %v", id, err)
+	}
+
+	certPEM, err := s.Renew(first, testCSR(t, "edge-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := parseCert(t, certPEM)
+	if second.Subject.CommonName != "edge-1" || serialOf(second) == serialOf(first) {
+		t.Fatalf("renewed certificate %s / %s", second.Subject.CommonName, serialOf(second))
+	}
+	if _, err := s.Verify(first); !errors.Is(err, ErrUnknownCert) {
+		t.Fatalf("previous certificate still valid: %v", err)
+	}
+	if id, err := s.Verify(second); err != nil || id != "edge-1" {
+		t.Fatalf("Verify(second) = %q, %v", id, err)
+	}
+	// Certificate đã thay không gia hạn được nữa
+	if _, err := s.Renew(first, testCSR(t, "edge-1")); !errors.Is(err, ErrUnknownCert) {
+		t.Fatalf("renew with rotated certificate: %v", err)
+	}
+	var rotated *Cert
+	for _, c := range s.st.Certs {
+		if c.Serial == serialOf(first) {
+			rotated = c
+		}
+	}
+	if rotated == nil || rotated.RevokedAt == nil || rotated.Reason != "rotated" {
+		t.Fatalf("previous certificate record %+v", rotated)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	s := testStore(t)
+	cert := enrollAgent(t, s, "edge-1")
+	other := enrollAgent(t, s, "edge-2")
+	pending, _, err := s.CreateToken("edge-1", "admin", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// certificate + token chưa dùng
+	n, err := s.Revoke("edge-1", "alice", "")
+	if err != nil || n != 2 {
+		t.Fatalf("Revoke = %d, %v; muốn 2", n, err)
+	}
+	if _, err := s.Verify(cert); !errors.Is(err, ErrUnknownCert) {
+		t.Fatalf("revoked certificate still valid: %v", err)
+	}
+	if _, _, err := s.Enroll(pending, testCSR(t, "edge-1"), ""); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("token of a revoked agent: %v", err)
+	}
+	if _, err := s.Verify(other); err != nil {
+		t.Fatalf("other agent revoked: %v", err)
+	}
+	if _, err := s.Revoke("edge-1", "alice", ""); !errors.Is(err, ErrNoAgent) {
+		t.Fatalf("revoking twice: %v", err)
+	}
+	if _, err := s.Revoke("nobody", "alice", ""); !errors.Is(err, ErrNoAgent) {
+		t.Fatalf("unknown agent: %v", err)
+	}
+
+	// Đăng ký lại bằng token mới
+	again := enrollAgent(t, s, "edge-1")
+	if _, err := s.Verify(again); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifySerialAndCN(t *testing.T) {
+	s := testStore(t)
+	cert := enrollAgent(t, s, "edge-1")
+
+	// Certificate do CA ký với serial đã cấp nhưng CN khác (vd lấy serial của agent khác)
+	forged, _, err := s.CA().signClient(testCSR(t, ""), "edge-2", time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.SerialNumber = cert.SerialNumber
+	if _, err := s.Verify(forged); !errors.Is(err, ErrUnknownCert) {
+		t.Fatalf("serial of edge-1 with CN edge-2: %v", err)
+	}
+	// CN đúng nhưng serial không do store cấp
+	unknown, _, err := s.CA().signClient(testCSR(t, ""), "edge-1", time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Verify(unknown); !errors.Is(err, ErrUnknownCert) {
+		t.Fatalf("unknown serial: %v", err)
+	}
+	// Bản ghi đã hết hạn
+	s.st.Certs[0].NotAfter = time.Now().Add(-time.Second)
+	if _, err := s.Verify(cert); !errors.Is(err, ErrUnknownCert) {
+		t.Fatalf("expired certificate: %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package hostkeys
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Entidi89/ssh_proxy1/internal/audit"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Mode: cách xử lý máy đích chưa có trong known_hosts
+type Mode string
+
+const (
+	// Strict: chỉ chấp nhận host key đã có trong known_hosts (hoặc cert của host CA)
+	Strict Mode = "strict"
+	// TOFU: tin tưởng lần đầu, ghi host key vào known_hosts và ghim lại cho các lần sau
+	TOFU Mode = "tofu"
+)
+
+// Sự kiện audit liên quan tới host key
+const (
+	EventMismatch    = "hostkey.mismatch"
+	EventUnknown     = "hostkey.unknown"
+	EventPinned      = "hostkey.pinned"
+	EventCertInvalid = "hostkey.cert-invalid"
+)
+
+var ErrHostKeyMismatch = errors.New("host key của máy đích KHÔNG khớp known_hosts (có thể bị MITM)")
+
+// KnownHosts: file known_hosts do proxy quản lý
+type KnownHosts struct {
+	mu   sync.Mutex
+	path string
+	keys map[string][]ssh.PublicKey // host đã chuẩn hóa -> danh sách key
+}
+
+// LoadKnownHosts đọc file known_hosts. File chưa tồn tại được coi là rỗng.
+func LoadKnownHosts(path string) (*KnownHosts, error) {
+	k := &KnownHosts{path: path, keys: make(map[string][]ssh.PublicKey)}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return k, nil
+		}
+		return nil, err
+	}
+	for len(b) > 0 {
+		marker, hosts, key, _, rest, err := ssh.ParseKnownHosts(b)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("lỗi đọc %s: %v", path, err)
+		}
+		b = rest
+		if marker != "" {
+			// @cert-authority / @revoked không dùng trong file do proxy quản lý
+			continue
+		}
+		for _, h := range hosts {
+			k.keys[h] = append(k.keys[h], key)
+		}
+	}
+	return k, nil
+}
+
+// Lookup trả về các key đã biết của host (addr dạng host:port)
+func (k *KnownHosts) Lookup(addr string) []ssh.PublicKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.keys[knownhosts.Normalize(addr)]
+}
+
+// Add ghim key cho host và ghi thêm vào file known_hosts
+func (k *KnownHosts) Add(addr string, key ssh.PublicKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	host := knownhosts.Normalize(addr)
+	for _, existing := range k.keys[host] {
+		if bytes.Equal(existing.Marshal(), key.Marshal()) {
+			return nil
+		}
+	}
+	f, err := os.OpenFile(k.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(knownhosts.Line([]string{host}, key) + "\n"); err != nil {
+		return err
+	}
+	k.keys[host] = append(k.keys[host], key)
+	return nil
+}
+
+// Verifier kiểm tra host key của máy đích theo known_hosts, TOFU và host CA
+type Verifier struct {
+	Mode  Mode
+	Known *KnownHosts
+	// Public key của SSH host CA (Vault ssh-host-signer). Rỗng = không nhận host certificate.
+	CAKeys []ssh.PublicKey
+	Audit  *audit.Logger
+}
+
+func (v *Verifier) isHostAuthority(auth ssh.PublicKey, _ string) bool {
+	for _, ca := range v.CAKeys {
+		if bytes.Equal(ca.Marshal(), auth.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Callback trả về HostKeyCallback cho một lần kết nối. fields được ghi kèm sự kiện audit.
+func (v *Verifier) Callback(fields map[string]interface{}) ssh.HostKeyCallback {
+	return func(addr string, remote net.Addr, key ssh.PublicKey) error {
+		ev := func(name string, extra map[string]interface{}) {
+			f := map[string]interface{}{
+				"target":      addr,
+				"remote":      remote.String(),
+				"fingerprint": ssh.FingerprintSHA256(key),
+				"key_type":    key.Type(),
+			}
+			for k, val := range fields {
+				f[k] = val
+			}
+			for k, val := range extra {
+				f[k] = val
+			}
+			v.Audit.Log(name, f)
+		}
+
+		if cert, ok := key.(*ssh.Certificate); ok {
+			if len(v.CAKeys) > 0 {
+				checker := &ssh.CertChecker{IsHostAuthority: v.isHostAuthority}
+				err := checker.CheckHostKey(addr, remote, key)
+				if err == nil {
+					return nil
+				}
+				ev(EventCertInvalid, map[string]interface{}{"error": err.Error()})
+				return fmt.Errorf("host certificate của %s không hợp lệ: %v", addr, err)
+			}
+			// Không cấu hình host CA: kiểm tra key bên dưới certificate như host key thường
+			key = cert.Key
+		}
+		return v.checkKnown(addr, key, ev)
+	}
+}
+
+func (v *Verifier) checkKnown(addr string, key ssh.PublicKey, ev func(string, map[string]interface{})) error {
+	known := v.Known.Lookup(addr)
+	for _, k := range known {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return nil
+		}
+	}
+	if len(known) > 0 {
+		expected := make([]string, 0, len(known))
+		for _, k := range known {
+			expected = append(expected, ssh.FingerprintSHA256(k))
+		}
+		ev(EventMismatch, map[string]interface{}{"expected": strings.Join(expected, ",")})
+		return fmt.Errorf("%s: %w", addr, ErrHostKeyMismatch)
+	}
+	if v.Mode != TOFU {
+		ev(EventUnknown, nil)
+		return fmt.Errorf("máy đích %s chưa có trong known_hosts (chế độ strict)", addr)
+	}
+	if err := v.Known.Add(addr, key); err != nil {
+		return fmt.Errorf("không ghi được known_hosts: %v", err)
+	}
+	ev(EventPinned, nil)
+	return nil
+}
+
+// HostKeyAlgorithms trả về danh sách thuật toán host key nên đề nghị với máy đích,
+// để máy đích đã ghim key loại này không trả về key loại khác gây báo nhầm MITM.
+func (v *Verifier) HostKeyAlgorithms(addr string) []string {
+	known := v.Known.Lookup(addr)
+	if len(known) == 0 {
+		return nil
+	}
+	var algos []string
+	if len(v.CAKeys) > 0 {
+		algos = append(algos,
+			ssh.CertAlgoED25519v01, ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01,
+			ssh.CertAlgoECDSA521v01, ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01)
+	}
+	for _, k := range known {
+		if k.Type() == ssh.KeyAlgoRSA {
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+			continue
+		}
+		algos = append(algos, k.Type())
+	}
+	return algos
+}
@@ -0,0 +1,253 @@
+package hostkeys
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Entidi89/ssh_proxy1/internal/audit"
+	"golang.org/x/crypto/ssh"
+)
+
+var remote = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// hostCert cấp host certificate cho key, ký bởi ca
+func hostCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, certType uint32, principals ...string) *ssh.Certificate {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        certType,
+		KeyId:           "test",
+		ValidPrincipals: principals,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// testVerifier dựng Verifier với known_hosts và file audit trong thư mục tạm
+func testVerifier(t *testing.T, mode Mode) (*Verifier, string) {
+	t.Helper()
+	dir := t.TempDir()
+	known, err := LoadKnownHosts(filepath.Join(dir, "known_hosts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditPath := filepath.Join(dir, "audit.jsonl")
+	logger, err := audit.Open(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Verifier{Mode: mode, Known: known, Audit: logger}, auditPath
+}
+
+func auditRecords(t *testing.T, path string) []audit.Record {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []audit.Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec audit.Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func auditEvents(t *testing.T, path string) []string {
+	t.Helper()
+	var events []string
+	for _, rec := range auditRecords(t, path) {
+		events = append(events, rec.Event)
+	}
+	return events
+}
+
+func TestStrictMode(t *testing.T) {
+	v, auditPath := testVerifier(t, Strict)
+	known := newSigner(t).PublicKey()
+	if err := v.Known.Add("10.0.0.1:22", known); err != nil {
+		t.Fatal(err)
+	}
+	check := v.Callback(map[string]interface{}{"session_id": "s1"})
+
+	if err := check("10.0.0.1:22", remote, known); err != nil {
+		t.Fatalf("known key rejected: %v", err)
+	}
+	// Máy đích chưa biết: từ chối và không ghim
+	other := newSigner(t).PublicKey()
+	if err := check("10.0.0.2:22", remote, other); err == nil {
+		t.Fatal("unknown host accepted in strict mode")
+	}
+	if keys := v.Known.Lookup("10.0.0.2:22"); len(keys) != 0 {
+		t.Fatalf("strict mode pinned %d keys", len(keys))
+	}
+	// Key khác với key đã biết: MITM
+	if err := check("10.0.0.1:22", remote, other); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("mismatch: err = %v", err)
+	}
+
+	records := auditRecords(t, auditPath)
+	if got, want := auditEvents(t, auditPath), []string{EventUnknown, EventMismatch}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("audit %v, want %v", got, want)
+	}
+	unknown, mismatch := records[0].Fields, records[1].Fields
+	if unknown["target"] != "10.0.0.2:22" || unknown["session_id"] != "s1" || unknown["fingerprint"] != ssh.FingerprintSHA256(other) {
+		t.Errorf("unknown event %v", unknown)
+	}
+	if mismatch["expected"] != ssh.FingerprintSHA256(known) || mismatch["fingerprint"] != ssh.FingerprintSHA256(other) {
+		t.Errorf("mismatch event %v", mismatch)
+	}
+}
+
+func TestTOFUMode(t *testing.T) {
+	v, auditPath := testVerifier(t, TOFU)
+	check := v.Callback(nil)
+	first := newSigner(t).PublicKey()
+
+	// Lần đầu: ghim key, cả với port khác 22
+	for _, addr := range []string{"10.0.0.1:22", "10.0.0.1:2222"} {
+		if err := check(addr, remote, first); err != nil {
+			t.Fatalf("%s: first use rejected: %v", addr, err)
+		}
+	}
+	if err := check("10.0.0.1:22", remote, first); err != nil {
+		t.Fatalf("pinned key rejected: %v", err)
+	}
+	if got, want := auditEvents(t, auditPath), []string{EventPinned, EventPinned}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("audit %v, want %v", got, want)
+	}
+
+	// Key được ghi xuống file và còn hiệu lực sau khi proxy khởi động lại
+	b, err := os.ReadFile(v.Known.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "[10.0.0.1]:2222 ") {
+		t.Errorf("known_hosts:\n%s", b)
+	}
+	reloaded, err := LoadKnownHosts(v.Known.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Known = reloaded
+
+	// Key đổi sau khi đã ghim: TOFU không ghim đè
+	changed := newSigner(t).PublicKey()
+	if err := check("10.0.0.1:22", remote, changed); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("changed key: err = %v", err)
+	}
+	if keys := v.Known.Lookup("10.0.0.1:22"); len(keys) != 1 {
+		t.Fatalf("%d keys pinned after mismatch", len(keys))
+	}
+	if got := auditEvents(t, auditPath); got[len(got)-1] != EventMismatch {
+		t.Fatalf("audit %v", got)
+	}
+}
+
+func TestHostCertificate(t *testing.T) {
+	ca := newSigner(t)
+	v, auditPath := testVerifier(t, Strict)
+	v.CAKeys = []ssh.PublicKey{ca.PublicKey()}
+	check := v.Callback(nil)
+	hostKey := newSigner(t).PublicKey()
+
+	// Cert hợp lệ của host CA: chấp nhận mà không cần known_hosts, không ghim
+	if err := check("10.0.0.1:22", remote, hostCert(t, ca, hostKey, ssh.HostCert, "10.0.0.1")); err != nil {
+		t.Fatalf("valid host cert rejected: %v", err)
+	}
+	if keys := v.Known.Lookup("10.0.0.1:22"); len(keys) != 0 {
+		t.Fatal("host cert pinned in known_hosts")
+	}
+	if got := auditEvents(t, auditPath); len(got) != 0 {
+		t.Fatalf("audit %v for a valid cert", got)
+	}
+
+	invalid := []struct {
+		name string
+		cert *ssh.Certificate
+	}{
+		{"other CA", hostCert(t, newSigner(t), hostKey, ssh.HostCert, "10.0.0.1")},
+		{"wrong principal", hostCert(t, ca, hostKey, ssh.HostCert, "10.0.0.2")},
+		{"user cert", hostCert(t, ca, hostKey, ssh.UserCert, "10.0.0.1")},
+	}
+	for _, tt := range invalid {
+		if err := check("10.0.0.1:22", remote, tt.cert); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+	// Cert không hợp lệ không rơi về kiểm tra known_hosts / TOFU
+	want := []string{EventCertInvalid, EventCertInvalid, EventCertInvalid}
+	if got := auditEvents(t, auditPath); !reflect.DeepEqual(got, want) {
+		t.Fatalf("audit %v, want %v", got, want)
+	}
+	if rec := auditRecords(t, auditPath)[0]; rec.Fields["error"] == nil {
+		t.Errorf("cert-invalid event without error: %v", rec.Fields)
+	}
+}
+
+func TestHostCertificateWithoutCA(t *testing.T) {
+	// Không cấu hình host CA: key bên dưới certificate được xử lý như host key thường
+	v, auditPath := testVerifier(t, TOFU)
+	check := v.Callback(nil)
+	hostKey := newSigner(t).PublicKey()
+	cert := hostCert(t, newSigner(t), hostKey, ssh.HostCert, "10.0.0.1")
+	if err := check("10.0.0.1:22", remote, cert); err != nil {
+		t.Fatalf("cert rejected: %v", err)
+	}
+	if keys := v.Known.Lookup("10.0.0.1:22"); len(keys) != 1 || keys[0].Type() != ssh.KeyAlgoED25519 {
+		t.Fatalf("pinned %v, want the underlying key", keys)
+	}
+	if err := check("10.0.0.1:22", remote, hostKey); err != nil {
+		t.Fatalf("plain key after cert rejected: %v", err)
+	}
+	if got, want := auditEvents(t, auditPath), []string{EventPinned}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("audit %v, want %v", got, want)
+	}
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	v, _ := testVerifier(t, TOFU)
+	if algos := v.HostKeyAlgorithms("10.0.0.1:22"); algos != nil {
+		t.Fatalf("unknown host: %v", algos)
+	}
+	if err := v.Known.Add("10.0.0.1:22", newSigner(t).PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if algos := v.HostKeyAlgorithms("10.0.0.1:22"); !reflect.DeepEqual(algos, []string{ssh.KeyAlgoED25519}) {
+		t.Fatalf("algos %v", algos)
+	}
+	v.CAKeys = []ssh.PublicKey{newSigner(t).PublicKey()}
+	if algos := v.HostKeyAlgorithms("10.0.0.1:22"); algos[0] != ssh.CertAlgoED25519v01 || algos[len(algos)-1] != ssh.KeyAlgoED25519 {
+		t.Fatalf("algos with host CA %v", algos)
+	}
+}
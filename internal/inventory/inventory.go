@@ -0,0 +1,285 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Port SSH mặc định khi user / inventory không chỉ định
+const DefaultPort = 22
+
+// Host: một máy đích khai báo trong inventory.json
+type Host struct {
+	// Tên gọi dùng trong username (alice+web1) và trong policy
+	Name string `json:"name"`
+	// IP hoặc hostname để kết nối
+	Address string `json:"address"`
+	Port    int    `json:"port,omitempty"`
+	// Nhãn dùng để phân quyền, vd {"env":"prod","team":"payments"}
+	Labels map[string]string `json:"labels,omitempty"`
+	// ID của agent (reverse tunnel) mà máy đích nằm sau; rỗng = proxy kết nối trực tiếp
+	Agent string `json:"agent,omitempty"`
+}
+
+// File: cấu trúc file inventory.json
+type File struct {
+	Hosts []Host `json:"hosts"`
+}
+
+// Inventory: danh sách máy đích đã nạp, tra cứu theo tên hoặc địa chỉ.
+// Inventory nil được coi là rỗng.
+type Inventory struct {
+	hosts  []Host
+	byName map[string]*Host
+	byAddr map[string]*Host // "ip:port" hoặc "hostname:port" đã chuẩn hóa
+}
+
+// Load đọc inventory.json. File chưa tồn tại được coi là rỗng.
+func Load(path string) (*Inventory, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return New(nil)
+		}
+		return nil, err
+	}
+	var f File
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("lỗi cú pháp trong %s: %v", path, err)
+	}
+	return New(f.Hosts)
+}
+
+// New dựng Inventory từ danh sách host, chuẩn hóa địa chỉ và kiểm tra trùng lặp
+func New(list []Host) (*Inventory, error) {
+	inv := &Inventory{byName: make(map[string]*Host), byAddr: make(map[string]*Host)}
+	for i := range list {
+		h := list[i]
+		if h.Name == "" || h.Address == "" {
+			return nil, fmt.Errorf("host thứ %d thiếu name hoặc address", i+1)
+		}
+		h.Name = strings.ToLower(h.Name)
+		if _, dup := inv.byName[h.Name]; dup {
+			return nil, fmt.Errorf("host '%s' bị khai báo trùng", h.Name)
+		}
+		if h.Port == 0 {
+			h.Port = DefaultPort
+		}
+		host, err := canonicalHost(h.Address)
+		if err != nil {
+			return nil, fmt.Errorf("host '%s': %v", h.Name, err)
+		}
+		if h.Port < 1 || h.Port > 65535 {
+			return nil, fmt.Errorf("host '%s': port %d không hợp lệ", h.Name, h.Port)
+		}
+		// Proxy không phân giải được DNS của mạng phía sau agent
+		if _, err := netip.ParseAddr(host); err != nil && h.Agent != "" {
+			return nil, fmt.Errorf("host '%s' nằm sau agent '%s' phải khai báo address bằng IP", h.Name, h.Agent)
+		}
+		h.Address = host
+		inv.hosts = append(inv.hosts, h)
+	}
+	for i := range inv.hosts {
+		h := &inv.hosts[i]
+		inv.byName[h.Name] = h
+		key := net.JoinHostPort(h.Address, strconv.Itoa(h.Port))
+		if _, dup := inv.byAddr[key]; dup {
+			return nil, fmt.Errorf("địa chỉ %s được khai báo cho nhiều host", key)
+		}
+		inv.byAddr[key] = h
+	}
+	return inv, nil
+}
+
+// Hosts trả về các host, sắp theo tên
+func (inv *Inventory) Hosts() []Host {
+	if inv == nil {
+		return nil
+	}
+	out := append([]Host(nil), inv.hosts...)
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// HostPrincipals trả về tên và địa chỉ của mọi host: các principal được phép ghi
+// vào host certificate của máy đích
+func (inv *Inventory) HostPrincipals() []string {
+	if inv == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var out []string
+	for _, h := range inv.hosts {
+		for _, p := range []string{h.Name, h.Address} {
+			if !seen[p] {
+				seen[p] = true
+				out = append(out, p)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// IsHostPrincipal cho biết p có phải tên hoặc địa chỉ của một host trong inventory
+func (inv *Inventory) IsHostPrincipal(p string) bool {
+	if inv == nil {
+		return false
+	}
+	if _, ok := inv.byName[p]; ok {
+		return true
+	}
+	host, err := canonicalHost(p)
+	if err != nil || host != p {
+		return false
+	}
+	for _, h := range inv.hosts {
+		if h.Address == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolver dùng để phân giải hostname của máy đích
+var Resolver = net.DefaultResolver
+
+// Thời gian chờ tối đa khi phân giải hostname
+const resolveTimeout = 3 * time.Second
+
+// Target: máy đích đã chuẩn hóa, dùng cho phân quyền và để kết nối
+type Target struct {
+	// Tên trong inventory (rỗng nếu máy đích không được khai báo)
+	Name string `json:"name,omitempty"`
+	// Hostname viết thường (rỗng nếu máy đích được chỉ định bằng IP)
+	Hostname string `json:"hostname,omitempty"`
+	// IP dạng chuẩn. Proxy luôn kết nối tới IP này để phân quyền theo CIDR không bị vượt qua bằng DNS.
+	IP     netip.Addr        `json:"ip"`
+	Port   int               `json:"port"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Agent dùng để tới máy đích (rỗng = kết nối trực tiếp)
+	Agent string `json:"agent,omitempty"`
+}
+
+// Addr trả về địa chỉ ip:port để kết nối
+func (t Target) Addr() string {
+	return netip.AddrPortFrom(t.IP, uint16(t.Port)).String()
+}
+
+func (t Target) String() string {
+	s := t.Addr()
+	if t.Name != "" {
+		s = t.Name + " (" + s + ")"
+	}
+	if t.Agent != "" {
+		s += " qua agent " + t.Agent
+	}
+	return s
+}
+
+// Normalize chuẩn hóa máy đích user nhập ("10.0.0.5", "10.0.0.5:2222", "web1", "[::1]:22"):
+// điền port mặc định, đưa IP về dạng chuẩn, phân giải hostname
+// và gắn tên / nhãn nếu máy đích có trong inventory.
+func (inv *Inventory) Normalize(input string) (Target, error) {
+	host, port, err := splitTarget(input)
+	if err != nil {
+		return Target{}, err
+	}
+	var t Target
+	if h, ok := inv.lookupName(host); ok {
+		// Tên trong inventory (port do user chỉ định được ưu tiên)
+		t = Target{Name: h.Name, Port: h.Port, Labels: h.Labels, Agent: h.Agent}
+		host = h.Address
+	} else {
+		if host, err = canonicalHost(host); err != nil {
+			return Target{}, err
+		}
+		t.Port = DefaultPort
+	}
+	if port != 0 {
+		t.Port = port
+	}
+	if t.IP, err = resolve(host); err != nil {
+		return Target{}, err
+	}
+	if t.IP.String() != host {
+		t.Hostname = host
+	}
+	if t.Name == "" {
+		h, ok := inv.lookupAddr(host, t.Port)
+		if !ok {
+			h, ok = inv.lookupAddr(t.IP.String(), t.Port)
+		}
+		if ok {
+			t.Name, t.Labels, t.Agent = h.Name, h.Labels, h.Agent
+		}
+	}
+	return t, nil
+}
+
+func (inv *Inventory) lookupName(name string) (*Host, bool) {
+	if inv == nil {
+		return nil, false
+	}
+	h, ok := inv.byName[strings.ToLower(name)]
+	return h, ok
+}
+
+func (inv *Inventory) lookupAddr(host string, port int) (*Host, bool) {
+	if inv == nil {
+		return nil, false
+	}
+	h, ok := inv.byAddr[net.JoinHostPort(host, strconv.Itoa(port))]
+	return h, ok
+}
+
+// resolve trả về IP của host (đã chuẩn hóa), phân giải DNS nếu host là hostname
+func resolve(host string) (netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := Resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil || len(ips) == 0 {
+		return netip.Addr{}, fmt.Errorf("không phân giải được máy đích '%s': %v", host, err)
+	}
+	return ips[0].Unmap(), nil
+}
+
+// splitTarget tách host và port (0 nếu không chỉ định)
+func splitTarget(input string) (string, int, error) {
+	if input == "" {
+		return "", 0, fmt.Errorf("máy đích rỗng")
+	}
+	host, portStr, err := net.SplitHostPort(input)
+	if err != nil {
+		// Không có port: "10.0.0.5", "web1", "::1", "[::1]"
+		return strings.TrimSuffix(strings.TrimPrefix(input, "["), "]"), 0, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("port '%s' không hợp lệ", portStr)
+	}
+	return host, port, nil
+}
+
+// canonicalHost đưa IP về dạng chuẩn (bỏ IPv4-mapped, nén IPv6) và hostname về chữ thường
+func canonicalHost(host string) (string, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip.Unmap().WithZone("").String(), nil
+	}
+	h := strings.TrimSuffix(strings.ToLower(host), ".")
+	if h == "" || strings.ContainsAny(h, " /@+*?[]") {
+		return "", fmt.Errorf("máy đích '%s' không hợp lệ", host)
+	}
+	return h, nil
+}
@@ -0,0 +1,164 @@
+package mfa
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOTP theo RFC 6238: HMAC-SHA1, bước 30 giây, mã 6 chữ số
+const (
+	Period = 30
+	Digits = 6
+	// Cho phép lệch đồng hồ ±1 bước
+	Skew = 1
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret sinh secret ngẫu nhiên 160 bit, mã hóa base32 (định dạng app Authenticator dùng)
+func GenerateSecret() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return b32.EncodeToString(buf), nil
+}
+
+// ProvisioningURI trả về otpauth:// URI để tạo QR code cho app Authenticator
+func ProvisioningURI(issuer, user, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(Period))
+	label := url.PathEscape(issuer + ":" + user)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	s := strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	return b32.DecodeString(strings.TrimRight(s, "="))
+}
+
+// hotp tính mã HOTP (RFC 4226) cho một counter
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, bin%mod)
+}
+
+// Code trả về mã TOTP tại thời điểm t
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", fmt.Errorf("secret TOTP không hợp lệ: %v", err)
+	}
+	return hotp(key, uint64(t.Unix())/Period), nil
+}
+
+// Sai mã liên tiếp MaxFailures lần -> user bị tạm khóa MFA (mọi kết nối), thời gian khóa
+// bắt đầu từ LockoutBase và gấp đôi sau mỗi lần sai tiếp theo, tối đa LockoutMax
+const (
+	MaxFailures = 5
+	LockoutBase = 30 * time.Second
+	LockoutMax  = 15 * time.Minute
+)
+
+// Verifier kiểm tra mã TOTP, chặn dùng lại một mã đã được chấp nhận
+// và tạm khóa user đoán sai mã nhiều lần (dùng chung cho mọi kết nối)
+type Verifier struct {
+	mu       sync.Mutex
+	lastStep map[string]uint64 // user -> bước thời gian cuối cùng đã dùng
+	failures map[string]*failure
+}
+
+// failure: số lần sai liên tiếp của một user và thời điểm hết khóa
+type failure struct {
+	count int
+	until time.Time
+}
+
+func NewVerifier() *Verifier {
+	return &Verifier{lastStep: make(map[string]uint64), failures: make(map[string]*failure)}
+}
+
+// LockedUntil trả về thời điểm hết khóa nếu user đang bị tạm khóa tại thời điểm t
+func (v *Verifier) LockedUntil(user string, t time.Time) (time.Time, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if f := v.failures[user]; f != nil && t.Before(f.until) {
+		return f.until, true
+	}
+	return time.Time{}, false
+}
+
+// Verify trả về true nếu code hợp lệ cho user tại thời điểm t.
+// User đang bị tạm khóa luôn bị từ chối, kể cả khi mã đúng.
+func (v *Verifier) Verify(user, secret, code string, t time.Time) bool {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return false
+	}
+	code = strings.TrimSpace(code)
+	now := uint64(t.Unix()) / Period
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if f := v.failures[user]; f != nil && t.Before(f.until) {
+		return false
+	}
+	if len(code) == Digits {
+		for d := -Skew; d <= Skew; d++ {
+			step := uint64(int64(now) + int64(d))
+			if subtle.ConstantTimeCompare([]byte(hotp(key, step)), []byte(code)) != 1 {
+				continue
+			}
+			// Mã đã dùng (hoặc cũ hơn mã đã dùng) -> từ chối để chống replay
+			if last, ok := v.lastStep[user]; ok && step <= last {
+				break
+			}
+			v.lastStep[user] = step
+			delete(v.failures, user)
+			return true
+		}
+	}
+	v.fail(user, t)
+	return false
+}
+
+// fail ghi nhận một lần sai mã và khóa user khi sai quá MaxFailures lần liên tiếp
+func (v *Verifier) fail(user string, t time.Time) {
+	f := v.failures[user]
+	if f == nil {
+		f = &failure{}
+		v.failures[user] = f
+	}
+	f.count++
+	if f.count < MaxFailures {
+		return
+	}
+	lock := LockoutMax
+	if n := f.count - MaxFailures; n < 10 {
+		lock = min(LockoutBase<<n, LockoutMax)
+	}
+	f.until = t.Add(lock)
+}
@@ -0,0 +1,161 @@
+package mfa
+
+import (
+	"testing"
+	"time"
+)
+
+// Secret của RFC 6238 phụ lục B ("12345678901234567890" dạng base32)
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func mustCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	code, err := Code(secret, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestCodeRFC6238(t *testing.T) {
+	// Vector SHA1 của RFC 6238 (mã 8 chữ số), lấy 6 chữ số cuối
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := mustCode(t, rfcSecret, time.Unix(tt.unix, 0)); got != tt.want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+	// Secret nhập tay: chữ thường, dấu cách, padding
+	if got := mustCode(t, "gezd gnbv gy3t qojq gezd gnbv gy3t qojq====", time.Unix(59, 0)); got != "287082" {
+		t.Errorf("Code with formatted secret = %s", got)
+	}
+	if _, err := Code("not base32!", time.Unix(59, 0)); err == nil {
+		t.Error("expected an error for an invalid secret")
+	}
+}
+
+func TestVerifySkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	tests := []struct {
+		offset time.Duration
+		want   bool
+	}{
+		{0, true},
+		{-Period * time.Second, true},
+		{Period * time.Second, true},
+		{-2 * Period * time.Second, false},
+		{2 * Period * time.Second, false},
+	}
+	for _, tt := range tests {
+		v := NewVerifier()
+		code := mustCode(t, rfcSecret, now.Add(tt.offset))
+		if got := v.Verify("alice", rfcSecret, code, now); got != tt.want {
+			t.Errorf("code from %v: got %v, want %v", tt.offset, got, tt.want)
+		}
+	}
+	v := NewVerifier()
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		if v.Verify("bob", rfcSecret, code, now) {
+			t.Errorf("malformed code %q accepted", code)
+		}
+	}
+	if v.Verify("bob", "not base32!", "123456", now) {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	v := NewVerifier()
+	now := time.Unix(1234567890, 0)
+	code := mustCode(t, rfcSecret, now)
+	if !v.Verify("alice", rfcSecret, code, now) {
+		t.Fatal("valid code rejected")
+	}
+	// Dùng lại cùng mã, kể cả từ kết nối khác vài giây sau
+	if v.Verify("alice", rfcSecret, " "+code+" ", now.Add(5*time.Second)) {
+		t.Fatal("replayed code accepted")
+	}
+	// Mã của bước trước vẫn trong khoảng lệch nhưng cũ hơn mã đã dùng
+	if v.Verify("alice", rfcSecret, mustCode(t, rfcSecret, now.Add(-Period*time.Second)), now) {
+		t.Fatal("older code accepted after a newer one")
+	}
+	// Bước kế tiếp được chấp nhận
+	next := now.Add(Period * time.Second)
+	if !v.Verify("alice", rfcSecret, mustCode(t, rfcSecret, next), next) {
+		t.Fatal("code of the next step rejected")
+	}
+	// lastStep tính riêng cho từng user
+	if !v.Verify("bob", rfcSecret, code, now) {
+		t.Fatal("another user's first use rejected")
+	}
+}
+
+func TestVerifyLockout(t *testing.T) {
+	v := NewVerifier()
+	now := time.Unix(2000000000, 0)
+	wrong := "000000"
+	if wrong == mustCode(t, rfcSecret, now) {
+		t.Fatal("pick another wrong code")
+	}
+	for i := 0; i < MaxFailures; i++ {
+		if _, locked := v.LockedUntil("alice", now); locked {
+			t.Fatalf("locked after %d failures", i)
+		}
+		v.Verify("alice", rfcSecret, wrong, now)
+	}
+	until, locked := v.LockedUntil("alice", now)
+	if !locked || !until.Equal(now.Add(LockoutBase)) {
+		t.Fatalf("LockedUntil = %v, %v; want %v", until, locked, now.Add(LockoutBase))
+	}
+	// Khóa theo user: mã đúng cũng bị từ chối, user khác không bị ảnh hưởng
+	if v.Verify("alice", rfcSecret, mustCode(t, rfcSecret, now), now) {
+		t.Fatal("valid code accepted while locked")
+	}
+	if !v.Verify("bob", rfcSecret, mustCode(t, rfcSecret, now), now) {
+		t.Fatal("other user locked out")
+	}
+
+	// Hết khóa: sai thêm một lần -> khóa gấp đôi
+	later := until
+	if _, locked := v.LockedUntil("alice", later); locked {
+		t.Fatal("still locked after the lockout")
+	}
+	v.Verify("alice", rfcSecret, wrong, later)
+	if until, _ := v.LockedUntil("alice", later); !until.Equal(later.Add(2 * LockoutBase)) {
+		t.Fatalf("second lockout until %v, want %v", until, later.Add(2*LockoutBase))
+	}
+
+	// Mã đúng sau khi hết khóa xóa bộ đếm
+	later = later.Add(2 * LockoutBase)
+	if !v.Verify("alice", rfcSecret, mustCode(t, rfcSecret, later), later) {
+		t.Fatal("valid code rejected after the lockout")
+	}
+	v.Verify("alice", rfcSecret, wrong, later)
+	if _, locked := v.LockedUntil("alice", later); locked {
+		t.Fatal("failure counter not reset by a successful code")
+	}
+}
+
+func TestLockoutCapped(t *testing.T) {
+	v := NewVerifier()
+	now := time.Unix(0, 0)
+	for i := 0; i < MaxFailures+20; i++ {
+		if until, locked := v.LockedUntil("alice", now); locked {
+			now = until
+		}
+		v.Verify("alice", rfcSecret, "000000", now)
+	}
+	if until, _ := v.LockedUntil("alice", now); !until.Equal(now.Add(LockoutMax)) {
+		t.Fatalf("lockout %v, want %v", until.Sub(now), LockoutMax)
+	}
+}
@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/enroll"
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+	"github.com/Entidi89/ssh_proxy1/internal/ws"
+)
+
+// dialer chọn cách kết nối tới máy đích: máy nằm sau agent (inventory "agent") được
+// kết nối qua stream do agent mở, còn lại kết nối TCP trực tiếp (nil)
+func (s *SSHServer) dialer(target inventory.Target) Dialer {
+	if target.Agent == "" {
+		return nil
+	}
+	return func(addr string) (net.Conn, error) {
+		if s.Agents == nil {
+			return nil, fmt.Errorf("máy đích %s nằm sau agent '%s' nhưng proxy chưa bật kết nối agent (-agent-addr)", addr, target.Agent)
+		}
+		agent, ok := s.Agents.GetAgent(target.Agent)
+		if !ok {
+			return nil, fmt.Errorf("agent '%s' của máy đích %s chưa kết nối tới proxy", target.Agent, addr)
+		}
+		stream, err := agent.CreateSession(addr)
+		var fe *ws.ForwardError
+		if errors.As(err, &fe) && fe.Denied() {
+			log.Printf("[BLOCK] Agent '%s' từ chối chuyển tiếp tới %s theo allowlist của agent: %s", target.Agent, addr, fe.Message)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return stream, nil
+	}
+}
+
+// RunAgents mở listener HTTPS cho agent: /agent/enroll (join token -> client certificate),
+// /agent/renew và /ws (bắt buộc client certificate do CA agent của proxy cấp).
+// hosts là hostname / IP agent dùng để gọi proxy, được ghi vào certificate server.
+func (s *ProxyServer) RunAgents(addr string, hosts []string) {
+	ca := s.Enroll.CA()
+	cert, err := ca.ServerCertificate(hosts)
+	if err != nil {
+		log.Fatalf("Không cấp được certificate cho listener agent: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/agent/enroll", s.handleAgentEnroll)
+	mux.HandleFunc("/agent/renew", s.handleAgentRenew)
+	mux.HandleFunc("/ws", s.handleAgentWS)
+	srv := &http.Server{Addr: addr, Handler: mux, TLSConfig: &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		// Đăng ký lần đầu chưa có certificate: handler tự bắt buộc certificate khi cần
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  ca.Pool(),
+	}}
+	log.Printf("[INIT] Listener agent tại %s (CA pin %s)", addr, ca.Pin())
+	log.Fatal(srv.ListenAndServeTLS("", ""))
+}
+
+// agentIdentity trả về ID agent từ client certificate (đã xác minh theo CA, chưa bị thu hồi)
+func (s *ProxyServer) agentIdentity(r *http.Request) (string, *x509.Certificate, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", nil, errors.New("client certificate required")
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	id, err := s.Enroll.Verify(leaf)
+	return id, leaf, err
+}
+
+// handleAgentEnroll: POST /agent/enroll {"token":"...","csr":"-----BEGIN CERTIFICATE REQUEST..."}
+func (s *ProxyServer) handleAgentEnroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Token string `json:"token"`
+		CSR   string `json:"csr"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil || req.Token == "" || req.CSR == "" {
+		http.Error(w, "token and csr are required", http.StatusBadRequest)
+		return
+	}
+	agentID, certPEM, err := s.Enroll.Enroll(req.Token, []byte(req.CSR), r.RemoteAddr)
+	if err != nil {
+		log.Printf("[BLOCK] Agent từ %s đăng ký thất bại: %v", r.RemoteAddr, err)
+		s.Audit.Log("agent.enroll-failed", map[string]interface{}{"remote": r.RemoteAddr, "error": err.Error()})
+		code := http.StatusBadRequest
+		if err == enroll.ErrInvalidToken {
+			code = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	log.Printf("[AGENT] Agent '%s' đã đăng ký từ %s", agentID, r.RemoteAddr)
+	writeCertResponse(w, agentID, certPEM, s.Enroll.CA().CertPEM())
+}
+
+// handleAgentRenew: POST /agent/renew {"csr":"..."} qua mTLS bằng certificate hiện tại
+func (s *ProxyServer) handleAgentRenew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, leaf, err := s.agentIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil || req.CSR == "" {
+		http.Error(w, "csr is required", http.StatusBadRequest)
+		return
+	}
+	certPEM, err := s.Enroll.Renew(leaf, []byte(req.CSR))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("[AGENT] Agent '%s' đã gia hạn certificate", leaf.Subject.CommonName)
+	writeCertResponse(w, leaf.Subject.CommonName, certPEM, s.Enroll.CA().CertPEM())
+}
+
+func writeCertResponse(w http.ResponseWriter, agentID string, certPEM, caPEM []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"agent_id": agentID, "certificate": string(certPEM), "ca": string(caPEM)})
+}
+
+// handleAgentWS nhận kết nối reverse tunnel. ID agent lấy từ client certificate;
+// một ID chỉ có một kết nối, kết nối mới không được thay kết nối đang có.
+func (s *ProxyServer) handleAgentWS(w http.ResponseWriter, r *http.Request) {
+	agentID, _, err := s.agentIdentity(r)
+	if err != nil {
+		log.Printf("[BLOCK] Kết nối agent từ %s bị từ chối: %v", r.RemoteAddr, err)
+		s.Audit.Log("agent.rejected", map[string]interface{}{"remote": r.RemoteAddr, "error": err.Error()})
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if _, exists := s.AgentMgr.GetAgent(agentID); exists {
+		log.Printf("[BLOCK] Agent '%s' từ %s bị từ chối: đang có kết nối khác cùng ID", agentID, r.RemoteAddr)
+		s.Audit.Log("agent.rejected", map[string]interface{}{"agent": agentID, "remote": r.RemoteAddr, "error": ws.ErrAgentExists.Error()})
+		http.Error(w, ws.ErrAgentExists.Error(), http.StatusConflict)
+		return
+	}
+	wsConn, err := s.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	agent, err := s.AgentMgr.RegisterAgent(agentID, wsConn)
+	if err != nil {
+		log.Printf("[BLOCK] Agent '%s' từ %s bị từ chối: %v", agentID, r.RemoteAddr, err)
+		wsConn.Close()
+		return
+	}
+	log.Printf("[AGENT] Agent '%s' đã kết nối từ %s", agentID, r.RemoteAddr)
+	s.Audit.Log("agent.connected", map[string]interface{}{"agent": agentID, "remote": r.RemoteAddr})
+	// Kết nối đóng, lỗi hoặc mất heartbeat: manager đã tự gỡ agent, chỉ cần ghi lại
+	go func() {
+		<-agent.Done()
+		info := agent.Info()
+		log.Printf("[AGENT] Agent '%s' đã ngắt kết nối: %v", agentID, agent.Err())
+		s.Audit.Log("agent.disconnected", map[string]interface{}{"agent": agentID, "remote": r.RemoteAddr,
+			"connected_since": info.ConnectedSince, "last_seen": info.LastSeen, "error": agent.Err().Error()})
+	}()
+}
+
+// handleAgentList liệt kê các agent đang kết nối. GET /admin/agents
+func (s *ProxyServer) handleAgentList(w http.ResponseWriter, r *http.Request) {
+	if s.AgentMgr == nil {
+		http.Error(w, "agent listener not configured", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.AgentMgr.List())
+}
+
+// handleAgentDisconnect ngắt kết nối của agent; các phiên đi qua agent bị đóng.
+// Agent vẫn giữ certificate và sẽ kết nối lại (muốn chặn hẳn thì dùng revoke).
+// POST /admin/agents/disconnect {"agent_id":"dc2"}
+func (s *ProxyServer) handleAgentDisconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		AgentID string `json:"agent_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AgentID == "" {
+		http.Error(w, "agent_id is required", http.StatusBadRequest)
+		return
+	}
+	auditField(w, "agent", req.AgentID)
+	if s.AgentMgr == nil {
+		http.Error(w, "agent listener not configured", http.StatusServiceUnavailable)
+		return
+	}
+	agent, ok := s.AgentMgr.GetAgent(req.AgentID)
+	if !ok {
+		http.Error(w, "agent not connected", http.StatusNotFound)
+		return
+	}
+	info := agent.Info()
+	s.AgentMgr.Disconnect(req.AgentID)
+	log.Printf("[ADMIN] '%s' đã ngắt kết nối agent '%s'", principalFrom(r).User, req.AgentID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// handleAgentToken tạo join token. POST /admin/agents/tokens {"agent_id":"dc2","ttl":"1h"}
+func (s *ProxyServer) handleAgentToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Enroll == nil {
+		http.Error(w, "agent enrollment not configured", http.StatusServiceUnavailable)
+		return
+	}
+	var req struct {
+		AgentID string `json:"agent_id"`
+		TTL     string `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AgentID == "" {
+		http.Error(w, "agent_id is required", http.StatusBadRequest)
+		return
+	}
+	auditField(w, "agent", req.AgentID)
+	ttl := time.Hour
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	token, t, err := s.Enroll.CreateToken(req.AgentID, principalFrom(r).User, ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"agent_id": t.AgentID, "token": token, "expires_at": t.ExpiresAt, "ca_pin": s.Enroll.CA().Pin(),
+	})
+}
+
+// handleAgentRotate yêu cầu agent đang kết nối đổi certificate (key mới) và kết nối lại;
+// certificate cũ bị thu hồi ngay khi certificate mới được cấp. POST /admin/agents/rotate {"agent_id":"dc2"}
+func (s *ProxyServer) handleAgentRotate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		AgentID string `json:"agent_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AgentID == "" {
+		http.Error(w, "agent_id is required", http.StatusBadRequest)
+		return
+	}
+	auditField(w, "agent", req.AgentID)
+	if s.AgentMgr == nil {
+		http.Error(w, "agent listener not configured", http.StatusServiceUnavailable)
+		return
+	}
+	agent, ok := s.AgentMgr.GetAgent(req.AgentID)
+	if !ok {
+		http.Error(w, "agent not connected", http.StatusConflict)
+		return
+	}
+	if err := agent.RequestRotation(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"agent_id": req.AgentID, "status": "rotation requested"})
+}
+
+// handleAgentRevoke thu hồi mọi certificate / join token của agent và ngắt kết nối đang mở.
+// POST /admin/agents/revoke {"agent_id":"dc2","reason":"máy bị xâm nhập"}
+func (s *ProxyServer) handleAgentRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Enroll == nil {
+		http.Error(w, "agent enrollment not configured", http.StatusServiceUnavailable)
+		return
+	}
+	var req struct {
+		AgentID string `json:"agent_id"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AgentID == "" {
+		http.Error(w, "agent_id is required", http.StatusBadRequest)
+		return
+	}
+	auditField(w, "agent", req.AgentID)
+	n, err := s.Enroll.Revoke(req.AgentID, principalFrom(r).User, req.Reason)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == enroll.ErrNoAgent {
+			code = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	disconnected := s.AgentMgr != nil && s.AgentMgr.Disconnect(req.AgentID)
+	log.Printf("[ADMIN] '%s' đã thu hồi agent '%s' (%d mục, ngắt kết nối: %v)", principalFrom(r).User, req.AgentID, n, disconnected)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"agent_id": req.AgentID, "revoked": n, "disconnected": disconnected})
+}
@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quyền trên HTTP API quản trị. Role quản trị (admin_auth.json) là danh sách các quyền này,
+// độc lập với role SSH trong roles.json. "*" = mọi quyền, "sessions.*" = mọi quyền sessions.
+const (
+	PermRBACRead          = "rbac.read"
+	PermRBACReload        = "rbac.reload"
+	PermHostsRead         = "hosts.read"
+	PermHostsSign         = "hosts.sign"
+	PermAccessRead        = "access.read"
+	PermAccessDecide      = "access.decide"
+	PermSessionsRead      = "sessions.read"
+	PermSessionsWatch     = "sessions.watch"
+	PermSessionsJoin      = "sessions.join"
+	PermSessionsTerminate = "sessions.terminate"
+	PermAgentsEnroll      = "agents.enroll"
+	PermAgentsRotate      = "agents.rotate"
+	PermAgentsRevoke      = "agents.revoke"
+	PermAgentsRead        = "agents.read"
+	PermAgentsDisconnect  = "agents.disconnect"
+)
+
+var adminPermissions = []string{
+	PermRBACRead, PermRBACReload, PermHostsRead, PermHostsSign, PermAccessRead, PermAccessDecide,
+	PermSessionsRead, PermSessionsWatch, PermSessionsJoin, PermSessionsTerminate,
+	PermAgentsEnroll, PermAgentsRotate, PermAgentsRevoke, PermAgentsRead, PermAgentsDisconnect,
+}
+
+// AdminAuthFile: cấu trúc admin_auth.json
+//
+//	{
+//	  "roles":   {"operator": ["sessions.*", "access.*"], "auditor": ["rbac.read", "sessions.read"]},
+//	  "tokens":  [{"user": "carol", "sha256": "<hex>", "roles": ["operator"]}],
+//	  "clients": [{"common_name": "ops-laptop", "user": "carol", "roles": ["operator"]}]
+//	}
+type AdminAuthFile struct {
+	Roles   map[string][]string `json:"roles"`
+	Tokens  []AdminToken        `json:"tokens"`
+	Clients []AdminClient       `json:"clients"`
+}
+
+// AdminToken: một bearer token. File chỉ lưu SHA-256 của token
+// (tạo bằng "proxy admin token" hoặc: printf '%s' "$TOKEN" | sha256sum).
+type AdminToken struct {
+	// Tên người dùng, ghi vào audit và dùng làm người duyệt yêu cầu cấp quyền
+	User   string   `json:"user"`
+	SHA256 string   `json:"sha256"`
+	Roles  []string `json:"roles"`
+}
+
+// AdminClient: client certificate (mTLS) được chấp nhận, nhận diện theo Common Name
+type AdminClient struct {
+	CommonName string   `json:"common_name"`
+	User       string   `json:"user"`
+	Roles      []string `json:"roles"`
+}
+
+// adminPrincipal: người gọi API đã xác thực
+type adminPrincipal struct {
+	User   string
+	Method string // token | mtls | ticket
+	perms  []string
+}
+
+// can kiểm tra quyền, hỗ trợ "*" và "<nhóm>.*"
+func (p *adminPrincipal) can(perm string) bool {
+	for _, have := range p.perms {
+		if have == "*" || have == perm || (strings.HasSuffix(have, ".*") && strings.HasPrefix(perm, strings.TrimSuffix(have, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminAuth: xác thực người gọi HTTP API quản trị bằng bearer token hoặc client certificate
+type AdminAuth struct {
+	tokens  map[string]*adminPrincipal // sha256(token) -> principal
+	clients map[string]*adminPrincipal // common name -> principal
+
+	// Vé dùng một lần để trình duyệt mở /admin/sessions/watch (xem issueWatchTicket)
+	mu      sync.Mutex
+	tickets map[string]watchTicket
+}
+
+// Thời hạn của vé xem phiên: đủ để trình duyệt mở WebSocket ngay sau khi lấy vé
+const watchTicketTTL = 30 * time.Second
+
+type watchTicket struct {
+	principal *adminPrincipal
+	sessionID string
+	expires   time.Time
+}
+
+// LoadAdminAuth đọc admin_auth.json. File không tồn tại -> mọi yêu cầu tới /admin/* bị từ chối.
+func LoadAdminAuth(path string) (*AdminAuth, error) {
+	a := &AdminAuth{tokens: make(map[string]*adminPrincipal), clients: make(map[string]*adminPrincipal)}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return a, nil
+		}
+		return nil, err
+	}
+	var f AdminAuthFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("lỗi cú pháp trong %s: %v", path, err)
+	}
+	for name, perms := range f.Roles {
+		for _, p := range perms {
+			if !validPermission(p) {
+				return nil, fmt.Errorf("role quản trị '%s': quyền '%s' không hợp lệ", name, p)
+			}
+		}
+	}
+	permsOf := func(who string, roles []string) ([]string, error) {
+		if len(roles) == 0 {
+			return nil, fmt.Errorf("%s chưa được gán role quản trị nào", who)
+		}
+		var perms []string
+		for _, role := range roles {
+			p, ok := f.Roles[role]
+			if !ok {
+				return nil, fmt.Errorf("%s: role quản trị '%s' chưa được khai báo", who, role)
+			}
+			perms = append(perms, p...)
+		}
+		return perms, nil
+	}
+	for i, tok := range f.Tokens {
+		sum, err := hex.DecodeString(tok.SHA256)
+		if tok.User == "" || err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("token thứ %d trong %s cần user và sha256 (64 ký tự hex)", i+1, path)
+		}
+		perms, err := permsOf("token của '"+tok.User+"'", tok.Roles)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens[strings.ToLower(tok.SHA256)] = &adminPrincipal{User: tok.User, Method: "token", perms: perms}
+	}
+	for i, c := range f.Clients {
+		if c.CommonName == "" || c.User == "" {
+			return nil, fmt.Errorf("client thứ %d trong %s cần common_name và user", i+1, path)
+		}
+		perms, err := permsOf("client '"+c.CommonName+"'", c.Roles)
+		if err != nil {
+			return nil, err
+		}
+		a.clients[c.CommonName] = &adminPrincipal{User: c.User, Method: "mtls", perms: perms}
+	}
+	return a, nil
+}
+
+func validPermission(p string) bool {
+	if p == "*" {
+		return true
+	}
+	for _, known := range adminPermissions {
+		if p == known || (strings.HasSuffix(p, ".*") && strings.HasPrefix(known, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate xác định người gọi: client certificate đã được xác minh (mTLS) trước,
+// sau đó tới header "Authorization: Bearer <token>". Token không bao giờ được nhận qua
+// query string; riêng /admin/sessions/watch nhận vé dùng một lần qua ?ticket=, vì
+// trình duyệt không gửi được header khi mở WebSocket.
+func (a *AdminAuth) authenticate(r *http.Request) (*adminPrincipal, bool) {
+	if a == nil {
+		return nil, false
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if p, ok := a.clients[r.TLS.VerifiedChains[0][0].Subject.CommonName]; ok {
+			return p, true
+		}
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok && r.URL.Path == watchPath {
+		if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+			return a.redeemWatchTicket(ticket, r.URL.Query().Get("id"))
+		}
+	}
+	if token == "" {
+		return nil, false
+	}
+	sum := sha256.Sum256([]byte(token))
+	p, ok := a.tokens[hex.EncodeToString(sum[:])]
+	return p, ok
+}
+
+// issueWatchTicket cấp cho p một vé xem phiên sessionID: ngẫu nhiên, dùng một lần,
+// hết hạn sau watchTicketTTL
+func (a *AdminAuth) issueWatchTicket(p *adminPrincipal, sessionID string) (string, time.Time) {
+	b := make([]byte, 32)
+	rand.Read(b)
+	ticket := hex.EncodeToString(b)
+	now := time.Now()
+	expires := now.Add(watchTicketTTL)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.tickets == nil {
+		a.tickets = make(map[string]watchTicket)
+	}
+	// Dọn vé đã hết hạn mà chưa được dùng
+	for k, t := range a.tickets {
+		if now.After(t.expires) {
+			delete(a.tickets, k)
+		}
+	}
+	a.tickets[ticket] = watchTicket{principal: p, sessionID: sessionID, expires: expires}
+	return ticket, expires
+}
+
+// redeemWatchTicket đổi vé lấy người gọi. Vé bị hủy ngay lần dùng đầu, kể cả khi
+// đã hết hạn hoặc được dùng cho phiên khác.
+func (a *AdminAuth) redeemWatchTicket(ticket, sessionID string) (*adminPrincipal, bool) {
+	a.mu.Lock()
+	t, ok := a.tickets[ticket]
+	delete(a.tickets, ticket)
+	a.mu.Unlock()
+	if !ok || time.Now().After(t.expires) || t.sessionID != sessionID {
+		return nil, false
+	}
+	p := *t.principal
+	p.Method = "ticket"
+	return &p, true
+}
+
+type principalKey struct{}
+
+// principalFrom trả về người gọi đã xác thực của request (do s.admin gắn vào)
+func principalFrom(r *http.Request) *adminPrincipal {
+	p, _ := r.Context().Value(principalKey{}).(*adminPrincipal)
+	return p
+}
+
+// admin bọc handler của /admin/*: yêu cầu xác thực và quyền perm, ghi audit cho mọi lời gọi
+func (s *ProxyServer) admin(perm string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fields := map[string]interface{}{"method": r.Method, "path": r.URL.Path, "permission": perm, "remote": r.RemoteAddr}
+		p, ok := s.Auth.authenticate(r)
+		if !ok {
+			s.Audit.Log("admin.unauthorized", fields)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fields["user"], fields["auth"] = p.User, p.Method
+		if !p.can(perm) {
+			s.Audit.Log("admin.forbidden", fields)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+		fields["status"] = rec.status
+		for k, v := range rec.audit {
+			fields[k] = v
+		}
+		s.Audit.Log("admin."+perm, fields)
+	}
+}
+
+// statusRecorder ghi lại status code để đưa vào audit. Handler có thể bổ sung
+// thông tin (vd ID yêu cầu, ID phiên) qua auditField.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	audit  map[string]interface{}
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Hijack cho phép nâng cấp WebSocket qua wrapper
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer không hỗ trợ hijack")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// auditField bổ sung thông tin vào bản ghi audit của lời gọi API hiện tại
+func auditField(w http.ResponseWriter, key string, value interface{}) {
+	if rec, ok := w.(*statusRecorder); ok {
+		if rec.audit == nil {
+			rec.audit = make(map[string]interface{})
+		}
+		rec.audit[key] = value
+	}
+}
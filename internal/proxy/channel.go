@@ -0,0 +1,405 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/Entidi89/ssh_proxy1/internal/audit"
+	"github.com/Entidi89/ssh_proxy1/internal/cmdfilter"
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+	"github.com/Entidi89/ssh_proxy1/internal/rbac"
+	"github.com/Entidi89/ssh_proxy1/internal/recorder"
+	"github.com/Entidi89/ssh_proxy1/internal/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// connContext: thông tin chung của một kết nối client, dùng cho mọi kênh bên trong
+type connContext struct {
+	sessionID string
+	proxyUser string
+	target    string
+	dest      inventory.Target
+	role      string
+	osUser    string
+	client    string
+	start     time.Time
+	// Thời điểm phiên phải kết thúc theo policy (nil = không giới hạn), đổi được khi
+	// policy được nạp lại; đọc / ghi qua currentDeadline / setDeadline (deadline.go)
+	deadline *time.Time
+	settings rbac.RoleSettings
+	commands *cmdfilter.Filter
+	upstream *UpstreamConn
+	rec      *recorder.SessionWriter
+	audit    *audit.Logger
+
+	// Số byte client -> máy đích và máy đích -> client
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	// Kênh client đang mở, dùng để gửi cảnh báo ra terminal của user
+	chMu     sync.Mutex
+	channels map[int]ssh.Channel
+	// Đóng kết nối client (kết thúc phiên)
+	closeConn func() error
+
+	// Đóng khi phiên kết thúc
+	done chan struct{}
+	// Bảo vệ deadline; stopDeadline dừng goroutine đang canh deadline cũ
+	deadlineMu   sync.Mutex
+	stopDeadline chan struct{}
+
+	// Người đang xem phiên và người đang điều khiển thay user (xem observe.go)
+	obsMu      sync.Mutex
+	observers  map[string]*observer
+	controller *observer
+	shell      *channelRelay
+}
+
+// record ghi một sự kiện vào bản ghi phiên (nếu có)
+func (c *connContext) record(typ string, v interface{}) {
+	if c.rec != nil {
+		c.rec.WriteEvent(typ, v)
+	}
+}
+
+// channelRelay chuyển tiếp một kênh session giữa client và máy đích
+type channelRelay struct {
+	conn     *connContext
+	id       int
+	client   ssh.Channel
+	upstream *PamSessionWrapper
+	// Client đã xin pty (phiên tương tác)
+	pty bool
+
+	// Dựng lại dòng lệnh từ stdin của kênh shell / exec (xem commands.go)
+	inMu      sync.Mutex
+	editor    cmdfilter.LineEditor
+	held      []byte
+	lineStart int
+
+	startOnce sync.Once
+	pumps     sync.WaitGroup
+}
+
+// handleChannel xử lý một kênh client mở tới proxy. Mỗi kênh session tương ứng
+// với một kênh session riêng trên cùng kết nối SSH tới máy đích.
+func (c *connContext) handleChannel(id int, newCh ssh.NewChannel) {
+	if newCh.ChannelType() != "session" {
+		newCh.Reject(ssh.Prohibited, "chỉ hỗ trợ kênh session")
+		return
+	}
+
+	upstream, err := c.upstream.OpenSession()
+	if err != nil {
+		log.Printf("[ERROR] Phiên %s: không mở được kênh tới máy đích: %v", c.sessionID, err)
+		newCh.Reject(ssh.ConnectionFailed, "không mở được kênh tới máy đích")
+		return
+	}
+	channel, requests, err := newCh.Accept()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+
+	c.addChannel(id, channel)
+	defer c.removeChannel(id)
+
+	r := &channelRelay{conn: c, id: id, client: channel, upstream: upstream}
+	go r.forwardClientRequests(requests)
+	r.forwardUpstreamRequests()
+
+	// Máy đích đã đóng kênh: chờ dữ liệu còn lại được chuyển hết rồi mới đóng phía client
+	r.pumps.Wait()
+	c.clearShell(r)
+	channel.Close()
+	c.record("event", map[string]interface{}{"channel": id, "event": "channel-close"})
+}
+
+// startPumps bắt đầu chuyển dữ liệu khi client yêu cầu shell/exec/subsystem.
+// Kênh subsystem sftp đi qua bộ phân tích SFTP thay vì ghi lại dữ liệu thô.
+func (r *channelRelay) startPumps(req *ssh.Request) {
+	r.startOnce.Do(func() {
+		if req.Type == "subsystem" && subsystemName(req.Payload) == "sftp" || req.Type == "exec" && isSFTPServer(execCommand(req.Payload)) {
+			r.startSFTPPumps()
+			return
+		}
+		if req.Type == "shell" {
+			r.conn.setShell(r)
+		}
+		// scp kiểu cũ: từng file được ghi lại qua sftp.SCPParser theo chiều gửi file
+		var scp *sftp.SCPParser
+		scpDir := ""
+		if req.Type == "exec" && isPlainSCP(execCommand(req.Payload)) {
+			scpDir = scpDirection(execCommand(req.Payload))
+		}
+		if scpDir != "" {
+			scp = r.newSCPParser(scpDir)
+		}
+		r.pumps.Add(2)
+		go func() {
+			defer r.pumps.Done()
+			var src io.Reader = r.upstream
+			if scpDir == "download" {
+				src = io.TeeReader(src, scp)
+				defer scp.Flush()
+			}
+			io.Copy(r.client, io.TeeReader(src, r.conn.outputStream("stdout")))
+		}()
+		go func() {
+			defer r.pumps.Done()
+			io.Copy(r.client.Stderr(), io.TeeReader(r.upstream.Stderr(), r.conn.outputStream("stderr")))
+		}()
+		go func() {
+			// exec có pty (vd ssh -t host bash) cũng là shell tương tác, và với role có rule chặn
+			// thì stdin của exec bất kỳ vẫn có thể là lệnh shell: đều phải đi qua bộ lọc lệnh.
+			// Riêng scp chạy trực tiếp, stdin là giao thức scp chứ không phải lệnh shell.
+			switch {
+			case scpDir == "upload":
+				io.Copy(r.upstream, io.TeeReader(io.TeeReader(r.client, r.conn.inputStream()), scp))
+				scp.Flush()
+			case scpDir == "" && (req.Type == "shell" || r.pty || r.conn.commands.Blocks()):
+				r.pumpStdin()
+			default:
+				io.Copy(r.upstream, io.TeeReader(r.client, r.conn.inputStream()))
+			}
+			r.upstream.CloseWrite()
+		}()
+	})
+}
+
+// newSCPParser ghi từng file truyền qua scp kiểu cũ vào bản ghi phiên, cùng dạng với SFTP
+func (r *channelRelay) newSCPParser(direction string) *sftp.SCPParser {
+	c := r.conn
+	return sftp.NewSCPParser(direction, func(ev sftp.Event) {
+		if ev.Op == "scp-unparsed" {
+			log.Printf("[SFTP] Phiên %s: không phân tích được luồng scp %s: %s", c.sessionID, direction, ev.Path)
+			c.record("sftp", map[string]interface{}{"channel": r.id, "op": ev.Op, "direction": direction, "error": ev.Path})
+			return
+		}
+		c.record("sftp", map[string]interface{}{"channel": r.id, "op": ev.Op, "path": ev.Path, "direction": ev.Direction,
+			"bytes": ev.Bytes, "scp": true})
+	})
+}
+
+// startSFTPPumps chuyển tiếp kênh SFTP qua sftp.Auditor: mọi thao tác file được ghi
+// vào bản ghi phiên, upload/download bị chặn theo thiết lập sftp của role
+func (r *channelRelay) startSFTPPumps() {
+	c := r.conn
+	policy := sftp.Policy{
+		DenyUpload:   c.settings.SFTP.DenyUpload,
+		DenyDownload: c.settings.SFTP.DenyDownload,
+	}
+	auditor := sftp.NewAuditor(policy, r.client, func(ev sftp.Event) {
+		if ev.Denied {
+			log.Printf("[BLOCK] Phiên %s: '%s' bị chặn %s %s trên %s", c.sessionID, c.proxyUser, ev.Op, ev.Path, c.target)
+		}
+		c.record("sftp", map[string]interface{}{"channel": r.id, "op": ev.Op, "path": ev.Path, "new_path": ev.NewPath,
+			"direction": ev.Direction, "bytes": ev.Bytes, "denied": ev.Denied})
+	})
+
+	r.pumps.Add(2)
+	go func() {
+		defer r.pumps.Done()
+		if err := auditor.ServerToClient(io.TeeReader(r.upstream, countBytes(&c.bytesOut))); err != nil {
+			log.Printf("[SFTP] Phiên %s: lỗi luồng máy đích -> client: %v", c.sessionID, err)
+			r.upstream.Close()
+		}
+		auditor.Flush()
+	}()
+	go func() {
+		defer r.pumps.Done()
+		io.Copy(r.client.Stderr(), r.upstream.Stderr())
+	}()
+	go func() {
+		if err := auditor.ClientToServer(io.TeeReader(r.client, countBytes(&c.bytesIn)), r.upstream); err != nil {
+			log.Printf("[SFTP] Phiên %s: lỗi luồng client -> máy đích: %v", c.sessionID, err)
+			r.upstream.Close()
+		}
+		r.upstream.CloseWrite()
+	}()
+}
+
+func subsystemName(payload []byte) string {
+	var p struct{ Name string }
+	ssh.Unmarshal(payload, &p)
+	return p.Name
+}
+
+func execCommand(payload []byte) string {
+	var p struct{ Command string }
+	ssh.Unmarshal(payload, &p)
+	return p.Command
+}
+
+// commandWords tách dòng lệnh thành các từ, bỏ qua dấu nháy và ký tự điều khiển của shell
+// để nhận ra cả lệnh được bọc, vd sh -c 'scp -t /tmp'
+func commandWords(command string) []string {
+	return strings.FieldsFunc(command, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(";&|'\"()`", r)
+	})
+}
+
+// isSFTPServer nhận diện exec chạy thẳng sftp-server (vd /usr/lib/openssh/sftp-server)
+// thay vì xin subsystem sftp
+func isSFTPServer(command string) bool {
+	for _, w := range commandWords(command) {
+		if path.Base(w) == "sftp-server" {
+			return true
+		}
+	}
+	return false
+}
+
+// isPlainSCP nhận diện exec chỉ chạy scp, không bọc trong shell hay nối thêm lệnh khác
+// (vd scp -t /tmp). Dấu nháy được chấp nhận vì không còn ký tự nào tách được lệnh.
+func isPlainSCP(command string) bool {
+	words := strings.Fields(command)
+	return len(words) > 0 && path.Base(words[0]) == "scp" && !strings.ContainsAny(command, ";&|`$()<>\\\n\r")
+}
+
+// scpDirection nhận diện lệnh scp kiểu cũ (scp -t: upload, scp -f: download)
+func scpDirection(command string) string {
+	words := commandWords(command)
+	for i, w := range words {
+		if path.Base(w) != "scp" {
+			continue
+		}
+		for _, f := range words[i+1:] {
+			if !strings.HasPrefix(f, "-") || f == "--" {
+				break
+			}
+			if strings.Contains(f, "t") {
+				return "upload"
+			}
+			if strings.Contains(f, "f") {
+				return "download"
+			}
+		}
+	}
+	return ""
+}
+
+// checkTransfer từ chối exec scp nếu chiều truyền file bị chặn với role hiện tại,
+// và từ chối exec sftp-server khi role chặn bất kỳ chiều truyền file nào
+func (r *channelRelay) checkTransfer(req *ssh.Request) bool {
+	if req.Type != "exec" {
+		return true
+	}
+	var p struct{ Command string }
+	if ssh.Unmarshal(req.Payload, &p) != nil {
+		return true
+	}
+	c := r.conn
+	sftpSettings := c.settings.SFTP
+	if isSFTPServer(p.Command) && (sftpSettings.DenyUpload || sftpSettings.DenyDownload) {
+		log.Printf("[BLOCK] Phiên %s: '%s' bị chặn exec sftp-server trên %s", c.sessionID, c.proxyUser, c.target)
+		c.record("sftp", map[string]interface{}{"channel": r.id, "op": "sftp-server", "command": p.Command, "denied": true})
+		return false
+	}
+	dir := scpDirection(p.Command)
+	denied := (dir == "upload" && sftpSettings.DenyUpload) || (dir == "download" && sftpSettings.DenyDownload)
+	if denied {
+		log.Printf("[BLOCK] Phiên %s: '%s' bị chặn scp %s trên %s", c.sessionID, c.proxyUser, dir, c.target)
+		c.record("sftp", map[string]interface{}{"channel": r.id, "op": "scp", "direction": dir, "command": p.Command, "denied": true})
+	}
+	return !denied
+}
+
+// forwardClientRequests chuyển các request của client (pty-req, env, exec, shell,
+// subsystem, window-change, signal, ...) tới kênh tương ứng ở máy đích
+func (r *channelRelay) forwardClientRequests(requests <-chan *ssh.Request) {
+	for req := range requests {
+		r.recordRequest(req)
+
+		if !r.checkTransfer(req) || !r.checkExec(req) {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+
+		starts := req.Type == "shell" || req.Type == "exec" || req.Type == "subsystem"
+		switch {
+		case req.Type == "pty-req":
+			r.pty = true
+		case starts:
+			// Giữ handleChannel chờ tới khi biết luồng dữ liệu có được bật hay không
+			r.pumps.Add(1)
+		}
+		ok, err := r.upstream.Channel.SendRequest(req.Type, req.WantReply, req.Payload)
+		if err != nil {
+			ok = false
+		}
+		if starts {
+			// Chỉ bật luồng dữ liệu khi máy đích đã nhận request: request bị từ chối (vd subsystem
+			// không có) không được dùng mất startOnce của request kế tiếp. Output máy đích gửi
+			// trước đó nằm trong buffer của kênh nên không bị mất.
+			if err == nil && (ok || !req.WantReply) {
+				r.startPumps(req)
+			}
+			r.pumps.Done()
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+	// Client đã đóng kênh -> đóng kênh phía máy đích
+	r.upstream.Close()
+}
+
+// forwardUpstreamRequests chuyển request của máy đích (exit-status, exit-signal, ...)
+// về client. Trả về khi kênh phía máy đích đóng.
+func (r *channelRelay) forwardUpstreamRequests() {
+	for req := range r.upstream.Requests {
+		if req.Type == "exit-status" {
+			var p struct{ Status uint32 }
+			if ssh.Unmarshal(req.Payload, &p) == nil {
+				r.conn.record("event", map[string]interface{}{"channel": r.id, "event": "exit-status", "status": p.Status})
+			}
+		}
+		ok, err := r.client.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			req.Reply(ok && err == nil, nil)
+		}
+	}
+}
+
+// recordRequest ghi các request quan trọng của client vào bản ghi phiên
+func (r *channelRelay) recordRequest(req *ssh.Request) {
+	c := r.conn
+	switch req.Type {
+	case "pty-req", "window-change":
+		if w, h, ok := parseWindowSize(req.Type, req.Payload); ok {
+			c.record("resize", map[string]uint32{"cols": w, "rows": h})
+		}
+	case "exec":
+		var p struct{ Command string }
+		if ssh.Unmarshal(req.Payload, &p) == nil {
+			log.Printf("[EXEC] Phiên %s: '%s' chạy lệnh trên %s: %s", c.sessionID, c.proxyUser, c.target, p.Command)
+			c.record("event", map[string]interface{}{"channel": r.id, "event": "exec", "command": p.Command})
+		}
+	case "subsystem":
+		var p struct{ Name string }
+		if ssh.Unmarshal(req.Payload, &p) == nil {
+			c.record("event", map[string]interface{}{"channel": r.id, "event": "subsystem", "name": p.Name})
+		}
+	case "env":
+		var p struct{ Name, Value string }
+		if ssh.Unmarshal(req.Payload, &p) == nil {
+			c.record("event", map[string]interface{}{"channel": r.id, "event": "env", "name": p.Name})
+		}
+	case "signal":
+		var p struct{ Signal string }
+		if ssh.Unmarshal(req.Payload, &p) == nil {
+			c.record("event", map[string]interface{}{"channel": r.id, "event": "signal", "signal": p.Signal})
+		}
+	case "shell":
+		c.record("event", map[string]interface{}{"channel": r.id, "event": "shell"})
+	}
+}
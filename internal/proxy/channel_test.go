@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/cmdfilter"
+	"github.com/Entidi89/ssh_proxy1/internal/recorder"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTransferCommands(t *testing.T) {
+	tests := []struct {
+		command string
+		sftp    bool
+		scp     string
+		plain   bool
+	}{
+		{"/usr/lib/openssh/sftp-server", true, "", false},
+		{"sftp-server -l INFO", true, "", false},
+		{"sh -c '/usr/libexec/sftp-server'", true, "", false},
+		{"scp -t /tmp", false, "upload", true},
+		{"scp -r -f /etc", false, "download", true},
+		{"/usr/bin/scp -v -t .", false, "upload", true},
+		{"scp -t '/tmp/my dir'", false, "upload", true},
+		{"sh -c \"scp -t /tmp\"", false, "upload", false},
+		{"scp -t /tmp; rm -rf /", false, "upload", false},
+		{"scp -f $(cat list)", false, "download", false},
+		{"scp", false, "", true},
+		{"ls -la", false, "", false},
+		{"echo sftp-server-docs", false, "", false},
+	}
+	for _, tt := range tests {
+		if got := isSFTPServer(tt.command); got != tt.sftp {
+			t.Errorf("isSFTPServer(%q) = %v, want %v", tt.command, got, tt.sftp)
+		}
+		if got := scpDirection(tt.command); got != tt.scp {
+			t.Errorf("scpDirection(%q) = %q, want %q", tt.command, got, tt.scp)
+		}
+		if got := isPlainSCP(tt.command); got != tt.plain {
+			t.Errorf("isPlainSCP(%q) = %v, want %v", tt.command, got, tt.plain)
+		}
+	}
+}
+
+// sshPipe dựng một kết nối SSH qua loopback: trả về đầu proxy (như sau bước xác thực) và client
+func sshPipe(t *testing.T) (*ssh.ServerConn, <-chan ssh.NewChannel, *ssh.Client) {
+	t.Helper()
+	hostKey, err := newEphemeralHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(hostKey)
+	// net.Pipe không có buffer: hai bên cùng gửi version trước khi đọc sẽ kẹt nhau
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	type accepted struct {
+		conn  *ssh.ServerConn
+		chans <-chan ssh.NewChannel
+		err   error
+	}
+	done := make(chan accepted, 1)
+	go func() {
+		a, err := l.Accept()
+		if err != nil {
+			done <- accepted{err: err}
+			return
+		}
+		conn, chans, reqs, err := ssh.NewServerConn(a, cfg)
+		if err == nil {
+			go ssh.DiscardRequests(reqs)
+		}
+		done <- accepted{conn, chans, err}
+	}()
+	b, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, chans, reqs, err := ssh.NewClientConn(b, l.Addr().String(), &ssh.ClientConfig{User: "dev", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ssh.NewClient(conn, chans, reqs)
+	t.Cleanup(func() { client.Close() })
+	srv := <-done
+	if srv.err != nil {
+		t.Fatal(srv.err)
+	}
+	return srv.conn, srv.chans, client
+}
+
+// sessionPair mở một kênh session qua sshPipe: trả về đầu client và đầu proxy
+// (kênh + request) để chạy forwardClientRequests như handleChannel
+func sessionPair(t *testing.T) (ssh.Channel, ssh.Channel, <-chan *ssh.Request) {
+	t.Helper()
+	_, chans, client := sshPipe(t)
+	type accepted struct {
+		ch   ssh.Channel
+		reqs <-chan *ssh.Request
+		err  error
+	}
+	done := make(chan accepted, 1)
+	go func() {
+		ch, reqs, err := (<-chans).Accept()
+		done <- accepted{ch, reqs, err}
+	}()
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ssh.DiscardRequests(reqs)
+	srv := <-done
+	if srv.err != nil {
+		t.Fatal(srv.err)
+	}
+	return ch, srv.ch, srv.reqs
+}
+
+func TestRefusedRequestDoesNotStartPumps(t *testing.T) {
+	client, proxySide, requests := sessionPair(t)
+	upstream := newFakeChannel("")
+	upstream.in = nil
+	upstream.reply = func(typ string) bool { return typ != "subsystem" }
+	r := &channelRelay{
+		conn:     &connContext{sessionID: "s1", proxyUser: "dev", target: "host"},
+		client:   proxySide,
+		upstream: &PamSessionWrapper{Channel: upstream},
+	}
+	go r.forwardClientRequests(requests)
+
+	// Máy đích không có subsystem sftp: client chuyển sang exec, dữ liệu phải đi như exec
+	// chứ không qua bộ phân tích SFTP của request đã bị từ chối
+	if ok, err := client.SendRequest("subsystem", true, ssh.Marshal(struct{ Name string }{"sftp"})); ok || err != nil {
+		t.Fatalf("subsystem: ok = %v, err = %v", ok, err)
+	}
+	if ok, err := client.SendRequest("exec", true, ssh.Marshal(struct{ Command string }{"cat"})); !ok || err != nil {
+		t.Fatalf("exec: ok = %v, err = %v", ok, err)
+	}
+	client.Write([]byte("hello world\n"))
+	client.CloseWrite()
+
+	select {
+	case <-upstream.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stdin chưa được chuyển tới máy đích")
+	}
+	if got := upstream.written(); got != "hello world\n" {
+		t.Errorf("máy đích nhận %q", got)
+	}
+}
+
+func TestSCPUploadAudited(t *testing.T) {
+	filter, err := cmdfilter.New([]cmdfilter.Rule{{Pattern: `\bshutdown\b`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := recorder.NewSessionWriter(t.TempDir(), "s1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nội dung file nhị phân có cả dòng trùng rule chặn: scp không phải lệnh shell nên
+	// luồng tới máy đích phải giữ nguyên từng byte
+	data := "shutdown -h now\n\x00\xff\r\x03"
+	stream := "D0755 0 conf\nC0644 20 run.sh\n" + data + "\x00E\n"
+	client := newFakeChannel(stream)
+	upstream := newFakeChannel("")
+	upstream.in = nil
+	r := &channelRelay{
+		conn:     &connContext{sessionID: "s1", proxyUser: "dev", target: "host", commands: filter, rec: rec},
+		client:   client,
+		upstream: &PamSessionWrapper{Channel: upstream},
+	}
+	r.startPumps(&ssh.Request{Type: "exec", Payload: ssh.Marshal(struct{ Command string }{"scp -r -t /srv"})})
+
+	select {
+	case <-upstream.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stdin chưa được chuyển hết tới máy đích")
+	}
+	if got := upstream.written(); got != stream {
+		t.Errorf("máy đích nhận %q, want %q", got, stream)
+	}
+	rec.Close()
+
+	f, err := os.Open(rec.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var files []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev struct {
+			Type string
+			V    map[string]interface{}
+		}
+		if json.Unmarshal(scanner.Bytes(), &ev) == nil && ev.Type == "sftp" {
+			files = append(files, ev.V)
+		}
+	}
+	if len(files) != 2 || files[0]["op"] != "mkdir" || files[0]["path"] != "conf" ||
+		files[1]["op"] != "write" || files[1]["path"] != "conf/run.sh" || files[1]["bytes"] != float64(len(data)) {
+		t.Errorf("sự kiện sftp %v", files)
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/Entidi89/ssh_proxy1/internal/cmdfilter"
+	"golang.org/x/crypto/ssh"
+)
+
+// pumpStdin chuyển stdin của kênh shell (hoặc exec cần lọc lệnh) tới máy đích. Khi observer đang điều khiển phiên,
+// phím của user vẫn được ghi lại nhưng không tới máy đích.
+func (r *channelRelay) pumpStdin() {
+	rec := r.conn.inputStream()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.client.Read(buf)
+		if n > 0 {
+			rec.Write(buf[:n])
+			if r.conn.controlledBy() == nil {
+				if werr := r.input(buf[:n]); werr != nil {
+					return
+				}
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	r.finishInput()
+}
+
+// input chuyển phím gõ (của user hoặc observer đang điều khiển) tới máy đích. Nếu role có
+// rule lọc lệnh, từng dòng lệnh được dựng lại và kiểm tra ngay khi nhấn Enter.
+//
+// Có pty: ký tự được chuyển ngay để shell echo như bình thường, riêng phím Enter của
+// lệnh bị chặn được thay bằng Ctrl-C để shell bỏ dòng đang gõ.
+// Không pty: cả dòng được giữ lại tới khi kiểm tra xong, lệnh bị chặn không tới máy đích.
+func (r *channelRelay) input(b []byte) error {
+	r.inMu.Lock()
+	defer r.inMu.Unlock()
+	if r.conn.commands == nil {
+		_, err := r.upstream.Write(b)
+		return err
+	}
+	for _, c := range b {
+		if !r.editor.Feed(c) {
+			r.held = append(r.held, c)
+			continue
+		}
+		allowed := r.checkCommand(r.editor.Line())
+		r.editor.Reset()
+		switch {
+		case allowed:
+			r.held = append(r.held, c)
+		case r.pty:
+			r.held = append(r.held, 0x03)
+		default:
+			r.held = r.held[:r.lineStart]
+		}
+		r.lineStart = len(r.held)
+	}
+	flush := len(r.held)
+	if !r.pty {
+		flush = r.lineStart
+	}
+	if _, err := r.upstream.Write(r.held[:flush]); err != nil {
+		return err
+	}
+	r.held = append(r.held[:0], r.held[flush:]...)
+	r.lineStart -= flush
+	return nil
+}
+
+// finishInput xử lý dòng cuối không có Enter khi stdin kết thúc (shell vẫn chạy dòng này khi gặp EOF)
+func (r *channelRelay) finishInput() {
+	r.inMu.Lock()
+	defer r.inMu.Unlock()
+	if len(r.held) > 0 && r.checkCommand(r.editor.Line()) {
+		r.upstream.Write(r.held)
+	}
+	r.held = nil
+}
+
+// checkExec kiểm tra lệnh của exec request trước khi chuyển tới máy đích
+func (r *channelRelay) checkExec(req *ssh.Request) bool {
+	if req.Type != "exec" || r.conn.commands == nil {
+		return true
+	}
+	var p struct{ Command string }
+	if ssh.Unmarshal(req.Payload, &p) != nil {
+		return true
+	}
+	return r.checkCommand(p.Command, true)
+}
+
+// checkCommand đối chiếu dòng lệnh với rule của role: ghi lệnh khớp rule vào bản ghi phiên,
+// báo cho user khi bị chặn / cảnh báo. Trả về false nếu lệnh bị chặn.
+// certain = false khi dòng có thể khác lệnh thực sự chạy (lịch sử, tab completion):
+// với role có rule chặn, dòng như vậy luôn bị chặn và user phải gõ lại.
+func (r *channelRelay) checkCommand(command string, certain bool) bool {
+	c := r.conn
+	m := c.commands.Check(command)
+	// Role có rule chặn: dòng không chắc chắn bị từ chối (fail closed), vì lệnh shell thực sự
+	// chạy có thể khác dòng proxy dựng lại, vd shutdo<Tab> hoặc rm -rf / lấy từ lịch sử lệnh
+	if !certain && c.commands.Blocks() && (m == nil || m.Rule.Action != cmdfilter.Block) {
+		log.Printf("[BLOCK] Phiên %s: '%s' bị chặn dòng lệnh không kiểm tra được trên %s: %q", c.sessionID, c.proxyUser, c.target, command)
+		c.record("command", map[string]interface{}{"channel": r.id, "command": command, "action": cmdfilter.Block, "incomplete": true})
+		c.audit.Log("command.blocked", map[string]interface{}{
+			"session_id": c.sessionID, "user": c.proxyUser, "target": c.target, "role": c.role,
+			"command": command, "reason": "incomplete",
+		})
+		r.tell("Lệnh bị chặn: dòng lệnh dùng Tab, lịch sử lệnh hoặc phím proxy không kiểm tra được. Hãy gõ lại toàn bộ lệnh.")
+		return false
+	}
+	if m == nil {
+		return true
+	}
+	fields := map[string]interface{}{"channel": r.id, "command": m.Command, "action": m.Rule.Action, "rule": m.Index, "pattern": m.Rule.Pattern}
+	if !certain {
+		fields["incomplete"] = true
+	}
+	c.record("command", fields)
+
+	switch m.Rule.Action {
+	case cmdfilter.Block:
+		log.Printf("[BLOCK] Phiên %s: '%s' bị chặn lệnh trên %s: %s", c.sessionID, c.proxyUser, c.target, m.Command)
+		c.audit.Log("command.blocked", map[string]interface{}{
+			"session_id": c.sessionID, "user": c.proxyUser, "target": c.target, "role": c.role,
+			"command": m.Command, "pattern": m.Rule.Pattern,
+		})
+		r.tell("Lệnh bị chặn: " + m.Reason())
+		return false
+	case cmdfilter.Warn:
+		log.Printf("[WARN] Phiên %s: '%s' chạy lệnh cần chú ý trên %s: %s", c.sessionID, c.proxyUser, c.target, m.Command)
+		r.tell("Cảnh báo: " + m.Reason())
+	default:
+		log.Printf("[FLAG] Phiên %s: '%s' chạy lệnh được đánh dấu trên %s: %s", c.sessionID, c.proxyUser, c.target, m.Command)
+	}
+	return true
+}
+
+// tell ghi thông báo của proxy ra stderr của kênh này
+func (r *channelRelay) tell(msg string) {
+	fmt.Fprintf(r.client.Stderr(), "\r\n*** [PROXY] %s ***\r\n", msg)
+}
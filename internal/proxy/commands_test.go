@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/cmdfilter"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeChannel: ssh.Channel trong bộ nhớ, đọc từ in và ghi lại mọi thứ được gửi tới
+type fakeChannel struct {
+	in     io.Reader
+	mu     sync.Mutex
+	out    bytes.Buffer
+	stderr bytes.Buffer
+	closed chan struct{}
+	once   sync.Once
+	// reply trả lời SendRequest; nil = máy đích nhận mọi request
+	reply func(typ string) bool
+}
+
+func newFakeChannel(in string) *fakeChannel {
+	return &fakeChannel{in: strings.NewReader(in), closed: make(chan struct{})}
+}
+
+func (f *fakeChannel) Read(b []byte) (int, error) {
+	if f.in == nil {
+		<-f.closed
+		return 0, io.EOF
+	}
+	return f.in.Read(b)
+}
+
+func (f *fakeChannel) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.out.Write(b)
+}
+
+func (f *fakeChannel) written() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.out.String()
+}
+
+func (f *fakeChannel) Close() error {
+	f.once.Do(func() { close(f.closed) })
+	return nil
+}
+
+func (f *fakeChannel) CloseWrite() error { return f.Close() }
+
+func (f *fakeChannel) SendRequest(typ string, wantReply bool, _ []byte) (bool, error) {
+	if f.reply == nil {
+		return true, nil
+	}
+	return f.reply(typ) && wantReply, nil
+}
+
+func (f *fakeChannel) Stderr() io.ReadWriter { return &lockedBuffer{mu: &f.mu, b: &f.stderr} }
+
+type lockedBuffer struct {
+	mu *sync.Mutex
+	b  *bytes.Buffer
+}
+
+func (l *lockedBuffer) Read(p []byte) (int, error) { return 0, io.EOF }
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func TestExecStdinFiltered(t *testing.T) {
+	filter, err := cmdfilter.New([]cmdfilter.Rule{{Pattern: `\bshutdown\b`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		pty   bool
+		rules *cmdfilter.Filter
+		input string
+		want  string
+	}{
+		// ssh -t host bash: lệnh bị chặn được thay bằng Ctrl-C như kênh shell
+		{"pty", true, filter, "ls\rshutdown -h now\r", "ls\rshutdown -h now\x03"},
+		// Không pty nhưng role có rule chặn: dòng bị chặn không tới máy đích
+		{"no pty", false, filter, "ls\nshutdown -h now\nid\n", "ls\nid\n"},
+		// Role không có rule: stdin chuyển nguyên vẹn
+		{"no rules", false, nil, "shutdown -h now\n", "shutdown -h now\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeChannel(tt.input)
+			upstream := newFakeChannel("")
+			upstream.in = nil
+			r := &channelRelay{
+				conn:     &connContext{sessionID: "s1", proxyUser: "dev", target: "host", commands: tt.rules},
+				client:   client,
+				upstream: &PamSessionWrapper{Channel: upstream},
+				pty:      tt.pty,
+			}
+			r.startPumps(&ssh.Request{Type: "exec", Payload: ssh.Marshal(struct{ Command string }{"bash"})})
+
+			select {
+			case <-upstream.closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("stdin chưa được chuyển hết tới máy đích")
+			}
+			if got := upstream.written(); got != tt.want {
+				t.Errorf("máy đích nhận %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// accessTarget: "máy đích" đặc biệt để user xin quyền tạm thời, vd
+//
+//	ssh alice+access@proxy request 10.0.0.50 admin-role 2h "sửa sự cố INC-123"
+const accessTarget = "access"
+
+const accessUsage = `Các lệnh (ssh <user>+access@<proxy> <lệnh>):
+  request <máy đích> <role> <thời hạn> <lý do...>   xin quyền tạm thời, vd: request 10.0.0.50 admin-role 2h sửa sự cố INC-123
+  list                                               xem các yêu cầu của bạn
+`
+
+// consoleHandler chạy một lệnh (rỗng = shell) và trả về exit status
+type consoleHandler func(command string, out, errOut io.Writer) uint32
+
+// Kết nối chỉ dùng để chạy lệnh của proxy bị đóng sau khoảng thời gian này
+const consoleTimeout = time.Minute
+
+// serveConsole phục vụ các kênh session bằng handler thay vì chuyển tới máy đích.
+// Dùng cho lệnh xin quyền và để báo cho user lý do bị từ chối.
+func serveConsole(conn ssh.Conn, chans <-chan ssh.NewChannel, handler consoleHandler) {
+	timer := time.AfterFunc(consoleTimeout, func() { conn.Close() })
+	defer timer.Stop()
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.Prohibited, "chỉ hỗ trợ kênh session")
+			continue
+		}
+		channel, requests, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				var command string
+				switch req.Type {
+				case "exec":
+					var p struct{ Command string }
+					ssh.Unmarshal(req.Payload, &p)
+					command = p.Command
+				case "shell":
+				default:
+					// pty-req, env, window-change...: chấp nhận để client không báo lỗi
+					if req.WantReply {
+						req.Reply(true, nil)
+					}
+					continue
+				}
+				if req.WantReply {
+					req.Reply(true, nil)
+				}
+				status := handler(command, crlfWriter{channel}, crlfWriter{channel.Stderr()})
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				return
+			}
+		}()
+	}
+}
+
+// crlfWriter đổi "\n" thành "\r\n" để hiển thị đúng trên terminal có pty
+type crlfWriter struct{ w io.Writer }
+
+func (c crlfWriter) Write(b []byte) (int, error) {
+	if _, err := c.w.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(string(b), "\r\n", "\n"), "\n", "\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// messageConsole chỉ in thông báo ra stderr và kết thúc với exit status 1
+func messageConsole(msg string) consoleHandler {
+	return func(_ string, _, errOut io.Writer) uint32 {
+		fmt.Fprint(errOut, msg)
+		return 1
+	}
+}
+
+// denyMessage là nội dung hiển thị cho user không có quyền vào máy đích
+func (s *SSHServer) denyMessage(proxyUser, target, reason string) string {
+	msg := fmt.Sprintf("[PROXY] Bạn không có quyền truy cập %s: %s\n", target, reason)
+	if s.Access != nil {
+		msg += fmt.Sprintf("Để xin quyền tạm thời, chạy:\n  ssh %s+%s@<proxy> request %s <role> <thời hạn> <lý do>\n",
+			proxyUser, accessTarget, target)
+	}
+	return msg
+}
+
+// accessConsole xử lý lệnh của user qua ssh <user>+access@proxy
+func (s *SSHServer) accessConsole(proxyUser string) consoleHandler {
+	return func(command string, out, errOut io.Writer) uint32 {
+		if s.Access == nil {
+			fmt.Fprintln(errOut, "Proxy chưa bật tính năng xin quyền tạm thời.")
+			return 1
+		}
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			fmt.Fprint(out, accessUsage)
+			return 0
+		}
+		switch args[0] {
+		case "request":
+			if len(args) < 5 {
+				fmt.Fprint(errOut, accessUsage)
+				return 2
+			}
+			return s.createAccessRequest(proxyUser, args[1], args[2], args[3], strings.Join(args[4:], " "), out, errOut)
+		case "list":
+			w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tMÁY ĐÍCH\tROLE\tTHỜI HẠN\tTRẠNG THÁI\tHẾT HẠN")
+			for _, r := range s.Access.List(proxyUser, "") {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.ID, r.Target, r.Role, r.Duration, r.Status, r.ExpiresAt.Local().Format(time.DateTime))
+			}
+			w.Flush()
+			return 0
+		case "help":
+			fmt.Fprint(out, accessUsage)
+			return 0
+		default:
+			fmt.Fprintf(errOut, "Lệnh không hợp lệ: %s\n%s", args[0], accessUsage)
+			return 2
+		}
+	}
+}
+
+func (s *SSHServer) createAccessRequest(proxyUser, targetInput, role, duration, reason string, out, errOut io.Writer) uint32 {
+	target, err := s.RBAC.Normalize(targetInput)
+	if err != nil {
+		fmt.Fprintf(errOut, "Máy đích không hợp lệ: %v\n", err)
+		return 1
+	}
+	if _, ok := s.Roles.Get(role); !ok {
+		fmt.Fprintf(errOut, "Role '%s' không tồn tại\n", role)
+		return 1
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		fmt.Fprintf(errOut, "Thời hạn '%s' không hợp lệ (vd 30m, 2h)\n", duration)
+		return 1
+	}
+	req, err := s.Access.Create(proxyUser, target.Addr(), targetInput, role, d, reason)
+	if err != nil {
+		fmt.Fprintf(errOut, "Không tạo được yêu cầu: %v\n", err)
+		return 1
+	}
+	log.Printf("[ACCESS] User '%s' xin quyền %s trên %s trong %s (%s): %s", proxyUser, role, target, req.Duration, req.ID, reason)
+	fmt.Fprintf(out, "Đã gửi yêu cầu %s (%s trên %s trong %s). Chờ người duyệt phê duyệt.\n", req.ID, role, target, req.Duration)
+	return 0
+}
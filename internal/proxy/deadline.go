@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Các mốc cảnh báo trước khi phiên bị ngắt do hết khung giờ / thời hạn quyền
+var sessionWarnings = []time.Duration{5 * time.Minute, time.Minute}
+
+func (c *connContext) addChannel(id int, ch ssh.Channel) {
+	c.chMu.Lock()
+	defer c.chMu.Unlock()
+	if c.channels == nil {
+		c.channels = make(map[int]ssh.Channel)
+	}
+	c.channels[id] = ch
+}
+
+func (c *connContext) removeChannel(id int) {
+	c.chMu.Lock()
+	delete(c.channels, id)
+	c.chMu.Unlock()
+}
+
+// notify ghi một thông báo của proxy ra terminal (stderr) của mọi kênh đang mở
+func (c *connContext) notify(msg string) {
+	c.chMu.Lock()
+	defer c.chMu.Unlock()
+	for _, ch := range c.channels {
+		fmt.Fprintf(ch.Stderr(), "\r\n*** [PROXY] %s ***\r\n", msg)
+	}
+}
+
+// terminate báo cho user, ghi bản ghi / audit rồi ngắt kết nối client.
+// by là người ra lệnh ngắt (rỗng = proxy tự ngắt theo policy).
+func (c *connContext) terminate(reason, by string) {
+	log.Printf("[BLOCK] Ngắt phiên %s của '%s' trên %s: %s", c.sessionID, c.proxyUser, c.target, reason)
+	c.notify("Phiên bị ngắt: " + reason)
+	fields := map[string]interface{}{"event": "terminated", "reason": reason}
+	if by != "" {
+		fields["by"] = by
+	}
+	c.record("event", fields)
+	c.audit.Log("session.terminated", map[string]interface{}{
+		"session_id": c.sessionID, "user": c.proxyUser, "target": c.target, "role": c.role, "reason": reason, "by": by,
+	})
+	if c.closeConn != nil {
+		c.closeConn()
+	}
+}
+
+// Lý do hiển thị khi phiên bị ngắt vì hết deadline
+const deadlineReason = "hết khung giờ / thời hạn của quyền truy cập"
+
+// setDeadline đặt deadline của phiên (nil = không giới hạn) và canh lại theo deadline mới.
+// Trả về false nếu deadline không đổi.
+func (c *connContext) setDeadline(deadline *time.Time) bool {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	if sameDeadline(c.deadline, deadline) {
+		return false
+	}
+	if c.stopDeadline != nil {
+		close(c.stopDeadline)
+		c.stopDeadline = nil
+	}
+	c.deadline = deadline
+	if deadline != nil {
+		c.stopDeadline = make(chan struct{})
+		go c.enforceDeadline(*deadline, deadlineReason, c.stopDeadline)
+	}
+	return true
+}
+
+// deadlineChanged báo cho user và ghi lại khi hạn phiên đổi sau khi nạp lại policy
+func (c *connContext) deadlineChanged(deadline *time.Time) {
+	at := "không giới hạn"
+	fields := map[string]interface{}{"event": "deadline-changed"}
+	if deadline != nil {
+		at = deadline.Format(time.RFC3339)
+		fields["deadline"] = at
+	}
+	log.Printf("[RBAC] Hạn phiên %s của '%s' đổi thành %s theo policy mới", c.sessionID, c.proxyUser, at)
+	if deadline != nil {
+		c.notify("Policy đã thay đổi: phiên sẽ bị ngắt lúc " + deadline.Local().Format("15:04:05"))
+	} else {
+		c.notify("Policy đã thay đổi: phiên không còn bị giới hạn thời gian")
+	}
+	c.record("event", fields)
+	c.audit.Log("session.deadline-changed", map[string]interface{}{
+		"session_id": c.sessionID, "user": c.proxyUser, "target": c.target, "role": c.role, "deadline": fields["deadline"],
+	})
+}
+
+// currentDeadline trả về deadline hiện tại của phiên (nil = không giới hạn)
+func (c *connContext) currentDeadline() *time.Time {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	return c.deadline
+}
+
+func sameDeadline(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// enforceDeadline cảnh báo user trước các mốc sessionWarnings và ngắt phiên khi tới deadline.
+// Dừng sớm khi phiên kết thúc hoặc khi stop bị đóng (deadline đã được thay).
+func (c *connContext) enforceDeadline(deadline time.Time, reason string, stop <-chan struct{}) {
+	wait := func(at time.Time) bool {
+		t := time.NewTimer(time.Until(at))
+		defer t.Stop()
+		select {
+		case <-t.C:
+			return true
+		case <-stop:
+			return false
+		case <-c.done:
+			return false
+		}
+	}
+	for _, before := range sessionWarnings {
+		at := deadline.Add(-before)
+		if time.Until(at) <= 0 {
+			continue
+		}
+		if !wait(at) {
+			return
+		}
+		c.notify(fmt.Sprintf("Phiên sẽ bị ngắt lúc %s (còn %s): %s",
+			deadline.Local().Format("15:04:05"), before, reason))
+		c.record("event", map[string]interface{}{"event": "deadline-warning", "deadline": deadline.Format(time.RFC3339)})
+	}
+	if wait(deadline) {
+		c.terminate(reason, "")
+	}
+}
@@ -1,78 +1,205 @@
 package proxy
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"fmt"
 	"io"
 	"log"
 	"net"
-	"os"
 	"strings"
+	"sync"
+	"time"
 
-	"golang.org/x/crypto/ssh"
+	"github.com/Entidi89/ssh_proxy1/internal/access"
+	"github.com/Entidi89/ssh_proxy1/internal/audit"
+	"github.com/Entidi89/ssh_proxy1/internal/cmdfilter"
+	"github.com/Entidi89/ssh_proxy1/internal/hostkeys"
+	"github.com/Entidi89/ssh_proxy1/internal/mfa"
+	"github.com/Entidi89/ssh_proxy1/internal/rbac"
+	"github.com/Entidi89/ssh_proxy1/internal/recorder"
+	"github.com/Entidi89/ssh_proxy1/internal/roles"
+	"github.com/Entidi89/ssh_proxy1/internal/util"
 	"github.com/Entidi89/ssh_proxy1/internal/vault"
+	"github.com/Entidi89/ssh_proxy1/internal/ws"
+	"golang.org/x/crypto/ssh"
 )
 
-// getOrCreateHostKey: Hàm này giúp Proxy "nhớ" chìa khóa của mình
-func getOrCreateHostKey() (ssh.Signer, error) {
-	keyFile := "proxy_id_rsa" // Tên file lưu chìa khóa
-
-	// 1. Thử đọc file chìa khóa cũ
-	content, err := os.ReadFile(keyFile)
-	if err == nil {
-		// Nếu có file -> Đọc và dùng lại
-		signer, err := ssh.ParsePrivateKey(content)
-		if err != nil {
-			return nil, err
+// loginRequest: username client gửi lên, dạng "user+ip" hoặc "user+login@ip"
+type loginRequest struct {
+	User   string // proxy user
+	Login  string // OS login yêu cầu trên máy đích (rỗng = default_login của role)
+	Target string
+}
+
+// parseLogin tách username thành proxy user, OS login (nếu có) và máy đích
+func parseLogin(input string) (loginRequest, error) {
+	parts := strings.Split(input, "+")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return loginRequest{}, fmt.Errorf("sai cú pháp '%s'. Yêu cầu: user+ip hoặc user+login@ip", input)
+	}
+	req := loginRequest{User: parts[0], Target: parts[1]}
+	if i := strings.LastIndex(parts[1], "@"); i >= 0 {
+		req.Login, req.Target = parts[1][:i], parts[1][i+1:]
+		if req.Login == "" || req.Target == "" {
+			return loginRequest{}, fmt.Errorf("sai cú pháp '%s'. Yêu cầu: user+login@ip", input)
 		}
-		return signer, nil
 	}
+	return req, nil
+}
 
-	// 2. Nếu chưa có file -> Tạo mới
-	log.Println("[PROXY] Đang tạo Host Key mới và lưu vào file...")
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, err
-	}
+// TOTPStore: nơi lưu secret TOTP của user (VaultClient dùng KV engine)
+type TOTPStore interface {
+	GetTOTPSecret(user string) (string, error)
+}
 
-	// Lưu xuống file để lần sau dùng lại
-	keyBytes := x509.MarshalPKCS1PrivateKey(key)
-	pemBlock := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: keyBytes,
+// mfaRole trả về role bắt buộc MFA của kết nối tới target (rỗng = không cần MFA).
+// Với join:<session-id>, MFA là bắt buộc nếu role của người xem trên máy đích của phiên
+// hoặc role của chính phiên đó yêu cầu MFA: xem / điều khiển một phiên root không được dễ hơn mở nó.
+func mfaRole(policy *rbac.RBAC, sessions *SessionRegistry, proxyUser, target string) string {
+	if target == accessTarget {
+		return ""
 	}
-	file, err := os.Create(keyFile)
+	if sessionID, ok := strings.CutPrefix(target, joinPrefix); ok {
+		cc, ok := sessions.get(sessionID)
+		if !ok {
+			return ""
+		}
+		if d := policy.CheckAccess(proxyUser, cc.dest); d.Allowed && policy.RequiresMFA(d.Role) {
+			return d.Role
+		}
+		if policy.RequiresMFA(cc.role) {
+			return cc.role
+		}
+		return ""
+	}
+	dest, err := policy.Normalize(target)
 	if err != nil {
-		return nil, err
+		return ""
 	}
-	defer file.Close()
-	if err := pem.Encode(file, pemBlock); err != nil {
-		return nil, err
+	decision := policy.CheckAccess(proxyUser, dest)
+	if !decision.Allowed || !policy.RequiresMFA(decision.Role) {
+		return ""
 	}
-
-	// Trả về signer
-	return ssh.NewSignerFromKey(key)
+	return decision.Role
 }
 
-func HandleConnection(nConn net.Conn, vClient *vault.VaultClient, rbac *RBACService) {
-	defer nConn.Close()
+// newServerConfig: xác thực client bằng public key theo authorized_keys trong policies.json,
+// sau đó yêu cầu mã TOTP qua keyboard-interactive nếu role của user bắt buộc MFA
+func newServerConfig(policy *rbac.RBAC, sessions *SessionRegistry, totp TOTPStore, verifier *mfa.Verifier) *ssh.ServerConfig {
+	return &ssh.ServerConfig{
+		MaxAuthTries: 3,
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			login, err := parseLogin(c.User())
+			if err != nil {
+				return nil, err
+			}
+			proxyUser := login.User
+			if !policy.IsAuthorizedKey(proxyUser, key) {
+				log.Printf("[AUTH] Từ chối key %s của user '%s' từ %s", ssh.FingerprintSHA256(key), proxyUser, c.RemoteAddr())
+				return nil, fmt.Errorf("public key không hợp lệ cho user '%s'", proxyUser)
+			}
+			// Danh tính đã xác thực được truyền qua Permissions, không đọc lại từ username
+			perms := &ssh.Permissions{
+				Extensions: map[string]string{
+					"proxy-user": proxyUser,
+					"pubkey-fp":  ssh.FingerprintSHA256(key),
+				},
+			}
 
-	// Cấu hình SSH Server
-	config := &ssh.ServerConfig{
-		NoClientAuth: true,
+			// Role sẽ được cấp cho kết nối này (hoặc role của phiên được xem) có bắt buộc MFA không?
+			roleName := mfaRole(policy, sessions, proxyUser, login.Target)
+			if roleName == "" {
+				return perms, nil
+			}
+
+			// Yếu tố thứ hai: TOTP qua keyboard-interactive
+			return nil, &ssh.PartialSuccessError{
+				Next: ssh.ServerAuthCallbacks{
+					KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+						secret, err := totp.GetTOTPSecret(proxyUser)
+						if err != nil {
+							log.Printf("[AUTH] User '%s' cần MFA cho role '%s' nhưng chưa đăng ký TOTP: %v", proxyUser, roleName, err)
+							return nil, fmt.Errorf("user '%s' chưa đăng ký TOTP", proxyUser)
+						}
+						// Sai mã quá nhiều lần: khóa theo user, không theo kết nối
+						if until, locked := verifier.LockedUntil(proxyUser, time.Now()); locked {
+							log.Printf("[AUTH] User '%s' đang bị tạm khóa MFA tới %s (từ %s)", proxyUser, until.Format(time.RFC3339), c.RemoteAddr())
+							return nil, fmt.Errorf("user '%s' bị tạm khóa MFA do nhập sai mã nhiều lần", proxyUser)
+						}
+						answers, err := client(proxyUser, "Role '"+roleName+"' yêu cầu xác thực 2 lớp.", []string{"Mã TOTP: "}, []bool{true})
+						if err != nil {
+							return nil, err
+						}
+						if len(answers) != 1 || !verifier.Verify(proxyUser, secret, answers[0], time.Now()) {
+							log.Printf("[AUTH] Sai mã TOTP của user '%s' từ %s", proxyUser, c.RemoteAddr())
+							return nil, fmt.Errorf("mã TOTP không hợp lệ")
+						}
+						perms.Extensions["mfa"] = "totp"
+						return perms, nil
+					},
+				},
+			}
+		},
 	}
+}
+
+// SSHServer: listener SSH của proxy cùng các thành phần nó phụ thuộc
+type SSHServer struct {
+	Vault *vault.VaultClient
+	RBAC  *rbac.RBAC
+	MFA   *mfa.Verifier
+	// Định nghĩa role (Vault role, OS login được phép, ...)
+	Roles *roles.Set
 
-	// [FIX] Dùng hàm lấy Key cố định thay vì tạo ngẫu nhiên
-	signer, err := getOrCreateHostKey()
+	// Thư mục lưu bản ghi phiên (session-<id>.jsonl)
+	RecordDir string
+	// Fail-closed: từ chối phiên nếu không mở được bản ghi
+	RecordFailClosed bool
+
+	// Kiểm tra host key của máy đích
+	HostKeys *hostkeys.Verifier
+	Audit    *audit.Logger
+	// Yêu cầu cấp quyền tạm thời (nil = tắt tính năng)
+	Access *access.Store
+
+	hostKey ssh.Signer
+	// Host certificate do Vault ký cho host key của proxy (nil nếu chưa cấp)
+	hostMu   sync.RWMutex
+	hostCert ssh.Signer
+
+	// Các phiên đang hoạt động (xem / điều khiển / ngắt qua SSH và HTTP API)
+	Sessions *SessionRegistry
+	// Agent reverse tunnel đang kết nối (dùng chung với ProxyServer), cho máy đích nằm sau agent
+	Agents *ws.Manager
+}
+
+func NewSSHServer(vClient *vault.VaultClient, policy *rbac.RBAC, roleSet *roles.Set, verifier *mfa.Verifier) (*SSHServer, error) {
+	// Host key tạm trong bộ nhớ; dùng LoadHostKey để giữ host key cố định qua các lần khởi động
+	signer, err := newEphemeralHostKey()
 	if err != nil {
-		log.Printf("Lỗi tải Host Key: %v", err)
-		return
+		return nil, fmt.Errorf("lỗi tạo Host Key: %v", err)
+	}
+	return &SSHServer{
+		Vault:     vClient,
+		RBAC:      policy,
+		Roles:     roleSet,
+		MFA:       verifier,
+		RecordDir: "sessions",
+		Sessions:  NewSessionRegistry(),
+		hostKey:   signer,
+	}, nil
+}
+
+func (s *SSHServer) HandleConnection(nConn net.Conn) {
+	defer nConn.Close()
+
+	// Cấu hình SSH Server
+	config := newServerConfig(s.RBAC, s.Sessions, s.Vault, s.MFA)
+	config.AddHostKey(s.hostKey)
+	if cert := s.hostCertificate(); cert != nil {
+		config.AddHostKey(cert)
 	}
-	config.AddHostKey(signer)
 
-	// Bắt tay SSH
+	// Bắt tay SSH (xác thực thất bại sẽ dừng tại đây, chưa chạm tới RBAC hay Vault)
 	sshConn, chans, reqs, err := ssh.NewServerConn(nConn, config)
 	if err != nil {
 		log.Printf("Lỗi handshake: %v", err)
@@ -83,63 +210,199 @@ func HandleConnection(nConn net.Conn, vClient *vault.VaultClient, rbac *RBACServ
 	go ssh.DiscardRequests(reqs)
 
 	// Xử lý logic kết nối
-	inputString := sshConn.User()
-	parts := strings.Split(inputString, "+")
-	
-	if len(parts) != 2 {
-		log.Printf("[PROXY] Lỗi cú pháp từ %s. Yêu cầu: user+ip", nConn.RemoteAddr())
+	login, err := parseLogin(sshConn.User())
+	if err != nil {
+		log.Printf("[PROXY] Lỗi cú pháp từ %s: %v", nConn.RemoteAddr(), err)
+		return
+	}
+	proxyUser := sshConn.Permissions.Extensions["proxy-user"]
+
+	log.Printf("[PROXY] User '%s' (key %s) yêu cầu vào '%s'", proxyUser, sshConn.Permissions.Extensions["pubkey-fp"], login.Target)
+
+	// ssh <user>+access@proxy: xin / xem quyền tạm thời
+	if login.Target == accessTarget {
+		serveConsole(sshConn, chans, s.accessConsole(proxyUser))
+		return
+	}
+
+	// ssh <user>+join:<session-id>@proxy: xem / điều khiển phiên của người khác
+	if sessionID, ok := strings.CutPrefix(login.Target, joinPrefix); ok {
+		s.serveJoin(sshConn, chans, proxyUser, sessionID)
 		return
 	}
-	
-	proxyUser := parts[0]
-	targetIP := parts[1]
 
-	log.Printf("[PROXY] User '%s' yêu cầu vào '%s'", proxyUser, targetIP)
+	// Chuẩn hóa máy đích (port mặc định, IP chuẩn, tên / nhãn trong inventory)
+	target, err := s.RBAC.Normalize(login.Target)
+	if err != nil {
+		log.Printf("[BLOCK] User '%s': %v", proxyUser, err)
+		serveConsole(sshConn, chans, messageConsole(fmt.Sprintf("[PROXY] %v\n", err)))
+		return
+	}
+	targetAddr := target.Addr()
 
 	// Kiểm tra RBAC
-	allowed, roleName := rbac.CheckAccess(proxyUser, targetIP)
-	if !allowed {
-		log.Printf("[BLOCK] User '%s' bị chặn truy cập '%s'", proxyUser, targetIP)
+	decision := s.RBAC.CheckAccess(proxyUser, target)
+	if !decision.Allowed {
+		log.Printf("[BLOCK] User '%s' bị chặn truy cập '%s': %s", proxyUser, target, decision)
+		s.Audit.Log("access.denied", map[string]interface{}{
+			"user": proxyUser, "target": targetAddr, "client": nConn.RemoteAddr().String(),
+			"rule": decision.Rule, "reason": decision.Reason,
+		})
+		serveConsole(sshConn, chans, messageConsole(s.denyMessage(proxyUser, login.Target, decision.Reason)))
 		return
 	}
+	roleName := decision.Role
+	log.Printf("[ALLOW] User '%s' -> '%s' với role '%s': %s", proxyUser, target, roleName, decision)
 
-	// Xác định User đích
-	var targetOSUser string
-	if roleName == "admin-role" {
-		targetOSUser = "root"
-	} else {
-		targetOSUser = "wazuhserver" 
+	// Xác định User đích theo định nghĩa role trong roles.json
+	roleDef, ok := s.Roles.Get(roleName)
+	if !ok {
+		log.Printf("[BLOCK] Role '%s' của user '%s' chưa được khai báo trong roles.json", roleName, proxyUser)
+		return
+	}
+	targetOSUser, err := roleDef.ResolveLogin(login.Login)
+	if err != nil {
+		log.Printf("[BLOCK] User '%s': %v", proxyUser, err)
+		return
 	}
 
-	// Kết nối Vault & Target
-	stream, err := ConnectUsingVault(vClient, targetIP, targetOSUser, roleName)
+	// Kết nối Vault & Target (một kết nối SSH dùng chung cho mọi kênh của client)
+	auditFields := map[string]interface{}{"user": proxyUser, "role": roleName, "client": nConn.RemoteAddr().String()}
+	if target.Agent != "" {
+		auditFields["agent"] = target.Agent
+	}
+	upstream, err := ConnectUsingVault(s.Vault, s.HostKeys, s.dialer(target), targetAddr, targetOSUser, roleDef.VaultRole, auditFields)
 	if err != nil {
 		log.Printf("[ERROR] Lỗi kết nối máy đích: %v", err)
 		return
 	}
-	defer stream.Close()
+	defer upstream.Close()
 
-	// Mở kênh dữ liệu
-	newChannels := <-chans
-	if newChannels == nil { return }
+	// Mở bản ghi phiên
+	sessionID := util.NewSessionID()
+	meta := map[string]interface{}{
+		"session_id":  sessionID,
+		"user":        proxyUser,
+		"target":      targetAddr,
+		"target_name": target.Name,
+		"agent":       target.Agent,
+		"role":        roleName,
+		"os_user":     targetOSUser,
+		"remote":      nConn.RemoteAddr().String(),
+		"cert_serial": upstream.CertSerial,
+		"pubkey_fp":   sshConn.Permissions.Extensions["pubkey-fp"],
+		"policy":      decision,
+		"start":       time.Now().Format(time.RFC3339),
+	}
+	rec, err := recorder.NewSessionWriter(s.RecordDir, sessionID, meta)
+	if err != nil {
+		if s.RecordFailClosed {
+			log.Printf("[BLOCK] Không mở được bản ghi phiên (fail-closed) -> từ chối user '%s': %v", proxyUser, err)
+			return
+		}
+		log.Printf("[WARN] Không mở được bản ghi phiên, phiên sẽ KHÔNG được ghi lại: %v", err)
+		rec = nil
+	} else {
+		defer rec.Close()
+		log.Printf("[RECORD] Phiên %s của '%s' -> %s", sessionID, proxyUser, rec.Path())
+	}
 
-	if newChannels.ChannelType() != "session" {
-		newChannels.Reject(ssh.UnknownChannelType, "unknown channel type")
+	settings := s.RBAC.Settings(roleName)
+	commands, err := cmdfilter.New(settings.Commands)
+	if err != nil {
+		log.Printf("[BLOCK] Rule lọc lệnh của role '%s' không hợp lệ -> từ chối user '%s': %v", roleName, proxyUser, err)
 		return
 	}
-	channel, requests, err := newChannels.Accept()
-	if err != nil { return }
+	cc := &connContext{
+		sessionID: sessionID,
+		proxyUser: proxyUser,
+		target:    targetAddr,
+		dest:      target,
+		role:      roleName,
+		osUser:    targetOSUser,
+		client:    nConn.RemoteAddr().String(),
+		start:     time.Now(),
+		settings:  settings,
+		commands:  commands,
+		upstream:  upstream,
+		rec:       rec,
+		audit:     s.Audit,
+		closeConn: sshConn.Close,
+		done:      make(chan struct{}),
+	}
 
+	s.Sessions.add(cc)
+	defer s.Sessions.remove(sessionID)
+	defer cc.closeObservers("phiên đã kết thúc")
+
+	// Quyền có thời hạn (khung giờ bảo trì, not_after, max_session): cảnh báo rồi ngắt phiên khi hết hạn
+	defer close(cc.done)
+	if cc.setDeadline(decision.Deadline) {
+		log.Printf("[PROXY] Phiên %s sẽ bị ngắt lúc %s", sessionID, decision.Deadline.Format(time.RFC3339))
+	}
+
+	// Máy đích ngắt kết nối -> đóng luôn kết nối client
 	go func() {
-		io.Copy(channel, stream)
-		channel.Close()
-	}()
-	go func() {
-		io.Copy(stream, channel)
+		upstream.Client.Wait()
+		sshConn.Close()
 	}()
-	
-	req := <-requests
-	if req != nil { req.Reply(true, nil) } 
-	
-	select {}
+
+	// Mỗi kênh client được xử lý song song trên cùng kết nối tới máy đích.
+	// Vòng lặp kết thúc khi client ngắt kết nối.
+	var wg sync.WaitGroup
+	id := 0
+	for newCh := range chans {
+		wg.Add(1)
+		go func(id int, newCh ssh.NewChannel) {
+			defer wg.Done()
+			cc.handleChannel(id, newCh)
+		}(id, newCh)
+		id++
+	}
+	upstream.Close()
+	wg.Wait()
+	log.Printf("[PROXY] Phiên %s của '%s' đã kết thúc", sessionID, proxyUser)
+}
+
+// recordStream trả về writer ghi dữ liệu vào bản ghi phiên với loại sự kiện typ
+func recordStream(rec *recorder.SessionWriter, typ string) io.Writer {
+	if rec == nil {
+		return io.Discard
+	}
+	return writerFunc(func(b []byte) (int, error) {
+		rec.WriteBytes(typ, b)
+		return len(b), nil
+	})
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) { return f(b) }
+
+// parseWindowSize đọc kích thước cửa sổ từ payload của pty-req (RFC 4254 6.2) hoặc window-change (6.7)
+func parseWindowSize(reqType string, payload []byte) (cols, rows uint32, ok bool) {
+	if reqType == "pty-req" {
+		var p struct {
+			Term   string
+			Cols   uint32
+			Rows   uint32
+			Width  uint32
+			Height uint32
+			Modes  string
+		}
+		if err := ssh.Unmarshal(payload, &p); err != nil {
+			return 0, 0, false
+		}
+		return p.Cols, p.Rows, true
+	}
+	var p struct {
+		Cols   uint32
+		Rows   uint32
+		Width  uint32
+		Height uint32
+	}
+	if err := ssh.Unmarshal(payload, &p); err != nil {
+		return 0, 0, false
+	}
+	return p.Cols, p.Rows, true
 }
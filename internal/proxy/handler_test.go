@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+	"github.com/Entidi89/ssh_proxy1/internal/rbac"
+)
+
+func TestMFARoleForJoin(t *testing.T) {
+	pf, err := rbac.ParsePolicyFile([]byte(`{"roles": {"admin-role": {"require_mfa": true}}, "users": [
+		{"user": "bob", "role": "admin-role", "targets": ["10.0.0.1"]},
+		{"user": "alice", "role": "dev", "targets": ["10.0.0.2"], "moderate": {"actions": ["join"]}},
+		{"user": "carol", "role": "admin-role", "targets": ["10.0.0.0/24"], "moderate": {"actions": ["join"]}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := rbac.New(pf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := NewSessionRegistry()
+	dest := func(ip string) inventory.Target { return inventory.Target{IP: netip.MustParseAddr(ip), Port: 22} }
+	sessions.add(&connContext{sessionID: "root", proxyUser: "bob", role: "admin-role", dest: dest("10.0.0.1")})
+	sessions.add(&connContext{sessionID: "dev", proxyUser: "dan", role: "dev", dest: dest("10.0.0.9")})
+
+	tests := []struct {
+		user, target, want string
+	}{
+		// phiên được xem yêu cầu MFA dù role của người xem không yêu cầu
+		{"alice", "join:root", "admin-role"},
+		// role của người xem trên máy đích của phiên yêu cầu MFA
+		{"carol", "join:dev", "admin-role"},
+		{"alice", "join:dev", ""},
+		{"alice", "join:missing", ""},
+		{"bob", "10.0.0.1", "admin-role"},
+		{"alice", "10.0.0.2", ""},
+		{"bob", accessTarget, ""},
+	}
+	for _, tt := range tests {
+		if got := mfaRole(policy, sessions, tt.user, tt.target); got != tt.want {
+			t.Errorf("mfaRole(%s, %s) = %q, want %q", tt.user, tt.target, got, tt.want)
+		}
+	}
+}
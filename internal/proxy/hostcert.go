@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeySigner: nơi ký host certificate (VaultClient, mount ssh-host-signer)
+type HostKeySigner interface {
+	SignHostKey(pubKey []byte, principals []string, ttl string) (string, error)
+}
+
+// newEphemeralHostKey sinh host key ed25519 chỉ nằm trong bộ nhớ (không ghi ra đĩa).
+// Client tin proxy qua host certificate (@cert-authority) nên host key đổi mỗi lần khởi động
+// không ảnh hưởng; không có host certificate thì client phải TOFU lại sau mỗi lần khởi động.
+func newEphemeralHostKey() (ssh.Signer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+// LoadHostKey dùng host key có sẵn (vd tạo bằng ssh-keygen, quyền 0600) thay cho host key tạm.
+// Gọi trước IssueHostCertificate và trước khi nhận kết nối.
+func (s *SSHServer) LoadHostKey(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("không đọc được host key %s: %v", path, err)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode().Perm()&0o077 != 0 {
+		return fmt.Errorf("host key %s không được cho group/other đọc (quyền %v)", path, fi.Mode().Perm())
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return fmt.Errorf("host key %s không hợp lệ: %v", path, err)
+	}
+	s.hostKey = signer
+	return nil
+}
+
+func (s *SSHServer) hostCertificate() ssh.Signer {
+	s.hostMu.RLock()
+	defer s.hostMu.RUnlock()
+	return s.hostCert
+}
+
+// IssueHostCertificate xin Vault ký host key của proxy thành host certificate.
+// Client tin host CA qua "@cert-authority" trong known_hosts thay vì TOFU host key của proxy.
+// Trả về thời điểm certificate hết hạn.
+func (s *SSHServer) IssueHostCertificate(v HostKeySigner, principals []string, ttl string) (time.Time, error) {
+	signed, err := v.SignHostKey(ssh.MarshalAuthorizedKey(s.hostKey.PublicKey()), principals, ttl)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Vault từ chối ký host key của proxy: %v", err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signed))
+	if err != nil {
+		return time.Time{}, err
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert {
+		return time.Time{}, fmt.Errorf("Vault không trả về host certificate")
+	}
+	certSigner, err := ssh.NewCertSigner(cert, s.hostKey)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	s.hostMu.Lock()
+	s.hostCert = certSigner
+	s.hostMu.Unlock()
+
+	expires := time.Unix(int64(cert.ValidBefore), 0)
+	log.Printf("[PROXY] Đã cấp host certificate (serial %d, principals %v, hết hạn %s)", cert.Serial, cert.ValidPrincipals, expires.Format(time.RFC3339))
+	return expires, nil
+}
+
+// RenewHostCertificate tự gia hạn host certificate khi đã dùng 2/3 thời hạn.
+// expires là thời điểm hết hạn của certificate hiện tại.
+func (s *SSHServer) RenewHostCertificate(v HostKeySigner, principals []string, ttl string, expires time.Time) {
+	for {
+		wait := time.Until(expires) * 2 / 3
+		if wait < time.Minute {
+			wait = time.Minute
+		}
+		time.Sleep(wait)
+
+		next, err := s.IssueHostCertificate(v, principals, ttl)
+		if err != nil {
+			log.Printf("[ERROR] Gia hạn host certificate thất bại: %v", err)
+			continue
+		}
+		expires = next
+	}
+}
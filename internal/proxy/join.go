@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/Entidi89/ssh_proxy1/internal/rbac"
+	"golang.org/x/crypto/ssh"
+)
+
+// joinPrefix: "máy đích" đặc biệt để xem / điều khiển phiên của người khác, vd
+//
+//	ssh carol+join:<session-id>@proxy
+const joinPrefix = "join:"
+
+// Phím thoát khi đang xem phiên qua SSH: Ctrl-] rồi một phím lệnh
+const escapeKey = 0x1d
+
+const observeHelp = `Đang xem phiên %s của '%s' trên %s (role %s).
+Phím lệnh: Ctrl-] q thoát | Ctrl-] j điều khiển phiên | Ctrl-] r trả lại quyền điều khiển | Ctrl-] t ngắt phiên
+`
+
+const terminateHelp = `Phiên %s của '%s' trên %s (role %s): bạn chỉ có quyền ngắt phiên, không xem được output.
+Phím lệnh: Ctrl-] q thoát | Ctrl-] t ngắt phiên
+`
+
+// serveJoin phục vụ kết nối ssh <user>+join:<session-id>@proxy
+func (s *SSHServer) serveJoin(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, proxyUser, sessionID string) {
+	cc, ok := s.Sessions.get(sessionID)
+	if !ok {
+		serveConsole(conn, chans, messageConsole(fmt.Sprintf("[PROXY] Không tìm thấy phiên đang hoạt động '%s'\n", sessionID)))
+		return
+	}
+	// Phiên có thể bắt đầu (hoặc policy đổi) sau bước xác thực: kiểm tra lại yêu cầu MFA
+	if role := mfaRole(s.RBAC, s.Sessions, proxyUser, joinPrefix+sessionID); role != "" && conn.Permissions.Extensions["mfa"] == "" {
+		log.Printf("[BLOCK] User '%s' cần MFA (role '%s') để xem phiên %s của '%s'", proxyUser, role, sessionID, cc.proxyUser)
+		s.Audit.Log("session.observe-denied", map[string]interface{}{
+			"session_id": sessionID, "user": cc.proxyUser, "target": cc.target, "observer": proxyUser, "client": conn.RemoteAddr().String(),
+			"reason": "mfa required",
+		})
+		serveConsole(conn, chans, messageConsole(fmt.Sprintf("[PROXY] Role '%s' yêu cầu xác thực 2 lớp, hãy kết nối lại\n", role)))
+		return
+	}
+	// Vào được nếu có ít nhất một quyền giám sát (join bao gồm observe): quyền của từng
+	// thao tác được kiểm tra khi thực hiện, để người chỉ có quyền terminate vẫn ngắt được phiên
+	if !s.RBAC.CanModerate(proxyUser, rbac.ModerateObserve, cc.dest) && !s.RBAC.CanModerate(proxyUser, rbac.ModerateTerminate, cc.dest) {
+		log.Printf("[BLOCK] User '%s' không có quyền giám sát phiên %s của '%s'", proxyUser, sessionID, cc.proxyUser)
+		s.Audit.Log("session.observe-denied", map[string]interface{}{
+			"session_id": sessionID, "user": cc.proxyUser, "target": cc.target, "observer": proxyUser, "client": conn.RemoteAddr().String(),
+		})
+		serveConsole(conn, chans, messageConsole(fmt.Sprintf("[PROXY] Bạn không có quyền xem phiên %s\n", sessionID)))
+		return
+	}
+
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.Prohibited, "chỉ hỗ trợ kênh session")
+			continue
+		}
+		channel, requests, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				// pty-req, shell, window-change...: chấp nhận, exec / subsystem thì không
+				ok := req.Type != "exec" && req.Type != "subsystem"
+				if req.WantReply {
+					req.Reply(ok, nil)
+				}
+			}
+		}()
+		s.observeSSH(cc, proxyUser, channel)
+		channel.Close()
+		return
+	}
+}
+
+// observeSSH gửi output của phiên tới kênh của observer (nếu có quyền xem) và xử lý phím lệnh Ctrl-]
+func (s *SSHServer) observeSSH(cc *connContext, proxyUser string, channel ssh.Channel) {
+	o := newObserver(proxyUser, "ssh")
+	cc.attach(o)
+	defer cc.detach(o, "observer ngắt kết nối")
+
+	can := func(action string) bool { return s.RBAC.CanModerate(proxyUser, action, cc.dest) }
+	watch := can(rbac.ModerateObserve)
+	out := crlfWriter{channel}
+	if watch {
+		fmt.Fprintf(out, observeHelp, cc.sessionID, cc.proxyUser, cc.target, cc.role)
+	} else {
+		fmt.Fprintf(out, terminateHelp, cc.sessionID, cc.proxyUser, cc.target, cc.role)
+	}
+	say := func(msg string) { fmt.Fprintf(channel, "\r\n*** [PROXY] %s ***\r\n", msg) }
+
+	go func() {
+		buf := make([]byte, 4096)
+		escape := false
+		for {
+			n, err := channel.Read(buf)
+			if err != nil {
+				o.close("observer ngắt kết nối")
+				return
+			}
+			var keys []byte
+			for _, b := range buf[:n] {
+				if !escape {
+					if b == escapeKey {
+						escape = true
+					} else {
+						keys = append(keys, b)
+					}
+					continue
+				}
+				escape = false
+				switch b {
+				case 'q', '.':
+					o.close("observer thoát")
+					return
+				case 'j':
+					if err := cc.moderate(can, o, rbac.ModerateJoin, ""); err != nil {
+						say("Không thể điều khiển phiên: " + err.Error())
+					} else {
+						say("Bạn đang điều khiển phiên, Ctrl-] r để trả lại")
+					}
+				case 'r':
+					cc.moderate(can, o, "release", "")
+				case 't':
+					if err := cc.moderate(can, o, rbac.ModerateTerminate, ""); err != nil {
+						say("Không thể ngắt phiên: " + err.Error())
+					}
+				default:
+					keys = append(keys, escapeKey, b)
+				}
+			}
+			// Phím thường chỉ tới máy đích khi observer đang điều khiển phiên
+			if len(keys) > 0 && cc.controlledBy() == o {
+				cc.controlInput(o, keys)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case b := <-o.out:
+			if !watch {
+				continue
+			}
+			if _, err := channel.Write(b); err != nil {
+				return
+			}
+		case <-o.gone:
+			say(strings.TrimSpace("Ngừng xem phiên: " + o.reason))
+			return
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/Entidi89/ssh_proxy1/internal/rbac"
+	"github.com/Entidi89/ssh_proxy1/internal/util"
+)
+
+// Số đoạn output được đệm cho mỗi observer. Observer đọc không kịp sẽ bị tách khỏi phiên
+// thay vì làm chậm phiên đang được xem.
+const observerBuffer = 256
+
+// observer: một người đang xem phiên (qua SSH hoặc WebSocket)
+type observer struct {
+	id   string
+	user string
+	via  string // ssh | websocket
+	out  chan []byte
+
+	once   sync.Once
+	gone   chan struct{}
+	reason string
+}
+
+func newObserver(user, via string) *observer {
+	return &observer{
+		id:   util.NewSessionID(),
+		user: user,
+		via:  via,
+		out:  make(chan []byte, observerBuffer),
+		gone: make(chan struct{}),
+	}
+}
+
+// close tách observer khỏi phiên, reason được hiển thị cho observer
+func (o *observer) close(reason string) {
+	o.once.Do(func() {
+		o.reason = reason
+		close(o.gone)
+	})
+}
+
+// attach thêm observer vào phiên và ghi lại vào bản ghi của phiên được xem
+func (c *connContext) attach(o *observer) {
+	c.obsMu.Lock()
+	if c.observers == nil {
+		c.observers = make(map[string]*observer)
+	}
+	c.observers[o.id] = o
+	c.obsMu.Unlock()
+
+	log.Printf("[OBSERVE] '%s' bắt đầu xem phiên %s của '%s' (%s)", o.user, c.sessionID, c.proxyUser, o.via)
+	c.record("event", map[string]interface{}{"event": "observer-joined", "observer": o.user, "observer_id": o.id, "via": o.via})
+	c.audit.Log("session.observed", map[string]interface{}{
+		"session_id": c.sessionID, "user": c.proxyUser, "target": c.target, "observer": o.user, "via": o.via,
+	})
+}
+
+// detach bỏ observer khỏi phiên (trả lại quyền điều khiển nếu observer đang giữ)
+func (c *connContext) detach(o *observer, reason string) {
+	o.close(reason)
+	c.release(o)
+	c.obsMu.Lock()
+	_, ok := c.observers[o.id]
+	delete(c.observers, o.id)
+	c.obsMu.Unlock()
+	if !ok {
+		return
+	}
+	log.Printf("[OBSERVE] '%s' ngừng xem phiên %s: %s", o.user, c.sessionID, o.reason)
+	c.record("event", map[string]interface{}{"event": "observer-left", "observer": o.user, "observer_id": o.id, "reason": o.reason})
+}
+
+// closeObservers tách mọi observer khi phiên kết thúc
+func (c *connContext) closeObservers(reason string) {
+	c.obsMu.Lock()
+	list := make([]*observer, 0, len(c.observers))
+	for _, o := range c.observers {
+		list = append(list, o)
+	}
+	c.obsMu.Unlock()
+	for _, o := range list {
+		c.detach(o, reason)
+	}
+}
+
+// broadcast gửi output của phiên tới mọi observer
+func (c *connContext) broadcast(b []byte) {
+	c.obsMu.Lock()
+	if len(c.observers) == 0 {
+		c.obsMu.Unlock()
+		return
+	}
+	chunk := append([]byte(nil), b...)
+	var slow []*observer
+	for _, o := range c.observers {
+		select {
+		case o.out <- chunk:
+		default:
+			slow = append(slow, o)
+		}
+	}
+	c.obsMu.Unlock()
+	for _, o := range slow {
+		c.detach(o, "đọc output quá chậm")
+	}
+}
+
+// outputStream trả về writer ghi output vào bản ghi phiên và gửi tới các observer
+func (c *connContext) outputStream(typ string) io.Writer {
+	rec := recordStream(c.rec, typ)
+	return writerFunc(func(b []byte) (int, error) {
+		rec.Write(b)
+		c.bytesOut.Add(int64(len(b)))
+		c.broadcast(b)
+		return len(b), nil
+	})
+}
+
+// inputStream trả về writer ghi stdin của client vào bản ghi phiên
+func (c *connContext) inputStream() io.Writer {
+	rec := recordStream(c.rec, "stdin")
+	return writerFunc(func(b []byte) (int, error) {
+		c.bytesIn.Add(int64(len(b)))
+		return rec.Write(b)
+	})
+}
+
+// setShell ghi nhận kênh shell đầu tiên của phiên: observer điều khiển thay user trên kênh này
+func (c *connContext) setShell(r *channelRelay) {
+	c.obsMu.Lock()
+	if c.shell == nil {
+		c.shell = r
+	}
+	c.obsMu.Unlock()
+}
+
+// clearShell bỏ ghi nhận kênh shell khi kênh đóng, để observer không điều khiển một kênh đã
+// chết; observer đang điều khiển kênh đó mất quyền điều khiển. Kênh shell mở sau đó của
+// cùng kết nối sẽ được ghi nhận lại qua setShell.
+func (c *connContext) clearShell(r *channelRelay) {
+	c.obsMu.Lock()
+	if c.shell != r {
+		c.obsMu.Unlock()
+		return
+	}
+	c.shell = nil
+	controller := c.controller
+	c.obsMu.Unlock()
+	if controller != nil {
+		c.release(controller)
+	}
+}
+
+// controlledBy trả về observer đang điều khiển thay user (nil = user tự điều khiển)
+func (c *connContext) controlledBy() *observer {
+	c.obsMu.Lock()
+	defer c.obsMu.Unlock()
+	return c.controller
+}
+
+var (
+	errNoShell    = errors.New("phiên không có shell tương tác")
+	errControlled = errors.New("phiên đang được người khác điều khiển")
+	errNotAllowed = errors.New("không có quyền thực hiện thao tác này trên phiên")
+)
+
+// takeOver chuyển quyền gõ phím của phiên cho observer; phím của user bị bỏ qua tới khi trả lại
+func (c *connContext) takeOver(o *observer) error {
+	c.obsMu.Lock()
+	switch {
+	case c.shell == nil:
+		c.obsMu.Unlock()
+		return errNoShell
+	case c.controller != nil && c.controller != o:
+		c.obsMu.Unlock()
+		return errControlled
+	}
+	c.controller = o
+	c.obsMu.Unlock()
+
+	log.Printf("[OBSERVE] '%s' điều khiển phiên %s của '%s'", o.user, c.sessionID, c.proxyUser)
+	c.notify("Phiên đang được '" + o.user + "' điều khiển, bàn phím của bạn tạm thời bị khóa")
+	c.record("event", map[string]interface{}{"event": "takeover", "observer": o.user, "observer_id": o.id})
+	c.audit.Log("session.joined", map[string]interface{}{
+		"session_id": c.sessionID, "user": c.proxyUser, "target": c.target, "observer": o.user, "via": o.via,
+	})
+	return nil
+}
+
+// release trả quyền gõ phím cho user nếu observer đang giữ
+func (c *connContext) release(o *observer) {
+	c.obsMu.Lock()
+	if c.controller != o {
+		c.obsMu.Unlock()
+		return
+	}
+	c.controller = nil
+	c.obsMu.Unlock()
+	c.notify("'" + o.user + "' đã trả lại quyền điều khiển phiên")
+	c.record("event", map[string]interface{}{"event": "release", "observer": o.user, "observer_id": o.id})
+}
+
+// controlInput chuyển phím observer gõ tới shell của phiên (chỉ khi đang điều khiển).
+// Phím đi qua cùng bộ lọc lệnh như phím của user, nhưng được ghi riêng là observer-input
+// kèm người gõ để bản ghi phân biệt được phím của user và của người điều khiển thay.
+func (c *connContext) controlInput(o *observer, b []byte) error {
+	c.obsMu.Lock()
+	shell, ok := c.shell, c.controller == o
+	c.obsMu.Unlock()
+	if !ok {
+		return errNotAllowed
+	}
+	if shell == nil {
+		return errNoShell
+	}
+	c.bytesIn.Add(int64(len(b)))
+	c.record("observer-input", map[string]interface{}{
+		"observer": o.user, "observer_id": o.id, "via": o.via, "data": base64.StdEncoding.EncodeToString(b),
+	})
+	return shell.input(b)
+}
+
+// moderate thực hiện thao tác của observer (join / release / terminate).
+// can kiểm tra quyền theo kênh observer dùng: policy SSH hoặc role quản trị của HTTP API.
+func (c *connContext) moderate(can func(action string) bool, o *observer, action, message string) error {
+	switch action {
+	case "release":
+		c.release(o)
+		return nil
+	case rbac.ModerateJoin:
+		if !can(rbac.ModerateJoin) {
+			return errNotAllowed
+		}
+		return c.takeOver(o)
+	case rbac.ModerateTerminate:
+		if !can(rbac.ModerateTerminate) {
+			return errNotAllowed
+		}
+		c.terminateBy(o.user, message)
+		return nil
+	}
+	return errors.New("thao tác không hợp lệ: " + action)
+}
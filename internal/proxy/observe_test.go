@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+	"github.com/Entidi89/ssh_proxy1/internal/rbac"
+	"github.com/Entidi89/ssh_proxy1/internal/recorder"
+	"golang.org/x/crypto/ssh"
+)
+
+// readEvents đọc các sự kiện loại typ trong bản ghi phiên
+func readEvents(t *testing.T, path, typ string) []interface{} {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev recorder.Event
+		if json.Unmarshal(scanner.Bytes(), &ev) == nil && ev.Type == typ {
+			events = append(events, ev.V)
+		}
+	}
+	return events
+}
+
+func TestObserverInputRecorded(t *testing.T) {
+	rec, err := recorder.NewSessionWriter(t.TempDir(), "s1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := &connContext{sessionID: "s1", proxyUser: "bob", target: "host", rec: rec}
+	upstream := newFakeChannel("")
+	shell := &channelRelay{conn: cc, upstream: &PamSessionWrapper{Channel: upstream}}
+	cc.setShell(shell)
+
+	o := newObserver("carol", "ssh")
+	cc.attach(o)
+	if err := cc.controlInput(o, []byte("id\r")); err != errNotAllowed {
+		t.Fatalf("phím trước khi điều khiển: err = %v", err)
+	}
+	if err := cc.takeOver(o); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.controlInput(o, []byte("id\r")); err != nil {
+		t.Fatal(err)
+	}
+	if got := upstream.written(); got != "id\r" {
+		t.Errorf("máy đích nhận %q", got)
+	}
+	rec.Close()
+
+	// Phím của observer không được ghi như stdin của user
+	if stdin := readEvents(t, rec.Path(), "stdin"); len(stdin) != 0 {
+		t.Errorf("phím của observer ghi thành stdin: %v", stdin)
+	}
+	events := readEvents(t, rec.Path(), "observer-input")
+	if len(events) != 1 {
+		t.Fatalf("observer-input %v", events)
+	}
+	ev := events[0].(map[string]interface{})
+	if ev["observer"] != "carol" || ev["observer_id"] != o.id || ev["data"] != base64.StdEncoding.EncodeToString([]byte("id\r")) {
+		t.Errorf("observer-input %v", ev)
+	}
+}
+
+func TestShellClearedOnClose(t *testing.T) {
+	cc := &connContext{sessionID: "s1", proxyUser: "bob", target: "host"}
+	first := &channelRelay{conn: cc, upstream: &PamSessionWrapper{Channel: newFakeChannel("")}}
+	other := &channelRelay{conn: cc, upstream: &PamSessionWrapper{Channel: newFakeChannel("")}}
+	cc.setShell(first)
+	o := newObserver("carol", "ssh")
+	cc.attach(o)
+	if err := cc.takeOver(o); err != nil {
+		t.Fatal(err)
+	}
+
+	// Kênh khác đóng: shell và quyền điều khiển giữ nguyên
+	cc.clearShell(other)
+	if cc.controlledBy() != o {
+		t.Fatal("mất quyền điều khiển khi một kênh khác đóng")
+	}
+
+	// Kênh shell đóng: observer mất quyền điều khiển và không join lại được kênh đã chết
+	cc.clearShell(first)
+	if cc.controlledBy() != nil {
+		t.Fatal("observer vẫn điều khiển kênh shell đã đóng")
+	}
+	if err := cc.takeOver(o); err != errNoShell {
+		t.Fatalf("takeOver sau khi shell đóng: err = %v", err)
+	}
+
+	// Kênh shell mới của cùng kết nối được ghi nhận lại
+	cc.setShell(other)
+	if err := cc.takeOver(o); err != nil {
+		t.Fatalf("takeOver với shell mới: %v", err)
+	}
+}
+
+func TestJoinTerminateOnly(t *testing.T) {
+	pf, err := rbac.ParsePolicyFile([]byte(`{"users": [
+		{"user": "bob", "role": "ops", "targets": ["10.0.0.1"]},
+		{"user": "tom", "role": "ops", "targets": ["10.0.0.2"], "moderate": {"actions": ["terminate"]}},
+		{"user": "eve", "role": "ops", "targets": ["10.0.0.2"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := rbac.New(pf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &SSHServer{RBAC: policy, Sessions: NewSessionRegistry()}
+	closed := make(chan struct{})
+	cc := &connContext{
+		sessionID: "s1", proxyUser: "bob", role: "ops", target: "10.0.0.1:22",
+		dest:      inventory.Target{IP: netip.MustParseAddr("10.0.0.1"), Port: 22},
+		closeConn: func() error { close(closed); return nil },
+	}
+	s.Sessions.add(cc)
+
+	join := func(user string) (ssh.Channel, *bufio.Reader) {
+		t.Helper()
+		conn, chans, client := sshPipe(t)
+		go s.serveJoin(conn, chans, user, "s1")
+		ch, reqs, err := client.OpenChannel("session", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go ssh.DiscardRequests(reqs)
+		if _, err := ch.SendRequest("shell", true, nil); err != nil {
+			t.Fatal(err)
+		}
+		return ch, bufio.NewReader(io.MultiReader(ch, ch.Stderr()))
+	}
+
+	// Không có quyền giám sát nào: bị từ chối
+	_, out := join("eve")
+	if msg, _ := io.ReadAll(out); !strings.Contains(string(msg), "không có quyền") {
+		t.Fatalf("eve: %q", msg)
+	}
+
+	// Chỉ có quyền terminate: vào được, không thấy output nhưng ngắt được phiên
+	ch, out := join("tom")
+	help, err := out.ReadString('\n')
+	if err != nil || !strings.Contains(help, "chỉ có quyền ngắt phiên") {
+		t.Fatalf("tom: %q, %v", help, err)
+	}
+	out.ReadString('\n')
+	cc.broadcast([]byte("secret output"))
+	if _, err := ch.Write([]byte{escapeKey, 't'}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("phiên không bị ngắt")
+	}
+	cc.closeObservers("phiên kết thúc")
+	if rest, _ := io.ReadAll(out); strings.Contains(string(rest), "secret") {
+		t.Errorf("người chỉ có quyền terminate thấy output: %q", rest)
+	}
+}
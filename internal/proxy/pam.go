@@ -5,46 +5,79 @@ import (
 	"crypto/rsa"
 	"fmt"
 	"io"
+	"net"
 	"strings"
 	"time"
 
+	"github.com/Entidi89/ssh_proxy1/internal/hostkeys"
 	"golang.org/x/crypto/ssh"
-	"github.com/Entidi89/ssh_proxy1/internal/vault"
 )
 
+// UpstreamConn: kết nối SSH tới máy đích (đăng nhập bằng certificate Vault),
+// dùng chung cho mọi kênh của một kết nối client
+type UpstreamConn struct {
+	Client *ssh.Client
+	// Serial của certificate Vault đã cấp cho kết nối này (ghi vào meta của bản ghi)
+	CertSerial uint64
+}
+
+func (u *UpstreamConn) Close() error { return u.Client.Close() }
+
+// OpenSession mở một kênh "session" thô tới máy đích. Các request (pty-req, exec,
+// shell, subsystem...) do client gửi sẽ được chuyển tiếp nguyên vẹn qua kênh này.
+func (u *UpstreamConn) OpenSession() (*PamSessionWrapper, error) {
+	ch, reqs, err := u.Client.OpenChannel("session", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &PamSessionWrapper{Channel: ch, Requests: reqs}, nil
+}
+
+// PamSessionWrapper: một kênh session phía máy đích
 type PamSessionWrapper struct {
-	Stdin   io.WriteCloser
-	Stdout  io.Reader
-	Client  *ssh.Client
-	Session *ssh.Session
+	Channel ssh.Channel
+	// Request máy đích gửi về (exit-status, exit-signal, ...)
+	Requests <-chan *ssh.Request
 }
 
-func (p *PamSessionWrapper) Read(b []byte) (int, error)  { return p.Stdout.Read(b) }
-func (p *PamSessionWrapper) Write(b []byte) (int, error) { return p.Stdin.Write(b) }
-func (p *PamSessionWrapper) Close() error {
-	p.Session.Close()
-	p.Client.Close()
-	return nil
+func (p *PamSessionWrapper) Read(b []byte) (int, error)  { return p.Channel.Read(b) }
+func (p *PamSessionWrapper) Write(b []byte) (int, error) { return p.Channel.Write(b) }
+func (p *PamSessionWrapper) Stderr() io.ReadWriter       { return p.Channel.Stderr() }
+func (p *PamSessionWrapper) CloseWrite() error           { return p.Channel.CloseWrite() }
+func (p *PamSessionWrapper) Close() error                { return p.Channel.Close() }
+
+// SSHKeySigner: nơi ký public key thành SSH certificate (VaultClient)
+type SSHKeySigner interface {
+	SignSSHKey(pubKey []byte, role, validPrincipal string) (string, error)
 }
 
-// ConnectUsingVault: Kết nối SSH sử dụng Certificate từ Vault
-func ConnectUsingVault(v *vault.VaultClient, targetAddr, targetUser, roleName string) (io.ReadWriteCloser, error) {
+// Dialer mở kết nối tới máy đích: TCP trực tiếp hoặc stream qua agent (xem agents.go)
+type Dialer func(addr string) (net.Conn, error)
+
+// Thời gian tối đa cho kết nối + bắt tay SSH với máy đích
+const upstreamTimeout = 5 * time.Second
+
+// ConnectUsingVault: Kết nối SSH sử dụng Certificate từ Vault.
+// dial = nil -> kết nối TCP trực tiếp tới targetAddr.
+func ConnectUsingVault(v SSHKeySigner, hostKeys *hostkeys.Verifier, dial Dialer, targetAddr, targetUser, roleName string, auditFields map[string]interface{}) (*UpstreamConn, error) {
 	// 1. Sinh khóa RSA dùng 1 lần (Ephemeral Key)
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return nil, fmt.Errorf("sinh key lỗi: %v", err)
 	}
-	
+
 	// Chuyển đổi RSA Key sang SSH Signer
-	signerFromKey, err := ssh.NewSignerFromKey(privateKey) 
+	signerFromKey, err := ssh.NewSignerFromKey(privateKey)
 	if err != nil {
 		return nil, err
 	}
 
 	// Tạo Public Key để gửi đi
 	pubKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
-	if err != nil { return nil, err }
-	
+	if err != nil {
+		return nil, err
+	}
+
 	// 2. Gửi sang Vault để xin chữ ký
 	// Truyền roleName vào thay vì hardcode
 	signedCert, err := v.SignSSHKey(ssh.MarshalAuthorizedKey(pubKey), roleName, targetUser)
@@ -54,48 +87,48 @@ func ConnectUsingVault(v *vault.VaultClient, targetAddr, targetUser, roleName st
 
 	// 3. Tạo Signer từ Certificate (Giấy phép đã ký)
 	certKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signedCert))
-	if err != nil { return nil, err }
+	if err != nil {
+		return nil, err
+	}
 	cert := certKey.(*ssh.Certificate)
 
 	certSigner, err := ssh.NewCertSigner(cert, signerFromKey)
-	if err != nil { return nil, err }
+	if err != nil {
+		return nil, err
+	}
 
 	// 4. Kết nối tới Server đích
 	// Đảm bảo địa chỉ có port
-	if !strings.Contains(targetAddr, ":") { targetAddr += ":22" }
-	
-	clientConfig := &ssh.ClientConfig{
-		User: targetUser,
-		Auth: []ssh.AuthMethod{ ssh.PublicKeys(certSigner) }, // Dùng Cert để login
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),         // Bỏ qua check host key
-		Timeout: 5 * time.Second,
+	if !strings.Contains(targetAddr, ":") {
+		targetAddr += ":22"
 	}
 
-	client, err := ssh.Dial("tcp", targetAddr, clientConfig)
-	if err != nil { return nil, err }
-
-	session, err := client.NewSession()
-	if err != nil { client.Close(); return nil, err }
-
-	// [ĐÃ SỬA] Request Terminal (PTY)
-	// Bỏ các modes phức tạp đi, chỉ gửi map rỗng để tránh lỗi "pty-req failed"
-	modes := ssh.TerminalModes{} 
-	
-	// Dùng "xterm" hoặc "xterm-256color"
-	if err := session.RequestPty("xterm", 80, 40, modes); err != nil {
-		session.Close()
-		client.Close()
-		// In lỗi rõ hơn để debug
-		return nil, fmt.Errorf("lỗi xin cấp PTY (RequestPty): %v", err)
+	clientConfig := &ssh.ClientConfig{
+		User:              targetUser,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(certSigner)}, // Dùng Cert để login
+		HostKeyCallback:   hostKeys.Callback(auditFields),               // known_hosts / TOFU / host CA
+		HostKeyAlgorithms: hostKeys.HostKeyAlgorithms(targetAddr),
+		Timeout:           upstreamTimeout,
 	}
 
-	stdin, _ := session.StdinPipe()
-	stdout, _ := session.StdoutPipe()
-	
-	// Bắt đầu Shell
-	if err := session.Shell(); err != nil {
-		session.Close(); client.Close(); return nil, err
+	if dial == nil {
+		dial = func(addr string) (net.Conn, error) { return net.DialTimeout("tcp", addr, upstreamTimeout) }
+	}
+	conn, err := dial(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	// Stream qua agent không có deadline: đóng kết nối nếu bắt tay quá lâu
+	timer := time.AfterFunc(upstreamTimeout, func() { conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, targetAddr, clientConfig)
+	if !timer.Stop() && err == nil {
+		c.Close()
+		err = fmt.Errorf("bắt tay SSH với %s quá thời gian %s", targetAddr, upstreamTimeout)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
 
-	return &PamSessionWrapper{Stdin: stdin, Stdout: stdout, Client: client, Session: session}, nil
+	return &UpstreamConn{Client: ssh.NewClient(c, chans, reqs), CertSerial: cert.Serial}, nil
 }
@@ -1,62 +1,142 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
 
+	"github.com/Entidi89/ssh_proxy1/internal/access"
+	"github.com/Entidi89/ssh_proxy1/internal/audit"
+	"github.com/Entidi89/ssh_proxy1/internal/enroll"
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
 	"github.com/Entidi89/ssh_proxy1/internal/ws"
 	"github.com/Entidi89/ssh_proxy1/internal/rbac"
+	"github.com/Entidi89/ssh_proxy1/internal/vault"
 )
 
 type ProxyServer struct {
 	AgentMgr *ws.Manager
 	RBAC     *rbac.RBAC
 	Upgrader websocket.Upgrader
+	// Ký host certificate cho máy đích (/admin/hosts/*)
+	Vault *vault.VaultClient
+	// Duyệt yêu cầu cấp quyền tạm thời (/admin/access/*)
+	Access *access.Store
+	// Nạp lại policy, inventory và nhóm cho /admin/rbac/reload. Dùng chung reloader với
+	// SIGHUP nên ghi cùng sự kiện audit; reason cho biết ai / cái gì yêu cầu nạp lại.
+	ReloadPolicy func(reason string) error
+	// Các phiên SSH đang hoạt động (/admin/sessions/*)
+	Sessions *SessionRegistry
+	// Xác thực và phân quyền cho /admin/* (bearer token hoặc client certificate)
+	Auth  *AdminAuth
+	Audit *audit.Logger
+	// Origin (vd "https://ops.example.com") ngoài chính địa chỉ API được phép mở WebSocket
+	// từ trình duyệt. Request không có header Origin (không phải trình duyệt) luôn được nhận.
+	AllowedOrigins []string
+	// Bật HTTPS; đặt ClientCAs + ClientAuth để nhận client certificate (mTLS)
+	TLSConfig *tls.Config
+	// Join token và certificate của agent (/agent/*, /admin/agents/*)
+	Enroll *enroll.Store
 }
 
 func NewProxyServer(agentMgr *ws.Manager, r *rbac.RBAC) *ProxyServer {
-	return &ProxyServer{
+	s := &ProxyServer{
 		AgentMgr: agentMgr,
 		RBAC:     r,
-		Upgrader: websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }},
 	}
+	s.Upgrader = websocket.Upgrader{CheckOrigin: s.checkOrigin}
+	return s
+}
+
+// checkOrigin chặn trang web lạ mở WebSocket bằng quyền của trình duyệt người quản trị:
+// Origin phải trùng địa chỉ API hoặc nằm trong AllowedOrigins
+func (s *ProxyServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range s.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	log.Printf("[BLOCK] Từ chối WebSocket %s từ origin %s", r.URL.Path, origin)
+	return false
 }
 
 func (s *ProxyServer) RunHTTP(addr string) {
-	http.HandleFunc("/ws", s.handleAgentWS)
-	http.HandleFunc("/admin/rbac/reload", s.handleRBACReload)
-	http.HandleFunc("/admin/rbac/list", s.handleRBACList)
-	http.Handle("/web/playback/", http.StripPrefix("/web/playback/", http.FileServer(http.Dir("web/playback"))))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/rbac/reload", s.admin(PermRBACReload, s.handleRBACReload))
+	mux.HandleFunc("/admin/rbac/list", s.admin(PermRBACRead, s.handleRBACList))
+	mux.HandleFunc("/admin/hosts/sign", s.admin(PermHostsSign, s.handleHostSign))
+	mux.HandleFunc("/admin/hosts/ca", s.admin(PermHostsRead, s.handleHostCA))
+	mux.HandleFunc("/admin/access/requests", s.admin(PermAccessRead, s.handleAccessList))
+	mux.HandleFunc("/admin/access/approve", s.admin(PermAccessDecide, s.handleAccessDecision))
+	mux.HandleFunc("/admin/access/deny", s.admin(PermAccessDecide, s.handleAccessDecision))
+	mux.HandleFunc("/admin/sessions", s.admin(PermSessionsRead, s.handleSessionList))
+	mux.HandleFunc("/admin/sessions/terminate", s.admin(PermSessionsTerminate, s.handleSessionTerminate))
+	mux.HandleFunc(watchPath, s.admin(PermSessionsWatch, s.handleSessionWatch))
+	mux.HandleFunc("/admin/sessions/watch-ticket", s.admin(PermSessionsWatch, s.handleWatchTicket))
+	mux.HandleFunc("/admin/agents", s.admin(PermAgentsRead, s.handleAgentList))
+	mux.HandleFunc("/admin/agents/disconnect", s.admin(PermAgentsDisconnect, s.handleAgentDisconnect))
+	mux.HandleFunc("/admin/agents/tokens", s.admin(PermAgentsEnroll, s.handleAgentToken))
+	mux.HandleFunc("/admin/agents/rotate", s.admin(PermAgentsRotate, s.handleAgentRotate))
+	mux.HandleFunc("/admin/agents/revoke", s.admin(PermAgentsRevoke, s.handleAgentRevoke))
+	// Route /admin/* không khai báo ở trên cũng phải xác thực trước khi trả 404
+	mux.HandleFunc("/admin/", s.admin("*", http.NotFound))
+	mux.Handle("/web/playback/", http.StripPrefix("/web/playback/", http.FileServer(http.Dir("web/playback"))))
+
+	srv := &http.Server{Addr: addr, Handler: mux, TLSConfig: s.TLSConfig}
+	if s.TLSConfig != nil {
+		log.Printf("proxy https listening on %s", addr)
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+	}
 	log.Printf("proxy http listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	log.Fatal(srv.ListenAndServe())
 }
 
-func (s *ProxyServer) handleAgentWS(w http.ResponseWriter, r *http.Request) {
-	agentID := r.URL.Query().Get("agent_id")
-	if agentID == "" {
-		http.Error(w, "missing agent_id", http.StatusBadRequest)
+func (s *ProxyServer) handleRBACReload(w http.ResponseWriter, r *http.Request) {
+	if s.RBAC == nil {
+		http.Error(w, "rbac not configured", http.StatusServiceUnavailable)
 		return
 	}
-	wsConn, err := s.Upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		http.Error(w, "upgrade failed", http.StatusInternalServerError)
+	// Chỉ nạp lại file chính sách đã cấu hình khi khởi động, không đọc đường dẫn tùy ý
+	path := s.RBAC.Path()
+	if q := r.URL.Query().Get("path"); q != "" && q != path {
+		http.Error(w, "reload is restricted to the configured policy file", http.StatusBadRequest)
 		return
 	}
-	s.AgentMgr.RegisterAgent(agentID, wsConn)
-	log.Printf("agent registered: %s", agentID)
-}
-
-func (s *ProxyServer) handleRBACReload(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Query().Get("path")
 	if path == "" {
-		http.Error(w, "missing path", http.StatusBadRequest)
+		http.Error(w, "policy file not configured", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.ReloadPolicy == nil {
+		http.Error(w, "reload not configured", http.StatusServiceUnavailable)
 		return
 	}
-	if err := s.RBAC.Reload(path); err != nil {
+	reason := "HTTP API"
+	if p := principalFrom(r); p != nil {
+		reason += " bởi '" + p.User + "'"
+	}
+	if err := s.ReloadPolicy(reason); err != nil {
 		http.Error(w, fmt.Sprintf("reload failed: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -64,9 +144,175 @@ func (s *ProxyServer) handleRBACReload(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *ProxyServer) handleRBACList(w http.ResponseWriter, r *http.Request) {
+	if s.RBAC == nil {
+		http.Error(w, "rbac not configured", http.StatusServiceUnavailable)
+		return
+	}
     policies := s.RBAC.ListPolicies()
     b, _ := json.Marshal(policies)
     w.Header().Set("Content-Type", "application/json")
     w.Write(b)
 }
 
+
+// handleHostSign ký host public key của máy đích.
+// POST {"public_key":"ssh-ed25519 AAAA...","principals":["10.0.0.5","web1"],"ttl":"720h"}
+// Principal phải là tên hoặc địa chỉ của một máy đích trong inventory.
+func (s *ProxyServer) handleHostSign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Vault == nil {
+		http.Error(w, "vault not configured", http.StatusServiceUnavailable)
+		return
+	}
+	var req struct {
+		PublicKey  string   `json:"public_key"`
+		Principals []string `json:"principals"`
+		TTL        string   `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey)); err != nil || len(req.Principals) == 0 {
+		http.Error(w, "public_key and principals are required", http.StatusBadRequest)
+		return
+	}
+	var inv *inventory.Inventory
+	if s.RBAC != nil {
+		inv = s.RBAC.Inventory()
+	}
+	for _, p := range req.Principals {
+		if !inv.IsHostPrincipal(p) {
+			http.Error(w, fmt.Sprintf("principal %q is not an inventory host", p), http.StatusForbidden)
+			return
+		}
+	}
+	signed, err := s.Vault.SignHostKey([]byte(req.PublicKey), req.Principals, req.TTL)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("sign failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	log.Printf("[ADMIN] Đã ký host key cho %v", req.Principals)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"signed_key": signed})
+}
+
+// handleHostCA trả về dòng @cert-authority để client thêm vào known_hosts
+func (s *ProxyServer) handleHostCA(w http.ResponseWriter, r *http.Request) {
+	if s.Vault == nil {
+		http.Error(w, "vault not configured", http.StatusServiceUnavailable)
+		return
+	}
+	ca, err := s.Vault.GetHostCAPublicKey()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("host ca unavailable: %v", err), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "@cert-authority * %s\n", strings.TrimSpace(ca))
+}
+
+// handleAccessList liệt kê yêu cầu cấp quyền tạm thời. GET ?status=pending&user=alice
+func (s *ProxyServer) handleAccessList(w http.ResponseWriter, r *http.Request) {
+	if s.Access == nil {
+		http.Error(w, "access requests not configured", http.StatusServiceUnavailable)
+		return
+	}
+	q := r.URL.Query()
+	list := s.Access.List(q.Get("user"), access.Status(q.Get("status")))
+	if list == nil {
+		list = []access.Request{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleAccessDecision duyệt hoặc từ chối một yêu cầu.
+// POST /admin/access/approve|deny {"id":"req-...","note":"INC-123"}
+func (s *ProxyServer) handleAccessDecision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Access == nil {
+		http.Error(w, "access requests not configured", http.StatusServiceUnavailable)
+		return
+	}
+	var req struct {
+		ID   string `json:"id"`
+		Note string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	auditField(w, "request_id", req.ID)
+	decide := s.Access.Approve
+	if strings.HasSuffix(r.URL.Path, "/deny") {
+		decide = s.Access.Deny
+	}
+	// Người duyệt là người gọi đã xác thực, không lấy từ nội dung request
+	approver := principalFrom(r).User
+	result, err := decide(req.ID, approver, req.Note)
+	if err != nil {
+		http.Error(w, err.Error(), accessStatusCode(err))
+		return
+	}
+	log.Printf("[ADMIN] '%s' đã %s yêu cầu %s của '%s' (%s trên %s)", approver, result.Status, result.ID, result.User, result.Role, result.Target)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func accessStatusCode(err error) int {
+	switch err {
+	case access.ErrNotFound:
+		return http.StatusNotFound
+	case access.ErrNotPending, access.ErrSelfApproval:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// handleSessionList liệt kê các phiên đang hoạt động. GET /admin/sessions
+func (s *ProxyServer) handleSessionList(w http.ResponseWriter, r *http.Request) {
+	if s.Sessions == nil {
+		http.Error(w, "sessions not configured", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Sessions.List())
+}
+
+// handleSessionTerminate ngắt một phiên, message được hiển thị cho user của phiên.
+// POST /admin/sessions/terminate {"id":"<session-id>","message":"bảo trì khẩn cấp"}
+func (s *ProxyServer) handleSessionTerminate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Sessions == nil {
+		http.Error(w, "sessions not configured", http.StatusServiceUnavailable)
+		return
+	}
+	var req struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	cc, ok := s.Sessions.get(req.ID)
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	auditField(w, "session_id", cc.sessionID)
+	info := cc.info()
+	cc.terminateBy(principalFrom(r).User, req.Message)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+	"github.com/Entidi89/ssh_proxy1/internal/rbac"
+	"github.com/Entidi89/ssh_proxy1/internal/vault"
+	"golang.org/x/crypto/ssh"
+)
+
+// testAdminAuth dựng AdminAuth với một token cho mỗi user, kèm quyền tương ứng
+func testAdminAuth(t *testing.T, tokens map[string][]string) *AdminAuth {
+	t.Helper()
+	f := AdminAuthFile{Roles: map[string][]string{}}
+	for user, perms := range tokens {
+		sum := sha256.Sum256([]byte(user + "-token"))
+		f.Roles[user] = perms
+		f.Tokens = append(f.Tokens, AdminToken{User: user, SHA256: hex.EncodeToString(sum[:]), Roles: []string{user}})
+	}
+	path := filepath.Join(t.TempDir(), "admin_auth.json")
+	b, _ := json.Marshal(f)
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := LoadAdminAuth(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestRBACReloadUsesReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policies.json")
+	if err := os.WriteFile(path, []byte(`{"users": []}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := rbac.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewProxyServer(nil, policy)
+	s.Auth = testAdminAuth(t, map[string][]string{"carol": {PermRBACReload}})
+	var reasons []string
+	fail := false
+	s.ReloadPolicy = func(reason string) error {
+		reasons = append(reasons, reason)
+		if fail {
+			return errors.New("inventory.json: lỗi cú pháp")
+		}
+		return nil
+	}
+	handler := s.admin(PermRBACReload, s.handleRBACReload)
+	reload := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/rbac/reload", nil)
+		req.Header.Set("Authorization", "Bearer carol-token")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	if w := reload(); w.Code != http.StatusOK {
+		t.Fatalf("reload: %d %s", w.Code, w.Body)
+	}
+	if len(reasons) != 1 || reasons[0] != "HTTP API bởi 'carol'" {
+		t.Fatalf("reloader được gọi với %q", reasons)
+	}
+	// Lỗi ở inventory / nhóm cũng làm reload thất bại, không chỉ lỗi policy
+	fail = true
+	if w := reload(); w.Code != http.StatusInternalServerError {
+		t.Fatalf("reload lỗi: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestAdminAuthRejectsQueryToken(t *testing.T) {
+	a := testAdminAuth(t, map[string][]string{"carol": {"*"}})
+	for _, path := range []string{"/admin/sessions?token=carol-token", "/admin/sessions/watch?id=s1&token=carol-token"} {
+		if _, ok := a.authenticate(httptest.NewRequest(http.MethodGet, path, nil)); ok {
+			t.Errorf("%s: token trong query string vẫn được chấp nhận", path)
+		}
+	}
+}
+
+func TestWatchTicket(t *testing.T) {
+	s := NewProxyServer(nil, nil)
+	s.Auth = testAdminAuth(t, map[string][]string{"carol": {PermSessionsWatch}})
+	s.Sessions = NewSessionRegistry()
+	s.Sessions.add(&connContext{sessionID: "s1"})
+	s.Sessions.add(&connContext{sessionID: "s2"})
+
+	issue := func() string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/admin/sessions/watch-ticket?id=s1", nil)
+		req.Header.Set("Authorization", "Bearer carol-token")
+		w := httptest.NewRecorder()
+		s.admin(PermSessionsWatch, s.handleWatchTicket)(w, req)
+		var resp struct{ Ticket string }
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &resp) != nil || resp.Ticket == "" {
+			t.Fatalf("cấp vé: %d %s", w.Code, w.Body)
+		}
+		return resp.Ticket
+	}
+	use := func(path string) (*adminPrincipal, bool) {
+		return s.Auth.authenticate(httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	ticket := issue()
+	p, ok := use(watchPath + "?id=s1&ticket=" + ticket)
+	if !ok || p.User != "carol" || p.Method != "ticket" || !p.can(PermSessionsWatch) {
+		t.Fatalf("vé hợp lệ bị từ chối: %+v %v", p, ok)
+	}
+	if _, ok := use(watchPath + "?id=s1&ticket=" + ticket); ok {
+		t.Fatal("vé dùng được hai lần")
+	}
+
+	// Vé chỉ dùng được cho đúng phiên và đúng đường dẫn; dùng sai cũng làm vé mất hiệu lực
+	ticket = issue()
+	if _, ok := use(watchPath + "?id=s2&ticket=" + ticket); ok {
+		t.Fatal("vé của s1 mở được s2")
+	}
+	if _, ok := use(watchPath + "?id=s1&ticket=" + ticket); ok {
+		t.Fatal("vé dùng sai phiên vẫn còn hiệu lực")
+	}
+	ticket = issue()
+	if _, ok := use("/admin/sessions/terminate?id=s1&ticket=" + ticket); ok {
+		t.Fatal("vé được nhận ngoài /admin/sessions/watch")
+	}
+
+	// Vé hết hạn
+	ticket = issue()
+	s.Auth.mu.Lock()
+	vt := s.Auth.tickets[ticket]
+	vt.expires = time.Now().Add(-time.Second)
+	s.Auth.tickets[ticket] = vt
+	s.Auth.mu.Unlock()
+	if _, ok := use(watchPath + "?id=s1&ticket=" + ticket); ok {
+		t.Fatal("vé hết hạn vẫn được nhận")
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	s := NewProxyServer(nil, nil)
+	s.AllowedOrigins = []string{"https://ops.example.com/"}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true}, // không phải trình duyệt (agent, công cụ dòng lệnh)
+		{"https://proxy.internal:8443", true},
+		{"https://ops.example.com", true},
+		{"https://evil.example.com", false},
+		{"https://ops.example.com.evil.net", false},
+		{"http://proxy.internal:9999", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "https://proxy.internal:8443"+watchPath, nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if got := s.Upgrader.CheckOrigin(req); got != tt.want {
+			t.Errorf("Origin %q: %v; muốn %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestHostSignInventoryPrincipals(t *testing.T) {
+	// Vault giả: chỉ trả lời lookup-self và lệnh ký host key
+	var signed []string
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			w.Write([]byte(`{"data": {}}`))
+		case "/v1/ssh-host-signer/sign/host-role":
+			var body struct {
+				ValidPrincipals string `json:"valid_principals"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			signed = append(signed, body.ValidPrincipals)
+			w.Write([]byte(`{"data": {"signed_key": "ssh-ed25519-cert-v01@openssh.com AAAA"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer fake.Close()
+	vc, err := vault.NewVaultClient(fake.URL, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := rbac.New(&rbac.PolicyFile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err := inventory.New([]inventory.Host{{Name: "web1", Address: "10.0.0.5"}, {Name: "db1", Address: "db1.corp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.SetInventory(inv)
+	s := NewProxyServer(nil, policy)
+	s.Vault = vc
+
+	key, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		principals []string
+		want       int
+	}{
+		{[]string{"web1", "10.0.0.5"}, http.StatusOK},
+		{[]string{"db1.corp"}, http.StatusOK},
+		{[]string{"web1", "web.attacker.com"}, http.StatusForbidden},
+		{[]string{"*"}, http.StatusForbidden},
+		{[]string{"web1.corp"}, http.StatusForbidden},
+		{[]string{"WEB1"}, http.StatusForbidden},
+		{[]string{"10.0.0.6"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		body, _ := json.Marshal(map[string]interface{}{
+			"public_key": string(ssh.MarshalAuthorizedKey(key)), "principals": tt.principals,
+		})
+		w := httptest.NewRecorder()
+		s.handleHostSign(w, httptest.NewRequest(http.MethodPost, "/admin/hosts/sign", bytes.NewReader(body)))
+		if w.Code != tt.want {
+			t.Errorf("principals %q: %d %s, want %d", tt.principals, w.Code, w.Body, tt.want)
+		}
+	}
+	// Vault chỉ được gọi cho các yêu cầu hợp lệ
+	if len(signed) != 2 || signed[0] != "web1,10.0.0.5" || signed[1] != "db1.corp" {
+		t.Errorf("Vault ký cho %q", signed)
+	}
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+)
+
+// SessionRegistry: các phiên SSH đang hoạt động theo session ID,
+// dùng chung giữa listener SSH và HTTP API quản trị
+type SessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*connContext
+}
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{sessions: make(map[string]*connContext)}
+}
+
+func (g *SessionRegistry) add(cc *connContext) {
+	g.mu.Lock()
+	g.sessions[cc.sessionID] = cc
+	g.mu.Unlock()
+}
+
+func (g *SessionRegistry) remove(id string) {
+	g.mu.Lock()
+	delete(g.sessions, id)
+	g.mu.Unlock()
+}
+
+func (g *SessionRegistry) get(id string) (*connContext, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	cc, ok := g.sessions[id]
+	return cc, ok
+}
+
+func (g *SessionRegistry) list() []*connContext {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make([]*connContext, 0, len(g.sessions))
+	for _, cc := range g.sessions {
+		out = append(out, cc)
+	}
+	return out
+}
+
+// SessionInfo: thông tin một phiên đang hoạt động (GET /admin/sessions)
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	Target     string    `json:"target"`
+	TargetName string    `json:"target_name,omitempty"`
+	Role       string    `json:"role"`
+	OSUser     string    `json:"os_user"`
+	Client     string    `json:"client"`
+	Start      time.Time `json:"start"`
+	// Số byte client gửi tới máy đích / máy đích trả về client
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// Người đang xem phiên và người đang điều khiển thay user
+	Observers    []string   `json:"observers,omitempty"`
+	ControlledBy string     `json:"controlled_by,omitempty"`
+	Deadline     *time.Time `json:"deadline,omitempty"`
+}
+
+// List trả về các phiên đang hoạt động, phiên bắt đầu trước đứng trước
+func (g *SessionRegistry) List() []SessionInfo {
+	list := g.list()
+	out := make([]SessionInfo, 0, len(list))
+	for _, cc := range list {
+		out = append(out, cc.info())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	return out
+}
+
+func (c *connContext) info() SessionInfo {
+	in := SessionInfo{
+		ID: c.sessionID, User: c.proxyUser, Target: c.target, TargetName: c.dest.Name,
+		Role: c.role, OSUser: c.osUser, Client: c.client, Start: c.start,
+		BytesIn: c.bytesIn.Load(), BytesOut: c.bytesOut.Load(), Deadline: c.currentDeadline(),
+	}
+	c.obsMu.Lock()
+	for _, o := range c.observers {
+		in.Observers = append(in.Observers, o.user+" ("+o.via+")")
+	}
+	if c.controller != nil {
+		in.ControlledBy = c.controller.user
+	}
+	c.obsMu.Unlock()
+	sort.Strings(in.Observers)
+	return in
+}
+
+// terminateBy ngắt phiên theo lệnh của người quản trị, message được hiển thị cho user
+func (c *connContext) terminateBy(by, message string) {
+	reason := "bị ngắt bởi '" + by + "'"
+	if message != "" {
+		reason += ": " + message
+	}
+	c.terminate(reason, by)
+}
+
+// countBytes trả về writer chỉ đếm số byte đi qua
+func countBytes(n *atomic.Int64) io.Writer {
+	return writerFunc(func(b []byte) (int, error) {
+		n.Add(int64(len(b)))
+		return len(b), nil
+	})
+}
+
+// ReevaluateSessions đánh giá lại policy cho mọi phiên đang mở (sau khi reload),
+// ngắt các phiên không còn quyền hoặc bị đổi sang role khác và áp dụng hạn phiên mới
+// (khung giờ, not_after, max_session tính từ lúc phiên bắt đầu) cho các phiên còn lại.
+// Trả về số phiên bị ngắt.
+func (s *SSHServer) ReevaluateSessions() int {
+	terminated := 0
+	now := time.Now()
+	for _, cc := range s.Sessions.list() {
+		dest, err := s.currentDest(cc)
+		if err != nil {
+			cc.terminate("máy đích không còn hợp lệ ("+err.Error()+")", "")
+			terminated++
+			continue
+		}
+		d := s.RBAC.CheckSession(cc.proxyUser, dest, cc.start, now)
+		switch {
+		case !d.Allowed:
+			cc.terminate("quyền truy cập đã bị thu hồi ("+d.Reason+")", "")
+		case d.Role != cc.role:
+			cc.terminate("role của phiên đã thay đổi từ '"+cc.role+"' sang '"+d.Role+"'", "")
+		default:
+			if cc.setDeadline(d.Deadline) {
+				cc.deadlineChanged(d.Deadline)
+			}
+			continue
+		}
+		terminated++
+	}
+	if terminated > 0 {
+		log.Printf("[RBAC] Đã ngắt %d phiên không còn quyền sau khi nạp lại policy", terminated)
+	}
+	return terminated
+}
+
+// currentDest chuẩn hóa lại máy đích của phiên theo inventory hiện tại: tên, nhãn và agent
+// có thể đã đổi sau khi nạp lại inventory, còn IP:port phiên đang kết nối thì giữ nguyên
+func (s *SSHServer) currentDest(cc *connContext) (inventory.Target, error) {
+	dest, err := s.RBAC.Normalize(cc.target)
+	if err != nil || dest.Name != "" || cc.dest.Name == "" {
+		return dest, err
+	}
+	// Phiên mở bằng tên inventory kèm port khác port khai báo (vd web1:2222): tra lại theo tên
+	for _, h := range s.RBAC.Inventory().Hosts() {
+		if h.Name != cc.dest.Name {
+			continue
+		}
+		byName, err := s.RBAC.Normalize(net.JoinHostPort(h.Name, strconv.Itoa(cc.dest.Port)))
+		if err == nil && byName.IP == dest.IP {
+			return byName, nil
+		}
+	}
+	return dest, nil
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+	"github.com/Entidi89/ssh_proxy1/internal/rbac"
+)
+
+func TestReevaluateSessionsDeadline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policies.json")
+	setPolicy := func(maxSession string) {
+		t.Helper()
+		policy := `{"users": [{"user": "bob", "role": "ops", "targets": ["10.0.0.1"], "conditions": {"max_session": "` + maxSession + `"}}]}`
+		if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setPolicy("1h")
+	policy, err := rbac.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &SSHServer{RBAC: policy, Sessions: NewSessionRegistry()}
+
+	closed := make(chan struct{})
+	start := time.Now().Add(-40 * time.Minute)
+	cc := &connContext{
+		sessionID: "s1", proxyUser: "bob", role: "ops", start: start, target: "10.0.0.1:22",
+		dest:      inventory.Target{IP: netip.MustParseAddr("10.0.0.1"), Port: 22},
+		done:      make(chan struct{}),
+		closeConn: func() error { close(closed); return nil },
+	}
+	defer close(cc.done)
+	s.Sessions.add(cc)
+
+	// Phiên mở khi chưa có giới hạn: policy mới áp max_session tính từ lúc phiên bắt đầu
+	if n := s.ReevaluateSessions(); n != 0 {
+		t.Fatalf("ngắt %d phiên; muốn 0", n)
+	}
+	if d := cc.currentDeadline(); d == nil || !d.Equal(start.Add(time.Hour)) {
+		t.Fatalf("deadline %v; muốn %v", d, start.Add(time.Hour))
+	}
+	if got := s.Sessions.list()[0].info().Deadline; got == nil || !got.Equal(start.Add(time.Hour)) {
+		t.Fatalf("SessionInfo.Deadline = %v", got)
+	}
+
+	// Rút max_session xuống dưới thời gian phiên đã chạy: phiên bị ngắt theo deadline mới
+	setPolicy("30m")
+	if err := policy.Reload(path); err != nil {
+		t.Fatal(err)
+	}
+	s.ReevaluateSessions()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("phiên quá hạn theo policy mới không bị ngắt")
+	}
+}
+
+func TestReevaluateSessionsInventoryLabels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policies.json")
+	policyJSON := `{"users": [{"user": "bob", "role": "ops", "targets": ["env=dev"]}]}`
+	if err := os.WriteFile(path, []byte(policyJSON), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := rbac.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := func(env string) *inventory.Inventory {
+		t.Helper()
+		inv, err := inventory.New([]inventory.Host{
+			{Name: "web1", Address: "10.0.0.5", Port: 2200, Labels: map[string]string{"env": env}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inv
+	}
+	if err := policy.ReloadWith(path, hosts("dev"), nil); err != nil {
+		t.Fatal(err)
+	}
+	s := &SSHServer{RBAC: policy, Sessions: NewSessionRegistry()}
+
+	closed := make(chan struct{}, 2)
+	open := func(id, input string) *connContext {
+		dest, err := policy.Normalize(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc := &connContext{
+			sessionID: id, proxyUser: "bob", role: "ops", start: time.Now(),
+			target: dest.Addr(), dest: dest, done: make(chan struct{}),
+			closeConn: func() error { closed <- struct{}{}; return nil },
+		}
+		t.Cleanup(func() { close(cc.done) })
+		s.Sessions.add(cc)
+		return cc
+	}
+	open("s1", "web1")
+	// Mở bằng tên kèm port khác port khai báo: vẫn được nhận ra là web1
+	open("s2", "web1:22")
+
+	// Inventory không đổi: không phiên nào bị ngắt
+	if n := s.ReevaluateSessions(); n != 0 {
+		t.Fatalf("ngắt %d phiên; muốn 0", n)
+	}
+
+	// web1 chuyển sang env=prod: bob mất quyền, cả hai phiên bị ngắt dù dest lưu lúc mở vẫn là env=dev
+	if err := policy.ReloadWith(path, hosts("prod"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.ReevaluateSessions(); n != 2 {
+		t.Fatalf("ngắt %d phiên; muốn 2", n)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("phiên trên máy đích đã đổi nhãn không bị ngắt")
+		}
+	}
+}
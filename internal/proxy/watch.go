@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Đường dẫn WebSocket xem phiên, nơi duy nhất nhận vé qua ?ticket=
+const watchPath = "/admin/sessions/watch"
+
+// handleWatchTicket cấp vé dùng một lần để trình duyệt mở WebSocket xem phiên
+// (trình duyệt không gửi được header Authorization khi mở WebSocket).
+// POST /admin/sessions/watch-ticket?id=<session-id> -> {"ticket":"...","expires":"..."}
+func (s *ProxyServer) handleWatchTicket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Sessions == nil {
+		http.Error(w, "sessions not configured", http.StatusServiceUnavailable)
+		return
+	}
+	cc, ok := s.Sessions.get(r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	auditField(w, "session_id", cc.sessionID)
+	ticket, expires := s.Auth.issueWatchTicket(principalFrom(r), cc.sessionID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"ticket": ticket, "expires": expires.Format(time.RFC3339)})
+}
+
+// handleSessionWatch: xem / điều khiển một phiên qua WebSocket.
+// GET /admin/sessions/watch?id=<session-id> (Authorization: Bearer <token>, hoặc từ trình
+// duyệt: ?ticket=<vé lấy từ /admin/sessions/watch-ticket>)
+//
+// Server gửi output của phiên dạng binary frame và thông báo dạng text frame JSON
+// {"type":"ok|error|closed","action":"...","message":"..."}.
+// Client gửi text frame {"type":"join"|"release"|"terminate","message":"..."} để điều khiển
+// (cần quyền sessions.join / sessions.terminate), và binary frame là phím gõ khi đang điều khiển.
+func (s *ProxyServer) handleSessionWatch(w http.ResponseWriter, r *http.Request) {
+	if s.Sessions == nil {
+		http.Error(w, "sessions not configured", http.StatusServiceUnavailable)
+		return
+	}
+	cc, ok := s.Sessions.get(r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	p := principalFrom(r)
+	auditField(w, "session_id", cc.sessionID)
+	can := func(action string) bool { return p.can("sessions." + action) }
+	conn, err := s.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	o := newObserver(p.User, "websocket")
+	cc.attach(o)
+	defer cc.detach(o, "observer ngắt kết nối")
+
+	var writeMu sync.Mutex
+	send := func(mt int, b []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteMessage(mt, b)
+	}
+	notice := func(typ, action, message string) {
+		b, _ := json.Marshal(map[string]string{"type": typ, "action": action, "message": message})
+		send(websocket.TextMessage, b)
+	}
+
+	go func() {
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				o.close("observer ngắt kết nối")
+				return
+			}
+			if mt == websocket.BinaryMessage {
+				if err := cc.controlInput(o, msg); err != nil {
+					notice("error", "input", err.Error())
+				}
+				continue
+			}
+			var ctrl struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			}
+			if err := json.Unmarshal(msg, &ctrl); err != nil {
+				notice("error", "", "invalid control message")
+				continue
+			}
+			if err := cc.moderate(can, o, ctrl.Type, ctrl.Message); err != nil {
+				notice("error", ctrl.Type, err.Error())
+				continue
+			}
+			notice("ok", ctrl.Type, "")
+		}
+	}()
+
+	for {
+		select {
+		case b := <-o.out:
+			if err := send(websocket.BinaryMessage, b); err != nil {
+				return
+			}
+		case <-o.gone:
+			notice("closed", "", o.reason)
+			return
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package rbac
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Conditions: điều kiện thời gian gắn với một quyền truy cập.
+//
+//	{"timezone": "Asia/Ho_Chi_Minh", "weekdays": ["sat", "sun"], "hours": "22:00-04:00",
+//	 "not_before": "2026-01-01T00:00:00+07:00", "not_after": "2026-03-31T23:59:59+07:00",
+//	 "max_session": "2h"}
+//
+// Khung giờ qua nửa đêm (22:00-04:00) thuộc về ngày bắt đầu: "sat" + "22:00-04:00"
+// cho phép từ 22h thứ Bảy tới 4h sáng Chủ nhật.
+type Conditions struct {
+	Timezone string   `json:"timezone,omitempty"`
+	Weekdays []string `json:"weekdays,omitempty"`
+	Hours    string   `json:"hours,omitempty"`
+	// Thời hạn tuyệt đối (RFC 3339), vd cho nhân sự thuê ngoài
+	NotBefore string `json:"not_before,omitempty"`
+	NotAfter  string `json:"not_after,omitempty"`
+	// Thời lượng tối đa của một phiên, vd "2h"
+	MaxSession string `json:"max_session,omitempty"`
+
+	loc                 *time.Location
+	days                [7]bool
+	hasHours            bool
+	startMin, endMin    int // phút trong ngày
+	notBefore, notAfter time.Time
+	maxSession          time.Duration
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseWeekday nhận tên ngày 3 chữ cái (mon) hoặc tên đầy đủ (monday), không phân biệt hoa thường
+func parseWeekday(d string) (time.Weekday, bool) {
+	s := strings.ToLower(strings.TrimSpace(d))
+	if wd, ok := weekdayNames[s]; ok {
+		return wd, true
+	}
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		if s == strings.ToLower(wd.String()) {
+			return wd, true
+		}
+	}
+	return 0, false
+}
+
+// compile kiểm tra và chuẩn bị điều kiện để đánh giá
+func (c *Conditions) compile() error {
+	var err error
+	c.loc = time.Local
+	if c.Timezone != "" {
+		if c.loc, err = time.LoadLocation(c.Timezone); err != nil {
+			return fmt.Errorf("timezone '%s' không hợp lệ: %v", c.Timezone, err)
+		}
+	}
+	if len(c.Weekdays) == 0 {
+		for i := range c.days {
+			c.days[i] = true
+		}
+	}
+	for _, d := range c.Weekdays {
+		wd, ok := parseWeekday(d)
+		if !ok {
+			return fmt.Errorf("ngày '%s' không hợp lệ (dùng mon, tue, ... hoặc monday, tuesday, ...)", d)
+		}
+		c.days[wd] = true
+	}
+	if c.Hours != "" {
+		from, to, ok := strings.Cut(c.Hours, "-")
+		if !ok {
+			return fmt.Errorf("hours '%s' không hợp lệ (cần dạng HH:MM-HH:MM)", c.Hours)
+		}
+		if c.startMin, err = parseClock(from); err != nil {
+			return err
+		}
+		if c.endMin, err = parseClock(to); err != nil {
+			return err
+		}
+		if c.startMin == c.endMin {
+			return fmt.Errorf("hours '%s': giờ bắt đầu trùng giờ kết thúc", c.Hours)
+		}
+		c.hasHours = true
+	}
+	if c.NotBefore != "" {
+		if c.notBefore, err = time.Parse(time.RFC3339, c.NotBefore); err != nil {
+			return fmt.Errorf("not_before không hợp lệ: %v", err)
+		}
+	}
+	if c.NotAfter != "" {
+		if c.notAfter, err = time.Parse(time.RFC3339, c.NotAfter); err != nil {
+			return fmt.Errorf("not_after không hợp lệ: %v", err)
+		}
+	}
+	if c.MaxSession != "" {
+		if c.maxSession, err = time.ParseDuration(c.MaxSession); err != nil || c.maxSession <= 0 {
+			return fmt.Errorf("max_session '%s' không hợp lệ", c.MaxSession)
+		}
+	}
+	return nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("giờ '%s' không hợp lệ (cần dạng HH:MM)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Active cho biết điều kiện có thỏa tại thời điểm now không. Nếu thỏa, deadline là thời điểm
+// quyền hết hiệu lực (cuối khung giờ, not_after hoặc hết max_session tính từ start, lúc phiên
+// bắt đầu); zero = không giới hạn.
+func (c *Conditions) Active(start, now time.Time) (deadline time.Time, ok bool, why string) {
+	if !c.notBefore.IsZero() && now.Before(c.notBefore) {
+		return time.Time{}, false, "chưa tới not_before " + c.NotBefore
+	}
+	if !c.notAfter.IsZero() && !now.Before(c.notAfter) {
+		return time.Time{}, false, "đã quá not_after " + c.NotAfter
+	}
+	end, ok := c.windowEnd(now.In(c.loc))
+	if !ok {
+		return time.Time{}, false, "ngoài khung giờ cho phép " + c.describeWindow()
+	}
+	deadline = end
+	if !c.notAfter.IsZero() && (deadline.IsZero() || c.notAfter.Before(deadline)) {
+		deadline = c.notAfter
+	}
+	if c.maxSession > 0 {
+		if limit := start.Add(c.maxSession); deadline.IsZero() || limit.Before(deadline) {
+			deadline = limit
+		}
+	}
+	return deadline, true, ""
+}
+
+// windowEnd trả về thời điểm khung ngày/giờ hiện tại kết thúc (zero nếu không giới hạn)
+func (c *Conditions) windowEnd(t time.Time) (time.Time, bool) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, c.loc)
+	if !c.hasHours {
+		if !c.days[t.Weekday()] {
+			return time.Time{}, false
+		}
+		// Gộp các ngày liên tiếp được phép
+		end := midnight
+		for i := 0; i < 7; i++ {
+			end = end.AddDate(0, 0, 1)
+			if !c.days[end.Weekday()] {
+				return end, true
+			}
+		}
+		return time.Time{}, true
+	}
+	// Khung bắt đầu hôm nay hoặc (nếu qua nửa đêm) hôm qua
+	for _, day := range []time.Time{midnight, midnight.AddDate(0, 0, -1)} {
+		if !c.days[day.Weekday()] {
+			continue
+		}
+		start := c.clock(day, c.startMin)
+		end := c.clock(day, c.endMin)
+		if c.endMin <= c.startMin {
+			end = c.clock(day.AddDate(0, 0, 1), c.endMin)
+		}
+		if !t.Before(start) && t.Before(end) {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// clock trả về thời điểm HH:MM (tính theo phút trong ngày) của ngày day, theo timezone của điều kiện
+func (c *Conditions) clock(day time.Time, minutes int) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), minutes/60, minutes%60, 0, 0, c.loc)
+}
+
+func (c *Conditions) describeWindow() string {
+	var parts []string
+	if len(c.Weekdays) > 0 {
+		parts = append(parts, strings.Join(c.Weekdays, ","))
+	}
+	if c.Hours != "" {
+		parts = append(parts, c.Hours)
+	}
+	if c.Timezone != "" {
+		parts = append(parts, c.Timezone)
+	}
+	return "(" + strings.Join(parts, " ") + ")"
+}
@@ -0,0 +1,184 @@
+package rbac
+
+import (
+	"testing"
+	"time"
+)
+
+func mustConditions(t *testing.T, c Conditions) *Conditions {
+	t.Helper()
+	if err := c.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return &c
+}
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("timezone %s unavailable: %v", name, err)
+	}
+	return loc
+}
+
+func TestConditionsWeekdays(t *testing.T) {
+	valid := map[string]time.Weekday{
+		"sun": time.Sunday, "Mon": time.Monday, "TUE": time.Tuesday, " wed ": time.Wednesday,
+		"thursday": time.Thursday, "Friday": time.Friday, "SATURDAY": time.Saturday,
+	}
+	for d, want := range valid {
+		c := mustConditions(t, Conditions{Weekdays: []string{d}})
+		for wd := time.Sunday; wd <= time.Saturday; wd++ {
+			if c.days[wd] != (wd == want) {
+				t.Errorf("%q: days[%s] = %v", d, wd, c.days[wd])
+			}
+		}
+	}
+	for _, d := range []string{"sunxyz", "monkey", "satur", "tues", "thurs", "mo", "s", "", "lundi", "sun,mon"} {
+		c := Conditions{Weekdays: []string{d}}
+		if err := c.compile(); err == nil {
+			t.Errorf("weekday %q accepted", d)
+		}
+	}
+}
+
+func TestConditionsCompileErrors(t *testing.T) {
+	for _, c := range []Conditions{
+		{Timezone: "Mars/Olympus"},
+		{Hours: "09:00"},
+		{Hours: "9am-5pm"},
+		{Hours: "09:00-24:00"},
+		{Hours: "10:00-10:00"},
+		{NotBefore: "2026-01-01"},
+		{NotAfter: "yesterday"},
+		{MaxSession: "0s"},
+		{MaxSession: "-1h"},
+		{MaxSession: "forever"},
+	} {
+		if err := c.compile(); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+}
+
+func TestActiveOvernightWindow(t *testing.T) {
+	hcm := mustLocation(t, "Asia/Ho_Chi_Minh")
+	// Khung 22:00-04:00 thuộc về thứ Bảy: từ 22h thứ Bảy tới 4h sáng Chủ nhật
+	c := mustConditions(t, Conditions{Timezone: "Asia/Ho_Chi_Minh", Weekdays: []string{"sat"}, Hours: "22:00-04:00"})
+	at := func(day, hour, min int) time.Time {
+		// 2026-01-03 là thứ Bảy; truyền vào giờ UTC để kiểm tra việc đổi sang timezone của điều kiện
+		return time.Date(2026, 1, day, hour, min, 0, 0, hcm).UTC()
+	}
+	sundayEnd := time.Date(2026, 1, 4, 4, 0, 0, 0, hcm)
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		ok       bool
+		deadline time.Time
+	}{
+		{"saturday before the window", at(3, 21, 59), false, time.Time{}},
+		{"saturday start", at(3, 22, 0), true, sundayEnd},
+		{"saturday midnight", at(4, 0, 0), true, sundayEnd},
+		{"sunday morning", at(4, 3, 59), true, sundayEnd},
+		{"sunday end", at(4, 4, 0), false, time.Time{}},
+		{"sunday night", at(4, 22, 30), false, time.Time{}},
+		{"friday night", at(2, 23, 0), false, time.Time{}},
+		{"saturday morning (friday's window)", at(3, 2, 0), false, time.Time{}},
+		{"next saturday", at(10, 23, 0), true, time.Date(2026, 1, 11, 4, 0, 0, 0, hcm)},
+	}
+	for _, tt := range tests {
+		deadline, ok, why := c.Active(tt.now, tt.now)
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v (%s), want %v", tt.name, ok, why, tt.ok)
+			continue
+		}
+		if ok && !deadline.Equal(tt.deadline) {
+			t.Errorf("%s: deadline %v, want %v", tt.name, deadline, tt.deadline)
+		}
+		if !ok && why == "" {
+			t.Errorf("%s: no reason given", tt.name)
+		}
+	}
+}
+
+func TestActiveTimezoneDST(t *testing.T) {
+	ny := mustLocation(t, "America/New_York")
+	office := mustConditions(t, Conditions{Timezone: "America/New_York", Weekdays: []string{"mon", "tue", "wed", "thu", "fri"}, Hours: "09:00-17:00"})
+
+	// 13:30 UTC là 08:30 EST trước ngày đổi giờ, nhưng 09:30 EDT sau đó (2026-03-08)
+	if _, ok, _ := office.Active(time.Time{}, time.Date(2026, 3, 6, 13, 30, 0, 0, time.UTC)); ok {
+		t.Error("friday 08:30 EST allowed")
+	}
+	now := time.Date(2026, 3, 9, 13, 30, 0, 0, time.UTC)
+	deadline, ok, why := office.Active(now, now)
+	if !ok {
+		t.Fatalf("monday 09:30 EDT refused: %s", why)
+	}
+	if want := time.Date(2026, 3, 9, 21, 0, 0, 0, time.UTC); !deadline.Equal(want) {
+		t.Errorf("deadline %v, want 17:00 EDT (%v)", deadline, want)
+	}
+
+	// Khung qua nửa đêm trùng lúc đổi giờ: kết thúc 04:00 EDT, chỉ 5 tiếng sau 22:00 EST
+	night := mustConditions(t, Conditions{Timezone: "America/New_York", Weekdays: []string{"saturday"}, Hours: "22:00-04:00"})
+	start := time.Date(2026, 3, 7, 22, 0, 0, 0, ny)
+	deadline, ok, why = night.Active(start, start.Add(3*time.Hour))
+	if !ok {
+		t.Fatalf("sunday 02:00 refused: %s", why)
+	}
+	if want := time.Date(2026, 3, 8, 4, 0, 0, 0, ny); !deadline.Equal(want) || deadline.Sub(start) != 5*time.Hour {
+		t.Errorf("deadline %v (%v after start), want %v", deadline, deadline.Sub(start), want)
+	}
+}
+
+func TestActiveWeekdaysOnly(t *testing.T) {
+	c := mustConditions(t, Conditions{Timezone: "UTC", Weekdays: []string{"fri", "sat"}})
+	// 2026-01-02 là thứ Sáu: các ngày được phép liên tiếp gộp lại tới hết thứ Bảy
+	now := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	deadline, ok, _ := c.Active(now, now)
+	if !ok || !deadline.Equal(time.Date(2026, 1, 4, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("friday: %v %v", deadline, ok)
+	}
+	if _, ok, _ := c.Active(now, now.AddDate(0, 0, 2)); ok {
+		t.Error("sunday allowed")
+	}
+
+	always := mustConditions(t, Conditions{Timezone: "UTC"})
+	if deadline, ok, _ := always.Active(now, now); !ok || !deadline.IsZero() {
+		t.Errorf("no conditions: %v %v", deadline, ok)
+	}
+}
+
+func TestActiveDeadlineLimits(t *testing.T) {
+	c := mustConditions(t, Conditions{
+		Timezone: "UTC", Hours: "08:00-20:00",
+		NotBefore: "2026-02-01T00:00:00Z", NotAfter: "2026-02-10T12:00:00Z",
+		MaxSession: "2h",
+	})
+	at := func(day, hour int) time.Time { return time.Date(2026, 2, day, hour, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name       string
+		start, now time.Time
+		ok         bool
+		deadline   time.Time
+	}{
+		{"before not_before", at(1, 8).Add(-24 * time.Hour), at(1, 8).Add(-24 * time.Hour), false, time.Time{}},
+		{"max_session first", at(3, 9), at(3, 10), true, at(3, 11)},
+		{"window end first", at(3, 19), at(3, 19), true, at(3, 20)},
+		{"not_after first", at(10, 11), at(10, 11), true, at(10, 12)},
+		// max_session tính từ lúc phiên bắt đầu, không phải từ lúc đánh giá lại
+		{"session already over", at(3, 8), at(3, 11), true, at(3, 10)},
+		{"after not_after", at(10, 12), at(10, 12), false, time.Time{}},
+	}
+	for _, tt := range tests {
+		deadline, ok, why := c.Active(tt.start, tt.now)
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v (%s), want %v", tt.name, ok, why, tt.ok)
+			continue
+		}
+		if ok && !deadline.Equal(tt.deadline) {
+			t.Errorf("%s: deadline %v, want %v", tt.name, deadline, tt.deadline)
+		}
+	}
+}
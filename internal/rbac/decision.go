@@ -0,0 +1,169 @@
+package rbac
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+)
+
+// Effect: kết quả của một rule
+type Effect string
+
+const (
+	Allow Effect = "allow"
+	Deny  Effect = "deny"
+)
+
+// Mức cụ thể của chủ thể rule: rule của riêng user được ưu tiên hơn rule chung
+const (
+	subjectGlobal = 0
+	subjectGroup  = 1
+	subjectUser   = 2
+)
+
+// rule: một rule allow/deny đã biên dịch, áp dụng cho một chủ thể
+type rule struct {
+	id      string // vd "users[bob].targets[1]", "deny[hsm].targets[0]"
+	effect  Effect
+	role    string // role được cấp (chỉ với allow)
+	target  TargetRule
+	subject int
+	// Điều kiện thời gian (chỉ với allow), nil = luôn hiệu lực
+	cond *Conditions
+}
+
+// Decision: kết quả đánh giá policy cho một yêu cầu truy cập
+type Decision struct {
+	Allowed bool   `json:"allowed"`
+	Role    string `json:"role,omitempty"`
+	Effect  Effect `json:"effect"`
+	// Rule quyết định kết quả (rỗng nếu không rule nào khớp -> mặc định chặn)
+	Rule    string `json:"rule,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	Reason  string `json:"reason"`
+	// Các nhóm của user tại thời điểm đánh giá
+	Groups []string `json:"groups,omitempty"`
+	// Các rule khác cũng khớp nhưng bị rule trên lấn át
+	Overridden []string `json:"overridden,omitempty"`
+	// Các rule allow khớp máy đích nhưng bị rule deny chặn (chỉ có khi kết quả là deny)
+	DeniedAllows []string `json:"denied_allows,omitempty"`
+	// Các rule allow khớp máy đích nhưng không hiệu lực tại thời điểm đánh giá (kèm lý do)
+	Inactive []string `json:"inactive,omitempty"`
+	// Thời điểm quyền hết hiệu lực: phiên phải kết thúc trước lúc này (nil = không giới hạn)
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+func (d Decision) String() string {
+	if d.Rule == "" {
+		return d.Reason
+	}
+	return fmt.Sprintf("%s theo rule %s (%s)", d.Effect, d.Rule, d.Pattern)
+}
+
+// beats cho biết rule a có được ưu tiên hơn rule b không:
+// deny luôn thắng allow (allow cụ thể hơn cũng không vượt được deny đang áp dụng cho user).
+// Giữa các rule cùng hiệu lực: máy đích cụ thể hơn > chủ thể cụ thể hơn,
+// thứ tự này chỉ quyết định rule nào được báo cáo (và role nào được cấp với allow).
+// Khi hòa hoàn toàn, rule khai báo trước được giữ.
+func (a *rule) beats(b *rule) bool {
+	if a.effect != b.effect {
+		return a.effect == Deny
+	}
+	if c := a.target.Specificity().Compare(b.target.Specificity()); c != 0 {
+		return c > 0
+	}
+	return a.subject > b.subject
+}
+
+// evaluate chọn rule thắng trong số các rule khớp target và đang hiệu lực tại thời điểm now,
+// với phiên bắt đầu lúc start
+func evaluate(rules []*rule, target inventory.Target, start, now time.Time) Decision {
+	var best *rule
+	var matched []*rule
+	var inactive []string
+	deadlines := map[*rule]time.Time{}
+	for _, r := range rules {
+		if !r.target.Match(target) {
+			continue
+		}
+		if r.cond != nil {
+			deadline, ok, why := r.cond.Active(start, now)
+			if !ok {
+				inactive = append(inactive, r.id+": "+why)
+				continue
+			}
+			deadlines[r] = deadline
+		}
+		matched = append(matched, r)
+		if best == nil || r.beats(best) {
+			best = r
+		}
+	}
+	if best == nil {
+		d := Decision{Effect: Deny, Reason: "không có rule nào cho phép máy đích này", Inactive: inactive}
+		if len(inactive) > 0 {
+			d.Reason = "quyền truy cập hiện không hiệu lực: " + strings.Join(inactive, "; ")
+		}
+		return d
+	}
+	d := Decision{
+		Allowed:  best.effect == Allow,
+		Effect:   best.effect,
+		Rule:     best.id,
+		Pattern:  best.target.String(),
+		Inactive: inactive,
+	}
+	if d.Allowed {
+		d.Role = best.role
+		d.Reason = "được cho phép bởi " + best.id
+		if deadline := deadlines[best]; !deadline.IsZero() {
+			d.Deadline = &deadline
+			d.Reason += ", hiệu lực tới " + deadline.Format(time.RFC3339)
+		}
+	} else {
+		d.Reason = "bị chặn bởi " + best.id + " (deny luôn thắng allow)"
+	}
+	for _, r := range matched {
+		if r == best {
+			continue
+		}
+		if best.effect == Deny && r.effect == Allow {
+			d.DeniedAllows = append(d.DeniedAllows, r.id)
+		} else {
+			d.Overridden = append(d.Overridden, r.id)
+		}
+	}
+	return d
+}
+
+// DenyRule: rule chặn áp dụng cho mọi user (trừ các user / nhóm được miễn)
+type DenyRule struct {
+	Name    string       `json:"name"`
+	Targets []TargetRule `json:"targets"`
+	// User và nhóm được miễn rule này, vd "mọi người trừ nhóm dba"
+	ExceptUsers  []string `json:"except_users,omitempty"`
+	ExceptGroups []string `json:"except_groups,omitempty"`
+}
+
+func (d *DenyRule) exempts(user string, groups []string) bool {
+	for _, u := range d.ExceptUsers {
+		if u == user {
+			return true
+		}
+	}
+	for _, g := range d.ExceptGroups {
+		for _, ug := range groups {
+			if strings.EqualFold(g, ug) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ruleID tạo định danh rule dễ đọc cho log và bản ghi phiên
+func ruleID(scope, name, field string, i int) string {
+	return fmt.Sprintf("%s[%s].%s[%d]", scope, name, field, i)
+}
@@ -0,0 +1,103 @@
+package rbac
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+)
+
+type staticGroups map[string][]string
+
+func (g staticGroups) Groups(user string) ([]string, error) { return g[user], nil }
+
+func mustRBAC(t *testing.T, policy string) *RBAC {
+	t.Helper()
+	pf, err := ParsePolicyFile([]byte(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(pf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func target(ip string, port int, name string, labels map[string]string) inventory.Target {
+	return inventory.Target{Name: name, IP: netip.MustParseAddr(ip), Port: port, Labels: labels}
+}
+
+func TestPrecedence(t *testing.T) {
+	r := mustRBAC(t, `{
+		"users": [
+			{"user": "bob", "role": "ops", "targets": ["*", "10.9.0.7", "hsm*", "zone=hsm"], "deny": ["10.5.0.0/16"]},
+			{"user": "carol", "role": "ops", "targets": ["10.5.0.0/16"]},
+			{"user": "dave", "role": "dev", "targets": ["10.0.0.0/8", "10.3.0.0/16"]},
+			{"user": "erin", "role": "dev", "targets": ["10.20.0.0/16"], "deny": ["10.20.1.5:2222"]}
+		],
+		"groups": [
+			{"group": "dba", "role": "dba", "targets": ["10.9.0.0/16"]},
+			{"group": "ops", "role": "grp", "targets": ["10.1.0.0/16", "10.3.0.0/16"]}
+		],
+		"deny": [
+			{"name": "hsm", "targets": ["10.9.0.0/16", "zone=hsm"], "except_groups": ["dba"]}
+		]
+	}`)
+	r.SetGroupResolver(staticGroups{"alice": {"dba"}, "dave": {"ops"}})
+
+	tests := []struct {
+		name   string
+		user   string
+		target inventory.Target
+		allow  bool
+		role   string
+		rule   string
+	}{
+		{"global deny beats exact-IP allow", "bob", target("10.9.0.7", 22, "", nil), false, "", "deny[hsm].targets[0]"},
+		{"global deny beats host-glob allow", "bob", target("10.9.0.8", 22, "hsm1", nil), false, "", "deny[hsm].targets[0]"},
+		{"label deny beats label allow", "bob", target("10.200.0.1", 22, "vault", map[string]string{"zone": "hsm"}), false, "", "deny[hsm].targets[1]"},
+		{"exempt group reaches denied range", "alice", target("10.9.0.7", 22, "", nil), true, "dba", "groups[dba].targets[0]"},
+		{"user deny beats wildcard allow", "bob", target("10.5.1.1", 22, "", nil), false, "", "users[bob].deny[0]"},
+		{"other user not affected by bob's deny", "carol", target("10.5.1.1", 22, "", nil), true, "ops", "users[carol].targets[0]"},
+		{"more specific group allow beats broader user allow", "dave", target("10.1.2.3", 22, "", nil), true, "grp", "groups[ops].targets[0]"},
+		{"user allow beats group allow of same specificity", "dave", target("10.3.1.1", 22, "", nil), true, "dev", "users[dave].targets[1]"},
+		{"port-specific deny", "erin", target("10.20.1.5", 2222, "", nil), false, "", "users[erin].deny[0]"},
+		{"deny port does not match other ports", "erin", target("10.20.1.5", 22, "", nil), true, "dev", "users[erin].targets[0]"},
+		{"no matching rule", "carol", target("192.168.1.1", 22, "", nil), false, "", ""},
+		{"unknown user", "mallory", target("10.3.1.1", 22, "", nil), false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := r.CheckAccessAt(tt.user, tt.target, time.Now())
+			if d.Allowed != tt.allow || d.Role != tt.role || d.Rule != tt.rule {
+				t.Errorf("got allowed=%v role=%q rule=%q (%s), want allowed=%v role=%q rule=%q",
+					d.Allowed, d.Role, d.Rule, d.Reason, tt.allow, tt.role, tt.rule)
+			}
+		})
+	}
+}
+
+func TestPrecedenceExplain(t *testing.T) {
+	r := mustRBAC(t, `{
+		"users": [{"user": "bob", "role": "ops", "targets": ["*", "10.9.0.7"]}],
+		"deny": [{"name": "hsm", "targets": ["10.9.0.0/16", "10.9.0.0/24"]}]
+	}`)
+	d := r.CheckAccessAt("bob", target("10.9.0.7", 22, "", nil), time.Now())
+	if d.Allowed || d.Rule != "deny[hsm].targets[1]" {
+		t.Fatalf("got %+v, want the most specific deny", d)
+	}
+	want := map[string]bool{"users[bob].targets[0]": true, "users[bob].targets[1]": true}
+	if len(d.DeniedAllows) != len(want) {
+		t.Fatalf("denied allows %v, want %v", d.DeniedAllows, want)
+	}
+	for _, id := range d.DeniedAllows {
+		if !want[id] {
+			t.Errorf("unexpected denied allow %s", id)
+		}
+	}
+	if len(d.Overridden) != 1 || d.Overridden[0] != "deny[hsm].targets[0]" {
+		t.Errorf("overridden %v, want [deny[hsm].targets[0]]", d.Overridden)
+	}
+}
@@ -0,0 +1,288 @@
+package rbac
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Entidi89/ssh_proxy1/internal/cmdfilter"
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+	"golang.org/x/crypto/ssh"
+)
+
+// Mức độ của vấn đề phát hiện khi kiểm tra policy
+const (
+	LevelError   = "error"
+	LevelWarning = "warning"
+)
+
+// Issue: một vấn đề phát hiện khi kiểm tra policies.json
+type Issue struct {
+	Level   string `json:"level"`
+	Where   string `json:"where,omitempty"` // vd "users[alice]", "dòng 12, cột 5"
+	Message string `json:"message"`
+}
+
+func (i Issue) String() string {
+	if i.Where == "" {
+		return fmt.Sprintf("[%s] %s", i.Level, i.Message)
+	}
+	return fmt.Sprintf("[%s] %s: %s", i.Level, i.Where, i.Message)
+}
+
+// LintOptions: thông tin ngoài policies.json dùng để kiểm tra chéo
+type LintOptions struct {
+	// Role có được khai báo trong roles.json không (nil = bỏ qua kiểm tra)
+	RoleExists func(name string) bool
+	// Inventory để phát hiện mẫu nhãn không khớp máy đích nào (nil = bỏ qua)
+	Inventory *inventory.Inventory
+}
+
+// Lint kiểm tra nội dung policies.json và trả về mọi vấn đề tìm thấy
+// thay vì dừng ở lỗi đầu tiên như khi nạp policy.
+func Lint(b []byte, opts LintOptions) []Issue {
+	var issues []Issue
+	add := func(level, where, format string, args ...interface{}) {
+		issues = append(issues, Issue{Level: level, Where: where, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// Cú pháp JSON và tên trường sai chính tả (vd "target" thay vì "targets")
+	legacy := false
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '[' {
+		legacy = true
+		add(LevelWarning, "", "policies.json đang dùng định dạng cũ (mảng user), nên chuyển sang {\"roles\", \"users\"}")
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var strict PolicyFile
+	var err error
+	if legacy {
+		err = dec.Decode(&strict.Users)
+	} else {
+		err = dec.Decode(&strict)
+	}
+	if err != nil {
+		add(LevelError, jsonErrorPosition(b, err), "%v", err)
+	}
+	// Target sai cú pháp được báo theo vị trí rồi bỏ qua, để vẫn kiểm tra được phần còn lại
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return issues
+	}
+	for _, bad := range dropBadTargets(doc) {
+		add(LevelError, bad.Where, "%s", bad.Message)
+	}
+	cleaned, _ := json.Marshal(doc)
+	pf, err := ParsePolicyFile(cleaned)
+	if err != nil {
+		add(LevelError, "", "%v", err)
+		return issues
+	}
+
+	roleKnown := func(where, role string) {
+		if role != "" && opts.RoleExists != nil && !opts.RoleExists(role) {
+			add(LevelError, where, "role '%s' chưa được khai báo trong roles.json", role)
+		}
+	}
+	checkTargets := func(where, field string, targets []TargetRule) {
+		for j, t := range targets {
+			if t.Host == "" && len(t.Labels) > 0 && opts.Inventory != nil && !matchesAnyHost(&t, opts.Inventory) {
+				add(LevelWarning, fmt.Sprintf("%s.%s[%d]", where, field, j), "nhãn %s không khớp máy đích nào trong inventory", t.String())
+			}
+		}
+	}
+	checkConditions := func(where string, c *Conditions) {
+		if err := compileConditions(c); err != nil {
+			add(LevelError, where+".conditions", "%v", err)
+		}
+	}
+
+	users := map[string]bool{}
+	for i, p := range pf.Users {
+		where := fmt.Sprintf("users[%d]", i)
+		if p.User == "" {
+			add(LevelError, where, "thiếu user")
+			continue
+		}
+		where = "users[" + p.User + "]"
+		if users[p.User] {
+			add(LevelError, where, "user bị khai báo trùng")
+		}
+		users[p.User] = true
+		if len(p.Targets) > 0 && p.Role == "" {
+			add(LevelError, where, "có targets nhưng thiếu role")
+		}
+		roleKnown(where, p.Role)
+		if len(p.AuthorizedKeys) == 0 {
+			add(LevelWarning, where, "chưa có authorized_keys -> không thể đăng nhập")
+		}
+		for j, line := range p.AuthorizedKeys {
+			if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err != nil {
+				add(LevelError, fmt.Sprintf("%s.authorized_keys[%d]", where, j), "key không hợp lệ: %v", err)
+			}
+		}
+		checkTargets(where, "targets", p.Targets)
+		checkTargets(where, "deny", p.Deny)
+		checkConditions(where, p.Conditions)
+		if err := p.Moderate.validate(); err != nil {
+			add(LevelError, where+".moderate", "%v", err)
+		}
+	}
+
+	groups := map[string]bool{}
+	for i, g := range pf.Groups {
+		where := fmt.Sprintf("groups[%d]", i)
+		if g.Group == "" {
+			add(LevelError, where, "thiếu group")
+			continue
+		}
+		where = "groups[" + g.Group + "]"
+		if groups[strings.ToLower(g.Group)] {
+			add(LevelError, where, "nhóm bị khai báo trùng")
+		}
+		groups[strings.ToLower(g.Group)] = true
+		if len(g.Targets) > 0 && g.Role == "" {
+			add(LevelError, where, "có targets nhưng thiếu role")
+		}
+		roleKnown(where, g.Role)
+		checkTargets(where, "targets", g.Targets)
+		checkTargets(where, "deny", g.Deny)
+		checkConditions(where, g.Conditions)
+		if err := g.Moderate.validate(); err != nil {
+			add(LevelError, where+".moderate", "%v", err)
+		}
+	}
+
+	denyNames := map[string]bool{}
+	for i, d := range pf.Deny {
+		where := fmt.Sprintf("deny[%d]", i)
+		if d.Name == "" {
+			add(LevelError, where, "thiếu name")
+		} else {
+			where = "deny[" + d.Name + "]"
+			if denyNames[d.Name] {
+				add(LevelError, where, "rule deny bị khai báo trùng")
+			}
+			denyNames[d.Name] = true
+		}
+		if len(d.Targets) == 0 {
+			add(LevelError, where, "thiếu targets")
+		}
+		checkTargets(where, "targets", d.Targets)
+		for _, u := range d.ExceptUsers {
+			if !users[u] {
+				add(LevelWarning, where, "except_users có '%s' không nằm trong users", u)
+			}
+		}
+		for _, g := range d.ExceptGroups {
+			if !groups[strings.ToLower(g)] {
+				add(LevelWarning, where, "except_groups có '%s' không được khai báo trong groups", g)
+			}
+		}
+	}
+
+	roleNames := make([]string, 0, len(pf.Roles))
+	for name := range pf.Roles {
+		roleNames = append(roleNames, name)
+	}
+	sort.Strings(roleNames)
+	for _, name := range roleNames {
+		rs := pf.Roles[name]
+		if opts.RoleExists != nil && !opts.RoleExists(name) {
+			add(LevelWarning, "roles["+name+"]", "thiết lập cho role chưa được khai báo trong roles.json")
+		}
+		if _, err := cmdfilter.New(rs.Commands); err != nil {
+			add(LevelError, "roles["+name+"].commands", "%v", err)
+		}
+	}
+	return issues
+}
+
+// HasErrors cho biết danh sách có vấn đề mức error không
+func HasErrors(issues []Issue) bool {
+	for _, i := range issues {
+		if i.Level == LevelError {
+			return true
+		}
+	}
+	return false
+}
+
+// dropBadTargets xóa khỏi tài liệu JSON (dạng generic) các target không parse được
+// trong users/groups/deny, trả về vị trí và lỗi của từng target bị xóa
+func dropBadTargets(doc interface{}) []Issue {
+	var issues []Issue
+	sections := map[string]interface{}{}
+	switch v := doc.(type) {
+	case []interface{}:
+		sections["users"] = v
+	case map[string]interface{}:
+		sections = v
+	}
+	for _, section := range []string{"users", "groups", "deny"} {
+		list, _ := sections[section].([]interface{})
+		for i, item := range list {
+			entry, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			where := fmt.Sprintf("%s[%d]", section, i)
+			for _, key := range []string{"user", "group", "name"} {
+				if name, ok := entry[key].(string); ok && name != "" {
+					where = section + "[" + name + "]"
+				}
+			}
+			for _, field := range []string{"targets", "deny"} {
+				targets, ok := entry[field].([]interface{})
+				if !ok {
+					continue
+				}
+				kept := targets[:0]
+				for j, t := range targets {
+					raw, _ := json.Marshal(t)
+					var rule TargetRule
+					if err := json.Unmarshal(raw, &rule); err != nil {
+						issues = append(issues, Issue{Level: LevelError, Where: fmt.Sprintf("%s.%s[%d]", where, field, j), Message: err.Error()})
+						continue
+					}
+					kept = append(kept, t)
+				}
+				entry[field] = kept
+			}
+		}
+	}
+	return issues
+}
+
+func matchesAnyHost(t *TargetRule, inv *inventory.Inventory) bool {
+	for _, h := range inv.Hosts() {
+		if t.Match(inventory.Target{Name: h.Name, Port: h.Port, Labels: h.Labels}) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonErrorPosition đổi offset của lỗi JSON thành "dòng X, cột Y"
+func jsonErrorPosition(b []byte, err error) string {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return ""
+	}
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	line := 1 + bytes.Count(b[:offset], []byte("\n"))
+	col := int(offset) - bytes.LastIndexByte(b[:offset], '\n')
+	return fmt.Sprintf("dòng %d, cột %d", line, col)
+}
@@ -0,0 +1,83 @@
+package rbac
+
+import (
+	"fmt"
+
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+)
+
+// Quyền giám sát phiên của người khác
+const (
+	ModerateObserve   = "observe"   // xem output của phiên theo thời gian thực
+	ModerateJoin      = "join"      // điều khiển thay user (bao gồm observe)
+	ModerateTerminate = "terminate" // ngắt phiên
+)
+
+// Moderation: quyền giám sát phiên của user / nhóm khác
+type Moderation struct {
+	// observe | join | terminate
+	Actions []string `json:"actions"`
+	// Chỉ áp dụng cho phiên tới các máy đích này (rỗng = mọi máy đích)
+	Targets []TargetRule `json:"targets,omitempty"`
+}
+
+func (m *Moderation) validate() error {
+	if m == nil {
+		return nil
+	}
+	if len(m.Actions) == 0 {
+		return fmt.Errorf("moderate thiếu actions")
+	}
+	for _, a := range m.Actions {
+		switch a {
+		case ModerateObserve, ModerateJoin, ModerateTerminate:
+		default:
+			return fmt.Errorf("moderate: action '%s' không hợp lệ (observe|join|terminate)", a)
+		}
+	}
+	return nil
+}
+
+// allows cho biết quyền này có cho phép action trên phiên tới target không
+func (m *Moderation) allows(action string, target inventory.Target) bool {
+	if m == nil {
+		return false
+	}
+	ok := false
+	for _, a := range m.Actions {
+		if a == action || (action == ModerateObserve && a == ModerateJoin) {
+			ok = true
+		}
+	}
+	if !ok {
+		return false
+	}
+	if len(m.Targets) == 0 {
+		return true
+	}
+	for i := range m.Targets {
+		if m.Targets[i].Match(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanModerate cho biết user có được thực hiện action (observe/join/terminate) trên
+// phiên tới target không, theo mục moderate của user và của các nhóm user thuộc về
+func (r *RBAC) CanModerate(user, action string, target inventory.Target) bool {
+	snap := r.current()
+	if up, ok := snap.users[user]; ok && up.Moderate.allows(action, target) {
+		return true
+	}
+	groups, err := snap.userGroups(user)
+	if err != nil {
+		return false
+	}
+	for _, g := range groups {
+		if snap.moderators[g].allows(action, target) {
+			return true
+		}
+	}
+	return false
+}
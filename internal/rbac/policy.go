@@ -0,0 +1,215 @@
+package rbac
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Entidi89/ssh_proxy1/internal/cmdfilter"
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+	"golang.org/x/crypto/ssh"
+)
+
+// RoleSettings: thiết lập kiểm soát truy cập gắn với một role
+type RoleSettings struct {
+	// Bắt buộc nhập mã TOTP (keyboard-interactive) sau khi xác thực public key
+	RequireMFA bool `json:"require_mfa"`
+	// Giới hạn truyền file qua SFTP/SCP
+	SFTP SFTPSettings `json:"sftp"`
+	// Lọc lệnh trong phiên shell/exec: chặn, cảnh báo hoặc đánh dấu theo regex
+	Commands []cmdfilter.Rule `json:"commands,omitempty"`
+}
+
+// SFTPSettings: chặn upload (ghi/sửa file trên máy đích) hoặc download theo role
+type SFTPSettings struct {
+	DenyUpload   bool `json:"deny_upload"`
+	DenyDownload bool `json:"deny_download"`
+}
+
+// PolicyEntry: một dòng phân quyền trong policies.json
+type PolicyEntry struct {
+	User string `json:"user"`
+	Role string `json:"role"`
+	// Máy đích được phép: "*", IP, CIDR, glob hoặc nhãn inventory (xem TargetRule)
+	Targets []TargetRule `json:"targets"`
+	// Máy đích bị chặn riêng với user này, vd "*" trừ các máy HSM
+	Deny []TargetRule `json:"deny,omitempty"`
+	// Điều kiện thời gian áp dụng cho các targets được cấp (không áp dụng cho deny)
+	Conditions *Conditions `json:"conditions,omitempty"`
+	// Public key (định dạng authorized_keys) dùng để xác thực user tại proxy
+	AuthorizedKeys []string `json:"authorized_keys"`
+	// Quyền xem / điều khiển / ngắt phiên của người khác
+	Moderate *Moderation `json:"moderate,omitempty"`
+}
+
+// GroupEntry: quyền cấp cho một nhóm. Thành viên nhóm lấy từ groups.json hoặc LDAP.
+type GroupEntry struct {
+	Group   string       `json:"group"`
+	Role    string       `json:"role"`
+	Targets []TargetRule `json:"targets"`
+	Deny    []TargetRule `json:"deny,omitempty"`
+	// Điều kiện thời gian áp dụng cho các targets được cấp
+	Conditions *Conditions `json:"conditions,omitempty"`
+	Moderate   *Moderation `json:"moderate,omitempty"`
+}
+
+// PolicyFile: cấu trúc file policies.json.
+// Vẫn chấp nhận định dạng cũ là một mảng PolicyEntry.
+type PolicyFile struct {
+	Roles  map[string]RoleSettings `json:"roles"`
+	Users  []PolicyEntry           `json:"users"`
+	Groups []GroupEntry            `json:"groups,omitempty"`
+	// Rule chặn áp dụng cho mọi user
+	Deny []DenyRule `json:"deny,omitempty"`
+}
+
+// ParsePolicyFile đọc nội dung policies.json
+func ParsePolicyFile(b []byte) (*PolicyFile, error) {
+	var pf PolicyFile
+	var err error
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(b, &pf.Users)
+	} else {
+		err = json.Unmarshal(b, &pf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pf, nil
+}
+
+// userPolicy: quyền của một user sau khi nạp
+type userPolicy struct {
+	Role     string
+	Rules    []*rule
+	Keys     []ssh.PublicKey
+	Moderate *Moderation
+}
+
+// snapshot: toàn bộ chính sách tại một thời điểm, được thay thế nguyên khối khi reload
+type snapshot struct {
+	file  *PolicyFile
+	users map[string]*userPolicy
+	roles map[string]RoleSettings
+	deny  []DenyRule
+	// Tên nhóm (viết thường) -> rule của nhóm
+	groups map[string][]*rule
+	// Tên nhóm (viết thường) -> quyền giám sát phiên của nhóm
+	moderators map[string]*Moderation
+
+	// Danh sách máy đích (tên, nhãn) dùng để chuẩn hóa và so khớp target
+	inv *inventory.Inventory
+	// Nguồn thành viên nhóm (groups.json hoặc LDAP)
+	resolver GroupResolver
+}
+
+// compile kiểm tra và dựng snapshot từ PolicyFile
+func compile(pf *PolicyFile) (*snapshot, error) {
+	s := &snapshot{
+		file:       pf,
+		users:      make(map[string]*userPolicy),
+		roles:      make(map[string]RoleSettings),
+		groups:     make(map[string][]*rule),
+		moderators: make(map[string]*Moderation),
+	}
+	for name, rs := range pf.Roles {
+		if _, err := cmdfilter.New(rs.Commands); err != nil {
+			return nil, fmt.Errorf("role '%s': %v", name, err)
+		}
+		s.roles[name] = rs
+	}
+	for i, p := range pf.Users {
+		if p.User == "" {
+			return nil, fmt.Errorf("policy thứ %d thiếu user", i+1)
+		}
+		if _, dup := s.users[p.User]; dup {
+			return nil, fmt.Errorf("user '%s' bị khai báo trùng", p.User)
+		}
+		if err := compileConditions(p.Conditions); err != nil {
+			return nil, fmt.Errorf("user '%s': %v", p.User, err)
+		}
+		if err := p.Moderate.validate(); err != nil {
+			return nil, fmt.Errorf("user '%s': %v", p.User, err)
+		}
+		up := &userPolicy{Role: p.Role, Moderate: p.Moderate}
+		for j, t := range p.Targets {
+			up.Rules = append(up.Rules, &rule{id: ruleID("users", p.User, "targets", j), effect: Allow, role: p.Role, target: t, subject: subjectUser, cond: p.Conditions})
+		}
+		for j, t := range p.Deny {
+			up.Rules = append(up.Rules, &rule{id: ruleID("users", p.User, "deny", j), effect: Deny, target: t, subject: subjectUser})
+		}
+		for _, line := range p.AuthorizedKeys {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				return nil, fmt.Errorf("authorized key của user '%s' không hợp lệ: %v", p.User, err)
+			}
+			up.Keys = append(up.Keys, key)
+		}
+		s.users[p.User] = up
+	}
+	for i, g := range pf.Groups {
+		if g.Group == "" {
+			return nil, fmt.Errorf("nhóm thứ %d thiếu group", i+1)
+		}
+		name := strings.ToLower(g.Group)
+		if _, dup := s.groups[name]; dup {
+			return nil, fmt.Errorf("nhóm '%s' bị khai báo trùng", g.Group)
+		}
+		if len(g.Targets) > 0 && g.Role == "" {
+			return nil, fmt.Errorf("nhóm '%s' có targets nhưng thiếu role", g.Group)
+		}
+		if err := compileConditions(g.Conditions); err != nil {
+			return nil, fmt.Errorf("nhóm '%s': %v", g.Group, err)
+		}
+		if err := g.Moderate.validate(); err != nil {
+			return nil, fmt.Errorf("nhóm '%s': %v", g.Group, err)
+		}
+		if g.Moderate != nil {
+			s.moderators[name] = g.Moderate
+		}
+		rules := []*rule{}
+		for j, t := range g.Targets {
+			rules = append(rules, &rule{id: ruleID("groups", g.Group, "targets", j), effect: Allow, role: g.Role, target: t, subject: subjectGroup, cond: g.Conditions})
+		}
+		for j, t := range g.Deny {
+			rules = append(rules, &rule{id: ruleID("groups", g.Group, "deny", j), effect: Deny, target: t, subject: subjectGroup})
+		}
+		s.groups[name] = rules
+	}
+	names := map[string]bool{}
+	for i, d := range pf.Deny {
+		if d.Name == "" {
+			return nil, fmt.Errorf("rule deny thứ %d thiếu name", i+1)
+		}
+		if names[d.Name] {
+			return nil, fmt.Errorf("rule deny '%s' bị khai báo trùng", d.Name)
+		}
+		if len(d.Targets) == 0 {
+			return nil, fmt.Errorf("rule deny '%s' thiếu targets", d.Name)
+		}
+		names[d.Name] = true
+		s.deny = append(s.deny, d)
+	}
+	return s, nil
+}
+
+func compileConditions(c *Conditions) error {
+	if c == nil {
+		return nil
+	}
+	return c.compile()
+}
+
+func loadSnapshot(path string) (*snapshot, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pf, err := ParsePolicyFile(b)
+	if err != nil {
+		return nil, fmt.Errorf("lỗi cú pháp trong %s: %v", path, err)
+	}
+	return compile(pf)
+}
@@ -1,72 +1,282 @@
 package rbac
 
 import (
-	"encoding/json"
-	"os"
+	"bytes"
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+	"golang.org/x/crypto/ssh"
 )
 
+// RBAC: engine phân quyền dùng chung cho listener SSH và HTTP API quản trị.
+// Chính sách được nạp từ policies.json và có thể reload nguyên khối khi đang chạy.
 type RBAC struct {
-	mu       sync.RWMutex
-	Policies map[string][]string
+	mu   sync.RWMutex
+	path string
+	// Chính sách cùng inventory và nguồn nhóm, luôn được thay cả khối
+	snap *snapshot
+	// Nguồn quyền tạm thời đã được duyệt
+	grants GrantProvider
+}
+
+// Grant: quyền tạm thời (just-in-time) đã được duyệt cho user trên một máy đích
+type Grant struct {
+	ID      string
+	Role    string
+	Target  string // ip:port đã chuẩn hóa
+	Expires time.Time
+}
+
+// GrantProvider cung cấp các quyền tạm thời còn hiệu lực của user
+type GrantProvider interface {
+	Grants(user string, now time.Time) []Grant
+}
+
+// GroupResolver trả về các nhóm mà user là thành viên
+type GroupResolver interface {
+	Groups(user string) ([]string, error)
 }
 
 func Load(path string) (*RBAC, error) {
-	b, err := os.ReadFile(path)
+	snap, err := loadSnapshot(path)
 	if err != nil {
 		return nil, err
 	}
-	var p map[string][]string
-	if err := json.Unmarshal(b, &p); err != nil {
+	return &RBAC{path: path, snap: snap}, nil
+}
+
+// New dựng RBAC từ PolicyFile đã có sẵn (không gắn với file)
+func New(pf *PolicyFile) (*RBAC, error) {
+	snap, err := compile(pf)
+	if err != nil {
 		return nil, err
 	}
-	return &RBAC{Policies: p}, nil
+	return &RBAC{snap: snap}, nil
 }
 
+// Reload đọc lại file chính sách. File lỗi bị từ chối và chính sách cũ được giữ nguyên.
 func (r *RBAC) Reload(path string) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	b, err := os.ReadFile(path)
+	return r.ReloadWith(path, nil, nil)
+}
+
+// ReloadWith đọc lại file chính sách và thay cùng lúc inventory và nguồn nhóm (nil = giữ
+// nguyên), để không request nào thấy chính sách mới đi với inventory hay nhóm cũ.
+// File lỗi bị từ chối và không thứ gì bị thay.
+func (r *RBAC) ReloadWith(path string, inv *inventory.Inventory, groups GroupResolver) error {
+	snap, err := loadSnapshot(path)
 	if err != nil {
 		return err
 	}
-	var p map[string][]string
-	if err := json.Unmarshal(b, &p); err != nil {
-		return err
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	snap.inv, snap.resolver = r.snap.inv, r.snap.resolver
+	if inv != nil {
+		snap.inv = inv
+	}
+	if groups != nil {
+		snap.resolver = groups
 	}
-	r.Policies = p
+	r.path = path
+	r.snap = snap
 	return nil
 }
 
-// ⭐ Thêm hàm public để lấy danh sách Policies
-func (r *RBAC) ListPolicies() map[string][]string {
+// Path trả về file chính sách đang dùng
+func (r *RBAC) Path() string {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	return r.Policies
+	return r.path
 }
 
-func (r *RBAC) Allows(user, target string) bool {
+// update thay snapshot bằng bản sao đã được sửa bởi change
+func (r *RBAC) update(change func(s *snapshot)) {
+	r.mu.Lock()
+	snap := *r.snap
+	change(&snap)
+	r.snap = &snap
+	r.mu.Unlock()
+}
+
+// SetInventory thay inventory dùng để chuẩn hóa máy đích
+func (r *RBAC) SetInventory(inv *inventory.Inventory) {
+	r.update(func(s *snapshot) { s.inv = inv })
+}
+
+// SetGroupResolver thay nguồn thành viên nhóm
+func (r *RBAC) SetGroupResolver(g GroupResolver) {
+	r.update(func(s *snapshot) { s.resolver = g })
+}
+
+// SetGrantProvider thay nguồn quyền tạm thời
+func (r *RBAC) SetGrantProvider(p GrantProvider) {
+	r.mu.Lock()
+	r.grants = p
+	r.mu.Unlock()
+}
+
+// Groups trả về các nhóm (viết thường) của user. Không cấu hình nguồn nhóm -> không có nhóm nào.
+func (r *RBAC) Groups(user string) ([]string, error) {
+	return r.current().userGroups(user)
+}
+
+func (s *snapshot) userGroups(user string) ([]string, error) {
+	if s.resolver == nil {
+		return nil, nil
+	}
+	groups, err := s.resolver.Groups(user)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, len(groups))
+	for i, name := range groups {
+		out[i] = strings.ToLower(name)
+	}
+	return out, nil
+}
+
+// Inventory trả về inventory đang dùng (có thể nil)
+func (r *RBAC) Inventory() *inventory.Inventory {
+	return r.current().inv
+}
+
+// Normalize chuẩn hóa máy đích user nhập theo inventory hiện tại
+func (r *RBAC) Normalize(input string) (inventory.Target, error) {
+	return r.Inventory().Normalize(input)
+}
+
+func (r *RBAC) current() *snapshot {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	allowed, ok := r.Policies[user]
+	return r.snap
+}
+
+// ⭐ Thêm hàm public để lấy danh sách Policies
+func (r *RBAC) ListPolicies() *PolicyFile {
+	return r.current().file
+}
+
+// Users trả về danh sách user đang có policy
+func (r *RBAC) Users() []string {
+	snap := r.current()
+	users := make([]string, 0, len(snap.users))
+	for u := range snap.users {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Settings trả về thiết lập của role (giá trị rỗng nếu role không được khai báo)
+func (r *RBAC) Settings(role string) RoleSettings {
+	return r.current().roles[role]
+}
+
+// RequiresMFA cho biết role có bắt buộc xác thực TOTP hay không
+func (r *RBAC) RequiresMFA(role string) bool {
+	return r.Settings(role).RequireMFA
+}
+
+// HasAuthorizedKeys cho biết user đã được cấu hình public key chưa
+func (r *RBAC) HasAuthorizedKeys(user string) bool {
+	up, ok := r.current().users[user]
+	return ok && len(up.Keys) > 0
+}
+
+// IsAuthorizedKey kiểm tra key client đưa ra có nằm trong danh sách của user không
+func (r *RBAC) IsAuthorizedKey(user string, key ssh.PublicKey) bool {
+	up, ok := r.current().users[user]
 	if !ok {
 		return false
 	}
-	for _, a := range allowed {
-		if a == "*" {
+	marshaled := key.Marshal()
+	for _, k := range up.Keys {
+		if bytes.Equal(k.Marshal(), marshaled) {
 			return true
 		}
-		if a == target {
-			return true
+	}
+	return false
+}
+
+// CheckAccess đánh giá policy cho user và máy đích (đã chuẩn hóa).
+// Quyền hiệu lực là hợp của rule riêng của user, rule của mọi nhóm user thuộc về
+// và các quyền tạm thời đã được duyệt.
+// Mọi rule deny khớp và áp dụng cho user đều thắng mọi allow, dù allow cụ thể hơn.
+// Giữa các rule cùng hiệu lực: máy đích cụ thể hơn, sau đó rule của user > rule của nhóm > rule chung.
+// Không rule nào khớp -> chặn.
+func (r *RBAC) CheckAccess(user string, target inventory.Target) Decision {
+	return r.CheckAccessAt(user, target, time.Now())
+}
+
+// CheckAccessAt giống CheckAccess nhưng đánh giá điều kiện thời gian tại thời điểm now
+func (r *RBAC) CheckAccessAt(user string, target inventory.Target, now time.Time) Decision {
+	return r.check(user, target, now, now)
+}
+
+// CheckSession đánh giá lại quyền của phiên đang mở bắt đầu lúc start: như CheckAccessAt
+// nhưng max_session tính từ lúc phiên bắt đầu, nên Deadline là hạn thật của phiên.
+func (r *RBAC) CheckSession(user string, target inventory.Target, start, now time.Time) Decision {
+	return r.check(user, target, start, now)
+}
+
+func (r *RBAC) check(user string, target inventory.Target, start, now time.Time) Decision {
+	snap := r.current()
+	// Không tra cứu được nhóm -> chặn, vì có thể bỏ sót rule deny của nhóm
+	groups, err := snap.userGroups(user)
+	if err != nil {
+		return Decision{Effect: Deny, Reason: fmt.Sprintf("không tra cứu được nhóm của user '%s': %v", user, err)}
+	}
+
+	var rules []*rule
+	if up, ok := snap.users[user]; ok {
+		rules = append(rules, up.Rules...)
+	}
+	for _, g := range groups {
+		rules = append(rules, snap.groups[g]...)
+	}
+	grants := r.activeGrants(user, now)
+	if len(rules) == 0 && len(grants) == 0 {
+		return Decision{Effect: Deny, Reason: fmt.Sprintf("user '%s' không có quyền nào trong policy", user)}
+	}
+	for _, d := range snap.deny {
+		if d.exempts(user, groups) {
+			continue
 		}
-		if strings.HasSuffix(a, "*") {
-			prefix := strings.TrimSuffix(a, "*")
-			if strings.HasPrefix(target, prefix) {
-				return true
-			}
+		for j, t := range d.Targets {
+			rules = append(rules, &rule{id: ruleID("deny", d.Name, "targets", j), effect: Deny, target: t, subject: subjectGlobal})
 		}
 	}
-	return false
+	d := evaluate(rules, target, start, now)
+	d.Groups = groups
+	// Quyền tạm thời đã duyệt thắng quyền thường trực, nhưng không vượt qua rule deny
+	if d.Effect == Deny && d.Rule != "" {
+		return d
+	}
+	for _, g := range grants {
+		if g.Target != target.Addr() {
+			continue
+		}
+		expires := g.Expires
+		return Decision{
+			Allowed: true, Role: g.Role, Effect: Allow,
+			Rule: "access[" + g.ID + "]", Pattern: g.Target, Groups: groups,
+			Reason:   "quyền tạm thời " + g.ID + " hiệu lực tới " + expires.Format(time.RFC3339),
+			Deadline: &expires,
+		}
+	}
+	return d
 }
 
+// activeGrants trả về các quyền tạm thời còn hiệu lực của user
+func (r *RBAC) activeGrants(user string, now time.Time) []Grant {
+	r.mu.RLock()
+	p := r.grants
+	r.mu.RUnlock()
+	if p == nil {
+		return nil
+	}
+	return p.Grants(user, now)
+}
@@ -0,0 +1,88 @@
+package rbac
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+)
+
+func writePolicy(t *testing.T, path, policy string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadWith(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policies.json")
+	writePolicy(t, path, `{"groups": [{"group": "ops", "role": "ops", "targets": ["env=prod"]}]}`)
+	r, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldInv, _ := inventory.New([]inventory.Host{{Name: "web1", Address: "10.0.0.1", Labels: map[string]string{"env": "prod"}}})
+	r.SetInventory(oldInv)
+	r.SetGroupResolver(staticGroups{"bob": {"ops"}})
+
+	web1, err := r.Normalize("web1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := r.CheckAccess("bob", web1); !d.Allowed {
+		t.Fatalf("trước reload: %s", d.Reason)
+	}
+
+	// Đổi cả ba: nhóm đổi tên, nhãn đổi giá trị, policy dùng tên và nhãn mới
+	writePolicy(t, path, `{"groups": [{"group": "sre", "role": "sre", "targets": ["env=production"]}]}`)
+	newInv, _ := inventory.New([]inventory.Host{{Name: "web1", Address: "10.0.0.1", Labels: map[string]string{"env": "production"}}})
+	if err := r.ReloadWith(path, newInv, staticGroups{"bob": {"sre"}}); err != nil {
+		t.Fatal(err)
+	}
+	web1, _ = r.Normalize("web1")
+	if d := r.CheckAccess("bob", web1); !d.Allowed || d.Role != "sre" {
+		t.Fatalf("sau reload: %v %q %s", d.Allowed, d.Role, d.Reason)
+	}
+
+	// File lỗi: không thứ gì bị thay, kể cả inventory và nhóm đi kèm
+	writePolicy(t, path, `{"groups": [`)
+	if err := r.ReloadWith(path, oldInv, staticGroups{"bob": {"ops"}}); err == nil {
+		t.Fatal("policy lỗi vẫn được nạp")
+	}
+	if r.Inventory() != newInv {
+		t.Fatal("inventory bị thay dù policy lỗi")
+	}
+	if groups, _ := r.Groups("bob"); len(groups) != 1 || groups[0] != "sre" {
+		t.Fatalf("nhóm bị thay dù policy lỗi: %v", groups)
+	}
+
+	// nil giữ nguyên inventory và nguồn nhóm hiện tại
+	writePolicy(t, path, `{"groups": [{"group": "sre", "role": "sre2", "targets": ["env=production"]}]}`)
+	if err := r.Reload(path); err != nil {
+		t.Fatal(err)
+	}
+	if d := r.CheckAccess("bob", web1); !d.Allowed || d.Role != "sre2" || r.Inventory() != newInv {
+		t.Fatalf("Reload làm mất inventory / nhóm: %v %q", d.Allowed, d.Role)
+	}
+}
+
+func TestCheckSessionDeadline(t *testing.T) {
+	r := mustRBAC(t, `{"users": [
+		{"user": "bob", "role": "ops", "targets": ["10.0.0.1"], "conditions": {"max_session": "1h"}}
+	]}`)
+	dest := target("10.0.0.1", 22, "", nil)
+	now := time.Now()
+
+	d := r.CheckAccessAt("bob", dest, now)
+	if d.Deadline == nil || !d.Deadline.Equal(now.Add(time.Hour)) {
+		t.Fatalf("phiên mới: deadline %v; muốn %v", d.Deadline, now.Add(time.Hour))
+	}
+	// Phiên đã chạy 40 phút: max_session tính từ lúc bắt đầu, không từ lúc đánh giá lại
+	start := now.Add(-40 * time.Minute)
+	d = r.CheckSession("bob", dest, start, now)
+	if !d.Allowed || d.Deadline == nil || !d.Deadline.Equal(start.Add(time.Hour)) {
+		t.Fatalf("phiên đang mở: %v, deadline %v; muốn %v", d.Allowed, d.Deadline, start.Add(time.Hour))
+	}
+}
@@ -0,0 +1,251 @@
+package rbac
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+)
+
+// TargetRule: một mẫu máy đích trong policy.
+//
+// Dạng rút gọn (chuỗi):
+//
+//	"*"                       mọi máy đích
+//	"10.0.0.5", "10.0.0.5:22" IP, có thể kèm port
+//	"10.0.0.0/16"             dải CIDR ("[fd00::/8]:22" nếu kèm port)
+//	"web*", "10.0.0.*"        glob trên tên inventory hoặc IP
+//	"env=prod,team=payments"  nhãn của máy đích trong inventory
+//
+// Dạng đầy đủ: {"host": "10.0.0.0/16", "ports": [22, 2222], "labels": {"env": "prod"}}
+//
+// Tên (glob hoặc chính xác) chỉ khớp tên do inventory khai báo, không khớp hostname user nhập:
+// user điều khiển được DNS của hostname đó (vd web.attacker.com). Máy đích ngoài inventory
+// chỉ được cấp quyền qua rule IP / CIDR trên IP đã phân giải.
+type TargetRule struct {
+	Host   string            `json:"host,omitempty"`
+	Ports  []int             `json:"ports,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	prefix netip.Prefix
+	ip     netip.Addr
+}
+
+func (t *TargetRule) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		rule, err := ParseTargetRule(s)
+		if err != nil {
+			return err
+		}
+		*t = rule
+		return nil
+	}
+	type plain TargetRule
+	var p plain
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	*t = TargetRule(p)
+	return t.compile()
+}
+
+// ParseTargetRule đọc dạng rút gọn của TargetRule
+func ParseTargetRule(s string) (TargetRule, error) {
+	s = strings.TrimSpace(s)
+	var t TargetRule
+	switch {
+	case s == "":
+		return t, fmt.Errorf("mẫu máy đích rỗng")
+	case strings.Contains(s, "="):
+		t.Labels = map[string]string{}
+		for _, kv := range strings.Split(s, ",") {
+			k, v, ok := strings.Cut(kv, "=")
+			k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+			if !ok || k == "" || v == "" {
+				return t, fmt.Errorf("nhãn '%s' không hợp lệ (cần dạng key=value)", kv)
+			}
+			t.Labels[k] = v
+		}
+	default:
+		t.Host = s
+		if host, port, err := net.SplitHostPort(s); err == nil {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return t, fmt.Errorf("mẫu máy đích '%s': port không hợp lệ", s)
+			}
+			t.Host, t.Ports = host, []int{p}
+		}
+	}
+	return t, t.compile()
+}
+
+// compile kiểm tra mẫu và chuẩn bị IP / CIDR để so khớp
+func (t *TargetRule) compile() error {
+	t.Host = strings.ToLower(strings.TrimSpace(t.Host))
+	for _, p := range t.Ports {
+		if p < 1 || p > 65535 {
+			return fmt.Errorf("mẫu máy đích '%s': port %d không hợp lệ", t.Host, p)
+		}
+	}
+	for k, v := range t.Labels {
+		if _, err := path.Match(v, ""); err != nil {
+			return fmt.Errorf("nhãn %s=%s: mẫu không hợp lệ", k, v)
+		}
+	}
+	if t.Host == "" && len(t.Labels) == 0 && len(t.Ports) == 0 {
+		return fmt.Errorf("mẫu máy đích rỗng")
+	}
+	if strings.Contains(t.Host, "/") {
+		prefix, err := netip.ParsePrefix(t.Host)
+		if err != nil {
+			return fmt.Errorf("dải CIDR '%s' không hợp lệ: %v", t.Host, err)
+		}
+		t.prefix = prefix.Masked()
+		return nil
+	}
+	if ip, err := netip.ParseAddr(t.Host); err == nil {
+		t.ip = ip.Unmap()
+		return nil
+	}
+	if _, err := path.Match(t.Host, ""); err != nil {
+		return fmt.Errorf("mẫu máy đích '%s' không hợp lệ", t.Host)
+	}
+	return nil
+}
+
+// Match kiểm tra máy đích (đã chuẩn hóa) có khớp mẫu không
+func (t *TargetRule) Match(target inventory.Target) bool {
+	if len(t.Ports) > 0 && !containsInt(t.Ports, target.Port) {
+		return false
+	}
+	for k, v := range t.Labels {
+		actual, ok := target.Labels[k]
+		if !ok {
+			return false
+		}
+		if matched, _ := path.Match(v, actual); !matched {
+			return false
+		}
+	}
+	switch {
+	case t.Host == "" || t.Host == "*":
+		return true
+	case t.prefix.IsValid():
+		return target.IP.IsValid() && t.prefix.Contains(target.IP.Unmap())
+	case t.ip.IsValid():
+		return target.IP.IsValid() && t.ip == target.IP.Unmap()
+	}
+	for _, name := range []string{target.Name, target.IP.String()} {
+		if name == "" {
+			continue
+		}
+		if matched, _ := path.Match(t.Host, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Specificity: mức cụ thể của mẫu máy đích, dùng để xếp thứ tự ưu tiên giữa các rule
+type Specificity struct {
+	// 0: mọi host; 1000+: glob (cộng số ký tự cố định); 2000+: CIDR (cộng độ dài prefix theo bit IPv6);
+	// 3000: IP hoặc hostname chính xác
+	Host   int
+	Ports  bool
+	Labels int
+}
+
+// Compare trả về 1 nếu s cụ thể hơn o, -1 nếu kém hơn, 0 nếu bằng
+func (s Specificity) Compare(o Specificity) int {
+	switch {
+	case s.Host != o.Host:
+		return sign(s.Host - o.Host)
+	case s.Ports != o.Ports:
+		if s.Ports {
+			return 1
+		}
+		return -1
+	default:
+		return sign(s.Labels - o.Labels)
+	}
+}
+
+func sign(n int) int {
+	switch {
+	case n > 0:
+		return 1
+	case n < 0:
+		return -1
+	}
+	return 0
+}
+
+func (t *TargetRule) Specificity() Specificity {
+	s := Specificity{Ports: len(t.Ports) > 0, Labels: len(t.Labels)}
+	switch {
+	case t.Host == "" || t.Host == "*":
+	case t.ip.IsValid():
+		s.Host = 3000
+	case t.prefix.IsValid():
+		bits := t.prefix.Bits()
+		if t.prefix.Addr().Is4() {
+			bits += 96
+		}
+		s.Host = 2000 + bits
+		if bits == 128 {
+			s.Host = 3000
+		}
+	case !strings.ContainsAny(t.Host, "*?["):
+		s.Host = 3000
+	default:
+		literal := len(t.Host) - strings.Count(t.Host, "*") - strings.Count(t.Host, "?")
+		if literal > 999 {
+			literal = 999
+		}
+		s.Host = 1000 + literal
+	}
+	return s
+}
+
+func (t TargetRule) String() string {
+	var parts []string
+	if t.Host != "" {
+		parts = append(parts, t.Host)
+	}
+	if len(t.Ports) > 0 {
+		ports := make([]string, len(t.Ports))
+		for i, p := range t.Ports {
+			ports[i] = strconv.Itoa(p)
+		}
+		parts = append(parts, "port "+strings.Join(ports, ","))
+	}
+	if len(t.Labels) > 0 {
+		keys := make([]string, 0, len(t.Labels))
+		for k := range t.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		labels := make([]string, len(keys))
+		for i, k := range keys {
+			labels[i] = k + "=" + t.Labels[k]
+		}
+		parts = append(parts, strings.Join(labels, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package rbac
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Entidi89/ssh_proxy1/internal/inventory"
+)
+
+func TestTargetRuleMatch(t *testing.T) {
+	web := target("10.0.1.5", 22, "web1", map[string]string{"env": "prod", "team": "payments"})
+	web.Hostname = "web1.corp"
+	targets := map[string]inventory.Target{
+		"web":    web,
+		"v6":     target("fd00::5", 2222, "", nil),
+		"mapped": target("::ffff:10.0.1.5", 22, "", nil),
+	}
+
+	tests := []struct {
+		rule   string
+		target string
+		want   bool
+	}{
+		{"*", "web", true},
+		{"10.0.1.5", "web", true},
+		{"10.0.1.6", "web", false},
+		{"10.0.1.5:22", "web", true},
+		{"10.0.1.5:2222", "web", false},
+		{"10.0.0.0/16", "web", true},
+		{"10.1.0.0/16", "web", false},
+		{"10.0.1.5", "mapped", true},
+		{"10.0.0.0/8", "mapped", true},
+		{"[fd00::/8]:2222", "v6", true},
+		{"[fd00::/8]:22", "v6", false},
+		{"fd00::5", "v6", true},
+		{"10.0.0.0/8", "v6", false},
+		{"web*", "web", true},
+		// Hostname không do inventory khai báo: không dùng để so khớp tên
+		{"*.corp", "web", false},
+		{"web1.corp", "web", false},
+		{"10.0.1.*", "web", true},
+		{"db*", "web", false},
+		{"WEB1", "web", true},
+		{"env=prod", "web", true},
+		{"env=prod,team=payments", "web", true},
+		{"env=prod,team=risk", "web", false},
+		{"env=dev", "web", false},
+		{"team=pay*", "web", true},
+		{"env=prod", "v6", false},
+	}
+	for _, tt := range tests {
+		rule, err := ParseTargetRule(tt.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.rule, err)
+		}
+		if got := rule.Match(targets[tt.target]); got != tt.want {
+			t.Errorf("%q matches %s: got %v, want %v", tt.rule, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestTargetRuleIgnoresTypedHostname(t *testing.T) {
+	// user nhập web.attacker.com, DNS do kẻ tấn công điều khiển trỏ về một máy ngoài inventory
+	adhoc := target("10.9.9.9", 22, "", nil)
+	adhoc.Hostname = "web.attacker.com"
+	// ... hoặc trỏ về máy db1 trong inventory
+	db := target("10.0.2.7", 22, "db1", nil)
+	db.Hostname = "web.attacker.com"
+
+	tests := []struct {
+		rule   string
+		target inventory.Target
+		want   bool
+	}{
+		{"web*", adhoc, false},
+		{"*.attacker.com", adhoc, false},
+		{"web.attacker.com", adhoc, false},
+		{"web*", db, false},
+		{"db*", db, true},
+		{"10.9.9.0/24", adhoc, true},
+		{"10.9.9.*", adhoc, true},
+	}
+	for _, tt := range tests {
+		rule, err := ParseTargetRule(tt.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.rule, err)
+		}
+		if got := rule.Match(tt.target); got != tt.want {
+			t.Errorf("%q matches %s: got %v, want %v", tt.rule, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestTargetRuleFullForm(t *testing.T) {
+	var rule TargetRule
+	if err := json.Unmarshal([]byte(`{"host": "10.0.0.0/16", "ports": [22, 2222], "labels": {"env": "prod"}}`), &rule); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target inventory.Target
+		want   bool
+	}{
+		{target("10.0.3.4", 2222, "", map[string]string{"env": "prod"}), true},
+		{target("10.0.3.4", 22, "", map[string]string{"env": "prod"}), true},
+		{target("10.0.3.4", 80, "", map[string]string{"env": "prod"}), false},
+		{target("10.0.3.4", 22, "", map[string]string{"env": "dev"}), false},
+		{target("10.0.3.4", 22, "", nil), false},
+		{target("10.1.3.4", 22, "", map[string]string{"env": "prod"}), false},
+	}
+	for _, tt := range tests {
+		if got := rule.Match(tt.target); got != tt.want {
+			t.Errorf("%s matches %s: got %v, want %v", rule, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestParseTargetRuleErrors(t *testing.T) {
+	for _, s := range []string{"", "10.0.0.0/33", "10.0.0.5:abc", "10.0.0.5:70000", "env=", "=prod", "web[", "env=[x"} {
+		if _, err := ParseTargetRule(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestSpecificityOrder(t *testing.T) {
+	// từ kém cụ thể tới cụ thể nhất
+	order := []string{"*", "web*", "web1*", "10.0.0.0/8", "10.0.0.0/16", "10.0.0.0/16:22", "10.0.0.5", "10.0.0.5:22"}
+	for i := 1; i < len(order); i++ {
+		a, _ := ParseTargetRule(order[i-1])
+		b, _ := ParseTargetRule(order[i])
+		if c := b.Specificity().Compare(a.Specificity()); c <= 0 {
+			t.Errorf("%q should be more specific than %q (compare=%d)", order[i], order[i-1], c)
+		}
+	}
+	one, _ := ParseTargetRule("env=prod")
+	two, _ := ParseTargetRule("env=prod,team=payments")
+	if two.Specificity().Compare(one.Specificity()) <= 0 {
+		t.Errorf("two labels should be more specific than one")
+	}
+}
@@ -0,0 +1,117 @@
+package roles
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Role: định nghĩa một role SSH (tương ứng một role trên mount ssh-client-signer của Vault)
+type Role struct {
+	Name string `json:"name"`
+	// Tên role trên Vault (mặc định = Name)
+	VaultRole string `json:"vault_role"`
+	// Thời hạn certificate, vd "15m", "1h"
+	TTL string `json:"ttl"`
+	// Các OS login (principal) được phép xin certificate. "*" = mọi login.
+	AllowedUsers []string `json:"allowed_users"`
+	// Login dùng khi user không chỉ định (alice+10.0.0.5)
+	DefaultLogin    string            `json:"default_login"`
+	Extensions      map[string]string `json:"extensions"`
+	CriticalOptions map[string]string `json:"critical_options"`
+}
+
+// File: cấu trúc file roles.json
+type File struct {
+	Roles []Role `json:"roles"`
+}
+
+// Set: tập role đã nạp, tra cứu theo tên
+type Set struct {
+	roles map[string]*Role
+}
+
+// Load đọc và kiểm tra roles.json
+func Load(path string) (*Set, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f File
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("lỗi cú pháp trong %s: %v", path, err)
+	}
+	return New(f.Roles)
+}
+
+// New dựng Set từ danh sách role, điền giá trị mặc định và kiểm tra hợp lệ
+func New(list []Role) (*Set, error) {
+	s := &Set{roles: make(map[string]*Role)}
+	for i := range list {
+		r := list[i]
+		if r.Name == "" {
+			return nil, fmt.Errorf("role thứ %d thiếu name", i+1)
+		}
+		if _, dup := s.roles[r.Name]; dup {
+			return nil, fmt.Errorf("role '%s' bị khai báo trùng", r.Name)
+		}
+		if r.VaultRole == "" {
+			r.VaultRole = r.Name
+		}
+		if r.TTL != "" {
+			if _, err := time.ParseDuration(r.TTL); err != nil {
+				return nil, fmt.Errorf("role '%s': ttl không hợp lệ: %v", r.Name, err)
+			}
+		}
+		if len(r.AllowedUsers) == 0 {
+			return nil, fmt.Errorf("role '%s' thiếu allowed_users", r.Name)
+		}
+		if r.DefaultLogin == "" {
+			return nil, fmt.Errorf("role '%s' thiếu default_login", r.Name)
+		}
+		if !r.Allows(r.DefaultLogin) {
+			return nil, fmt.Errorf("role '%s': default_login '%s' không nằm trong allowed_users", r.Name, r.DefaultLogin)
+		}
+		s.roles[r.Name] = &r
+	}
+	return s, nil
+}
+
+// Get trả về role theo tên
+func (s *Set) Get(name string) (*Role, bool) {
+	r, ok := s.roles[name]
+	return r, ok
+}
+
+// List trả về các role, sắp theo tên
+func (s *Set) List() []*Role {
+	out := make([]*Role, 0, len(s.roles))
+	for _, r := range s.roles {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Allows cho biết OS login có được role này cho phép không
+func (r *Role) Allows(login string) bool {
+	for _, u := range r.AllowedUsers {
+		if u == "*" || u == login {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveLogin chọn OS login cho phiên: login user yêu cầu (nếu được phép) hoặc default_login
+func (r *Role) ResolveLogin(requested string) (string, error) {
+	if requested == "" {
+		return r.DefaultLogin, nil
+	}
+	if !r.Allows(requested) {
+		return "", fmt.Errorf("role '%s' không cho phép đăng nhập bằng '%s'", r.Name, requested)
+	}
+	return requested, nil
+}
@@ -0,0 +1,389 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Kiểu gói tin SFTP v3 (draft-ietf-secsh-filexfer-02)
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpSetstat  = 9
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpRmdir    = 15
+	fxpRename   = 18
+	fxpSymlink  = 20
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpExtended = 200
+)
+
+// Cờ mở file (pflags) của SSH_FXP_OPEN
+const (
+	fxfRead   = 0x01
+	fxfWrite  = 0x02
+	fxfAppend = 0x04
+	fxfCreat  = 0x08
+	fxfTrunc  = 0x10
+)
+
+const fxPermissionDenied = 3
+
+// Gói tin lớn hơn giới hạn này bị coi là luồng hỏng (OpenSSH giới hạn 256KB)
+const maxPacket = 4 << 20
+
+var errPacketTooLarge = errors.New("sftp: gói tin quá lớn")
+
+// Policy: giới hạn truyền file theo role
+type Policy struct {
+	DenyUpload   bool
+	DenyDownload bool
+}
+
+// Event: một thao tác file được ghi vào bản ghi phiên
+type Event struct {
+	Op        string `json:"op"` // open, read, write, rename, hardlink, remove, mkdir, rmdir, setstat, symlink
+	Path      string `json:"path"`
+	NewPath   string `json:"new_path,omitempty"`
+	Direction string `json:"direction,omitempty"` // upload / download
+	Bytes     uint64 `json:"bytes,omitempty"`
+	Denied    bool   `json:"denied,omitempty"`
+}
+
+type openFile struct {
+	path    string
+	read    uint64
+	written uint64
+}
+
+type pendingReq struct {
+	typ    byte
+	path   string
+	handle string
+}
+
+// Auditor phân tích luồng SFTP giữa client và máy đích: ghi lại mọi thao tác file
+// và từ chối upload/download theo Policy bằng cách trả SSH_FXP_STATUS cho client.
+type Auditor struct {
+	policy  Policy
+	onEvent func(Event)
+
+	mu      sync.Mutex
+	pending map[uint32]pendingReq
+	handles map[string]*openFile
+
+	// toClient được dùng chung bởi luồng máy đích -> client và các phản hồi từ chối
+	writeMu  sync.Mutex
+	toClient io.Writer
+}
+
+func NewAuditor(policy Policy, toClient io.Writer, onEvent func(Event)) *Auditor {
+	return &Auditor{
+		policy:   policy,
+		onEvent:  onEvent,
+		pending:  make(map[uint32]pendingReq),
+		handles:  make(map[string]*openFile),
+		toClient: toClient,
+	}
+}
+
+// readPacket đọc một gói tin SFTP (uint32 length + payload)
+func readPacket(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == 0 || n > maxPacket {
+		return nil, errPacketTooLarge
+	}
+	buf := make([]byte, 4+n)
+	copy(buf, hdr[:])
+	if _, err := io.ReadFull(r, buf[4:]); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// packetReader giúp đọc các trường của payload
+type packetReader struct {
+	b   []byte
+	err error
+}
+
+func (p *packetReader) uint32() uint32 {
+	if p.err != nil || len(p.b) < 4 {
+		p.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint32(p.b)
+	p.b = p.b[4:]
+	return v
+}
+
+func (p *packetReader) uint64() uint64 {
+	if p.err != nil || len(p.b) < 8 {
+		p.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint64(p.b)
+	p.b = p.b[8:]
+	return v
+}
+
+func (p *packetReader) string() string {
+	n := p.uint32()
+	if p.err != nil || uint32(len(p.b)) < n {
+		p.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	s := string(p.b[:n])
+	p.b = p.b[n:]
+	return s
+}
+
+func (a *Auditor) emit(ev Event) {
+	if a.onEvent != nil {
+		a.onEvent(ev)
+	}
+}
+
+// writeClient gửi một gói tin về client
+func (a *Auditor) writeClient(pkt []byte) error {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	_, err := a.toClient.Write(pkt)
+	return err
+}
+
+// deny trả SSH_FXP_STATUS(PERMISSION_DENIED) cho request id mà không chuyển tới máy đích
+func (a *Auditor) deny(id uint32, msg string) error {
+	var body []byte
+	body = append(body, fxpStatus)
+	body = binary.BigEndian.AppendUint32(body, id)
+	body = binary.BigEndian.AppendUint32(body, fxPermissionDenied)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(msg)))
+	body = append(body, msg...)
+	body = binary.BigEndian.AppendUint32(body, 0) // language tag
+	pkt := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	return a.writeClient(append(pkt, body...))
+}
+
+// ClientToServer đọc gói tin từ client, ghi nhận / kiểm tra quyền rồi chuyển tới máy đích
+func (a *Auditor) ClientToServer(client io.Reader, upstream io.Writer) error {
+	for {
+		pkt, err := readPacket(client)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		forward, err := a.inspectRequest(pkt)
+		if err != nil {
+			return err
+		}
+		if !forward {
+			continue
+		}
+		if _, err := upstream.Write(pkt); err != nil {
+			return err
+		}
+	}
+}
+
+// ServerToClient đọc phản hồi từ máy đích, ghi nhận handle / số byte rồi chuyển về client
+func (a *Auditor) ServerToClient(upstream io.Reader) error {
+	for {
+		pkt, err := readPacket(upstream)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		a.inspectResponse(pkt)
+		if err := a.writeClient(pkt); err != nil {
+			return err
+		}
+	}
+}
+
+// inspectRequest trả về false nếu request bị từ chối (đã trả lời client)
+func (a *Auditor) inspectRequest(pkt []byte) (bool, error) {
+	typ := pkt[4]
+	if typ == fxpInit {
+		return true, nil
+	}
+	p := &packetReader{b: pkt[5:]}
+	id := p.uint32()
+
+	switch typ {
+	case fxpOpen:
+		path := p.string()
+		flags := p.uint32()
+		if p.err != nil {
+			return false, fmt.Errorf("sftp: gói OPEN không hợp lệ: %v", p.err)
+		}
+		ev := Event{Op: "open", Path: path}
+		writing := flags&(fxfWrite|fxfAppend|fxfCreat|fxfTrunc) != 0
+		reading := flags&fxfRead != 0
+		switch {
+		case writing:
+			ev.Direction = "upload"
+		case reading:
+			ev.Direction = "download"
+		}
+		if (writing && a.policy.DenyUpload) || (reading && a.policy.DenyDownload) {
+			ev.Denied = true
+			a.emit(ev)
+			return false, a.deny(id, "proxy: "+ev.Direction+" denied by policy")
+		}
+		a.emit(ev)
+		a.track(id, pendingReq{typ: typ, path: path})
+
+	case fxpRead, fxpWrite:
+		handle := p.string()
+		p.uint64() // offset
+		a.mu.Lock()
+		f := a.handles[handle]
+		a.mu.Unlock()
+		if typ == fxpWrite {
+			data := p.string()
+			if a.policy.DenyUpload {
+				return false, a.deny(id, "proxy: upload denied by policy")
+			}
+			// Chỉ tính dữ liệu thực sự được chuyển tới máy đích
+			if f != nil {
+				a.mu.Lock()
+				f.written += uint64(len(data))
+				a.mu.Unlock()
+			}
+			break
+		}
+		a.track(id, pendingReq{typ: typ, handle: handle})
+
+	case fxpClose:
+		handle := p.string()
+		a.closeHandle(handle)
+
+	case fxpRemove, fxpRmdir, fxpMkdir, fxpSetstat:
+		path := p.string()
+		ops := map[byte]string{fxpRemove: "remove", fxpRmdir: "rmdir", fxpMkdir: "mkdir", fxpSetstat: "setstat"}
+		ev := Event{Op: ops[typ], Path: path}
+		if a.policy.DenyUpload {
+			ev.Denied = true
+			a.emit(ev)
+			return false, a.deny(id, "proxy: modification denied by policy")
+		}
+		a.emit(ev)
+
+	case fxpRename, fxpSymlink:
+		oldPath := p.string()
+		newPath := p.string()
+		ev := Event{Op: "rename", Path: oldPath, NewPath: newPath}
+		if typ == fxpSymlink {
+			ev.Op = "symlink"
+		}
+		if a.policy.DenyUpload {
+			ev.Denied = true
+			a.emit(ev)
+			return false, a.deny(id, "proxy: modification denied by policy")
+		}
+		a.emit(ev)
+
+	case fxpExtended:
+		name := p.string()
+		if name == "posix-rename@openssh.com" || name == "hardlink@openssh.com" {
+			oldPath := p.string()
+			newPath := p.string()
+			ev := Event{Op: "rename", Path: oldPath, NewPath: newPath}
+			if name == "hardlink@openssh.com" {
+				ev.Op = "hardlink"
+			}
+			if a.policy.DenyUpload {
+				ev.Denied = true
+				a.emit(ev)
+				return false, a.deny(id, "proxy: modification denied by policy")
+			}
+			a.emit(ev)
+		}
+	}
+	return true, nil
+}
+
+func (a *Auditor) track(id uint32, req pendingReq) {
+	a.mu.Lock()
+	a.pending[id] = req
+	a.mu.Unlock()
+}
+
+// closeHandle ghi tổng số byte đã đọc / ghi của file khi client đóng handle
+func (a *Auditor) closeHandle(handle string) {
+	a.mu.Lock()
+	f, ok := a.handles[handle]
+	delete(a.handles, handle)
+	a.mu.Unlock()
+	if !ok {
+		return
+	}
+	if f.read > 0 {
+		a.emit(Event{Op: "read", Path: f.path, Direction: "download", Bytes: f.read})
+	}
+	if f.written > 0 {
+		a.emit(Event{Op: "write", Path: f.path, Direction: "upload", Bytes: f.written})
+	}
+}
+
+func (a *Auditor) inspectResponse(pkt []byte) {
+	typ := pkt[4]
+	if typ == fxpVersion {
+		return
+	}
+	p := &packetReader{b: pkt[5:]}
+	id := p.uint32()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	req, ok := a.pending[id]
+	if !ok {
+		return
+	}
+	delete(a.pending, id)
+
+	switch {
+	case typ == fxpHandle && req.typ == fxpOpen:
+		handle := p.string()
+		if p.err == nil {
+			a.handles[handle] = &openFile{path: req.path}
+		}
+	case typ == fxpData && req.typ == fxpRead:
+		data := p.string()
+		if f := a.handles[req.handle]; f != nil && p.err == nil {
+			f.read += uint64(len(data))
+		}
+	}
+}
+
+// Flush ghi lại các file client chưa đóng khi kênh kết thúc
+func (a *Auditor) Flush() {
+	a.mu.Lock()
+	handles := make([]string, 0, len(a.handles))
+	for h := range a.handles {
+		handles = append(handles, h)
+	}
+	a.mu.Unlock()
+	for _, h := range handles {
+		a.closeHandle(h)
+	}
+}
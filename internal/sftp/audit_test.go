@@ -0,0 +1,61 @@
+package sftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// packet dựng một gói tin SFTP: kiểu, request id rồi các trường (string hoặc uint32)
+func packet(typ byte, id uint32, fields ...interface{}) []byte {
+	body := []byte{typ}
+	body = binary.BigEndian.AppendUint32(body, id)
+	for _, f := range fields {
+		switch v := f.(type) {
+		case string:
+			body = binary.BigEndian.AppendUint32(body, uint32(len(v)))
+			body = append(body, v...)
+		case uint32:
+			body = binary.BigEndian.AppendUint32(body, v)
+		case uint64:
+			body = binary.BigEndian.AppendUint64(body, v)
+		}
+	}
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(body))), body...)
+}
+
+func TestHardlinkIsAuditedAsHardlink(t *testing.T) {
+	var events []Event
+	a := NewAuditor(Policy{}, &bytes.Buffer{}, func(ev Event) { events = append(events, ev) })
+	var upstream bytes.Buffer
+	in := packet(fxpExtended, 1, "hardlink@openssh.com", "/etc/shadow", "/tmp/x")
+	in = append(in, packet(fxpExtended, 2, "posix-rename@openssh.com", "/tmp/a", "/tmp/b")...)
+	if err := a.ClientToServer(bytes.NewReader(in), &upstream); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Op != "hardlink" || events[1].Op != "rename" {
+		t.Fatalf("events %+v, want hardlink then rename", events)
+	}
+}
+
+func TestDeniedWriteIsNotCounted(t *testing.T) {
+	var events []Event
+	a := NewAuditor(Policy{DenyUpload: true}, &bytes.Buffer{}, func(ev Event) { events = append(events, ev) })
+	// handle đã mở (vd trước khi policy đổi): dữ liệu bị chặn không được tính là đã upload
+	a.handles["h1"] = &openFile{path: "/tmp/f"}
+	var upstream, client bytes.Buffer
+	a.toClient = &client
+	in := packet(fxpWrite, 7, "h1", uint64(0), "secret data")
+	if err := a.ClientToServer(bytes.NewReader(in), &upstream); err != nil {
+		t.Fatal(err)
+	}
+	if upstream.Len() != 0 {
+		t.Errorf("denied write was forwarded upstream")
+	}
+	if client.Len() == 0 || client.Bytes()[4] != fxpStatus {
+		t.Errorf("client did not get a status reply")
+	}
+	if n := a.handles["h1"].written; n != 0 {
+		t.Errorf("written = %d, want 0", n)
+	}
+}
@@ -0,0 +1,148 @@
+package sftp
+
+import (
+	"bytes"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Dòng điều khiển dài hơn giới hạn này bị coi là luồng không phải scp
+const maxSCPLine = 8 << 10
+
+// SCPParser đọc luồng dữ liệu của giao thức scp kiểu cũ (scp -t / scp -f, OpenSSH scp -O)
+// theo chiều gửi file: upload là luồng client -> máy đích, download là luồng máy đích -> client.
+// Mỗi file truyền xong được báo qua Event (op write cho upload, read cho download) với đường
+// dẫn tương đối so với đích của lệnh scp; thư mục tạo khi upload được báo là mkdir.
+//
+// SCPParser chỉ quan sát, không sửa dữ liệu. Gặp dòng điều khiển không hiểu được thì ngừng
+// phân tích (Broken) và báo một event "scp-unparsed", dữ liệu vẫn được chuyển nguyên vẹn.
+type SCPParser struct {
+	direction string
+	onEvent   func(Event)
+
+	dirs   []string
+	line   []byte
+	file   string
+	size   uint64
+	copied uint64
+	// Đang trong dữ liệu file (kể cả byte 0 kết thúc file)
+	inData bool
+	broken bool
+}
+
+// NewSCPParser tạo bộ phân tích cho một lệnh scp; direction là "upload" hoặc "download"
+func NewSCPParser(direction string, onEvent func(Event)) *SCPParser {
+	return &SCPParser{direction: direction, onEvent: onEvent}
+}
+
+// Broken cho biết luồng đã không còn phân tích được
+func (p *SCPParser) Broken() bool { return p.broken }
+
+// Write nhận dữ liệu theo chiều gửi file; luôn nhận hết để dùng được với io.TeeReader
+func (p *SCPParser) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 && !p.broken {
+		if p.inData {
+			// size byte dữ liệu rồi một byte 0
+			if left := p.size - p.copied; left > 0 {
+				k := uint64(len(b))
+				if k > left {
+					k = left
+				}
+				p.copied += k
+				b = b[k:]
+				continue
+			}
+			p.inData = false
+			b = b[1:]
+			p.finishFile()
+			continue
+		}
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			p.line = append(p.line, b...)
+			if len(p.line) > maxSCPLine {
+				p.fail("dòng điều khiển quá dài")
+			}
+			break
+		}
+		p.line = append(p.line, b[:i]...)
+		b = b[i+1:]
+		p.control(string(p.line))
+		p.line = p.line[:0]
+	}
+	return n, nil
+}
+
+// Flush báo file đang truyền dở khi luồng kết thúc
+func (p *SCPParser) Flush() {
+	if p.inData {
+		p.inData = false
+		p.finishFile()
+	}
+}
+
+// control xử lý một dòng điều khiển: C (file), D (vào thư mục), E (ra khỏi thư mục), T (thời gian),
+// 0x01 / 0x02 (thông báo lỗi)
+func (p *SCPParser) control(line string) {
+	if line == "" {
+		p.fail("dòng điều khiển rỗng")
+		return
+	}
+	switch line[0] {
+	case 'T':
+		return
+	case '\x01', '\x02':
+		// Cảnh báo / lỗi của phía gửi (vd file không tồn tại), không kèm dữ liệu
+		return
+	case 'E':
+		if len(p.dirs) > 0 {
+			p.dirs = p.dirs[:len(p.dirs)-1]
+		}
+		return
+	case 'C', 'D':
+	default:
+		p.fail("dòng điều khiển không hợp lệ: " + strconv.Quote(line))
+		return
+	}
+	// C0644 <size> <name> / D0755 0 <name>
+	fields := strings.SplitN(line[1:], " ", 3)
+	if len(fields) != 3 || fields[2] == "" || strings.Contains(fields[2], "/") {
+		p.fail("dòng điều khiển không hợp lệ: " + strconv.Quote(line))
+		return
+	}
+	size, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		p.fail("kích thước không hợp lệ: " + strconv.Quote(line))
+		return
+	}
+	name := path.Join(append(append([]string(nil), p.dirs...), fields[2])...)
+	if line[0] == 'D' {
+		p.dirs = append(p.dirs, fields[2])
+		if p.direction == "upload" {
+			p.emit(Event{Op: "mkdir", Path: name, Direction: p.direction})
+		}
+		return
+	}
+	p.file, p.size, p.copied, p.inData = name, size, 0, true
+}
+
+func (p *SCPParser) finishFile() {
+	op := "read"
+	if p.direction == "upload" {
+		op = "write"
+	}
+	p.emit(Event{Op: op, Path: p.file, Direction: p.direction, Bytes: p.copied})
+}
+
+func (p *SCPParser) fail(reason string) {
+	p.broken = true
+	p.emit(Event{Op: "scp-unparsed", Path: reason, Direction: p.direction})
+}
+
+func (p *SCPParser) emit(ev Event) {
+	if p.onEvent != nil {
+		p.onEvent(ev)
+	}
+}
@@ -0,0 +1,92 @@
+package sftp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// scpStream dựng luồng gửi file của scp -r: thư mục dir chứa a.txt, rồi b.bin ở ngoài
+func scpStream() string {
+	return "T1700000000 0 1700000000 0\n" +
+		"D0755 0 dir\n" +
+		"C0644 5 a.txt\n" + "hello" + "\x00" +
+		"E\n" +
+		"C0600 7 b.bin\n" + "\x00\n\tC\nE\n" + "\x00"
+}
+
+func TestSCPParserUpload(t *testing.T) {
+	want := []Event{
+		{Op: "mkdir", Path: "dir", Direction: "upload"},
+		{Op: "write", Path: "dir/a.txt", Direction: "upload", Bytes: 5},
+		{Op: "write", Path: "b.bin", Direction: "upload", Bytes: 7},
+	}
+	// Cả luồng một lần và từng byte một: kết quả phải như nhau
+	for _, chunk := range []int{0, 1, 3} {
+		var events []Event
+		p := NewSCPParser("upload", func(ev Event) { events = append(events, ev) })
+		stream := scpStream()
+		if chunk == 0 {
+			p.Write([]byte(stream))
+		} else {
+			for i := 0; i < len(stream); i += chunk {
+				p.Write([]byte(stream[i:min(i+chunk, len(stream))]))
+			}
+		}
+		p.Flush()
+		if p.Broken() || !reflect.DeepEqual(events, want) {
+			t.Errorf("chunk %d: events %+v (broken %v), want %+v", chunk, events, p.Broken(), want)
+		}
+	}
+}
+
+func TestSCPParserDownload(t *testing.T) {
+	var events []Event
+	p := NewSCPParser("download", func(ev Event) { events = append(events, ev) })
+	// Lỗi của phía gửi (file không tồn tại) rồi một thư mục: mkdir không được báo khi download
+	p.Write([]byte("\x01scp: /etc/nope: No such file or directory\nD0755 0 logs\nC0644 3 x.log\nabc\x00E\n"))
+	want := []Event{{Op: "read", Path: "logs/x.log", Direction: "download", Bytes: 3}}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("events %+v, want %+v", events, want)
+	}
+}
+
+func TestSCPParserPartialFile(t *testing.T) {
+	var events []Event
+	p := NewSCPParser("upload", func(ev Event) { events = append(events, ev) })
+	p.Write([]byte("C0644 100 big.iso\n" + strings.Repeat("x", 40)))
+	if len(events) != 0 {
+		t.Fatalf("file reported before it finished: %+v", events)
+	}
+	// Luồng đứt giữa chừng: báo số byte đã truyền
+	p.Flush()
+	want := []Event{{Op: "write", Path: "big.iso", Direction: "upload", Bytes: 40}}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("events %+v, want %+v", events, want)
+	}
+}
+
+func TestSCPParserBroken(t *testing.T) {
+	for _, stream := range []string{
+		"hello world\n",
+		"\n",
+		"C0644 abc file\n",
+		"C0644 5\n",
+		"C0644 5 ../etc/passwd\n",
+		"C0644 5 " + strings.Repeat("a", maxSCPLine+1),
+	} {
+		var events []Event
+		p := NewSCPParser("upload", func(ev Event) { events = append(events, ev) })
+		if n, err := p.Write([]byte(stream)); n != len(stream) || err != nil {
+			t.Fatalf("%.20q: Write = %d, %v", stream, n, err)
+		}
+		if !p.Broken() || len(events) != 1 || events[0].Op != "scp-unparsed" {
+			t.Errorf("%.20q: broken %v, events %+v", stream, p.Broken(), events)
+		}
+		// Sau khi hỏng: không phân tích tiếp, không báo thêm
+		p.Write([]byte("C0644 1 a\nx\x00"))
+		if len(events) != 1 {
+			t.Errorf("%.20q: events after broken %+v", stream, events)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Package tunnel multiplexes TCP streams over one WebSocket connection between the
+// proxy and an agent.
+//
+// Every WebSocket binary message carries exactly one frame:
+//
+//	version  uint8   protocol version (Version)
+//	type     uint8   FrameOpen, FrameData, ...
+//	stream   uint32  stream ID, big endian (0 = connection-level control)
+//	length   uint32  payload length, big endian
+//	payload  [length]byte
+//
+// Streams are opened by the proxy (odd IDs); an open sent by the agent is a protocol
+// error that ends the connection. Each direction of a stream has a
+// receive window of InitialWindow bytes; the receiver grants more with FrameWindow
+// as its reader consumes data, so a slow stream never stalls the others.
+// FrameClose half-closes one direction, FrameReset aborts the whole stream.
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Version of the framing; frames with another version end the connection
+const Version = 1
+
+const headerLen = 10
+
+// InitialWindow is how many unacknowledged bytes a sender may have in flight per stream
+const InitialWindow = 256 << 10
+
+// MaxPayload bounds the payload of a single frame
+const MaxPayload = 32 << 10
+
+type FrameType uint8
+
+const (
+	// payload: target address ("10.0.0.5:22")
+	FrameOpen FrameType = iota + 1
+	// the agent reached the target, data may flow
+	FrameOpenOK
+	FrameData
+	// payload: uint32 window increment
+	FrameWindow
+	// sender will send no more data on this stream (half-close)
+	FrameClose
+	// payload: uint16 code + message; aborts the stream in both directions
+	FrameReset
+	// stream 0, payload: JSON control message
+	FrameControl
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameOpen:
+		return "open"
+	case FrameOpenOK:
+		return "open-ok"
+	case FrameData:
+		return "data"
+	case FrameWindow:
+		return "window"
+	case FrameClose:
+		return "close"
+	case FrameReset:
+		return "reset"
+	case FrameControl:
+		return "control"
+	}
+	return fmt.Sprintf("frame(%d)", uint8(t))
+}
+
+type Frame struct {
+	Type    FrameType
+	Stream  uint32
+	Payload []byte
+}
+
+func (f Frame) Marshal() []byte {
+	b := make([]byte, headerLen+len(f.Payload))
+	b[0] = Version
+	b[1] = byte(f.Type)
+	binary.BigEndian.PutUint32(b[2:], f.Stream)
+	binary.BigEndian.PutUint32(b[6:], uint32(len(f.Payload)))
+	copy(b[headerLen:], f.Payload)
+	return b
+}
+
+// ErrVersion is returned for frames from a peer speaking another protocol version
+var ErrVersion = errors.New("tunnel: unsupported protocol version")
+
+func ParseFrame(b []byte) (Frame, error) {
+	if len(b) < headerLen {
+		return Frame{}, errors.New("tunnel: short frame")
+	}
+	if b[0] != Version {
+		return Frame{}, fmt.Errorf("%w %d (want %d)", ErrVersion, b[0], Version)
+	}
+	n := binary.BigEndian.Uint32(b[6:])
+	if n > MaxPayload {
+		return Frame{}, fmt.Errorf("tunnel: frame length %d exceeds %d", n, MaxPayload)
+	}
+	if int(n) != len(b)-headerLen {
+		return Frame{}, fmt.Errorf("tunnel: frame length %d does not match payload %d", n, len(b)-headerLen)
+	}
+	f := Frame{Type: FrameType(b[1]), Stream: binary.BigEndian.Uint32(b[2:]), Payload: b[headerLen:]}
+	if f.Type < FrameOpen || f.Type > FrameControl {
+		return Frame{}, fmt.Errorf("tunnel: unknown %s", f.Type)
+	}
+	if (f.Stream == 0) != (f.Type == FrameControl) {
+		return Frame{}, fmt.Errorf("tunnel: %s frame on stream %d", f.Type, f.Stream)
+	}
+	return f, nil
+}
+
+// Reset codes
+type Code uint16
+
+const (
+	// the peer closed the stream without reading everything
+	CodeClosed Code = iota
+	// the agent could not reach the target
+	CodeRefused
+	// the peer broke the protocol (window overrun, unknown stream, ...)
+	CodeProtocol
+	// the tunnel connection went away
+	CodeGone
+	// the agent's local allowlist does not permit the target
+	CodeDenied
+)
+
+func (c Code) String() string {
+	switch c {
+	case CodeClosed:
+		return "closed"
+	case CodeRefused:
+		return "refused"
+	case CodeProtocol:
+		return "protocol error"
+	case CodeGone:
+		return "tunnel gone"
+	case CodeDenied:
+		return "denied"
+	}
+	return fmt.Sprintf("code %d", uint16(c))
+}
+
+// StreamError is how a reset stream fails its reads and writes
+type StreamError struct {
+	Code    Code
+	Message string
+}
+
+func (e *StreamError) Error() string {
+	if e.Message == "" {
+		return "tunnel: stream reset: " + e.Code.String()
+	}
+	return "tunnel: stream reset: " + e.Code.String() + ": " + e.Message
+}
+
+func resetPayload(code Code, msg string) []byte {
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(code))
+	copy(b[2:], msg)
+	return b
+}
+
+func parseReset(p []byte) *StreamError {
+	if len(p) < 2 {
+		return &StreamError{Code: CodeProtocol, Message: "malformed reset"}
+	}
+	return &StreamError{Code: Code(binary.BigEndian.Uint16(p)), Message: string(p[2:])}
+}
@@ -0,0 +1,324 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrClosed is returned once the tunnel connection is gone
+var ErrClosed = errors.New("tunnel: connection closed")
+
+// Mux runs the framing protocol over one WebSocket connection
+type Mux struct {
+	// Label names the peer in stream addresses and errors (the agent ID)
+	Label string
+	// OnControl receives FrameControl payloads. It runs on the read loop and must not block.
+	OnControl func(payload []byte)
+
+	ws   *websocket.Conn
+	wmu  sync.Mutex
+	side Side
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	accept  chan *Stream
+	done    chan struct{}
+	err     error
+
+	// unix nanoseconds of the last frame, ping or pong from the peer; last ping round trip
+	lastSeen atomic.Int64
+	rtt      atomic.Int64
+	// without a frame, ping or pong for this long the connection is dropped (0 = never)
+	timeout time.Duration
+}
+
+// How long a ping or pong write may block
+const controlWriteWait = 5 * time.Second
+
+// Side says which end of the tunnel a Mux runs on. Streams are only ever opened
+// in one direction: the proxy opens them and the agent accepts them.
+type Side int
+
+const (
+	// Opener opens streams (the proxy). A FrameOpen from the peer is a protocol error.
+	Opener Side = iota
+	// Acceptor accepts streams (the agent) and cannot open any.
+	Acceptor
+)
+
+// NewMux wraps ws for the given side of the tunnel
+func NewMux(ws *websocket.Conn, label string, side Side) *Mux {
+	m := &Mux{
+		Label:   label,
+		ws:      ws,
+		side:    side,
+		streams: make(map[uint32]*Stream),
+		nextID:  1,
+		accept:  make(chan *Stream, 16),
+		done:    make(chan struct{}),
+	}
+	ws.SetReadLimit(headerLen + MaxPayload)
+	m.lastSeen.Store(time.Now().UnixNano())
+	return m
+}
+
+// Keepalive pings the peer every interval and ends the connection once nothing has
+// been heard from it for timeout, so a half-open tunnel is noticed even when idle.
+// Pongs also measure the round trip (RTT). Call before Run.
+func (m *Mux) Keepalive(interval, timeout time.Duration) {
+	m.timeout = timeout
+	m.touch()
+	m.ws.SetPongHandler(func(data string) error {
+		if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+			m.rtt.Store(time.Now().UnixNano() - sent)
+		}
+		return m.touch()
+	})
+	m.ws.SetPingHandler(func(data string) error {
+		m.touch()
+		err := m.ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(controlWriteWait))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				now := strconv.FormatInt(time.Now().UnixNano(), 10)
+				if err := m.ws.WriteControl(websocket.PingMessage, []byte(now), time.Now().Add(controlWriteWait)); err != nil {
+					m.ws.Close()
+					return
+				}
+			case <-m.done:
+				return
+			}
+		}
+	}()
+}
+
+// touch records that the peer is alive and pushes the read deadline out.
+// Only called from the read loop (directly or through the ping/pong handlers).
+func (m *Mux) touch() error {
+	now := time.Now()
+	m.lastSeen.Store(now.UnixNano())
+	if m.timeout > 0 {
+		return m.ws.SetReadDeadline(now.Add(m.timeout))
+	}
+	return nil
+}
+
+// LastSeen is when the peer last sent anything (frame, ping or pong)
+func (m *Mux) LastSeen() time.Time { return time.Unix(0, m.lastSeen.Load()) }
+
+// RTT is the round trip of the last answered ping (0 before the first pong)
+func (m *Mux) RTT() time.Duration { return time.Duration(m.rtt.Load()) }
+
+// NumStreams counts the open streams
+func (m *Mux) NumStreams() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.streams)
+}
+
+// Done is closed when the connection has ended
+func (m *Mux) Done() <-chan struct{} { return m.done }
+
+// Err returns why the connection ended (nil while it is running)
+func (m *Mux) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Close ends the connection and resets every stream
+func (m *Mux) Close() error {
+	return m.ws.Close()
+}
+
+func (m *Mux) writeFrame(f Frame) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	return m.ws.WriteMessage(websocket.BinaryMessage, f.Marshal())
+}
+
+func (m *Mux) sendReset(id uint32, code Code, msg string) {
+	m.writeFrame(Frame{Type: FrameReset, Stream: id, Payload: resetPayload(code, msg)})
+}
+
+// SendControl sends a JSON control message on stream 0
+func (m *Mux) SendControl(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return m.writeFrame(Frame{Type: FrameControl, Payload: b})
+}
+
+// Open asks the peer to connect to target and waits until it confirms.
+// A refusal comes back as *StreamError with CodeRefused.
+func (m *Mux) Open(target string, timeout time.Duration) (*Stream, error) {
+	if m.side != Opener {
+		return nil, errors.New("tunnel: only the opening side can open streams")
+	}
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, ErrClosed
+	}
+	id := m.nextID
+	m.nextID += 2
+	s := newStream(m, id, target)
+	m.streams[id] = s
+	m.mu.Unlock()
+
+	if err := m.writeFrame(Frame{Type: FrameOpen, Stream: id, Payload: []byte(target)}); err != nil {
+		m.remove(id)
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-s.opened:
+		if err := s.resetErr(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case <-timer.C:
+		s.Reset(CodeClosed, "open timed out")
+		return nil, fmt.Errorf("tunnel: %s did not open %s within %s", m.Label, target, timeout)
+	}
+}
+
+// Accept returns the next stream the peer asked to open. The caller must answer it
+// with Stream.Confirm or Stream.Reject.
+func (m *Mux) Accept() (*Stream, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.done:
+		return nil, ErrClosed
+	}
+}
+
+func (m *Mux) stream(id uint32) (*Stream, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.streams[id]
+	return s, ok
+}
+
+func (m *Mux) remove(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+// Run reads frames until the connection fails, then resets all streams.
+// It never blocks on a stream: data is buffered up to the window the peer was granted.
+func (m *Mux) Run() error {
+	err := m.readLoop()
+	m.mu.Lock()
+	m.err = err
+	streams := m.streams
+	m.streams = make(map[uint32]*Stream)
+	m.mu.Unlock()
+	for _, s := range streams {
+		s.setReset(&StreamError{Code: CodeGone, Message: err.Error()})
+	}
+	m.ws.Close()
+	close(m.done)
+	return err
+}
+
+func (m *Mux) readLoop() error {
+	for {
+		mt, msg, err := m.ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		m.touch()
+		if mt != websocket.BinaryMessage {
+			return errors.New("tunnel: unexpected text message")
+		}
+		f, err := ParseFrame(msg)
+		if err != nil {
+			return err
+		}
+		if err := m.handle(f); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *Mux) handle(f Frame) error {
+	if f.Type == FrameControl {
+		if m.OnControl != nil {
+			m.OnControl(f.Payload)
+		}
+		return nil
+	}
+	if f.Type == FrameOpen {
+		if m.side != Acceptor {
+			return fmt.Errorf("tunnel: %s sent open for stream %d to the opening side", m.Label, f.Stream)
+		}
+		if f.Stream%2 == 0 {
+			return fmt.Errorf("tunnel: open with even stream id %d", f.Stream)
+		}
+		m.mu.Lock()
+		_, dup := m.streams[f.Stream]
+		s := newStream(m, f.Stream, string(f.Payload))
+		if !dup {
+			m.streams[f.Stream] = s
+		}
+		m.mu.Unlock()
+		if dup {
+			return fmt.Errorf("tunnel: open of stream %d already in use", f.Stream)
+		}
+		select {
+		case m.accept <- s:
+		default:
+			m.remove(f.Stream)
+			m.sendReset(f.Stream, CodeRefused, "too many pending streams")
+		}
+		return nil
+	}
+
+	s, ok := m.stream(f.Stream)
+	if !ok {
+		// late frames for a stream we already closed or reset
+		return nil
+	}
+	switch f.Type {
+	case FrameOpenOK:
+		s.openOnce.Do(func() { close(s.opened) })
+	case FrameData:
+		if !s.push(f.Payload) {
+			s.Reset(CodeProtocol, "receive window exceeded")
+		}
+	case FrameWindow:
+		if len(f.Payload) != 4 {
+			s.Reset(CodeProtocol, "malformed window update")
+			return nil
+		}
+		s.grant(binary.BigEndian.Uint32(f.Payload))
+	case FrameClose:
+		s.peerClosed()
+	case FrameReset:
+		m.remove(f.Stream)
+		s.setReset(parseReset(f.Payload))
+	}
+	return nil
+}
@@ -0,0 +1,478 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pipeListener hands out a single net.Pipe end to an http.Server
+type pipeListener struct {
+	conn chan net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conn:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return Addr{Label: "pipe"} }
+
+// wsPair connects two WebSockets over net.Pipe: client plays the agent, server the proxy
+func wsPair(t *testing.T) (client, server *websocket.Conn) {
+	t.Helper()
+	cEnd, sEnd := net.Pipe()
+	l := &pipeListener{conn: make(chan net.Conn, 1), done: make(chan struct{})}
+	l.conn <- sEnd
+	upgraded := make(chan *websocket.Conn, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		upgraded <- ws
+	})}
+	go srv.Serve(l)
+	t.Cleanup(func() { l.Close() })
+
+	dialer := websocket.Dialer{NetDial: func(string, string) (net.Conn, error) { return cEnd, nil }}
+	client, _, err := dialer.Dial("ws://pipe/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case server = <-upgraded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upgrade timed out")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func run(t *testing.T, m *Mux) {
+	go m.Run()
+	t.Cleanup(func() {
+		m.Close()
+		<-m.Done()
+	})
+}
+
+// muxPair returns a running proxy (opener) and agent (acceptor) connected to each other
+func muxPair(t *testing.T) (proxy, agent *Mux) {
+	t.Helper()
+	c, s := wsPair(t)
+	proxy = NewMux(s, "agent-1", Opener)
+	agent = NewMux(c, "proxy", Acceptor)
+	run(t, proxy)
+	run(t, agent)
+	return proxy, agent
+}
+
+// openPair opens a stream from the proxy and confirms it on the agent
+func openPair(t *testing.T, proxy, agent *Mux) (ps, as *Stream) {
+	t.Helper()
+	accepted := make(chan *Stream, 1)
+	go func() {
+		s, err := agent.Accept()
+		if err != nil {
+			t.Errorf("accept: %v", err)
+			close(accepted)
+			return
+		}
+		s.Confirm()
+		accepted <- s
+	}()
+	ps, err := proxy.Open("10.0.0.5:22", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as = <-accepted
+	if as == nil {
+		t.FailNow()
+	}
+	if as.ID() != ps.ID() || as.Target() != "10.0.0.5:22" {
+		t.Fatalf("accepted stream %d %q, opened %d", as.ID(), as.Target(), ps.ID())
+	}
+	return ps, as
+}
+
+// rawPeer speaks frames directly so tests can misbehave
+type rawPeer struct {
+	ws     *websocket.Conn
+	frames chan Frame
+}
+
+func newRawPeer(t *testing.T, ws *websocket.Conn) *rawPeer {
+	p := &rawPeer{ws: ws, frames: make(chan Frame, 1024)}
+	go func() {
+		defer close(p.frames)
+		for {
+			_, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			f, err := ParseFrame(msg)
+			if err != nil {
+				t.Errorf("peer sent bad frame: %v", err)
+				return
+			}
+			p.frames <- f
+		}
+	}()
+	return p
+}
+
+func (p *rawPeer) send(t *testing.T, f Frame) {
+	t.Helper()
+	p.sendRaw(t, f.Marshal())
+}
+
+func (p *rawPeer) sendRaw(t *testing.T, b []byte) {
+	t.Helper()
+	if err := p.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// next returns the next frame of the given type, skipping others
+func (p *rawPeer) next(t *testing.T, typ FrameType) Frame {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case f, ok := <-p.frames:
+			if !ok {
+				t.Fatalf("connection closed waiting for %s", typ)
+			}
+			if f.Type == typ {
+				return f
+			}
+		case <-timeout:
+			t.Fatalf("no %s frame", typ)
+		}
+	}
+}
+
+func waitDone(t *testing.T, m *Mux) error {
+	t.Helper()
+	select {
+	case <-m.Done():
+		return m.Err()
+	case <-time.After(5 * time.Second):
+		t.Fatal("mux still running")
+		return nil
+	}
+}
+
+func streamErr(t *testing.T, err error) *StreamError {
+	t.Helper()
+	var se *StreamError
+	if !errors.As(err, &se) {
+		t.Fatalf("want *StreamError, got %v", err)
+	}
+	return se
+}
+
+func TestWindowExhaustionAndUpdate(t *testing.T) {
+	proxy, agent := muxPair(t)
+	ps, as := openPair(t, proxy, agent)
+
+	data := make([]byte, InitialWindow+1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	// Nobody reads on the agent: the writer stops after one window
+	ps.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := ps.Write(data)
+	if n != InitialWindow || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write = %d, %v; want %d, deadline exceeded", n, err, InitialWindow)
+	}
+
+	// Reading half the window sends a window update that unblocks the writer
+	got := make([]byte, InitialWindow/2)
+	if _, err := io.ReadFull(as, got); err != nil {
+		t.Fatal(err)
+	}
+	ps.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if n, err := ps.Write(data[InitialWindow:]); n != 1000 || err != nil {
+		t.Fatalf("Write after update = %d, %v", n, err)
+	}
+
+	rest := make([]byte, len(data)-len(got))
+	if _, err := io.ReadFull(as, rest); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(got, rest...), data) {
+		t.Fatal("data corrupted across window update")
+	}
+}
+
+func TestWindowOverrunResets(t *testing.T) {
+	c, s := wsPair(t)
+	agent := NewMux(c, "proxy", Acceptor)
+	run(t, agent)
+	peer := newRawPeer(t, s)
+
+	peer.send(t, Frame{Type: FrameOpen, Stream: 1, Payload: []byte("10.0.0.5:22")})
+	as, err := agent.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	as.Confirm()
+	peer.next(t, FrameOpenOK)
+
+	// Fill the window exactly, then send one byte more without waiting for an update
+	chunk := make([]byte, MaxPayload)
+	for sent := 0; sent < InitialWindow; sent += len(chunk) {
+		peer.send(t, Frame{Type: FrameData, Stream: 1, Payload: chunk})
+	}
+	peer.send(t, Frame{Type: FrameData, Stream: 1, Payload: []byte{1}})
+
+	f := peer.next(t, FrameReset)
+	if f.Stream != 1 || parseReset(f.Payload).Code != CodeProtocol {
+		t.Fatalf("reset %d %v; want stream 1 %s", f.Stream, parseReset(f.Payload), CodeProtocol)
+	}
+	if _, err := as.Write([]byte("x")); streamErr(t, err).Code != CodeProtocol {
+		t.Fatalf("Write after overrun: %v", err)
+	}
+	// The stream is gone, the connection is not
+	if agent.NumStreams() != 0 {
+		t.Fatalf("%d streams left after reset", agent.NumStreams())
+	}
+	select {
+	case <-agent.Done():
+		t.Fatalf("overrun ended the whole connection: %v", agent.Err())
+	default:
+	}
+}
+
+// halfClose checks that once from closes its write side, to reads EOF but both
+// can still carry data the other way, then finishes the close from to.
+func halfClose(t *testing.T, from, to *Stream) {
+	t.Helper()
+	if _, err := from.Write([]byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(to); string(got) != "last" || err != nil {
+		t.Fatalf("ReadAll = %q, %v; want \"last\" then EOF", got, err)
+	}
+	if _, err := from.Write([]byte("more")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Write after CloseWrite: %v", err)
+	}
+
+	if _, err := to.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(from, buf); string(buf) != "reply" || err != nil {
+		t.Fatalf("read back %q, %v", buf, err)
+	}
+	to.CloseWrite()
+	if _, err := from.Read(buf); err != io.EOF {
+		t.Fatalf("Read after both closed: %v", err)
+	}
+}
+
+func waitStreams(t *testing.T, m *Mux) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for m.NumStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s still has %d streams", m.Label, m.NumStreams())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	t.Run("proxy first", func(t *testing.T) {
+		proxy, agent := muxPair(t)
+		ps, as := openPair(t, proxy, agent)
+		halfClose(t, ps, as)
+		waitStreams(t, proxy)
+		waitStreams(t, agent)
+	})
+	t.Run("agent first", func(t *testing.T) {
+		proxy, agent := muxPair(t)
+		ps, as := openPair(t, proxy, agent)
+		halfClose(t, as, ps)
+		waitStreams(t, proxy)
+		waitStreams(t, agent)
+	})
+}
+
+func TestResetPropagation(t *testing.T) {
+	t.Run("reject open", func(t *testing.T) {
+		proxy, agent := muxPair(t)
+		go func() {
+			if s, err := agent.Accept(); err == nil {
+				s.Reject(CodeDenied, "not in allowlist")
+			}
+		}()
+		_, err := proxy.Open("10.0.0.9:22", 5*time.Second)
+		if se := streamErr(t, err); se.Code != CodeDenied || se.Message != "not in allowlist" {
+			t.Fatalf("Open = %v", err)
+		}
+		waitStreams(t, proxy)
+	})
+	t.Run("reset stream", func(t *testing.T) {
+		proxy, agent := muxPair(t)
+		ps, as := openPair(t, proxy, agent)
+		ps.Reset(CodeClosed, "bye")
+		if _, err := as.Read(make([]byte, 1)); streamErr(t, err).Message != "bye" {
+			t.Fatalf("Read after peer reset: %v", err)
+		}
+		if _, err := as.Write([]byte("x")); streamErr(t, err).Code != CodeClosed {
+			t.Fatalf("Write after peer reset: %v", err)
+		}
+		waitStreams(t, agent)
+	})
+	t.Run("close without reading", func(t *testing.T) {
+		proxy, agent := muxPair(t)
+		ps, as := openPair(t, proxy, agent)
+		as.Close()
+		if _, err := ps.Read(make([]byte, 1)); streamErr(t, err).Code != CodeClosed {
+			t.Fatalf("Read after peer close: %v", err)
+		}
+	})
+	t.Run("connection lost", func(t *testing.T) {
+		proxy, agent := muxPair(t)
+		ps, as := openPair(t, proxy, agent)
+		proxy.Close()
+		waitDone(t, agent)
+		for _, s := range []*Stream{ps, as} {
+			if _, err := s.Read(make([]byte, 1)); streamErr(t, err).Code != CodeGone {
+				t.Fatalf("Read after connection loss: %v", err)
+			}
+		}
+		if _, err := proxy.Open("10.0.0.5:22", time.Second); err != ErrClosed {
+			t.Fatalf("Open on closed mux: %v", err)
+		}
+	})
+}
+
+func TestOpenDirection(t *testing.T) {
+	t.Run("open sent to opener", func(t *testing.T) {
+		c, s := wsPair(t)
+		proxy := NewMux(s, "agent-1", Opener)
+		run(t, proxy)
+		peer := newRawPeer(t, c)
+		peer.send(t, Frame{Type: FrameOpen, Stream: 1, Payload: []byte("127.0.0.1:22")})
+		if err := waitDone(t, proxy); err == nil {
+			t.Fatal("open from the agent did not end the connection")
+		}
+	})
+	t.Run("acceptor cannot open", func(t *testing.T) {
+		_, agent := muxPair(t)
+		if _, err := agent.Open("10.0.0.5:22", time.Second); err == nil {
+			t.Fatal("agent opened a stream")
+		}
+	})
+	t.Run("even id", func(t *testing.T) {
+		c, s := wsPair(t)
+		agent := NewMux(c, "proxy", Acceptor)
+		run(t, agent)
+		peer := newRawPeer(t, s)
+		peer.send(t, Frame{Type: FrameOpen, Stream: 2, Payload: []byte("10.0.0.5:22")})
+		if err := waitDone(t, agent); err == nil {
+			t.Fatal("open with an even id did not end the connection")
+		}
+	})
+}
+
+func header(version byte, typ FrameType, stream, length uint32) []byte {
+	b := make([]byte, headerLen)
+	b[0] = version
+	b[1] = byte(typ)
+	binary.BigEndian.PutUint32(b[2:], stream)
+	binary.BigEndian.PutUint32(b[6:], length)
+	return b
+}
+
+func TestParseFrame(t *testing.T) {
+	valid := Frame{Type: FrameData, Stream: 3, Payload: []byte("hello")}
+	f, err := ParseFrame(valid.Marshal())
+	if err != nil || f.Type != FrameData || f.Stream != 3 || string(f.Payload) != "hello" {
+		t.Fatalf("ParseFrame(valid) = %+v, %v", f, err)
+	}
+
+	cases := []struct {
+		name string
+		b    []byte
+	}{
+		{"short", []byte{Version, byte(FrameData), 0, 0}},
+		{"unknown version", append(header(Version+1, FrameData, 1, 2), 'h', 'i')},
+		{"oversize length", append(header(Version, FrameData, 1, MaxPayload+1), make([]byte, MaxPayload+1)...)},
+		{"length beyond payload", append(header(Version, FrameData, 1, 10), 'h', 'i')},
+		{"length short of payload", append(header(Version, FrameData, 1, 1), 'h', 'i')},
+		{"unknown type", header(Version, FrameControl+1, 1, 0)},
+		{"zero type", header(Version, 0, 1, 0)},
+		{"data on stream 0", header(Version, FrameData, 0, 0)},
+		{"control on a stream", header(Version, FrameControl, 1, 0)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := ParseFrame(c.b); err == nil {
+				t.Fatal("accepted")
+			}
+		})
+	}
+	if _, err := ParseFrame(header(Version+1, FrameData, 1, 0)); !errors.Is(err, ErrVersion) {
+		t.Fatalf("unknown version: %v; want ErrVersion", err)
+	}
+}
+
+func TestBadFrameEndsConnection(t *testing.T) {
+	cases := []struct {
+		name string
+		b    []byte
+	}{
+		{"unknown version", header(Version+1, FrameData, 1, 0)},
+		{"length mismatch", append(header(Version, FrameData, 1, 64), 'x')},
+		{"oversize message", append(header(Version, FrameData, 1, MaxPayload+1), make([]byte, MaxPayload+1)...)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, s := wsPair(t)
+			agent := NewMux(client, "proxy", Acceptor)
+			run(t, agent)
+			newRawPeer(t, s)
+			// the agent may drop the connection before an oversize message is fully written
+			go s.WriteMessage(websocket.BinaryMessage, c.b)
+			if err := waitDone(t, agent); err == nil {
+				t.Fatal("bad frame did not end the connection")
+			}
+			if _, err := agent.Accept(); err != ErrClosed {
+				t.Fatalf("Accept after failure: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is one multiplexed connection; it implements net.Conn
+type Stream struct {
+	m      *Mux
+	id     uint32
+	target string
+
+	opened   chan struct{}
+	openOnce sync.Once
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	// bytes read since the last window update we sent
+	consumed int
+	// bytes we may still send before the peer grants more
+	sendWindow int
+	// peer sent FrameClose (EOF after buf), we sent FrameClose, Close was called
+	peerEOF, sentEOF, closed bool
+	reset                    *StreamError
+
+	readDeadline, writeDeadline time.Time
+}
+
+func newStream(m *Mux, id uint32, target string) *Stream {
+	s := &Stream{m: m, id: id, target: target, opened: make(chan struct{}), sendWindow: InitialWindow}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// ID of the stream within its Mux
+func (s *Stream) ID() uint32 { return s.id }
+
+// Target is the address the stream was opened for
+func (s *Stream) Target() string { return s.target }
+
+// Confirm tells the opener that the target is connected (agent side)
+func (s *Stream) Confirm() error {
+	return s.m.writeFrame(Frame{Type: FrameOpenOK, Stream: s.id})
+}
+
+// Reject refuses the open with a reason (agent side)
+func (s *Stream) Reject(code Code, msg string) {
+	s.Reset(code, msg)
+}
+
+// Reset aborts the stream in both directions and tells the peer why
+func (s *Stream) Reset(code Code, msg string) {
+	s.mu.Lock()
+	already := s.reset != nil
+	s.mu.Unlock()
+	if already {
+		return
+	}
+	// fail local reads and writes before the peer can learn about the reset
+	s.m.remove(s.id)
+	s.setReset(&StreamError{Code: code, Message: msg})
+	s.m.sendReset(s.id, code, msg)
+}
+
+func (s *Stream) setReset(err *StreamError) {
+	s.mu.Lock()
+	if s.reset == nil {
+		s.reset = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.openOnce.Do(func() { close(s.opened) })
+}
+
+func (s *Stream) resetErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reset != nil {
+		return s.reset
+	}
+	return nil
+}
+
+// push buffers data from the peer; false if the peer overran its window
+func (s *Stream) push(p []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.reset != nil {
+		return true
+	}
+	if len(s.buf)+len(p) > InitialWindow {
+		return false
+	}
+	s.buf = append(s.buf, p...)
+	s.cond.Broadcast()
+	return true
+}
+
+func (s *Stream) grant(n uint32) {
+	s.mu.Lock()
+	s.sendWindow += int(n)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *Stream) peerClosed() {
+	s.mu.Lock()
+	s.peerEOF = true
+	done := s.sentEOF
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if done {
+		s.m.remove(s.id)
+	}
+}
+
+// wait blocks on cond until the deadline; returns false when it has passed
+func (s *Stream) wait(deadline time.Time) bool {
+	if !deadline.IsZero() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		t := time.AfterFunc(time.Until(deadline), func() {
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		})
+		defer t.Stop()
+	}
+	s.cond.Wait()
+	return true
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	for len(s.buf) == 0 {
+		switch {
+		case s.closed:
+			s.mu.Unlock()
+			return 0, net.ErrClosed
+		case s.reset != nil:
+			s.mu.Unlock()
+			return 0, s.reset
+		case s.peerEOF:
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		if !s.wait(s.readDeadline) {
+			s.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+	s.consumed += n
+	var update int
+	if s.consumed >= InitialWindow/2 && !s.peerEOF {
+		update, s.consumed = s.consumed, 0
+	}
+	s.mu.Unlock()
+	if update > 0 {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(update))
+		s.m.writeFrame(Frame{Type: FrameWindow, Stream: s.id, Payload: b})
+	}
+	return n, nil
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		s.mu.Lock()
+		for s.sendWindow == 0 && s.reset == nil && !s.closed && !s.sentEOF {
+			if !s.wait(s.writeDeadline) {
+				s.mu.Unlock()
+				return written, os.ErrDeadlineExceeded
+			}
+		}
+		switch {
+		case s.closed, s.sentEOF:
+			s.mu.Unlock()
+			return written, net.ErrClosed
+		case s.reset != nil:
+			err := s.reset
+			s.mu.Unlock()
+			return written, err
+		}
+		n := min(len(p)-written, s.sendWindow, MaxPayload)
+		s.sendWindow -= n
+		s.mu.Unlock()
+		if err := s.m.writeFrame(Frame{Type: FrameData, Stream: s.id, Payload: p[written : written+n]}); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the stream: the peer reads EOF, we can still read
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.sentEOF || s.reset != nil || s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.sentEOF = true
+	done := s.peerEOF
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	err := s.m.writeFrame(Frame{Type: FrameClose, Stream: s.id})
+	if done {
+		s.m.remove(s.id)
+	}
+	return err
+}
+
+// Close ends the stream. After both sides half-closed this is a clean close;
+// otherwise the peer gets a reset because nobody will read what it sends.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed || s.reset != nil {
+		s.closed = true
+		s.mu.Unlock()
+		return nil
+	}
+	graceful := s.peerEOF
+	s.mu.Unlock()
+	if graceful {
+		s.CloseWrite()
+	} else {
+		s.m.remove(s.id)
+		s.m.sendReset(s.id, CodeClosed, "")
+	}
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.m.remove(s.id)
+	return nil
+}
+
+func (s *Stream) LocalAddr() net.Addr  { return Addr{Label: "local"} }
+func (s *Stream) RemoteAddr() net.Addr { return Addr{Label: s.m.Label, Target: s.target} }
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return nil
+}
+
+// Addr identifies a stream end: the target reached through a tunnel peer
+type Addr struct {
+	Label  string
+	Target string
+}
+
+func (Addr) Network() string { return "tunnel" }
+
+func (a Addr) String() string {
+	if a.Target == "" {
+		return a.Label
+	}
+	return a.Target + " via agent " + a.Label
+}
@@ -0,0 +1,99 @@
+package vault
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// Mount SSH thứ hai, chỉ dùng để ký host certificate (máy đích và chính proxy)
+const (
+	hostSignerMount = "ssh-host-signer"
+	hostSignerRole  = "host-role"
+)
+
+// ensureHostSigner bật mount ssh-host-signer, sinh CA key và tạo role ký host key
+func (v *VaultClient) ensureHostSigner(mounts map[string]*vault.MountOutput) error {
+	if _, ok := mounts[hostSignerMount+"/"]; !ok {
+		log.Println("[CORE PAM] SSH Host Signer chưa bật -> Đang kích hoạt...")
+		mountInput := &vault.MountInput{Type: "ssh"}
+		if err := v.client.Sys().Mount(hostSignerMount, mountInput); err != nil {
+			return fmt.Errorf("lỗi bật ssh host signer: %v", err)
+		}
+	}
+
+	caData := map[string]interface{}{"generate_signing_key": true}
+	if _, err := v.client.Logical().Write(hostSignerMount+"/config/ca", caData); err != nil {
+		if !strings.Contains(err.Error(), "keys are already configured") {
+			return fmt.Errorf("lỗi cấu hình host CA: %v", err)
+		}
+	} else {
+		log.Println("[CORE PAM] Đã sinh Host CA Key mới thành công.")
+	}
+
+	// Role mới (hoặc role cũ cho phép mọi principal) chưa cho phép principal nào:
+	// proxy gọi SetHostPrincipals theo inventory khi khởi động và mỗi lần nạp lại
+	role, err := v.client.Logical().Read(hostSignerMount + "/roles/" + hostSignerRole)
+	if err != nil {
+		return fmt.Errorf("lỗi đọc %s: %v", hostSignerRole, err)
+	}
+	if role == nil || role.Data["allowed_domains"] == "*" {
+		return v.SetHostPrincipals(nil)
+	}
+	return nil
+}
+
+// SetHostPrincipals ghi lại role ký host key, chỉ cho phép đúng các principal này
+// (tên / địa chỉ máy đích trong inventory và hostname của proxy), không cho phép subdomain.
+// Danh sách rỗng = Vault từ chối ký mọi host certificate.
+func (v *VaultClient) SetHostPrincipals(principals []string) error {
+	roleData := map[string]interface{}{
+		"key_type":                "ca",
+		"allow_host_certificates": true,
+		"allowed_domains":         strings.Join(principals, ","),
+		"allow_subdomains":        false,
+		"allow_bare_domains":      true,
+		"ttl":                     "720h",
+		"max_ttl":                 "8760h",
+	}
+	if _, err := v.client.Logical().Write(hostSignerMount+"/roles/"+hostSignerRole, roleData); err != nil {
+		return fmt.Errorf("lỗi tạo %s: %v", hostSignerRole, err)
+	}
+	return nil
+}
+
+// EnableHostSigner bảo đảm mount ký host certificate đã sẵn sàng (dùng cho CLI)
+func (v *VaultClient) EnableHostSigner() error {
+	mounts, err := v.client.Sys().ListMounts()
+	if err != nil {
+		return fmt.Errorf("không thể liệt kê mounts: %v", err)
+	}
+	return v.ensureHostSigner(mounts)
+}
+
+// SignHostKey ký host public key thành host certificate với các principal (hostname/IP).
+// ttl rỗng = dùng TTL mặc định của role.
+func (v *VaultClient) SignHostKey(pubKey []byte, principals []string, ttl string) (string, error) {
+	data := map[string]interface{}{
+		"public_key":       string(pubKey),
+		"cert_type":        "host",
+		"valid_principals": strings.Join(principals, ","),
+	}
+	if ttl != "" {
+		data["ttl"] = ttl
+	}
+	secret, err := v.client.Logical().Write(hostSignerMount+"/sign/"+hostSignerRole, data)
+	if err != nil {
+		return "", err
+	}
+	if secret == nil {
+		return "", fmt.Errorf("Vault không trả về dữ liệu khi ký host key")
+	}
+	signedKey, ok := secret.Data["signed_key"].(string)
+	if !ok {
+		return "", fmt.Errorf("không tìm thấy signed_key trong phản hồi")
+	}
+	return signedKey, nil
+}
@@ -3,12 +3,16 @@ package vault
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strings"
-	
+
+	"github.com/Entidi89/ssh_proxy1/internal/roles"
 	vault "github.com/hashicorp/vault/api"
 )
 
-func (v *VaultClient) ConfigurePAMSystem() error {
+// ConfigurePAMSystem bật các mount cần thiết và đồng bộ roles.json vào Vault.
+// pruneRoles: xóa role trên ssh-client-signer không có trong roles.json (xem ReconcileRoles).
+func (v *VaultClient) ConfigurePAMSystem(roleSet *roles.Set, pruneRoles bool) error {
 	log.Println("[CORE PAM] Đang kiểm tra hệ thống Vault...")
 
 	// 1. Kiểm tra và Bật SSH Engine
@@ -16,7 +20,7 @@ func (v *VaultClient) ConfigurePAMSystem() error {
 	if err != nil {
 		return fmt.Errorf("không thể liệt kê mounts: %v", err)
 	}
-	
+
 	if _, ok := mounts["ssh-client-signer/"]; !ok {
 		log.Println("[CORE PAM] SSH Engine chưa bật -> Đang kích hoạt...")
 		mountInput := &vault.MountInput{Type: "ssh"}
@@ -25,6 +29,16 @@ func (v *VaultClient) ConfigurePAMSystem() error {
 		}
 	}
 
+	// SSH Engine thứ hai để ký host certificate
+	if err := v.ensureHostSigner(mounts); err != nil {
+		return err
+	}
+
+	// KV Engine lưu secret TOTP (MFA)
+	if err := v.ensureMFAStore(mounts); err != nil {
+		return err
+	}
+
 	// 2. Kiểm tra/Tạo CA Key
 	log.Println("[CORE PAM] Đang cấu hình CA Signing Key...")
 	caConfigPath := "ssh-client-signer/config/ca"
@@ -41,56 +55,108 @@ func (v *VaultClient) ConfigurePAMSystem() error {
 		log.Println("[CORE PAM] Đã sinh CA Key mới thành công.")
 	}
 
-	// 3. Cập nhật Role Admin
-	log.Println("[CORE PAM] Cập nhật Role: admin-role (Full Permission)...")
-	adminRolePath := "ssh-client-signer/roles/admin-role"
-	
-	// [ĐÃ SỬA] default_extensions phải là Map, không phải String
-	defaultExts := map[string]string{
-		"permit-pty":              "",
-		"permit-port-forwarding":  "",
-		"permit-agent-forwarding": "",
-		"permit-user-rc":          "",
-		"permit-X11-forwarding":   "",
-	}
-
-	adminRoleData := map[string]interface{}{
-		"allow_user_certificates": true,
-		"allowed_users":           "*",
-		"default_user":            "root",
-		"ttl":                     "1h0m0s",
-		"key_type":                "ca",
-		"allowed_extensions":      "permit-pty,permit-port-forwarding,permit-agent-forwarding,permit-user-rc,permit-X11-forwarding",
-		"default_extensions":      defaultExts, // Truyền Map vào đây
-	}
-	if _, err := v.client.Logical().Write(adminRolePath, adminRoleData); err != nil {
-		return fmt.Errorf("lỗi tạo admin-role: %v", err)
-	}
-
-	// Cập nhật Role Dev
-	log.Println("[CORE PAM] Cập nhật Role: dev-role...")
-	devRolePath := "ssh-client-signer/roles/dev-role"
-	devExts := map[string]string{
-		"permit-pty":             "",
-		"permit-port-forwarding": "",
-	}
-	devRoleData := map[string]interface{}{
-		"allow_user_certificates": true,
-		"allowed_users":           "ubuntu,ec2-user,testuser,wazuhserver", 
-		"default_user":            "ubuntu",
-		"ttl":                     "15m0s",
-		"key_type":                "ca",
-		"allowed_extensions":      "permit-pty,permit-port-forwarding",
-		"default_extensions":      devExts, // Truyền Map vào đây
-	}
-	if _, err := v.client.Logical().Write(devRolePath, devRoleData); err != nil {
-		return fmt.Errorf("lỗi tạo dev-role: %v", err)
+	// 3. Đồng bộ các role khai báo trong roles.json vào Vault
+	if err := v.ReconcileRoles(roleSet, pruneRoles); err != nil {
+		return err
 	}
 
 	log.Println("[CORE PAM] >>> Hệ thống phân quyền đã sẵn sàng! <<<")
 	return nil
 }
 
+// ReconcileRoles ghi mọi role khai báo vào ssh-client-signer. Role trên Vault không có trong
+// roles.json chỉ bị xóa khi prune = true: mount có thể được dùng chung với hệ thống khác,
+// mặc định proxy chỉ cảnh báo và không động tới role nó không khai báo.
+func (v *VaultClient) ReconcileRoles(roleSet *roles.Set, prune bool) error {
+	declared := map[string]bool{}
+	for _, r := range roleSet.List() {
+		log.Printf("[CORE PAM] Cập nhật Role: %s (Vault role '%s', ttl %s)...", r.Name, r.VaultRole, r.TTL)
+		if _, err := v.client.Logical().Write("ssh-client-signer/roles/"+r.VaultRole, vaultRoleData(r)); err != nil {
+			return fmt.Errorf("lỗi tạo %s: %v", r.VaultRole, err)
+		}
+		declared[r.VaultRole] = true
+	}
+
+	existing, err := v.ListSSHRoles()
+	if err != nil {
+		return err
+	}
+	var undeclared []string
+	for _, name := range existing {
+		if !declared[name] {
+			undeclared = append(undeclared, name)
+		}
+	}
+	if !prune {
+		if len(undeclared) > 0 {
+			log.Printf("[WARN] Role trên Vault không có trong roles.json (giữ nguyên, dùng -prune-vault-roles để xóa): %s", strings.Join(undeclared, ", "))
+		}
+		return nil
+	}
+	for _, name := range undeclared {
+		log.Printf("[CORE PAM] Xóa Role '%s' (không còn trong roles.json)...", name)
+		if _, err := v.client.Logical().Delete("ssh-client-signer/roles/" + name); err != nil {
+			return fmt.Errorf("lỗi xóa %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// ListSSHRoles trả về tên các role đang có trên mount ssh-client-signer
+func (v *VaultClient) ListSSHRoles() ([]string, error) {
+	existing, err := v.client.Logical().List("ssh-client-signer/roles")
+	if err != nil {
+		return nil, fmt.Errorf("không thể liệt kê role trên Vault: %v", err)
+	}
+	if existing == nil {
+		return nil, nil
+	}
+	keys, _ := existing.Data["keys"].([]interface{})
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if name, _ := k.(string); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// vaultRoleData chuyển định nghĩa role sang tham số của ssh-client-signer/roles/<name>
+func vaultRoleData(r *roles.Role) map[string]interface{} {
+	// default_extensions / default_critical_options phải là Map, không phải String
+	exts := r.Extensions
+	if exts == nil {
+		exts = map[string]string{}
+	}
+	opts := r.CriticalOptions
+	if opts == nil {
+		opts = map[string]string{}
+	}
+	data := map[string]interface{}{
+		"allow_user_certificates":  true,
+		"key_type":                 "ca",
+		"allowed_users":            strings.Join(r.AllowedUsers, ","),
+		"default_user":             r.DefaultLogin,
+		"allowed_extensions":       strings.Join(sortedKeys(exts), ","),
+		"default_extensions":       exts,
+		"allowed_critical_options": strings.Join(sortedKeys(opts), ","),
+		"default_critical_options": opts,
+	}
+	if r.TTL != "" {
+		data["ttl"] = r.TTL
+	}
+	return data
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (v *VaultClient) GetCAPublicKey() (string, error) {
 	secret, err := v.client.Logical().Read("ssh-client-signer/config/ca")
 	if err != nil || secret == nil {
@@ -98,3 +164,16 @@ func (v *VaultClient) GetCAPublicKey() (string, error) {
 	}
 	return secret.Data["public_key"].(string), nil
 }
+
+// GetHostCAPublicKey đọc public key của SSH host CA (mount ssh-host-signer),
+// dùng để xác thực host certificate của máy đích
+func (v *VaultClient) GetHostCAPublicKey() (string, error) {
+	secret, err := v.client.Logical().Read(hostSignerMount + "/config/ca")
+	if err != nil {
+		return "", err
+	}
+	if secret == nil || secret.Data["public_key"] == nil {
+		return "", fmt.Errorf("host CA chưa được cấu hình trên Vault")
+	}
+	return secret.Data["public_key"].(string), nil
+}
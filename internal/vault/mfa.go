@@ -0,0 +1,58 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// Secret TOTP của user được lưu trong KV v2 của Vault (Vault mã hóa dữ liệu qua barrier)
+const mfaMount = "pam-mfa"
+
+func totpPath(user string) string { return "totp/" + user }
+
+// ensureMFAStore bật KV v2 engine dùng để lưu secret TOTP nếu chưa có
+func (v *VaultClient) ensureMFAStore(mounts map[string]*vault.MountOutput) error {
+	if _, ok := mounts[mfaMount+"/"]; ok {
+		return nil
+	}
+	log.Println("[CORE PAM] KV Engine cho MFA chưa bật -> Đang kích hoạt...")
+	mountInput := &vault.MountInput{Type: "kv", Options: map[string]string{"version": "2"}}
+	if err := v.client.Sys().Mount(mfaMount, mountInput); err != nil {
+		return fmt.Errorf("lỗi bật kv engine cho MFA: %v", err)
+	}
+	return nil
+}
+
+// EnableMFAStore bảo đảm KV engine cho MFA đã được bật (dùng cho CLI enroll)
+func (v *VaultClient) EnableMFAStore() error {
+	mounts, err := v.client.Sys().ListMounts()
+	if err != nil {
+		return fmt.Errorf("không thể liệt kê mounts: %v", err)
+	}
+	return v.ensureMFAStore(mounts)
+}
+
+// PutTOTPSecret lưu (hoặc thay thế) secret TOTP của user
+func (v *VaultClient) PutTOTPSecret(user, secret string) error {
+	data := map[string]interface{}{"secret": secret}
+	if _, err := v.client.KVv2(mfaMount).Put(context.Background(), totpPath(user), data); err != nil {
+		return fmt.Errorf("lỗi lưu secret TOTP của '%s': %v", user, err)
+	}
+	return nil
+}
+
+// GetTOTPSecret đọc secret TOTP của user. Trả về lỗi nếu user chưa đăng ký.
+func (v *VaultClient) GetTOTPSecret(user string) (string, error) {
+	kv, err := v.client.KVv2(mfaMount).Get(context.Background(), totpPath(user))
+	if err != nil {
+		return "", fmt.Errorf("user '%s' chưa đăng ký TOTP: %v", user, err)
+	}
+	secret, ok := kv.Data["secret"].(string)
+	if !ok || secret == "" {
+		return "", fmt.Errorf("user '%s' chưa đăng ký TOTP", user)
+	}
+	return secret, nil
+}
@@ -1,95 +1,186 @@
 package ws
 
 import (
-	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-	"net/http"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/Entidi89/ssh_proxy1/internal/tunnel"
 	"github.com/gorilla/websocket"
 )
 
-// Protocol (text control JSON):
-// proxy -> agent: {"type":"forward","id":"<sid>","target":"127.0.0.1:22"}
-// proxy -> agent: {"type":"close","id":"<sid>"}
-// agent -> proxy: {"type":"forward-ack","id":"<sid>","status":"ok"}
-// Binary frames: prefix "<sid>|" then payload bytes
+// Protocol: binary frames of package tunnel. The proxy opens one stream per
+// forwarded connection (FrameOpen with the target address); the agent dials the
+// target and answers FrameOpenOK, or FrameReset with CodeDenied (target outside
+// the agent's allowlist) or CodeRefused (dial failed).
+// Control messages (stream 0, JSON):
+// proxy -> agent: {"type":"rotate"} (renew the client certificate, then reconnect)
+// agent -> proxy: {"type":"hello","version":"1.2.0","hostname":"gw1","labels":{"dc":"hn"}}
+// Both sides send WebSocket pings and drop the connection when the peer goes quiet.
+
+// How long CreateSession waits for the agent to dial the target
+const forwardTimeout = 10 * time.Second
+
+// Default heartbeat: ping every PingInterval, drop agents silent for PingTimeout
+const (
+	defaultPingInterval = 15 * time.Second
+	defaultPingTimeout  = 45 * time.Second
+)
+
+// ErrAgentGone is returned for sessions on an agent whose connection dropped
+var ErrAgentGone = errors.New("agent disconnected")
+
+// ErrAgentExists is returned by RegisterAgent while another connection holds the ID
+var ErrAgentExists = errors.New("an agent with this id is already connected")
+
+// ForwardError is returned by CreateSession when the agent refuses to forward:
+// Code is tunnel.CodeDenied for targets outside the agent's allowlist,
+// tunnel.CodeRefused when the target could not be reached.
+type ForwardError struct {
+	Agent   string
+	Target  string
+	Code    tunnel.Code
+	Message string
+}
+
+func (e *ForwardError) Error() string {
+	return fmt.Sprintf("agent %s refused forward to %s (%s): %s", e.Agent, e.Target, e.Code, e.Message)
+}
+
+// Denied reports whether the agent's local policy refused the target
+func (e *ForwardError) Denied() bool { return e.Code == tunnel.CodeDenied }
 
 type AgentConn struct {
-	ID         string
-	Conn       *websocket.Conn
-	sendMu     sync.Mutex
-	sessions   sync.Map // map[string]chan []byte (recv from agent)
-	recvActive chan struct{}
+	ID   string
+	Conn *websocket.Conn
+	mgr  *Manager
+	mux  *tunnel.Mux
+
+	connected time.Time
+	mu        sync.Mutex
+	hello     control
+}
+
+type control struct {
+	Type     string            `json:"type"`
+	Version  string            `json:"version,omitempty"`
+	Hostname string            `json:"hostname,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// AgentInfo describes a connected agent for the admin API
+type AgentInfo struct {
+	ID             string            `json:"id"`
+	Remote         string            `json:"remote"`
+	ConnectedSince time.Time         `json:"connected_since"`
+	LastSeen       time.Time         `json:"last_seen"`
+	RTTMillis      float64           `json:"rtt_ms"`
+	Sessions       int               `json:"sessions"`
+	Version        string            `json:"version,omitempty"`
+	Hostname       string            `json:"hostname,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
 }
 
 type Manager struct {
-	mu       sync.Mutex
-	agents   map[string]*AgentConn
-	upgrader websocket.Upgrader
+	// Heartbeat of new connections (NewManager sets the defaults)
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+
+	mu     sync.Mutex
+	agents map[string]*AgentConn
 }
 
 func NewManager() *Manager {
 	return &Manager{
-		agents:   map[string]*AgentConn{},
-		upgrader: websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }},
+		PingInterval: defaultPingInterval,
+		PingTimeout:  defaultPingTimeout,
+		agents:       map[string]*AgentConn{},
 	}
 }
 
-func (m *Manager) RegisterAgent(id string, conn *websocket.Conn) *AgentConn {
+// RegisterAgent adds a connected agent. An existing connection with the same ID is
+// never replaced: the caller gets ErrAgentExists and should close conn.
+func (m *Manager) RegisterAgent(id string, conn *websocket.Conn) (*AgentConn, error) {
 	ac := &AgentConn{
-		ID:         id,
-		Conn:       conn,
-		sessions:   sync.Map{},
-		recvActive: make(chan struct{}),
+		ID:        id,
+		Conn:      conn,
+		mgr:       m,
+		mux:       tunnel.NewMux(conn, id, tunnel.Opener),
+		connected: time.Now(),
 	}
+	ac.mux.OnControl = ac.handleControl
 	m.mu.Lock()
+	if _, exists := m.agents[id]; exists {
+		m.mu.Unlock()
+		return nil, ErrAgentExists
+	}
 	m.agents[id] = ac
 	m.mu.Unlock()
+	ac.mux.Keepalive(m.PingInterval, m.PingTimeout)
 	go ac.readLoop()
-	return ac
+	return ac, nil
 }
 
+// readLoop serves the connection; once it ends (closed, failed or missed heartbeats)
+// the agent is unregistered
 func (a *AgentConn) readLoop() {
-	for {
-		mt, msg, err := a.Conn.ReadMessage()
-		if err != nil {
-			log.Printf("agent %s read err: %v", a.ID, err)
-			a.closeAllSessions()
-			return
-		}
-		if mt == websocket.TextMessage {
-			// ignore for now or handle ack
-			continue
-		}
-		if mt == websocket.BinaryMessage {
-			// parse sid prefix
-			idx := bytes.IndexByte(msg, '|')
-			if idx <= 0 {
-				continue
-			}
-			sid := string(msg[:idx])
-			payload := msg[idx+1:]
-			if chi, ok := a.sessions.Load(sid); ok {
-				ch := chi.(chan []byte)
-				// non-blocking push
-				select {
-				case ch <- payload:
-				default:
-				}
-			}
-		}
+	err := a.mux.Run()
+	log.Printf("agent %s read err: %v", a.ID, err)
+	a.mgr.remove(a)
+}
+
+func (a *AgentConn) handleControl(payload []byte) {
+	var ctrl control
+	if err := json.Unmarshal(payload, &ctrl); err != nil {
+		log.Printf("agent %s: bad control message: %v", a.ID, err)
+		return
+	}
+	if ctrl.Type == "hello" {
+		a.mu.Lock()
+		a.hello = ctrl
+		a.mu.Unlock()
+	}
+}
+
+// Info reports the agent's connection state
+func (a *AgentConn) Info() AgentInfo {
+	a.mu.Lock()
+	hello := a.hello
+	a.mu.Unlock()
+	return AgentInfo{
+		ID:             a.ID,
+		Remote:         a.Conn.RemoteAddr().String(),
+		ConnectedSince: a.connected,
+		LastSeen:       a.mux.LastSeen(),
+		RTTMillis:      float64(a.mux.RTT().Microseconds()) / 1000,
+		Sessions:       a.mux.NumStreams(),
+		Version:        hello.Version,
+		Hostname:       hello.Hostname,
+		Labels:         hello.Labels,
 	}
 }
 
-func (a *AgentConn) closeAllSessions() {
-	a.sessions.Range(func(k, v any) bool {
-		sid := k.(string)
-		ch := v.(chan []byte)
-		close(ch)
-		a.sessions.Delete(sid)
-		return true
-	})
+// Err returns why the connection ended (nil while it is up)
+func (a *AgentConn) Err() error { return a.mux.Err() }
+
+// List returns the connected agents sorted by ID
+func (m *Manager) List() []AgentInfo {
+	m.mu.Lock()
+	agents := make([]*AgentConn, 0, len(m.agents))
+	for _, a := range m.agents {
+		agents = append(agents, a)
+	}
+	m.mu.Unlock()
+	out := make([]AgentInfo, 0, len(agents))
+	for _, a := range agents {
+		out = append(out, a.Info())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
 }
 
 func (m *Manager) GetAgent(id string) (*AgentConn, bool) {
@@ -99,51 +190,45 @@ func (m *Manager) GetAgent(id string) (*AgentConn, bool) {
 	return a, ok
 }
 
-func (m *Manager) UnregisterAgent(id string) {
+// remove drops a only if it is still the registered connection for its ID
+func (m *Manager) remove(a *AgentConn) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	delete(m.agents, id)
+	if m.agents[a.ID] == a {
+		delete(m.agents, a.ID)
+	}
 }
 
-func (a *AgentConn) SendControl(ctrl any) error {
-	a.sendMu.Lock()
-	defer a.sendMu.Unlock()
-	return a.Conn.WriteJSON(ctrl)
+// Disconnect closes the agent's connection; its sessions end and it is unregistered
+func (m *Manager) Disconnect(id string) bool {
+	a, ok := m.GetAgent(id)
+	if ok {
+		a.mux.Close()
+	}
+	return ok
 }
 
-// Create session: returns 'recv' channel (agent->proxy) and 'send' channel proxy->agent
-func (a *AgentConn) CreateSession(sid, target string) (recv <-chan []byte, send chan<- []byte, err error) {
-	// create channels
-	rch := make(chan []byte, 100)
-	sch := make(chan []byte, 100)
-	a.sessions.Store(sid, rch)
+// RequestRotation asks the agent to renew its client certificate and reconnect with it
+func (a *AgentConn) RequestRotation() error {
+	return a.mux.SendControl(control{Type: "rotate"})
+}
 
-	// send forward control
-	ctrl := map[string]string{"type": "forward", "id": sid, "target": target}
-	if err := a.SendControl(ctrl); err != nil {
-		a.sessions.Delete(sid)
-		return nil, nil, err
-	}
+// Done is closed once the agent's connection has ended
+func (a *AgentConn) Done() <-chan struct{} { return a.mux.Done() }
 
-	// start goroutine to write from 'sch' to websocket as binary frames
-	go func() {
-		for chunk := range sch {
-			frame := append([]byte(sid+"|"), chunk...)
-			a.sendMu.Lock()
-			_ = a.Conn.WriteMessage(websocket.BinaryMessage, frame)
-			a.sendMu.Unlock()
+// CreateSession asks the agent to dial target and returns the forwarded stream once
+// the agent has connected. Closing the stream closes the agent's connection to target.
+func (a *AgentConn) CreateSession(target string) (*tunnel.Stream, error) {
+	s, err := a.mux.Open(target, forwardTimeout)
+	if errors.Is(err, tunnel.ErrClosed) {
+		return nil, ErrAgentGone
+	}
+	var se *tunnel.StreamError
+	if errors.As(err, &se) {
+		if se.Code == tunnel.CodeGone {
+			return nil, ErrAgentGone
 		}
-		// send close signal
-		_ = a.SendControl(map[string]string{"type": "close", "id": sid})
-	}()
-
-	return rch, sch, nil
-}
-
-func (a *AgentConn) CloseSession(sid string) {
-	if v, ok := a.sessions.Load(sid); ok {
-		ch := v.(chan []byte)
-		close(ch)
-		a.sessions.Delete(sid)
+		return nil, &ForwardError{Agent: a.ID, Target: target, Code: se.Code, Message: se.Message}
 	}
+	return s, err
 }